@@ -0,0 +1,209 @@
+// Package admin serves an HTTP API for looking into a running proxy.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/fault"
+	"github.com/mu-wahba/db-proxy-go/proxy"
+	"github.com/mu-wahba/db-proxy-go/stats"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// BackendStatus describes one backend.
+type BackendStatus struct {
+	Addr string `json:"addr"`
+	// Protocol is postgres, mysql or redis
+	Protocol string `json:"protocol"`
+	Role     string `json:"role"`
+	Weight   int    `json:"weight"`
+	Healthy  bool   `json:"healthy"`
+	// Clients is how many clients are using the backend right now
+	Clients int64 `json:"clients"`
+}
+
+type handler struct {
+	server *proxy.Server
+	token  string
+	mux    *http.ServeMux
+}
+
+// NewHandler returns the admin API for server:
+//
+//	GET    /connections       connected clients
+//	DELETE /connections/{id}  disconnect a client
+//	GET    /backends          backend status
+//	GET    /faults            fault injection rules
+//	PUT    /faults            replace the fault injection rules
+//	DELETE /faults            stop injecting faults
+//	GET    /statements        statement statistics
+//	DELETE /statements        reset the statement statistics
+//	GET    /shadow/statements statement statistics of the shadow server
+//	DELETE /shadow/statements reset them
+//	GET    /metrics           Prometheus metrics
+//
+// With a non-empty token every request must carry it as a bearer token.
+func NewHandler(server *proxy.Server, token string) http.Handler {
+	h := &handler{server: server, token: token, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/connections", h.connections)
+	h.mux.HandleFunc("/connections/", h.connection)
+	h.mux.HandleFunc("/backends", h.backendStatus)
+	h.mux.HandleFunc("/faults", h.faults)
+	h.mux.HandleFunc("/statements", h.statements)
+	h.mux.HandleFunc("/shadow/statements", h.shadowStatements)
+	h.mux.Handle("/metrics", promhttp.Handler())
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.token != "" {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(h.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, message("not authorized"))
+			return
+		}
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *handler) connections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, message("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, h.server.Clients())
+}
+
+func (h *handler) connection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, message("method not allowed"))
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/connections/"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, message("invalid connection id"))
+		return
+	}
+	if !h.server.CloseClient(id) {
+		writeJSON(w, http.StatusNotFound, message("connection not found"))
+		return
+	}
+	log.Printf("Connection %d closed through the admin API by %v", id, r.RemoteAddr)
+	writeJSON(w, http.StatusOK, message("connection closed"))
+}
+
+func (h *handler) backendStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, message("method not allowed"))
+		return
+	}
+	var status []BackendStatus
+	add := func(protocol string, backends []*backend.Backend) {
+		for _, b := range backends {
+			status = append(status, BackendStatus{
+				Addr:     b.Addr,
+				Protocol: protocol,
+				Role:     b.Role,
+				Weight:   b.Weight,
+				Healthy:  b.Healthy(),
+				Clients:  b.Active(),
+			})
+		}
+	}
+	add(proxy.ProtocolPostgres, h.server.Backends())
+	add(proxy.ProtocolMySQL, h.server.MySQLBackends())
+	add(proxy.ProtocolRedis, h.server.RedisBackends())
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (h *handler) faults(w http.ResponseWriter, r *http.Request) {
+	var in *fault.Injector
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, h.server.Faults())
+		return
+	case http.MethodPut:
+		var specs []fault.Spec
+		if err := json.NewDecoder(r.Body).Decode(&specs); err != nil {
+			writeJSON(w, http.StatusBadRequest, message("invalid fault rules: "+err.Error()))
+			return
+		}
+		var err error
+		if in, err = fault.New(specs); err != nil {
+			writeJSON(w, http.StatusBadRequest, message(err.Error()))
+			return
+		}
+	case http.MethodDelete:
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, message("method not allowed"))
+		return
+	}
+	if err := h.server.SetFaults(in); err != nil {
+		writeJSON(w, http.StatusForbidden, message(err.Error()))
+		return
+	}
+	log.Printf("Fault rules set to %d rules through the admin API by %v", len(in.Specs()), r.RemoteAddr)
+	writeJSON(w, http.StatusOK, h.server.Faults())
+}
+
+func (h *handler) statements(w http.ResponseWriter, r *http.Request) {
+	collector := h.server.Stats()
+	if collector == nil {
+		writeJSON(w, http.StatusNotFound, message("statement statistics are off"))
+		return
+	}
+	serveStatements(w, r, collector, "Statement statistics")
+}
+
+func (h *handler) shadowStatements(w http.ResponseWriter, r *http.Request) {
+	collector := h.server.ShadowStats()
+	if collector == nil {
+		writeJSON(w, http.StatusNotFound, message("no shadow server configured"))
+		return
+	}
+	serveStatements(w, r, collector, "Shadow statement statistics")
+}
+
+// serveStatements lists or resets the statistics in collector, which are
+// called name in the log.
+func serveStatements(w http.ResponseWriter, r *http.Request, collector *stats.Collector, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		list := collector.Snapshot(r.URL.Query().Get("sort"))
+		if v := r.URL.Query().Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 0 {
+				writeJSON(w, http.StatusBadRequest, message("invalid limit"))
+				return
+			}
+			if limit < len(list) {
+				list = list[:limit]
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodDelete:
+		collector.Reset()
+		log.Printf("%s reset through the admin API by %v", name, r.RemoteAddr)
+		writeJSON(w, http.StatusOK, message("statistics reset"))
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, message("method not allowed"))
+	}
+}
+
+func message(msg string) map[string]string {
+	return map[string]string{"msg": msg}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing admin response: %v", err)
+	}
+}
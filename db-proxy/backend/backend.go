@@ -0,0 +1,116 @@
+// Package backend describes the PostgreSQL servers behind the proxy and
+// picks one for each new connection.
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mu-wahba/db-proxy-go/metrics"
+)
+
+// Backend roles. Replicas only receive read-only traffic, and only when
+// read/write splitting is on.
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
+// Backend is one PostgreSQL server.
+type Backend struct {
+	Addr   string
+	Weight int
+	Role   string
+
+	// active counts the client connections currently using this backend
+	active int64
+	// down is 1 while health checks have the backend ejected
+	down int32
+	// consecutive check results, only touched by the Checker
+	successes int
+	failures  int
+}
+
+// Healthy reports whether b may be given new connections.
+func (b *Backend) Healthy() bool {
+	return atomic.LoadInt32(&b.down) == 0
+}
+
+// Healthy returns the backends in list that are not ejected.
+func Healthy(list []*Backend) []*Backend {
+	healthy := make([]*Backend, 0, len(list))
+	for _, b := range list {
+		if b.Healthy() {
+			healthy = append(healthy, b)
+		}
+	}
+	return healthy
+}
+
+// Active returns the number of connections currently using b.
+func (b *Backend) Active() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// Inc records a connection starting to use b.
+func (b *Backend) Inc() {
+	atomic.AddInt64(&b.active, 1)
+	metrics.BackendActive.WithLabelValues(b.Addr).Inc()
+}
+
+// Dec records a connection that stopped using b.
+func (b *Backend) Dec() {
+	atomic.AddInt64(&b.active, -1)
+	metrics.BackendActive.WithLabelValues(b.Addr).Dec()
+}
+
+func (b *Backend) String() string {
+	return b.Addr
+}
+
+// Reuse returns list with each backend that also appears in old, with the
+// same address, weight and role, replaced by the one from old. Its health
+// state and connection count then carry over a configuration reload.
+func Reuse(old, list []*Backend) []*Backend {
+	merged := make([]*Backend, len(list))
+	for i, b := range list {
+		merged[i] = b
+		for _, o := range old {
+			if o.Addr == b.Addr && o.Weight == b.Weight && o.Role == b.Role {
+				merged[i] = o
+				break
+			}
+		}
+	}
+	return merged
+}
+
+// ParseList parses a comma separated list of host:port entries, each with
+// an optional weight: "db1:5432@3,db2:5432". The default weight is 1.
+func ParseList(s string) ([]*Backend, error) {
+	var backends []*Backend
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		b := &Backend{Addr: entry, Weight: 1, Role: RolePrimary}
+		if i := strings.LastIndexByte(entry, '@'); i >= 0 {
+			w, err := strconv.Atoi(entry[i+1:])
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("backend %q: weight must be a positive integer", entry)
+			}
+			b.Addr, b.Weight = entry[:i], w
+		}
+		if !strings.Contains(b.Addr, ":") {
+			return nil, fmt.Errorf("backend %q: expected host:port", entry)
+		}
+		backends = append(backends, b)
+	}
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no backends configured")
+	}
+	return backends, nil
+}
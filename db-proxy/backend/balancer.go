@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// Load-balancing strategies.
+const (
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-connections"
+	Weighted         = "weighted"
+	Random           = "random"
+)
+
+// Balancer picks the backend for a new connection. Pick returns nil only
+// when candidates is empty.
+type Balancer interface {
+	Pick(candidates []*Backend) *Backend
+}
+
+// NewBalancer returns the balancer for a strategy name.
+func NewBalancer(strategy string) (Balancer, error) {
+	switch strategy {
+	case RoundRobin:
+		return &roundRobin{}, nil
+	case LeastConnections:
+		return leastConnections{}, nil
+	case Weighted:
+		return &weighted{current: map[*Backend]int{}}, nil
+	case Random:
+		return &random{rng: rand.New(rand.NewSource(rand.Int63()))}, nil
+	}
+	return nil, fmt.Errorf("unknown load-balancing strategy %q", strategy)
+}
+
+// roundRobin takes the backends in turn.
+type roundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (r *roundRobin) Pick(candidates []*Backend) *Backend {
+	if len(candidates) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := candidates[r.next%len(candidates)]
+	r.next++
+	return b
+}
+
+// leastConnections takes the backend with the fewest active connections,
+// the first one listed on a tie.
+type leastConnections struct{}
+
+func (leastConnections) Pick(candidates []*Backend) *Backend {
+	var best *Backend
+	for _, b := range candidates {
+		if best == nil || b.Active() < best.Active() {
+			best = b
+		}
+	}
+	return best
+}
+
+// weighted is smooth weighted round-robin, as in nginx: a backend with
+// weight 3 is picked three times as often as one with weight 1, and the
+// picks are interleaved rather than bunched together.
+type weighted struct {
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+func (w *weighted) Pick(candidates []*Backend) *Backend {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var best *Backend
+	total := 0
+	for _, b := range candidates {
+		w.current[b] += b.Weight
+		total += b.Weight
+		if best == nil || w.current[b] > w.current[best] {
+			best = b
+		}
+	}
+	if best != nil {
+		w.current[best] -= total
+	}
+	return best
+}
+
+// random takes a backend uniformly at random.
+type random struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (r *random) Pick(candidates []*Backend) *Backend {
+	if len(candidates) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return candidates[r.rng.Intn(len(candidates))]
+}
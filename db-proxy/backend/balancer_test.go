@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+// picks returns the addresses of n backends picked in a row.
+func picks(b Balancer, candidates []*Backend, n int) string {
+	var addrs []string
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, b.Pick(candidates).Addr)
+	}
+	return strings.Join(addrs, " ")
+}
+
+func TestRoundRobin(t *testing.T) {
+	b, _ := NewBalancer(RoundRobin)
+	candidates := []*Backend{{Addr: "a", Weight: 1}, {Addr: "b", Weight: 5}, {Addr: "c", Weight: 1}}
+	if got, want := picks(b, candidates, 7), "a b c a b c a"; got != want {
+		t.Errorf("round-robin picked %q, want %q", got, want)
+	}
+	if got := b.Pick(nil); got != nil {
+		t.Errorf("Pick(nil) = %v, want nil", got)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	tests := []struct {
+		weights []int
+		want    string
+	}{
+		{[]int{1, 1}, "a b a b"},
+		{[]int{3, 1}, "a a b a a a b a"},
+		{[]int{5, 1, 1}, "a a b a c a a a a b a c a a"},
+		{[]int{1, 2}, "b a b b a b"},
+	}
+	for _, tt := range tests {
+		var candidates []*Backend
+		for i, w := range tt.weights {
+			candidates = append(candidates, &Backend{Addr: string(rune('a' + i)), Weight: w})
+		}
+		b, _ := NewBalancer(Weighted)
+		n := len(strings.Fields(tt.want))
+		if got := picks(b, candidates, n); got != tt.want {
+			t.Errorf("weights %v picked %q, want %q", tt.weights, got, tt.want)
+		}
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	a, b, c := &Backend{Addr: "a"}, &Backend{Addr: "b"}, &Backend{Addr: "c"}
+	candidates := []*Backend{a, b, c}
+	lb, _ := NewBalancer(LeastConnections)
+
+	//ties go to the first one listed
+	if got := lb.Pick(candidates); got != a {
+		t.Errorf("all idle: picked %v, want a", got)
+	}
+	a.Inc()
+	a.Inc()
+	b.Inc()
+	if got := lb.Pick(candidates); got != c {
+		t.Errorf("a=2 b=1 c=0: picked %v, want c", got)
+	}
+	c.Inc()
+	c.Inc()
+	if got := lb.Pick(candidates); got != b {
+		t.Errorf("a=2 b=1 c=2: picked %v, want b", got)
+	}
+	a.Dec()
+	a.Dec()
+	if got := lb.Pick(candidates); got != a {
+		t.Errorf("a=0 b=1 c=2: picked %v, want a", got)
+	}
+	if got := lb.Pick(nil); got != nil {
+		t.Errorf("Pick(nil) = %v, want nil", got)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	lb, _ := NewBalancer(Random)
+	candidates := []*Backend{{Addr: "a"}, {Addr: "b"}, {Addr: "c"}}
+	seen := map[*Backend]int{}
+	for i := 0; i < 300; i++ {
+		seen[lb.Pick(candidates)]++
+	}
+	for b, n := range seen {
+		if b != candidates[0] && b != candidates[1] && b != candidates[2] {
+			t.Errorf("picked %v, not a candidate", b)
+		}
+		if n < 50 {
+			t.Errorf("picked %v %d times out of 300", b, n)
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("picked %d of 3 backends", len(seen))
+	}
+	if got := lb.Pick(nil); got != nil {
+		t.Errorf("Pick(nil) = %v, want nil", got)
+	}
+}
+
+func TestNewBalancerUnknown(t *testing.T) {
+	if _, err := NewBalancer("fastest"); err == nil {
+		t.Error("NewBalancer(\"fastest\") did not fail")
+	}
+}
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/pool"
+)
+
+// HealthConfig controls the active health checks.
+type HealthConfig struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	// Fall consecutive failures eject a backend, Rise consecutive
+	// successes bring it back
+	Fall int
+	Rise int
+	// Credentials for protocol-level probes (startup plus SELECT 1).
+	// With an empty User the probe only opens a TCP connection.
+	Credentials pool.Credentials
+	// TLS is used for protocol-level probes when it is not nil
+	TLS *tls.Config
+}
+
+// Checker probes backends on an interval and ejects the ones that fail.
+type Checker struct {
+	backends []*Backend
+	cfg      HealthConfig
+}
+
+// NewChecker creates a Checker for backends.
+func NewChecker(backends []*Backend, cfg HealthConfig) *Checker {
+	return &Checker{backends: backends, cfg: cfg}
+}
+
+// Run probes every backend each interval until ctx is done.
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		c.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Checker) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range c.backends {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			err := c.probe(ctx, b)
+			//a probe cut short by Run stopping says nothing about b
+			if ctx.Err() == nil {
+				c.record(b, err)
+			}
+		}(b)
+	}
+	wg.Wait()
+}
+
+// probe checks one backend within the configured timeout.
+func (c *Checker) probe(ctx context.Context, b *Backend) error {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	if c.cfg.Credentials.User == "" {
+		//servers expecting a PROXY header would count the probe as a bad client
+		conn, err := pool.Dial(ctx, b.Addr, c.cfg.Credentials.ProxyHeader, nil)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	conn, err := pool.Connect(ctx, b.Addr, c.cfg.Credentials, c.cfg.TLS)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if err := pgproto.Write(conn, &pgproto.Query{String: "SELECT 1"}, &pgproto.Terminate{}); err != nil {
+		return err
+	}
+	var queryErr error
+	for {
+		msg, err := pgproto.ReadBackendMessage(conn.Reader)
+		if err != nil {
+			return err
+		}
+		switch m := msg.(type) {
+		case *pgproto.ErrorResponse:
+			queryErr = m
+		case *pgproto.ReadyForQuery:
+			return queryErr
+		}
+	}
+}
+
+// record applies a probe result and logs state changes.
+func (c *Checker) record(b *Backend, err error) {
+	if err == nil {
+		b.failures = 0
+		b.successes++
+		if !b.Healthy() && b.successes >= c.cfg.Rise {
+			atomic.StoreInt32(&b.down, 0)
+			log.Printf("Backend %s is healthy again after %d successful checks", b.Addr, b.successes)
+		}
+		return
+	}
+
+	b.successes = 0
+	b.failures++
+	if b.Healthy() && b.failures >= c.cfg.Fall {
+		atomic.StoreInt32(&b.down, 1)
+		log.Printf("Backend %s ejected after %d failed checks: %v", b.Addr, b.failures, err)
+	}
+}
+
+// Validate reports settings that would make the checker misbehave.
+func (cfg HealthConfig) Validate() error {
+	if cfg.Interval <= 0 || cfg.Timeout <= 0 {
+		return fmt.Errorf("health check interval and timeout must be positive")
+	}
+	if cfg.Fall < 1 || cfg.Rise < 1 {
+		return fmt.Errorf("health check rise and fall must be at least 1")
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckerFallRise(t *testing.T) {
+	c := NewChecker(nil, HealthConfig{Fall: 2, Rise: 3})
+	b := &Backend{Addr: "a"}
+	failed := errors.New("connection refused")
+	steps := []struct {
+		err     error
+		healthy bool
+	}{
+		{failed, true},
+		//a success resets the failure count
+		{nil, true},
+		{failed, true},
+		{failed, false},
+		{failed, false},
+		{nil, false},
+		{nil, false},
+		//a failure resets the success count
+		{failed, false},
+		{nil, false},
+		{nil, false},
+		{nil, true},
+		{nil, true},
+		{failed, true},
+		{failed, false},
+	}
+	for i, s := range steps {
+		c.record(b, s.err)
+		if b.Healthy() != s.healthy {
+			t.Fatalf("after check %d (error %v): Healthy() = %v, want %v", i+1, s.err, b.Healthy(), s.healthy)
+		}
+	}
+}
+
+func TestCheckerProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	//nothing listens on a port just given back
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	up := &Backend{Addr: l.Addr().String()}
+	down := &Backend{Addr: closed.Addr().String()}
+	c := NewChecker([]*Backend{up, down}, HealthConfig{Interval: time.Second, Timeout: time.Second, Fall: 1, Rise: 1})
+	c.checkAll(context.Background())
+	if !up.Healthy() {
+		t.Errorf("%s ejected", up.Addr)
+	}
+	if down.Healthy() {
+		t.Errorf("%s still healthy", down.Addr)
+	}
+}
+
+func TestHealthConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg HealthConfig
+		ok  bool
+	}{
+		{HealthConfig{Interval: time.Second, Timeout: time.Second, Fall: 1, Rise: 1}, true},
+		{HealthConfig{Timeout: time.Second, Fall: 1, Rise: 1}, false},
+		{HealthConfig{Interval: time.Second, Fall: 1, Rise: 1}, false},
+		{HealthConfig{Interval: time.Second, Timeout: time.Second, Rise: 1}, false},
+		{HealthConfig{Interval: time.Second, Timeout: time.Second, Fall: 1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v.Validate() = %v, want ok %v", tt.cfg, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// Package cache keeps the results of read-only statements, so a query
+// that runs again before its rule's TTL is up can be answered without a
+// server. Entries are keyed by the statement's normalized text, with the
+// user and database it ran for, and dropped when a write through the
+// proxy names one of the tables they read.
+package cache
+
+import (
+	"container/list"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/sqlparse"
+)
+
+// Rule says which statements are cached and for how long. Every condition
+// that is set must hold; a rule without conditions matches every
+// cacheable statement.
+type Rule struct {
+	Name string
+	// Tables match the tables a statement reads. A name without a schema
+	// matches the table in any schema.
+	Tables []string
+	// Pattern is matched against the normalized text of the statement
+	Pattern *regexp.Regexp
+	Users   []string
+	// TTL is how long results stay; zero keeps matching statements out
+	// of the cache
+	TTL time.Duration
+}
+
+// Key identifies the result of a statement for one user and database.
+type Key struct {
+	User     string
+	Database string
+	// Text is the normalized statement, see Normalize
+	Text string
+}
+
+// Lookup is a statement that may be cached. If Get finds no result, the
+// statement goes to the server and its result is stored with Put once it
+// is complete.
+type Lookup struct {
+	Key   Key
+	cache *Cache
+	rule  string
+	ttl   time.Duration
+	// tables are the tables read, unqualified, with their generation
+	// when the statement was sent
+	tables      []string
+	generations []uint64
+}
+
+// Cache holds results up to a memory limit, dropping the least recently
+// used ones to make room. A nil *Cache caches nothing.
+type Cache struct {
+	rules    []Rule
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[Key]*list.Element
+	// lru has the most recently used entry at the front
+	lru   list.List
+	bytes int64
+	// byTable lists the keys of the entries that read each table, and
+	// generations counts the writes to it, so a result that was read
+	// while a write went on is not stored
+	byTable     map[string]map[Key]bool
+	generations map[string]uint64
+}
+
+type entry struct {
+	key     Key
+	tables  []string
+	expires time.Time
+	size    int64
+	msgs    []pgproto.Message
+}
+
+// maxEntryShare is the largest part of the memory limit one result may
+// take; bigger results are not cached.
+const maxEntryShare = 8
+
+// New returns a cache for rules that holds up to maxBytes of results.
+func New(rules []Rule, maxBytes int64) *Cache {
+	return &Cache{
+		rules:       rules,
+		maxBytes:    maxBytes,
+		entries:     map[Key]*list.Element{},
+		byTable:     map[string]map[Key]bool{},
+		generations: map[string]uint64{},
+	}
+}
+
+// Check returns a Lookup for sql if a rule caches it for the client user.
+// Only a single read-only SELECT that reads at least one table qualifies.
+// key has the server user and database the result depends on; Check
+// fills in the text.
+func (c *Cache) Check(user string, key Key, sql string) (*Lookup, bool) {
+	if c == nil {
+		return nil, false
+	}
+	stmts := sqlparse.Parse(sql)
+	if len(stmts) != 1 {
+		return nil, false
+	}
+	st := stmts[0]
+	if st.Command != "SELECT" || !st.ReadOnly || st.SessionState || len(st.Tables) == 0 {
+		return nil, false
+	}
+	key.Text = Normalize(st.Tokens)
+	for _, r := range c.rules {
+		if !r.matches(user, key.Text, st.Tables) {
+			continue
+		}
+		if r.TTL <= 0 {
+			return nil, false
+		}
+		l := &Lookup{Key: key, cache: c, rule: r.Name, ttl: r.TTL}
+		c.mu.Lock()
+		for _, table := range st.Tables {
+			table = unqualified(table)
+			l.tables = append(l.tables, table)
+			l.generations = append(l.generations, c.generations[table])
+		}
+		c.mu.Unlock()
+		return l, true
+	}
+	return nil, false
+}
+
+// Get returns the messages that answered the statement, from
+// RowDescription to CommandComplete, if they are cached.
+func (l *Lookup) Get() ([]pgproto.Message, bool) {
+	c := l.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[l.Key]
+	if ok && time.Now().After(el.Value.(*entry).expires) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		metrics.CacheLookups.WithLabelValues(l.rule, metrics.CacheMiss).Inc()
+		return nil, false
+	}
+	metrics.CacheLookups.WithLabelValues(l.rule, metrics.CacheHit).Inc()
+	c.lru.MoveToFront(el)
+	return el.Value.(*entry).msgs, true
+}
+
+// Put stores the result of the statement, of size bytes encoded, unless
+// a write to one of its tables went through since Check or it is too big.
+func (l *Lookup) Put(msgs []pgproto.Message, size int64) {
+	if !l.Fits(size) {
+		return
+	}
+	c := l.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, table := range l.tables {
+		if c.generations[table] != l.generations[i] {
+			return
+		}
+	}
+	if el, ok := c.entries[l.Key]; ok {
+		c.remove(el)
+	}
+	e := &entry{key: l.Key, tables: l.tables, expires: time.Now().Add(l.ttl), size: size, msgs: msgs}
+	c.entries[l.Key] = c.lru.PushFront(e)
+	c.bytes += size
+	for _, table := range e.tables {
+		if c.byTable[table] == nil {
+			c.byTable[table] = map[Key]bool{}
+		}
+		c.byTable[table][l.Key] = true
+	}
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		metrics.CacheEvictions.Inc()
+	}
+	metrics.CacheBytes.Set(float64(c.bytes))
+}
+
+// Fits reports whether a result of size bytes may be cached at all.
+func (l *Lookup) Fits(size int64) bool {
+	return size <= l.cache.maxBytes/maxEntryShare
+}
+
+// Invalidate drops the results that read any of tables, as named by a
+// statement that writes to them.
+func (c *Cache) Invalidate(tables []string) {
+	if c == nil || len(tables) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, table := range tables {
+		table = unqualified(table)
+		c.generations[table]++
+		for key := range c.byTable[table] {
+			c.remove(c.entries[key])
+			metrics.CacheInvalidations.Inc()
+		}
+	}
+	metrics.CacheBytes.Set(float64(c.bytes))
+}
+
+// remove drops an entry. It must be called with c.mu held.
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+	for _, table := range e.tables {
+		delete(c.byTable[table], e.key)
+		if len(c.byTable[table]) == 0 {
+			delete(c.byTable, table)
+		}
+	}
+}
+
+func (r *Rule) matches(user, text string, tables []string) bool {
+	if len(r.Users) > 0 && !contains(r.Users, user) {
+		return false
+	}
+	if len(r.Tables) > 0 && !matchTable(r.Tables, tables) {
+		return false
+	}
+	if r.Pattern != nil && !r.Pattern.MatchString(text) {
+		return false
+	}
+	return true
+}
+
+// Normalize turns a statement into its cache key text: keywords and
+// unquoted names in upper case, one space between tokens, and no
+// comments, so statements that differ only in layout share an entry.
+// Literals are kept as written; they are the statement's parameters.
+func Normalize(tokens []sqlparse.Token) string {
+	var b strings.Builder
+	for i, t := range tokens {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		switch t.Kind {
+		case sqlparse.Word:
+			b.WriteString(t.Upper())
+		case sqlparse.QuotedIdent:
+			b.WriteString(`"` + strings.ReplaceAll(t.Text, `"`, `""`) + `"`)
+		default:
+			b.WriteString(t.Text)
+		}
+	}
+	return b.String()
+}
+
+// unqualified folds a table name to the name without its schema, so a
+// write to public.events drops what was read from events.
+func unqualified(table string) string {
+	return table[strings.LastIndex(table, ".")+1:]
+}
+
+func matchTable(rules, tables []string) bool {
+	for _, table := range tables {
+		for _, rule := range rules {
+			if rule == table || (!strings.Contains(rule, ".") && rule == unqualified(table)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
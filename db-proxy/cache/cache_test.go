@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+)
+
+var key = Key{User: "app", Database: "db"}
+
+func result(s string) []pgproto.Message {
+	return []pgproto.Message{
+		&pgproto.RowDescription{Fields: []pgproto.FieldDescription{{Name: "a"}}},
+		&pgproto.DataRow{Values: [][]byte{[]byte(s)}},
+		&pgproto.CommandComplete{Tag: "SELECT 1"},
+	}
+}
+
+func mustCheck(t *testing.T, c *Cache, sql string) *Lookup {
+	t.Helper()
+	l, ok := c.Check("app", key, sql)
+	if !ok {
+		t.Fatalf("Check(%q) does not cache it", sql)
+	}
+	return l
+}
+
+func TestCheck(t *testing.T) {
+	c := New([]Rule{
+		{Name: "no-live", Tables: []string{"live"}},
+		{Name: "reports", Users: []string{"reporter"}, TTL: time.Hour},
+		{Name: "all", TTL: time.Minute},
+	}, 1<<20)
+	tests := []struct {
+		user, sql string
+		rule      string
+	}{
+		{"app", "SELECT * FROM t", "all"},
+		{"reporter", "SELECT * FROM t", "reports"},
+		{"app", "SELECT * FROM live", ""},
+		{"app", "SELECT 1", ""},
+		{"app", "SELECT * FROM t FOR UPDATE", ""},
+		{"app", "SELECT nextval('s') FROM t", ""},
+		{"app", "SELECT * FROM t; SELECT * FROM u", ""},
+		{"app", "UPDATE t SET a = 1", ""},
+		{"app", "WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d", ""},
+	}
+	for _, tt := range tests {
+		l, ok := c.Check(tt.user, key, tt.sql)
+		rule := ""
+		if ok {
+			rule = l.rule
+		}
+		if rule != tt.rule {
+			t.Errorf("Check(%s, %q) rule = %q, want %q", tt.user, tt.sql, rule, tt.rule)
+		}
+	}
+
+	a := mustCheck(t, c, "select *\n  from T -- comment")
+	b := mustCheck(t, c, "SELECT * FROM t")
+	if a.Key != b.Key {
+		t.Errorf("keys differ by layout: %q and %q", a.Key.Text, b.Key.Text)
+	}
+	if l := mustCheck(t, c, "SELECT * FROM t WHERE a = 'x'"); l.Key == b.Key {
+		t.Errorf("literals do not count in key %q", l.Key.Text)
+	}
+
+	if _, ok := (*Cache)(nil).Check("app", key, "SELECT * FROM t"); ok {
+		t.Errorf("nil cache caches")
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	c := New([]Rule{{TTL: time.Minute}}, 1<<20)
+	l := mustCheck(t, c, "SELECT * FROM t")
+	if _, ok := l.Get(); ok {
+		t.Fatal("empty cache has a result")
+	}
+	l.Put(result("1"), 100)
+	got, ok := mustCheck(t, c, "SELECT * FROM t").Get()
+	if !ok || !reflect.DeepEqual(got, result("1")) {
+		t.Errorf("Get = %v, %v", got, ok)
+	}
+
+	other := key
+	other.Database = "other"
+	if l, ok := c.Check("app", other, "SELECT * FROM t"); !ok {
+		t.Fatal("Check for another database does not cache")
+	} else if _, ok := l.Get(); ok {
+		t.Errorf("result shared with another database")
+	}
+}
+
+func TestPutAfterWrite(t *testing.T) {
+	c := New([]Rule{{TTL: time.Minute}}, 1<<20)
+	l := mustCheck(t, c, "SELECT * FROM t JOIN u ON true")
+	//a write committed while the result was on its way may be missing from it
+	c.Invalidate([]string{"public.u"})
+	l.Put(result("stale"), 100)
+	if _, ok := l.Get(); ok {
+		t.Errorf("result read during a write was stored")
+	}
+
+	l = mustCheck(t, c, "SELECT * FROM t JOIN u ON true")
+	c.Invalidate([]string{"other"})
+	l.Put(result("fresh"), 100)
+	if _, ok := l.Get(); !ok {
+		t.Errorf("a write to another table kept the result out")
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	tests := []struct {
+		read, written string
+		dropped       bool
+	}{
+		{"t", "t", true},
+		{"t", "public.t", true},
+		{"public.t", "t", true},
+		{"app.t", "public.t", true},
+		{"t", "u", false},
+		{"public.t", "public.tt", false},
+	}
+	for _, tt := range tests {
+		c := New([]Rule{{TTL: time.Minute}}, 1<<20)
+		l := mustCheck(t, c, "SELECT * FROM "+tt.read)
+		l.Put(result("1"), 100)
+		c.Invalidate([]string{tt.written})
+		if _, ok := l.Get(); ok == tt.dropped {
+			t.Errorf("read %s, wrote %s: cached %v, want %v", tt.read, tt.written, ok, !tt.dropped)
+		}
+		if tt.dropped && c.bytes != 0 {
+			t.Errorf("read %s, wrote %s: %d bytes left", tt.read, tt.written, c.bytes)
+		}
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c := New([]Rule{{TTL: time.Minute}}, 800)
+	lookups := make([]*Lookup, 9)
+	for i := range lookups {
+		lookups[i] = mustCheck(t, c, fmt.Sprintf("SELECT * FROM t WHERE a = %d", i))
+	}
+	for _, l := range lookups[:8] {
+		l.Put(result("x"), 100)
+	}
+	//using the oldest makes the second one the least recently used
+	if _, ok := lookups[0].Get(); !ok {
+		t.Fatal("cache at its limit lost a result")
+	}
+	lookups[8].Put(result("x"), 100)
+	for i, l := range lookups {
+		_, ok := l.Get()
+		if want := i != 1; ok != want {
+			t.Errorf("result %d cached %v, want %v", i, ok, want)
+		}
+	}
+	if c.bytes != 800 {
+		t.Errorf("cache holds %d bytes, want 800", c.bytes)
+	}
+
+	big := mustCheck(t, c, "SELECT * FROM big")
+	if big.Fits(101) {
+		t.Errorf("a result of more than an eighth of the limit fits")
+	}
+	big.Put(result("x"), 101)
+	if _, ok := big.Get(); ok {
+		t.Errorf("oversized result was stored")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	c := New([]Rule{{TTL: time.Minute}}, 1<<20)
+	l := mustCheck(t, c, "SELECT * FROM t")
+	l.Put(result("1"), 100)
+	if _, ok := l.Get(); !ok {
+		t.Fatal("fresh result missing")
+	}
+	c.entries[l.Key].Value.(*entry).expires = time.Now().Add(-time.Second)
+	if _, ok := l.Get(); ok {
+		t.Errorf("expired result returned")
+	}
+	if len(c.entries) != 0 || c.bytes != 0 {
+		t.Errorf("expired result kept: %d entries, %d bytes", len(c.entries), c.bytes)
+	}
+
+	c = New([]Rule{{TTL: 20 * time.Millisecond}}, 1<<20)
+	l = mustCheck(t, c, "SELECT * FROM t")
+	l.Put(result("1"), 100)
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := l.Get(); ok {
+		t.Errorf("result outlived its TTL")
+	}
+}
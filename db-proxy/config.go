@@ -0,0 +1,471 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/cache"
+	"github.com/mu-wahba/db-proxy-go/fault"
+	"github.com/mu-wahba/db-proxy-go/firewall"
+	"github.com/mu-wahba/db-proxy-go/pool"
+	"github.com/mu-wahba/db-proxy-go/proxy"
+	"github.com/mu-wahba/db-proxy-go/proxyproto"
+	"github.com/mu-wahba/db-proxy-go/slowlog"
+	"github.com/mu-wahba/db-proxy-go/stats"
+	"github.com/mu-wahba/db-proxy-go/tracing"
+)
+
+// config is everything main needs to start the proxy.
+type config struct {
+	// Listen is the address clients connect to, and MySQLListen and
+	// RedisListen the ones for MySQL and Redis clients if they are not empty
+	Listen      string
+	MySQLListen string
+	RedisListen string
+	Proxy       proxy.Config
+	// Health checks are off when Health.Interval is zero
+	Health backend.HealthConfig
+	// AdminListen is the admin API address; empty turns the API off
+	AdminListen string
+	AdminToken  string
+	// DrainTimeout bounds how long a shutdown waits for busy clients
+	DrainTimeout time.Duration
+	// RecordFile is opened by main and handed to the proxy as
+	// Proxy.Recorder; empty turns recording off
+	RecordFile string
+	// SlowLogFile is opened by main and handed to the proxy as
+	// Proxy.SlowLog; empty turns the slow query log off
+	SlowLogFile string
+	// Tracing is set up by main, which hands the tracer to the proxy as
+	// Proxy.Tracer
+	Tracing tracing.Config
+	// Stats are set up by main, which hands the collector to the proxy as
+	// Proxy.Stats
+	Stats stats.Config
+}
+
+// loadConfig reads the config file at path and the environment, and
+// checks the result. A missing file is only an error if required is set.
+func loadConfig(path string, required bool) (config, error) {
+	s, err := loadSettings(path, required)
+	if err != nil {
+		return config{}, err
+	}
+	return buildConfig(s)
+}
+
+// buildConfig checks s and turns it into the proxy configuration, loading
+// the user list and certificates it refers to.
+func buildConfig(s settings) (config, error) {
+	cfg := config{
+		Listen:       s.Listen.Address,
+		MySQLListen:  s.MySQL.Listen,
+		RedisListen:  s.Redis.Listen,
+		AdminListen:  s.Admin.Address,
+		AdminToken:   s.Admin.Token,
+		DrainTimeout: s.Timeouts.Drain,
+		RecordFile:   s.Record.File,
+		SlowLogFile:  s.SlowLog.File,
+		Tracing: tracing.Config{
+			Exporter:    s.Tracing.Exporter,
+			Endpoint:    s.Tracing.Endpoint,
+			Insecure:    s.Tracing.Insecure,
+			File:        s.Tracing.File,
+			ServiceName: s.Tracing.ServiceName,
+			SampleRatio: s.Tracing.SampleRatio,
+		},
+		Stats: stats.Config{
+			Enabled:       s.Stats.Enabled,
+			MaxStatements: s.Stats.MaxStatements,
+			File:          s.Stats.File,
+			FileInterval:  s.Stats.FileInterval,
+		},
+		Proxy: proxy.Config{
+			PoolMode:        s.Pool.Mode,
+			ReadWriteSplit:  s.ReadWriteSplit,
+			PoolSize:        s.Pool.Size,
+			PoolWaitTimeout: s.Pool.WaitTimeout,
+			LogProtocol:     s.LogProtocol,
+
+			ProxyProtocol:       s.Listen.ProxyProtocol,
+			ServerProxyProtocol: s.ServerProxy,
+
+			StripSQLComments: s.Tracing.StripComments,
+
+			SlowQueryThreshold: s.SlowLog.Threshold,
+			SlowLogRedact:      s.SlowLog.Redact,
+
+			Shadow:        s.Shadow.Address,
+			ShadowMirror:  s.Shadow.Mirror,
+			ShadowCompare: s.Shadow.Compare,
+			ShadowQueue:   s.Shadow.QueueSize,
+
+			MaxConnections:      s.Limits.MaxConnections,
+			MaxConnectionsPerIP: s.Limits.MaxConnectionsPerIP,
+			QueueSize:           s.Limits.QueueSize,
+			QueueTimeout:        s.Limits.QueueTimeout,
+
+			DialTimeout:        s.Timeouts.Dial,
+			ClientIdleTimeout:  s.Timeouts.ClientIdle,
+			ServerIdleTimeout:  s.Timeouts.ServerIdle,
+			MaxSessionLifetime: s.Timeouts.MaxSession,
+		},
+		Health: backend.HealthConfig{
+			Interval: s.HealthCheck.Interval,
+			Timeout:  s.HealthCheck.Timeout,
+			Fall:     s.HealthCheck.Fall,
+			Rise:     s.HealthCheck.Rise,
+			Credentials: pool.Credentials{
+				User:     s.HealthCheck.User,
+				Password: s.HealthCheck.Password,
+				Database: s.HealthCheck.Database,
+			},
+		},
+	}
+	p := &cfg.Proxy
+
+	if len(s.Backends) == 0 {
+		return cfg, fmt.Errorf("no backends configured")
+	}
+	for _, b := range s.Backends {
+		parsed, err := buildBackend(b)
+		if err != nil {
+			return cfg, err
+		}
+		p.Backends = append(p.Backends, parsed)
+	}
+	var err error
+	if p.Balancer, err = backend.NewBalancer(s.LoadBalancing); err != nil {
+		return cfg, err
+	}
+
+	switch p.PoolMode {
+	case proxy.PoolModeSession:
+		p.ProxyAuth = s.Pool.ProxyAuth
+	case proxy.PoolModeTransaction:
+	default:
+		return cfg, fmt.Errorf("pool.mode must be %q or %q, got %q", proxy.PoolModeSession, proxy.PoolModeTransaction, p.PoolMode)
+	}
+	if p.PoolMode == proxy.PoolModeTransaction || p.ProxyAuth || s.Shadow.Address != "" {
+		//the proxy logs in on its own, so it needs the passwords
+		if s.Pool.AuthFile == "" {
+			return cfg, fmt.Errorf("pool.auth_file is required in %s mode, with pool.proxy_auth or with shadow.address", proxy.PoolModeTransaction)
+		}
+		if p.Users, p.UserMappings, err = proxy.LoadUserList(s.Pool.AuthFile); err != nil {
+			return cfg, err
+		}
+		//clients of the same server user share its pools, so one login
+		//must hold for all of them
+		logins := map[string]string{}
+		for user, password := range p.Users {
+			if m, ok := p.UserMappings[user]; ok {
+				user, password = m.User, m.Password
+			}
+			if known, ok := logins[user]; ok && known != password {
+				return cfg, fmt.Errorf("pool.auth_file: server user %q has two different passwords", user)
+			}
+			logins[user] = password
+		}
+	}
+	if err := buildMySQL(s.MySQL, p); err != nil {
+		return cfg, err
+	}
+	if err := buildRedis(s.Redis, p); err != nil {
+		return cfg, err
+	}
+	if p.ReadWriteSplit && p.PoolMode != proxy.PoolModeTransaction {
+		return cfg, fmt.Errorf("read_write_split needs pool.mode %s", proxy.PoolModeTransaction)
+	}
+	if p.ServerIdleTimeout > 0 && p.PoolMode != proxy.PoolModeTransaction && p.MySQL.PoolMode != proxy.PoolModeTransaction {
+		//session-mode server connections belong to their client, only pools have idle ones
+		return cfg, fmt.Errorf("timeouts.server_idle needs pool.mode or mysql.pool_mode %s", proxy.PoolModeTransaction)
+	}
+	if p.PoolSize < 1 {
+		return cfg, fmt.Errorf("pool.size must be at least 1")
+	}
+	if p.ClientTLS, p.RequireClientTLS, err = clientTLSConfig(s.Listen.TLS); err != nil {
+		return cfg, err
+	}
+	if p.ServerTLS, err = serverTLSConfig(s.ServerTLS); err != nil {
+		return cfg, err
+	}
+
+	if p.Allow, err = proxy.ParseNetworks(s.Access.Allow); err != nil {
+		return cfg, fmt.Errorf("access.allow: %w", err)
+	}
+	if p.Deny, err = proxy.ParseNetworks(s.Access.Deny); err != nil {
+		return cfg, fmt.Errorf("access.deny: %w", err)
+	}
+	if p.ProxyProtocolFrom, err = proxy.ParseNetworks(s.Listen.ProxyProtocolFrom); err != nil {
+		return cfg, fmt.Errorf("listen.proxy_protocol_from: %w", err)
+	}
+	if len(p.ProxyProtocolFrom) > 0 && !p.ProxyProtocol {
+		return cfg, fmt.Errorf("listen.proxy_protocol_from needs listen.proxy_protocol")
+	}
+	if v := p.ServerProxyProtocol; v < 0 || v > 2 {
+		return cfg, fmt.Errorf("server_proxy_protocol must be 1, 2 or 0 for none, got %d", v)
+	}
+	if p.MaxConnections < 0 || p.MaxConnectionsPerIP < 0 || p.QueueSize < 0 {
+		return cfg, fmt.Errorf("limits must not be negative")
+	}
+	if p.DialTimeout <= 0 {
+		return cfg, fmt.Errorf("timeouts.dial must be positive")
+	}
+	if p.ClientIdleTimeout < 0 || p.ServerIdleTimeout < 0 || p.MaxSessionLifetime < 0 {
+		return cfg, fmt.Errorf("timeouts must not be negative")
+	}
+	if p.Firewall, err = buildFirewall(s.Firewall); err != nil {
+		return cfg, err
+	}
+	if p.Cache, err = buildCache(s.Cache, p.PoolMode); err != nil {
+		return cfg, err
+	}
+	if len(s.Faults.Rules) > 0 && !s.Faults.Enabled {
+		return cfg, fmt.Errorf("faults.rules need faults.enabled")
+	}
+	p.FaultsEnabled = s.Faults.Enabled
+	if p.Faults, err = fault.New(s.Faults.Rules); err != nil {
+		return cfg, err
+	}
+
+	switch t := cfg.Tracing; t.Exporter {
+	case tracing.ExporterNone, tracing.ExporterOTLP, tracing.ExporterStdout:
+	case tracing.ExporterFile:
+		if t.File == "" {
+			return cfg, fmt.Errorf("tracing.file is required for the %s exporter", t.Exporter)
+		}
+	default:
+		return cfg, fmt.Errorf("tracing.exporter must be %q, %q, %q or %q, got %q", tracing.ExporterNone, tracing.ExporterOTLP, tracing.ExporterStdout, tracing.ExporterFile, t.Exporter)
+	}
+	if r := cfg.Tracing.SampleRatio; r < 0 || r > 1 {
+		return cfg, fmt.Errorf("tracing.sample_ratio must be between 0 and 1")
+	}
+	if cfg.SlowLogFile != "" {
+		if p.SlowQueryThreshold < 0 {
+			return cfg, fmt.Errorf("slow_log.threshold must not be negative")
+		}
+		switch p.SlowLogRedact {
+		case slowlog.RedactNone, slowlog.RedactParameters, slowlog.RedactLiterals:
+		default:
+			return cfg, fmt.Errorf("slow_log.redact must be %q, %q or %q, got %q", slowlog.RedactNone, slowlog.RedactParameters, slowlog.RedactLiterals, p.SlowLogRedact)
+		}
+	}
+	if st := cfg.Stats; st.Enabled {
+		if st.MaxStatements < 1 {
+			return cfg, fmt.Errorf("stats.max_statements must be at least 1")
+		}
+		if st.File != "" && st.FileInterval <= 0 {
+			return cfg, fmt.Errorf("stats.file_interval must be positive")
+		}
+	} else if st.File != "" {
+		return cfg, fmt.Errorf("stats.file needs stats.enabled")
+	}
+	if p.Shadow != "" {
+		switch p.ShadowMirror {
+		case proxy.ShadowReads, proxy.ShadowAll:
+		default:
+			return cfg, fmt.Errorf("shadow.mirror must be %q or %q, got %q", proxy.ShadowReads, proxy.ShadowAll, p.ShadowMirror)
+		}
+		if p.ShadowQueue < 1 {
+			return cfg, fmt.Errorf("shadow.queue_size must be at least 1")
+		}
+		//the shadow's statistics are kept whether stats.enabled is set or not
+		if cfg.Stats.MaxStatements < 1 {
+			return cfg, fmt.Errorf("stats.max_statements must be at least 1")
+		}
+	}
+
+	h := &cfg.Health
+	h.TLS = p.ServerTLS
+	if p.ServerProxyProtocol > 0 {
+		//probes are the proxy's own connections
+		h.Credentials.ProxyHeader = proxyproto.Header(p.ServerProxyProtocol, nil, nil)
+	}
+	if h.Credentials.Database == "" {
+		h.Credentials.Database = h.Credentials.User
+	}
+	if h.Interval > 0 {
+		if err := h.Validate(); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// buildBackend checks the settings of one backend.
+func buildBackend(b backendSettings) (*backend.Backend, error) {
+	if b.Address == "" {
+		return nil, fmt.Errorf("backend without an address")
+	}
+	role := backendRole(b)
+	if role != backend.RolePrimary && role != backend.RoleReplica {
+		return nil, fmt.Errorf("backend %s: role must be %q or %q, got %q", b.Address, backend.RolePrimary, backend.RoleReplica, role)
+	}
+	weight := b.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	if weight < 0 {
+		return nil, fmt.Errorf("backend %s: weight must be positive", b.Address)
+	}
+	return &backend.Backend{Addr: b.Address, Weight: weight, Role: role}, nil
+}
+
+// buildMySQL checks the MySQL settings, which only matter when there is a
+// MySQL listener, and puts them into p.
+func buildMySQL(s mysqlSettings, p *proxy.Config) error {
+	if s.Listen == "" {
+		return nil
+	}
+	if len(s.Backends) == 0 {
+		return fmt.Errorf("mysql.backends are required with mysql.listen")
+	}
+	m := &p.MySQL
+	for _, b := range s.Backends {
+		parsed, err := buildBackend(b)
+		if err != nil {
+			return fmt.Errorf("mysql: %w", err)
+		}
+		if parsed.Role != backend.RolePrimary {
+			return fmt.Errorf("mysql backend %s: only primaries are supported", parsed.Addr)
+		}
+		m.Backends = append(m.Backends, parsed)
+	}
+	m.PoolMode = s.PoolMode
+	switch m.PoolMode {
+	case proxy.PoolModeSession:
+	case proxy.PoolModeTransaction:
+		if s.AuthFile == "" {
+			return fmt.Errorf("mysql.auth_file is required in %s mode", m.PoolMode)
+		}
+		users, mappings, err := proxy.LoadUserList(s.AuthFile)
+		if err != nil {
+			return err
+		}
+		if len(mappings) > 0 {
+			return fmt.Errorf("mysql.auth_file: mapping users to server users is only supported for PostgreSQL")
+		}
+		m.Users = users
+		for user, password := range m.Users {
+			//MySQL's scrambles need the password itself
+			if strings.HasPrefix(password, "md5") && len(password) == 35 {
+				return fmt.Errorf("mysql.auth_file: user %q has an MD5 secret, MySQL needs the plain password", user)
+			}
+		}
+	default:
+		return fmt.Errorf("mysql.pool_mode must be %q or %q, got %q", proxy.PoolModeSession, proxy.PoolModeTransaction, m.PoolMode)
+	}
+	return nil
+}
+
+// buildCache checks the cache settings and returns the cache, or nil when
+// caching is off.
+func buildCache(s cacheSettings, poolMode string) (*cache.Cache, error) {
+	if !s.Enabled {
+		return nil, nil
+	}
+	if poolMode != proxy.PoolModeTransaction {
+		return nil, fmt.Errorf("cache.enabled needs pool.mode %s", proxy.PoolModeTransaction)
+	}
+	if s.MaxMemoryMB < 1 {
+		return nil, fmt.Errorf("cache.max_memory_mb must be at least 1")
+	}
+	if len(s.Rules) == 0 {
+		return nil, fmt.Errorf("cache.rules must say what to cache")
+	}
+	var rules []cache.Rule
+	for i, r := range s.Rules {
+		rule := cache.Rule{Name: r.Name, Tables: r.Tables, Users: r.Users, TTL: r.TTL}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if rule.TTL < 0 {
+			return nil, fmt.Errorf("cache rule %q: ttl must not be negative", rule.Name)
+		}
+		if r.Pattern != "" {
+			var err error
+			if rule.Pattern, err = regexp.Compile(r.Pattern); err != nil {
+				return nil, fmt.Errorf("cache rule %q: %w", rule.Name, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return cache.New(rules, int64(s.MaxMemoryMB)<<20), nil
+}
+
+// buildRedis checks the Redis settings, which only matter when there is a
+// Redis listener, and puts them into p.
+func buildRedis(s redisSettings, p *proxy.Config) error {
+	if s.Listen == "" {
+		return nil
+	}
+	if len(s.Backends) == 0 {
+		return fmt.Errorf("redis.backends are required with redis.listen")
+	}
+	r := &p.Redis
+	primaries := 0
+	for _, b := range s.Backends {
+		parsed, err := buildBackend(b)
+		if err != nil {
+			return fmt.Errorf("redis: %w", err)
+		}
+		if parsed.Role == backend.RolePrimary {
+			primaries++
+		}
+		r.Backends = append(r.Backends, parsed)
+	}
+	if primaries == 0 {
+		return fmt.Errorf("redis.backends need at least one primary")
+	}
+	r.ReadFromReplicas = s.ReadFromReplicas
+	r.Blocked = map[string]bool{}
+	for _, command := range s.BlockedCommands {
+		words := strings.Fields(strings.ToLower(command))
+		if len(words) == 0 || len(words) > 2 {
+			return fmt.Errorf("redis.blocked_commands: %q must be a command, optionally followed by a subcommand", command)
+		}
+		r.Blocked[strings.Join(words, " ")] = true
+	}
+	return nil
+}
+
+// buildFirewall checks the firewall rules and compiles them. It returns
+// nil when there is nothing to check.
+func buildFirewall(s firewallSettings) (*firewall.Firewall, error) {
+	if s.Default == "" {
+		s.Default = firewall.Allow
+	}
+	if s.Default != firewall.Allow && s.Default != firewall.Deny {
+		return nil, fmt.Errorf("firewall.default must be %q or %q, got %q", firewall.Allow, firewall.Deny, s.Default)
+	}
+	if len(s.Rules) == 0 && s.Default == firewall.Allow {
+		return nil, nil
+	}
+	fw := &firewall.Firewall{Default: s.Default}
+	for i, r := range s.Rules {
+		rule := firewall.Rule{Name: r.Name, Action: r.Action, Tables: r.Tables, Users: r.Users}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if rule.Action != firewall.Allow && rule.Action != firewall.Deny {
+			return nil, fmt.Errorf("firewall rule %q: action must be %q or %q, got %q", rule.Name, firewall.Allow, firewall.Deny, rule.Action)
+		}
+		for _, c := range r.Commands {
+			rule.Commands = append(rule.Commands, strings.ToUpper(c))
+		}
+		var err error
+		if r.Pattern != "" {
+			if rule.Pattern, err = regexp.Compile(r.Pattern); err != nil {
+				return nil, fmt.Errorf("firewall rule %q: %w", rule.Name, err)
+			}
+		}
+		if rule.Clients, err = proxy.ParseNetworks(r.Clients); err != nil {
+			return nil, fmt.Errorf("firewall rule %q: %w", rule.Name, err)
+		}
+		fw.Rules = append(fw.Rules, rule)
+	}
+	return fw, nil
+}
@@ -0,0 +1,193 @@
+// Package fault injects failures into client sessions for chaos testing:
+// latency, throttled responses, dropped or reset connections and
+// synthetic errors. Rules pick the statements to fail by pattern and user,
+// and fire with a given probability.
+package fault
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Kinds of fault.
+const (
+	// Latency holds a statement back before it goes to the server
+	Latency = "latency"
+	// Throttle slows the response to a statement down to a bandwidth
+	Throttle = "throttle"
+	// Drop closes the client connection without a word
+	Drop = "drop"
+	// Reset closes the client connection with a TCP reset
+	Reset = "reset"
+	// Error answers a statement with an error instead of running it
+	Error = "error"
+)
+
+// Default error for rules of kind Error that do not set one.
+const (
+	DefaultCode    = "XX000"
+	DefaultMessage = "fault injected by db-proxy"
+)
+
+// Spec is a rule as written in the config file or sent to the admin API.
+type Spec struct {
+	Name string `yaml:"name" json:"name"`
+	// Fault is one of the kinds above
+	Fault string `yaml:"fault" json:"fault"`
+	// Pattern is matched against the statement text and Users against
+	// the client's user; either one empty matches everything
+	Pattern string   `yaml:"pattern" json:"pattern,omitempty"`
+	Users   []string `yaml:"users" json:"users,omitempty"`
+	// Probability is the chance that a matching statement gets the
+	// fault, from 0 to 1; 0 stands for 1
+	Probability float64 `yaml:"probability" json:"probability,omitempty"`
+	// Latency is a duration such as "250ms", for Latency
+	Latency string `yaml:"latency" json:"latency,omitempty"`
+	// Bandwidth is in bytes per second, for Throttle
+	Bandwidth int64 `yaml:"bandwidth" json:"bandwidth,omitempty"`
+	// Code and Message make up the error, for Error
+	Code    string `yaml:"code" json:"code,omitempty"`
+	Message string `yaml:"message" json:"message,omitempty"`
+}
+
+// Fault is a fault to inject into one statement.
+type Fault struct {
+	// Rule is the name of the rule and Index its position
+	Rule  string
+	Index int
+	Kind  string
+
+	Latency   time.Duration
+	Bandwidth int64
+	Code      string
+	Message   string
+}
+
+type rule struct {
+	Fault
+	pattern     *regexp.Regexp
+	users       []string
+	probability float64
+}
+
+// Injector holds the rules. A nil *Injector injects nothing.
+type Injector struct {
+	specs []Spec
+	rules []rule
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// New checks specs and compiles them. It returns nil for no rules.
+func New(specs []Spec) (*Injector, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	in := &Injector{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for i, s := range specs {
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("fault %d", i+1)
+		}
+		r := rule{Fault: Fault{Rule: s.Name, Index: i, Kind: s.Fault}, users: s.Users, probability: s.Probability}
+		if r.probability == 0 {
+			r.probability = 1
+		}
+		if r.probability < 0 || r.probability > 1 {
+			return nil, fmt.Errorf("fault rule %q: probability must be between 0 and 1", s.Name)
+		}
+		var err error
+		if s.Pattern != "" {
+			if r.pattern, err = regexp.Compile(s.Pattern); err != nil {
+				return nil, fmt.Errorf("fault rule %q: %w", s.Name, err)
+			}
+		}
+		switch s.Fault {
+		case Latency:
+			if r.Latency, err = time.ParseDuration(s.Latency); err != nil || r.Latency <= 0 {
+				return nil, fmt.Errorf("fault rule %q: latency must be a positive duration such as 250ms, got %q", s.Name, s.Latency)
+			}
+		case Throttle:
+			if s.Bandwidth <= 0 {
+				return nil, fmt.Errorf("fault rule %q: bandwidth must be a positive number of bytes per second", s.Name)
+			}
+			r.Bandwidth = s.Bandwidth
+		case Error:
+			r.Code, r.Message = s.Code, s.Message
+			if r.Code == "" {
+				r.Code = DefaultCode
+			}
+			if len(r.Code) != 5 {
+				return nil, fmt.Errorf("fault rule %q: code must be a five-character SQLSTATE, got %q", s.Name, r.Code)
+			}
+			if r.Message == "" {
+				r.Message = DefaultMessage
+			}
+		case Drop, Reset:
+		default:
+			return nil, fmt.Errorf("fault rule %q: fault must be one of %s, %s, %s, %s or %s, got %q", s.Name, Latency, Throttle, Drop, Reset, Error, s.Fault)
+		}
+		in.specs = append(in.specs, s)
+		in.rules = append(in.rules, r)
+	}
+	return in, nil
+}
+
+// Specs returns the rules as they were given, with names filled in.
+func (in *Injector) Specs() []Spec {
+	if in == nil {
+		return []Spec{}
+	}
+	return append([]Spec(nil), in.specs...)
+}
+
+// Pick returns the fault to inject into sql sent by user, or nil. Every
+// rule that matches rolls its dice in turn; the first one that comes up
+// decides.
+func (in *Injector) Pick(user, sql string) *Fault {
+	if in == nil {
+		return nil
+	}
+	for i := range in.rules {
+		r := &in.rules[i]
+		if len(r.users) > 0 && !contains(r.users, user) {
+			continue
+		}
+		if r.pattern != nil && !r.pattern.MatchString(sql) {
+			continue
+		}
+		if r.probability < 1 && !in.roll(r.probability) {
+			continue
+		}
+		f := r.Fault
+		return &f
+	}
+	return nil
+}
+
+// Rule returns the fault of the rule at index, if there is one.
+func (in *Injector) Rule(index int) *Fault {
+	if in == nil || index < 0 || index >= len(in.rules) {
+		return nil
+	}
+	f := in.rules[index].Fault
+	return &f
+}
+
+func (in *Injector) roll(probability float64) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.rng.Float64() < probability
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+// Package firewall decides which SQL statements clients may run. Rules
+// match statements by command, table, pattern, user and client address;
+// the first rule that matches a statement decides whether it may run.
+package firewall
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/mu-wahba/db-proxy-go/sqlparse"
+)
+
+// Actions a rule can take.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// DefaultRule is the name reported when no rule matched and Default
+// blocked the statement.
+const DefaultRule = "default"
+
+// Rule matches statements. Every condition that is set must hold; a rule
+// without conditions matches everything.
+type Rule struct {
+	Name   string
+	Action string
+	// Commands are leading keywords such as DROP, or several of them such
+	// as "ALTER SEQUENCE", in upper case
+	Commands []string
+	// Tables match the tables a statement names. A name without a schema
+	// matches the table in any schema.
+	Tables []string
+	// Pattern is matched against the text of the statement
+	Pattern *regexp.Regexp
+	Users   []string
+	Clients []*net.IPNet
+}
+
+// Firewall holds the rules. A nil *Firewall allows everything.
+type Firewall struct {
+	Rules []Rule
+	// Default is the action for statements no rule matches
+	Default string
+}
+
+// Client is who sent a statement.
+type Client struct {
+	User string
+	IP   net.IP
+}
+
+// Check returns the rule that blocks sql for c, or "" if every statement
+// in it may run. Statements are checked one by one; if any is blocked the
+// whole string is.
+func (f *Firewall) Check(c Client, sql string) (blocked string) {
+	if f == nil {
+		return ""
+	}
+	for _, st := range sqlparse.Parse(sql) {
+		if rule := f.check(c, st); rule != "" {
+			return rule
+		}
+	}
+	return ""
+}
+
+func (f *Firewall) check(c Client, st sqlparse.Statement) string {
+	for _, r := range f.Rules {
+		if !r.matches(c, st) {
+			continue
+		}
+		if r.Action == Deny {
+			return r.Name
+		}
+		return ""
+	}
+	if f.Default == Deny {
+		return DefaultRule
+	}
+	return ""
+}
+
+func (r *Rule) matches(c Client, st sqlparse.Statement) bool {
+	if len(r.Users) > 0 && !contains(r.Users, c.User) {
+		return false
+	}
+	if len(r.Clients) > 0 && !inNetworks(r.Clients, c.IP) {
+		return false
+	}
+	if len(r.Commands) > 0 && !matchCommand(r.Commands, st) {
+		return false
+	}
+	if len(r.Tables) > 0 && !matchTable(r.Tables, st.Tables) {
+		return false
+	}
+	if r.Pattern != nil && !r.Pattern.MatchString(st.Text) {
+		return false
+	}
+	return true
+}
+
+// matchCommand reports whether st starts with one of commands. A WITH
+// query counts as its main command, so "DELETE" also catches
+// WITH x AS (...) DELETE FROM ...
+func matchCommand(commands []string, st sqlparse.Statement) bool {
+	for _, command := range commands {
+		words := strings.Fields(command)
+		if len(words) == 0 || words[0] != st.Command {
+			continue
+		}
+		if len(words) == 1 || hasWords(st.Tokens, words) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasWords reports whether tokens begin with words, ignoring case.
+func hasWords(tokens []sqlparse.Token, words []string) bool {
+	if len(tokens) < len(words) {
+		return false
+	}
+	for i, w := range words {
+		if !tokens[i].Is(w) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchTable(rules, tables []string) bool {
+	for _, table := range tables {
+		unqualified := table[strings.LastIndex(table, ".")+1:]
+		for _, rule := range rules {
+			if rule == table || (!strings.Contains(rule, ".") && rule == unqualified) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func inNetworks(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package firewall
+
+import (
+	"net"
+	"regexp"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestCheck(t *testing.T) {
+	app := Client{User: "app", IP: net.ParseIP("10.0.0.5")}
+	admin := Client{User: "admin", IP: net.ParseIP("192.168.1.7")}
+	fw := &Firewall{
+		Rules: []Rule{
+			{Name: "admins-from-lan", Action: Allow, Users: []string{"admin"}, Clients: []*net.IPNet{mustCIDR(t, "192.168.1.0/24")}},
+			{Name: "no-drop", Action: Deny, Commands: []string{"DROP", "TRUNCATE"}},
+			{Name: "no-sequence-changes", Action: Deny, Commands: []string{"ALTER SEQUENCE"}},
+			{Name: "audit-read", Action: Allow, Commands: []string{"SELECT"}, Tables: []string{"audit.log"}},
+			{Name: "no-audit", Action: Deny, Tables: []string{"audit.log"}},
+			{Name: "no-secrets", Action: Deny, Tables: []string{"secrets"}},
+			{Name: "no-sleep", Action: Deny, Pattern: regexp.MustCompile(`(?i)pg_sleep`)},
+		},
+		Default: Allow,
+	}
+	tests := []struct {
+		client Client
+		sql    string
+		want   string
+	}{
+		{app, "SELECT 1", ""},
+		{app, "DROP TABLE t", "no-drop"},
+		{app, "drop table t", "no-drop"},
+		{app, "TRUNCATE t", "no-drop"},
+		{app, "SELECT 1; DROP TABLE t", "no-drop"},
+		{app, "SELECT 'DROP TABLE t'", ""},
+
+		//several words must all match
+		{app, "ALTER SEQUENCE s RESTART", "no-sequence-changes"},
+		{app, "alter  sequence s restart", "no-sequence-changes"},
+		{app, "ALTER TABLE s ADD COLUMN a int", ""},
+
+		//first match wins: the allow rule comes before the deny rule
+		{app, "SELECT * FROM audit.log", ""},
+		{app, "DELETE FROM audit.log", "no-audit"},
+
+		//a qualified rule only matches that schema, an unqualified one any
+		{app, "DELETE FROM log", ""},
+		{app, "DELETE FROM public.log", ""},
+		{app, "SELECT * FROM secrets", "no-secrets"},
+		{app, "SELECT * FROM vault.secrets", "no-secrets"},
+		{app, `SELECT * FROM "Secrets"`, ""},
+		{app, "SELECT * FROM t JOIN secrets s ON s.id = t.id", "no-secrets"},
+		{app, "WITH secrets AS (SELECT 1) SELECT * FROM secrets", ""},
+
+		{app, "SELECT pg_sleep(10)", "no-sleep"},
+
+		//user and client conditions must both hold
+		{admin, "DROP TABLE t", ""},
+		{Client{User: "admin", IP: net.ParseIP("10.0.0.5")}, "DROP TABLE t", "no-drop"},
+		{Client{User: "app", IP: net.ParseIP("192.168.1.7")}, "DROP TABLE t", "no-drop"},
+		{Client{User: "admin"}, "DROP TABLE t", "no-drop"},
+	}
+	for _, tt := range tests {
+		if got := fw.Check(tt.client, tt.sql); got != tt.want {
+			t.Errorf("Check(%s@%v, %q) = %q, want %q", tt.client.User, tt.client.IP, tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestCheckDefault(t *testing.T) {
+	c := Client{User: "app", IP: net.ParseIP("10.0.0.5")}
+	fw := &Firewall{
+		Rules: []Rule{
+			{Name: "reads", Action: Allow, Commands: []string{"SELECT"}},
+			{Name: "deny-app-writes", Action: Deny, Users: []string{"app"}, Commands: []string{"INSERT", "UPDATE", "DELETE"}},
+		},
+		Default: Deny,
+	}
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{"SELECT 1", ""},
+		{"UPDATE t SET a = 1", "deny-app-writes"},
+		{"WITH x AS (SELECT 1) DELETE FROM t", "deny-app-writes"},
+		{"VACUUM", DefaultRule},
+		{"SELECT 1; VACUUM", DefaultRule},
+		//nothing to run, nothing to block
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := fw.Check(c, tt.sql); got != tt.want {
+			t.Errorf("Check(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+
+	fw.Default = Allow
+	if got := fw.Check(c, "VACUUM"); got != "" {
+		t.Errorf("Check(%q) with default allow = %q, want none", "VACUUM", got)
+	}
+	if got := (*Firewall)(nil).Check(c, "DROP TABLE t"); got != "" {
+		t.Errorf("nil firewall blocked with %q", got)
+	}
+}
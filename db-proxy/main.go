@@ -1,53 +1,358 @@
 package main
 
 import (
-	"io"
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/mu-wahba/db-proxy-go/admin"
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/pool"
+	"github.com/mu-wahba/db-proxy-go/proxy"
+	"github.com/mu-wahba/db-proxy-go/record"
+	"github.com/mu-wahba/db-proxy-go/slowlog"
+	"github.com/mu-wahba/db-proxy-go/stats"
+	"github.com/mu-wahba/db-proxy-go/tracing"
 )
 
+// configWatchInterval is how often the config file is checked for changes.
+const configWatchInterval = 2 * time.Second
+
+// traceFlushTimeout bounds exporting the last spans at shutdown.
+const traceFlushTimeout = 5 * time.Second
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
+	}
+	configPath := flag.String("config", "dbproxy.yaml", "config file; may be left out if the environment has everything")
+	check := flag.Bool("check", false, "check the config and exit")
+	flag.Parse()
+	//a config file that was asked for by name has to be there
+	required := false
+	flag.Visit(func(f *flag.Flag) {
+		required = required || f.Name == "config"
+	})
+
 	//load env
-	err := godotenv.Load()
+	err := loadEnvFile()
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	cfg, err := loadConfig(*configPath, required)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if *check {
+		log.Printf("Config OK: %d backends, %s pooling, listening on %s", len(cfg.Proxy.Backends), cfg.Proxy.PoolMode, cfg.Listen)
+		return
+	}
+	if cfg.Proxy.Recorder, err = openRecorder(nil, cfg.RecordFile); err != nil {
+		log.Fatalf("Error opening recording: %v", err)
+	}
+	if cfg.Proxy.SlowLog, err = openSlowLog(nil, cfg.SlowLogFile); err != nil {
+		log.Fatalf("Error opening slow query log: %v", err)
+	}
+	tracer, err := tracing.New(cfg.Tracing)
 	if err != nil {
-		log.Fatalf("Error loading .env file")
+		log.Fatalf("Error setting up tracing: %v", err)
+	}
+	if tracer != nil {
+		cfg.Proxy.Tracer = tracer.Tracer()
+	}
+	if cfg.Stats.Enabled {
+		cfg.Proxy.Stats = stats.New(cfg.Stats.MaxStatements)
+	}
+	stopStatsExport := startStatsExport(cfg.Stats, cfg.Proxy.Stats)
+	//kept whether or not there is a shadow, which a reload may add
+	cfg.Proxy.ShadowStats = stats.New(cfg.Stats.MaxStatements)
+	server := proxy.NewServer(cfg.Proxy)
+	stopHealthChecks := startHealthChecks(cfg)
+
+	var adminServer *http.Server
+	if cfg.AdminListen != "" {
+		adminServer = &http.Server{Addr: cfg.AdminListen, Handler: admin.NewHandler(server, cfg.AdminToken)}
+		go func() {
+			log.Printf("Admin API listening on %s", cfg.AdminListen)
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalf("Error serving admin API: %v", err)
+			}
+		}()
 	}
 
 	//create listener
-	listener, err := net.Listen("tcp", "0.0.0.0"+":"+os.Getenv("LOCAL_PORT"))
+	listener, err := net.Listen("tcp", cfg.Listen)
 	if err != nil {
 		log.Fatalf("Error creating listener: %v", err)
 	}
+	go accept(listener, server.HandleConnection)
+	var mysqlListener net.Listener
+	if cfg.MySQLListen != "" {
+		if mysqlListener, err = net.Listen("tcp", cfg.MySQLListen); err != nil {
+			log.Fatalf("Error creating MySQL listener: %v", err)
+		}
+		log.Printf("MySQL clients listening on %s", cfg.MySQLListen)
+		go accept(mysqlListener, server.HandleMySQLConnection)
+	}
+	var redisListener net.Listener
+	if cfg.RedisListen != "" {
+		if redisListener, err = net.Listen("tcp", cfg.RedisListen); err != nil {
+			log.Fatalf("Error creating Redis listener: %v", err)
+		}
+		log.Printf("Redis clients listening on %s", cfg.RedisListen)
+		go accept(redisListener, server.HandleRedisConnection)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	changed := watchFile(*configPath, configWatchInterval)
+	for running := true; running; {
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				log.Printf("Received %v, shutting down", sig)
+				running = false
+				continue
+			}
+		case <-changed:
+			log.Printf("Config file %s changed", *configPath)
+		}
+		//reload config
+		next, err := reload(cfg, *configPath, required)
+		if err != nil {
+			log.Printf("Error reloading config, keeping the old one: %v", err)
+			continue
+		}
+		if next.Proxy.Recorder, err = openRecorder(cfg.Proxy.Recorder, next.RecordFile); err != nil {
+			log.Printf("Error opening recording, keeping the old config: %v", err)
+			continue
+		}
+		if next.Proxy.SlowLog, err = openSlowLog(cfg.Proxy.SlowLog, next.SlowLogFile); err != nil {
+			log.Printf("Error opening slow query log, keeping the old config: %v", err)
+			if next.Proxy.Recorder != cfg.Proxy.Recorder {
+				next.Proxy.Recorder.Close()
+			}
+			continue
+		}
+		next.Proxy.Tracer = cfg.Proxy.Tracer
+		next.Proxy.Stats = cfg.Proxy.Stats
+		next.Proxy.ShadowStats = cfg.Proxy.ShadowStats
+		stopHealthChecks()
+		next.Proxy.Backends = backend.Reuse(server.Backends(), next.Proxy.Backends)
+		next.Proxy.MySQL.Backends = backend.Reuse(server.MySQLBackends(), next.Proxy.MySQL.Backends)
+		next.Proxy.Redis.Backends = backend.Reuse(server.RedisBackends(), next.Proxy.Redis.Backends)
+		server.Reload(next.Proxy)
+		stopHealthChecks = startHealthChecks(next)
+		if cfg.Proxy.Recorder != next.Proxy.Recorder {
+			cfg.Proxy.Recorder.Close()
+		}
+		if cfg.Proxy.SlowLog != next.Proxy.SlowLog {
+			cfg.Proxy.SlowLog.Close()
+		}
+		cfg = next
+		log.Printf("Config reloaded")
+	}
 
+	//stop taking new clients and let the connected ones finish
+	listener.Close()
+	if mysqlListener != nil {
+		mysqlListener.Close()
+	}
+	if redisListener != nil {
+		redisListener.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error draining connections: %v", err)
+	}
+	stopHealthChecks()
+	if err := cfg.Proxy.Recorder.Close(); err != nil {
+		log.Printf("Error closing recording: %v", err)
+	}
+	if err := cfg.Proxy.SlowLog.Close(); err != nil {
+		log.Printf("Error closing slow query log: %v", err)
+	}
+	stopStatsExport()
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), traceFlushTimeout)
+	defer cancelFlush()
+	if err := tracer.Shutdown(flushCtx); err != nil {
+		log.Printf("Error exporting traces: %v", err)
+	}
+	if adminServer != nil {
+		adminServer.Close()
+	}
+	log.Printf("Shutdown complete")
+}
+
+// accept hands connections to handle until the listener is closed.
+func accept(listener net.Listener, handle func(net.Conn)) {
 	for {
 		connection, err := listener.Accept()
-		//add logging for the connection
-		log.Printf("Connection accepted: %v", connection.LocalAddr())
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
-			log.Fatalf("Error accepting connection: %v", err)
+			//out of file descriptors and the like; back off and retry
+			log.Printf("Error accepting connection: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
 		}
+		//add logging for the connection
+		log.Printf("Connection accepted: %v", connection.RemoteAddr())
 
-		go handleConnection(connection)
+		go handle(connection)
 	}
-
 }
 
-func handleConnection(connection net.Conn) {
-	//connect to actul db server
-	db, err := net.Dial("tcp", os.Getenv("REMOTE_DB_HOST")+":"+os.Getenv("REMOTE_DB_PORT"))
+// reload reads the configuration again. Settings for the listeners cannot
+// change without a restart and keep their old values.
+func reload(current config, path string, required bool) (config, error) {
+	if err := loadEnvFile(); err != nil {
+		return current, err
+	}
+	cfg, err := loadConfig(path, required)
 	if err != nil {
-		log.Fatalf("Error connecting to db: %v", err)
-		return
+		return current, err
 	}
+	if cfg.Listen != current.Listen || cfg.MySQLListen != current.MySQLListen || cfg.RedisListen != current.RedisListen || cfg.AdminListen != current.AdminListen || cfg.AdminToken != current.AdminToken {
+		log.Printf("The listen addresses and the admin settings only change on restart")
+		cfg.Listen, cfg.MySQLListen, cfg.RedisListen = current.Listen, current.MySQLListen, current.RedisListen
+		cfg.AdminListen, cfg.AdminToken = current.AdminListen, current.AdminToken
+	}
+	if cfg.Tracing != current.Tracing {
+		log.Printf("The tracing settings only change on restart")
+		cfg.Tracing = current.Tracing
+	}
+	if cfg.Stats != current.Stats {
+		log.Printf("The statement statistics settings only change on restart")
+		cfg.Stats = current.Stats
+	}
+	return cfg, nil
+}
 
-	defer db.Close()
+// startHealthChecks runs the health checkers for cfg, if they are enabled,
+// and returns a function that stops them and waits for them to finish.
+// MySQL and Redis backends are only checked for accepting TCP connections.
+func startHealthChecks(cfg config) func() {
+	if cfg.Health.Interval <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	run := func(checker *backend.Checker) {
+		wg.Add(1)
+		go func() {
+			checker.Run(ctx)
+			wg.Done()
+		}()
+	}
+	run(backend.NewChecker(cfg.Proxy.Backends, cfg.Health))
+	tcpOnly := cfg.Health
+	tcpOnly.Credentials = pool.Credentials{ProxyHeader: cfg.Health.Credentials.ProxyHeader}
+	if len(cfg.Proxy.MySQL.Backends) > 0 {
+		run(backend.NewChecker(cfg.Proxy.MySQL.Backends, tcpOnly))
+	}
+	if len(cfg.Proxy.Redis.Backends) > 0 {
+		run(backend.NewChecker(cfg.Proxy.Redis.Backends, tcpOnly))
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
 
-	go io.Copy(db, connection) //from client to db in seperate
+// startStatsExport writes the statement statistics to the file cfg names
+// every cfg.FileInterval, and returns a function that stops the export
+// after writing the file one last time.
+func startStatsExport(cfg stats.Config, collector *stats.Collector) func() {
+	if collector == nil || cfg.File == "" {
+		return func() {}
+	}
+	write := func() {
+		if err := collector.WriteFile(cfg.File); err != nil {
+			log.Printf("Error writing statement statistics: %v", err)
+		}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.FileInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				write()
+			case <-stop:
+				write()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
 
-	io.Copy(connection, db)
+// openRecorder returns the recorder for path: current if it already
+// records there, a new one otherwise, or nil if path is empty.
+func openRecorder(current *record.Recorder, path string) (*record.Recorder, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if current != nil && current.Path == path {
+		return current, nil
+	}
+	return record.Open(path)
+}
 
+// openSlowLog returns the slow query log for path: current if it already
+// logs there, a new one otherwise, or nil if path is empty.
+func openSlowLog(current *slowlog.Logger, path string) (*slowlog.Logger, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if current != nil && current.Path == path {
+		return current, nil
+	}
+	return slowlog.Open(path)
 }
 
+// watchFile polls path and sends on the returned channel when its
+// modification time or size changes, including when it appears or goes away.
+func watchFile(path string, interval time.Duration) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+	go func() {
+		modTime, size := stat()
+		for range time.Tick(interval) {
+			m, sz := stat()
+			if m.Equal(modTime) && sz == size {
+				continue
+			}
+			modTime, size = m, sz
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changed
+}
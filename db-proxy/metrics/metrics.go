@@ -0,0 +1,163 @@
+// Package metrics holds the proxy's Prometheus metrics. They are
+// registered with the default registry, which the admin API serves on
+// /metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons a client connection is rejected, used as the reason label.
+const (
+	RejectStartup   = "startup"
+	RejectTLS       = "tls_required"
+	RejectAuth      = "auth"
+	RejectNoBackend = "no_backend"
+	RejectShutdown  = "shutdown"
+	RejectACL       = "acl"
+	RejectLimit     = "limit"
+	// RejectProxyProtocol is for a missing or invalid PROXY header
+	RejectProxyProtocol = "proxy_protocol"
+)
+
+// Where Redis commands went, used as the route label. Blocked commands
+// were answered with an error by the proxy.
+const (
+	RoutePrimary = "primary"
+	RouteReplica = "replica"
+	RouteBlocked = "blocked"
+)
+
+// Results of cache lookups, used as the result label.
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// Results of requests mirrored to the shadow server, used as the result
+// label. Answers are checked against the backend's as match or mismatch
+// when comparing, and otherwise counted as ok or error. Requests are
+// dropped when the session's queue is full, and unavailable when there
+// is no connection to the shadow.
+const (
+	ShadowOK          = "ok"
+	ShadowError       = "error"
+	ShadowMatch       = "match"
+	ShadowMismatch    = "mismatch"
+	ShadowDropped     = "dropped"
+	ShadowUnavailable = "unavailable"
+)
+
+// Timeouts that close connections, used as the timeout label.
+const (
+	TimeoutDial            = "dial"
+	TimeoutClientIdle      = "client_idle"
+	TimeoutServerIdle      = "server_idle"
+	TimeoutSessionLifetime = "session_lifetime"
+)
+
+var (
+	ConnectionsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dbproxy_connections_accepted_total",
+		Help: "Client connections accepted.",
+	})
+	ConnectionsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbproxy_connections_rejected_total",
+		Help: "Client connections turned away before their session started, by reason.",
+	}, []string{"reason"})
+	ConnectionsQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dbproxy_connections_queued",
+		Help: "Clients waiting for a connection slot under the connection limits.",
+	})
+	ConnectionsTimedOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbproxy_connections_timed_out_total",
+		Help: "Client and server connections closed, or given up on while connecting, because a timeout ran out, by timeout.",
+	}, []string{"timeout"})
+
+	BackendActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dbproxy_backend_active_connections",
+		Help: "Server connections in use by clients, per backend.",
+	}, []string{"backend"})
+	BackendDialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dbproxy_backend_dial_duration_seconds",
+		Help:    "Time taken to connect to a backend, including the TLS handshake.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"backend"})
+	BackendDialErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbproxy_backend_dial_errors_total",
+		Help: "Failed attempts to connect to a backend.",
+	}, []string{"backend"})
+
+	// Bytes counts what clients send (direction "in") and receive ("out")
+	Bytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbproxy_client_bytes_total",
+		Help: "Bytes transferred between clients and the proxy, by direction.",
+	}, []string{"direction"})
+	BytesIn  = Bytes.WithLabelValues("in")
+	BytesOut = Bytes.WithLabelValues("out")
+
+	FirewallBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbproxy_firewall_blocked_total",
+		Help: "Statements blocked by the firewall, by rule.",
+	}, []string{"rule"})
+
+	FaultsInjected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbproxy_faults_injected_total",
+		Help: "Faults injected into client sessions, by rule and kind of fault.",
+	}, []string{"rule", "fault"})
+
+	CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbproxy_cache_lookups_total",
+		Help: "Statements looked up in the result cache, by rule and result.",
+	}, []string{"rule", "result"})
+	CacheInvalidations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dbproxy_cache_invalidations_total",
+		Help: "Cached results dropped because a write named one of their tables.",
+	})
+	CacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dbproxy_cache_evictions_total",
+		Help: "Cached results dropped to stay within the memory limit.",
+	})
+	CacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dbproxy_cache_bytes",
+		Help: "Size of the cached results, as sent to clients.",
+	})
+
+	StatementsEvicted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dbproxy_statement_stats_evicted_total",
+		Help: "Fingerprints dropped from the statement statistics to stay within their limit.",
+	})
+
+	ShadowRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbproxy_shadow_requests_total",
+		Help: "Requests of PostgreSQL clients mirrored to the shadow server, by result.",
+	}, []string{"result"})
+	ShadowDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dbproxy_shadow_request_duration_seconds",
+		Help:    "Time the shadow server took to answer a mirrored request.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	})
+
+	// RedisCommands are labelled with the lower case command name, or
+	// "unknown" for a name the proxy does not know
+	RedisCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbproxy_redis_commands_total",
+		Help: "Redis commands received from clients, by command and route.",
+	}, []string{"command", "route"})
+	RedisCommandErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbproxy_redis_command_errors_total",
+		Help: "Redis commands the server answered with an error, by command.",
+	}, []string{"command"})
+	RedisCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dbproxy_redis_command_duration_seconds",
+		Help:    "Time from sending a Redis command to the server to its reply, by command.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1},
+	}, []string{"command"})
+
+	SessionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dbproxy_session_duration_seconds",
+		Help:    "How long client sessions last, from accept to disconnect.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+)
@@ -0,0 +1,119 @@
+package mysqlproto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+)
+
+// Answers to caching_sha2_password, sent after 0x01 as AuthMoreData.
+const (
+	// FastAuthOK says the server knew the password hash; an OK follows
+	FastAuthOK = 0x03
+	// FullAuthRequired asks for the password itself, in clear over TLS
+	// or encrypted with the server's public key otherwise
+	FullAuthRequired = 0x04
+	// requestPublicKey is what the client sends to get the key
+	requestPublicKey = 0x02
+)
+
+// NewScramble returns a random scramble for a greeting. Like the server's
+// it is printable ASCII, without NUL, which would end it, or '$'.
+func NewScramble() []byte {
+	b := make([]byte, 20)
+	rand.Read(b)
+	for i := range b {
+		b[i] = '%' + b[i]%('~'-'%')
+	}
+	return b
+}
+
+// ScrambleNativePassword answers a mysql_native_password challenge:
+// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password))).
+func ScrambleNativePassword(scramble []byte, password string) []byte {
+	if password == "" {
+		return nil
+	}
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(scramble[:20])
+	h.Write(stage2[:])
+	out := h.Sum(nil)
+	for i := range out {
+		out[i] ^= stage1[i]
+	}
+	return out
+}
+
+// CheckNativePassword reports whether response answers the
+// mysql_native_password challenge scramble for password.
+func CheckNativePassword(scramble []byte, password string, response []byte) bool {
+	want := ScrambleNativePassword(scramble, password)
+	return len(want) == len(response) && subtle.ConstantTimeCompare(want, response) == 1
+}
+
+// ScrambleCachingSHA2 answers a caching_sha2_password challenge:
+// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble).
+func ScrambleCachingSHA2(scramble []byte, password string) []byte {
+	if password == "" {
+		return nil
+	}
+	stage1 := sha256.Sum256([]byte(password))
+	stage2 := sha256.Sum256(stage1[:])
+	h := sha256.New()
+	h.Write(stage2[:])
+	h.Write(scramble[:20])
+	out := h.Sum(nil)
+	for i := range out {
+		out[i] ^= stage1[i]
+	}
+	return out
+}
+
+// Scramble answers the challenge of plugin, for the plugins the proxy
+// logs in with.
+func Scramble(plugin string, scramble []byte, password string) ([]byte, error) {
+	switch plugin {
+	case NativePassword, "":
+		return ScrambleNativePassword(scramble, password), nil
+	case CachingSHA2Password:
+		return ScrambleCachingSHA2(scramble, password), nil
+	case ClearPassword:
+		return append([]byte(password), 0), nil
+	}
+	return nil, errors.New("mysqlproto: unsupported authentication plugin " + plugin)
+}
+
+// RequestPublicKey is the AuthMoreData payload that asks the server for
+// its RSA key during a full caching_sha2_password authentication.
+func RequestPublicKey() []byte {
+	return []byte{requestPublicKey}
+}
+
+// EncryptPassword encrypts password for a full caching_sha2_password
+// authentication without TLS, with the PEM public key the server sent.
+func EncryptPassword(password string, scramble, publicKey []byte) ([]byte, error) {
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return nil, errors.New("mysqlproto: invalid server public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("mysqlproto: server public key is not an RSA key")
+	}
+	plain := append([]byte(password), 0)
+	for i := range plain {
+		plain[i] ^= scramble[i%len(scramble)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaKey, plain, nil)
+}
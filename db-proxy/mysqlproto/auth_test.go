@@ -0,0 +1,65 @@
+package mysqlproto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+var testScramble = []byte("abcdefghij0123456789")
+
+func TestNativePassword(t *testing.T) {
+	want, _ := hex.DecodeString("99db25ccb2a625f0e7cf4ce2e895ef9609dfe5e4")
+	if got := ScrambleNativePassword(testScramble, "secret"); !bytes.Equal(got, want) {
+		t.Errorf("ScrambleNativePassword = %x, want %x", got, want)
+	}
+	if !CheckNativePassword(testScramble, "secret", want) {
+		t.Errorf("right password rejected")
+	}
+	if CheckNativePassword(testScramble, "Secret", want) {
+		t.Errorf("wrong password accepted")
+	}
+	if CheckNativePassword(testScramble, "secret", want[:19]) {
+		t.Errorf("short response accepted")
+	}
+	other := append([]byte("ABCDEFGHIJ"), testScramble[10:]...)
+	if CheckNativePassword(other, "secret", want) {
+		t.Errorf("response to another scramble accepted")
+	}
+
+	//an empty password is answered with nothing
+	if !CheckNativePassword(testScramble, "", nil) || CheckNativePassword(testScramble, "", want) {
+		t.Errorf("empty password checked wrongly")
+	}
+	if CheckNativePassword(testScramble, "secret", nil) {
+		t.Errorf("empty response accepted for a password")
+	}
+}
+
+func TestCachingSHA2(t *testing.T) {
+	want, _ := hex.DecodeString("bd7d89fc1c297010da753d08822e9e48d3eafbb6e68e1f9b403be12dc5687a40")
+	if got := ScrambleCachingSHA2(testScramble, "secret"); !bytes.Equal(got, want) {
+		t.Errorf("ScrambleCachingSHA2 = %x, want %x", got, want)
+	}
+	if got, err := Scramble(CachingSHA2Password, testScramble, "secret"); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("Scramble(caching_sha2_password) = %x, %v", got, err)
+	}
+	if got, _ := Scramble(ClearPassword, testScramble, "secret"); string(got) != "secret\x00" {
+		t.Errorf("Scramble(mysql_clear_password) = %q", got)
+	}
+	if _, err := Scramble("sha256_password", testScramble, "secret"); err == nil {
+		t.Errorf("unsupported plugin accepted")
+	}
+}
+
+func TestNewScramble(t *testing.T) {
+	a, b := NewScramble(), NewScramble()
+	if len(a) != 20 || bytes.Equal(a, b) {
+		t.Errorf("scrambles %q and %q", a, b)
+	}
+	for _, c := range a {
+		if c < '%' || c > '~' {
+			t.Errorf("scramble %q has %q", a, c)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package mysqlproto
+
+import (
+	"fmt"
+)
+
+// Capability flags.
+const (
+	ClientLongPassword              = 1 << 0
+	ClientFoundRows                 = 1 << 1
+	ClientLongFlag                  = 1 << 2
+	ClientConnectWithDB             = 1 << 3
+	ClientCompress                  = 1 << 5
+	ClientLocalFiles                = 1 << 7
+	ClientProtocol41                = 1 << 9
+	ClientInteractive               = 1 << 10
+	ClientSSL                       = 1 << 11
+	ClientTransactions              = 1 << 13
+	ClientSecureConnection          = 1 << 15
+	ClientMultiStatements           = 1 << 16
+	ClientMultiResults              = 1 << 17
+	ClientPSMultiResults            = 1 << 18
+	ClientPluginAuth                = 1 << 19
+	ClientConnectAttrs              = 1 << 20
+	ClientPluginAuthLenencData      = 1 << 21
+	ClientSessionTrack              = 1 << 23
+	ClientDeprecateEOF              = 1 << 24
+	ClientOptionalResultsetMetadata = 1 << 25
+	ClientZstdCompression           = 1 << 26
+	ClientQueryAttributes           = 1 << 27
+	ClientMultiFactorAuth           = 1 << 28
+)
+
+// Unsupported are the capabilities that change the framing or the
+// layout of packets beyond what this package follows. The proxy never
+// offers them.
+const Unsupported = ClientCompress | ClientZstdCompression | ClientOptionalResultsetMetadata | ClientQueryAttributes | ClientMultiFactorAuth
+
+// Authentication plugins.
+const (
+	NativePassword      = "mysql_native_password"
+	CachingSHA2Password = "caching_sha2_password"
+	ClearPassword       = "mysql_clear_password"
+)
+
+// protocolVersion is the only handshake version this package speaks.
+const protocolVersion = 10
+
+// sslRequestLength is the size of an SSLRequest, the start of a
+// HandshakeResponse sent on its own before the TLS handshake.
+const sslRequestLength = 32
+
+// Handshake is the greeting a server sends when a client connects.
+type Handshake struct {
+	ServerVersion string
+	ConnectionID  uint32
+	// AuthData is the scramble, usually 20 bytes
+	AuthData     []byte
+	Capabilities uint32
+	Charset      byte
+	Status       uint16
+	AuthPlugin   string
+	// reserved is kept as sent, MariaDB keeps capabilities of its own there
+	reserved []byte
+}
+
+// ParseHandshake decodes a server greeting.
+func ParseHandshake(payload []byte) (*Handshake, error) {
+	if len(payload) > 0 && payload[0] == 0xff {
+		//the server turned us away before the handshake
+		return nil, ParseError(payload)
+	}
+	d := &decoder{buf: payload}
+	if v := d.byte(); v != protocolVersion {
+		return nil, fmt.Errorf("mysqlproto: unsupported protocol version %d", v)
+	}
+	h := &Handshake{ServerVersion: d.string(), ConnectionID: d.uint32()}
+	h.AuthData = d.bytes(8)
+	d.byte()
+	h.Capabilities = uint32(d.uint16())
+	h.Charset = d.byte()
+	h.Status = d.uint16()
+	h.Capabilities |= uint32(d.uint16()) << 16
+	authLength := int(d.byte())
+	h.reserved = d.bytes(10)
+	if h.Capabilities&ClientSecureConnection != 0 {
+		n := authLength - 8
+		if n < 13 {
+			n = 13
+		}
+		part := d.bytes(n)
+		if len(part) > 0 && part[len(part)-1] == 0 {
+			part = part[:len(part)-1]
+		}
+		h.AuthData = append(h.AuthData, part...)
+	}
+	if h.Capabilities&ClientPluginAuth != 0 {
+		h.AuthPlugin = d.string()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return h, nil
+}
+
+// Encode appends the payload of the greeting to dst.
+func (h *Handshake) Encode(dst []byte) []byte {
+	dst = append(dst, protocolVersion)
+	dst = appendString(dst, h.ServerVersion)
+	dst = appendUint32(dst, h.ConnectionID)
+	data := make([]byte, 20)
+	copy(data, h.AuthData)
+	if len(h.AuthData) > 20 {
+		data = h.AuthData
+	}
+	dst = append(dst, data[:8]...)
+	dst = append(dst, 0)
+	dst = appendUint16(dst, uint16(h.Capabilities))
+	dst = append(dst, h.Charset)
+	dst = appendUint16(dst, h.Status)
+	dst = appendUint16(dst, uint16(h.Capabilities>>16))
+	if h.Capabilities&ClientPluginAuth != 0 {
+		dst = append(dst, byte(len(data)+1))
+	} else {
+		dst = append(dst, 0)
+	}
+	reserved := make([]byte, 10)
+	copy(reserved, h.reserved)
+	dst = append(dst, reserved...)
+	if h.Capabilities&ClientSecureConnection != 0 {
+		dst = append(dst, data[8:]...)
+		dst = append(dst, 0)
+	}
+	if h.Capabilities&ClientPluginAuth != 0 {
+		dst = appendString(dst, h.AuthPlugin)
+	}
+	return dst
+}
+
+// HandshakeResponse is the client's answer to the greeting, with its
+// credentials.
+type HandshakeResponse struct {
+	Capabilities  uint32
+	MaxPacketSize uint32
+	Charset       byte
+	User          string
+	AuthResponse  []byte
+	Database      string
+	AuthPlugin    string
+	// Attributes are the connection attributes, encoded as sent
+	Attributes []byte
+}
+
+// IsSSLRequest reports whether payload is an SSLRequest: the fixed part
+// of a HandshakeResponse, asking to switch to TLS first.
+func IsSSLRequest(payload []byte) bool {
+	if len(payload) != sslRequestLength {
+		return false
+	}
+	d := &decoder{buf: payload}
+	return d.uint32()&ClientSSL != 0
+}
+
+// ParseHandshakeResponse decodes a HandshakeResponse41.
+func ParseHandshakeResponse(payload []byte) (*HandshakeResponse, error) {
+	d := &decoder{buf: payload}
+	r := &HandshakeResponse{Capabilities: d.uint32()}
+	if d.err == nil && r.Capabilities&ClientProtocol41 == 0 {
+		return nil, fmt.Errorf("mysqlproto: client does not speak protocol 4.1")
+	}
+	r.MaxPacketSize = d.uint32()
+	r.Charset = d.byte()
+	d.bytes(23)
+	r.User = d.string()
+	switch {
+	case r.Capabilities&ClientPluginAuthLenencData != 0:
+		r.AuthResponse = d.lenencBytes()
+	case r.Capabilities&ClientSecureConnection != 0:
+		r.AuthResponse = d.bytes(int(d.byte()))
+	default:
+		r.AuthResponse = []byte(d.string())
+	}
+	if r.Capabilities&ClientConnectWithDB != 0 && len(d.buf) > 0 {
+		r.Database = d.string()
+	}
+	if r.Capabilities&ClientPluginAuth != 0 && len(d.buf) > 0 {
+		r.AuthPlugin = d.string()
+	}
+	if r.Capabilities&ClientConnectAttrs != 0 && len(d.buf) > 0 {
+		r.Attributes = d.lenencBytes()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return r, nil
+}
+
+// Encode appends the payload of the response to dst.
+func (r *HandshakeResponse) Encode(dst []byte) []byte {
+	dst = r.EncodeSSLRequest(dst)
+	dst = appendString(dst, r.User)
+	switch {
+	case r.Capabilities&ClientPluginAuthLenencData != 0:
+		dst = appendLenencBytes(dst, r.AuthResponse)
+	case r.Capabilities&ClientSecureConnection != 0:
+		dst = append(dst, byte(len(r.AuthResponse)))
+		dst = append(dst, r.AuthResponse...)
+	default:
+		dst = appendString(dst, string(r.AuthResponse))
+	}
+	if r.Capabilities&ClientConnectWithDB != 0 {
+		dst = appendString(dst, r.Database)
+	}
+	if r.Capabilities&ClientPluginAuth != 0 {
+		dst = appendString(dst, r.AuthPlugin)
+	}
+	if r.Capabilities&ClientConnectAttrs != 0 {
+		dst = appendLenencBytes(dst, r.Attributes)
+	}
+	return dst
+}
+
+// EncodeSSLRequest appends the SSLRequest that goes before the response
+// when the connection switches to TLS. Capabilities must include
+// ClientSSL.
+func (r *HandshakeResponse) EncodeSSLRequest(dst []byte) []byte {
+	dst = appendUint32(dst, r.Capabilities)
+	dst = appendUint32(dst, r.MaxPacketSize)
+	dst = append(dst, r.Charset)
+	return append(dst, make([]byte, 23)...)
+}
+
+// AuthSwitchRequest asks the client to authenticate again with another
+// plugin.
+type AuthSwitchRequest struct {
+	Plugin   string
+	AuthData []byte
+}
+
+// Encode appends the payload of the request to dst.
+func (m *AuthSwitchRequest) Encode(dst []byte) []byte {
+	dst = append(dst, 0xfe)
+	dst = appendString(dst, m.Plugin)
+	dst = append(dst, m.AuthData...)
+	return append(dst, 0)
+}
+
+// ParseAuthSwitchRequest decodes the payload of an AuthSwitchRequest.
+func ParseAuthSwitchRequest(payload []byte) (*AuthSwitchRequest, error) {
+	d := &decoder{buf: payload}
+	if d.byte() != 0xfe {
+		return nil, ErrMalformed
+	}
+	m := &AuthSwitchRequest{Plugin: d.string(), AuthData: d.rest()}
+	if n := len(m.AuthData); n > 0 && m.AuthData[n-1] == 0 {
+		m.AuthData = m.AuthData[:n-1]
+	}
+	return m, d.err
+}
@@ -0,0 +1,147 @@
+package mysqlproto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	want := &Handshake{
+		ServerVersion: "8.0.36",
+		ConnectionID:  42,
+		AuthData:      []byte("abcdefghij0123456789"),
+		Capabilities:  ClientProtocol41 | ClientSecureConnection | ClientPluginAuth | ClientSSL | ClientDeprecateEOF,
+		Charset:       255,
+		Status:        StatusAutocommit,
+		AuthPlugin:    CachingSHA2Password,
+		reserved:      make([]byte, 10),
+	}
+	got, err := ParseHandshake(want.Encode(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %#v, want %#v", got, want)
+	}
+
+	if _, err := ParseHandshake([]byte{9, 'x', 0}); err == nil {
+		t.Errorf("protocol 9 accepted")
+	}
+	refused := NewError(1130, "HY000", "Host is not allowed")
+	if _, err := ParseHandshake(refused.Encode(nil)); !reflect.DeepEqual(err, refused) {
+		t.Errorf("refusal parsed as %v", err)
+	}
+	if _, err := ParseHandshake(want.Encode(nil)[:20]); err == nil {
+		t.Errorf("truncated greeting accepted")
+	}
+}
+
+// handshakeResponse builds a HandshakeResponse41 by hand, with auth
+// already encoded for caps.
+func handshakeResponse(caps uint32, auth []byte, tail string) []byte {
+	b := appendUint32(nil, caps)
+	b = appendUint32(b, 1<<24)
+	b = append(b, 45)
+	b = append(b, make([]byte, 23)...)
+	b = append(b, "root\x00"...)
+	b = append(b, auth...)
+	return append(b, tail...)
+}
+
+func TestParseHandshakeResponse(t *testing.T) {
+	scramble := bytes.Repeat([]byte{0x11}, 20)
+	long := bytes.Repeat([]byte{0x22}, 300)
+	base := uint32(ClientProtocol41 | ClientSecureConnection | ClientPluginAuth | ClientConnectWithDB)
+	tests := []struct {
+		name    string
+		payload []byte
+		want    HandshakeResponse
+	}{
+		{
+			"one-byte auth length",
+			handshakeResponse(base, append([]byte{20}, scramble...), "shop\x00mysql_native_password\x00"),
+			HandshakeResponse{Capabilities: base, AuthResponse: scramble, Database: "shop", AuthPlugin: NativePassword},
+		},
+		{
+			"lenenc auth data",
+			handshakeResponse(base|ClientPluginAuthLenencData, append([]byte{20}, scramble...), "shop\x00mysql_native_password\x00"),
+			HandshakeResponse{Capabilities: base | ClientPluginAuthLenencData, AuthResponse: scramble, Database: "shop", AuthPlugin: NativePassword},
+		},
+		{
+			"lenenc auth data over 250 bytes",
+			handshakeResponse(base|ClientPluginAuthLenencData, append([]byte{0xfc, 0x2c, 0x01}, long...), "shop\x00x\x00"),
+			HandshakeResponse{Capabilities: base | ClientPluginAuthLenencData, AuthResponse: long, Database: "shop", AuthPlugin: "x"},
+		},
+		{
+			"connection attributes",
+			handshakeResponse(base|ClientPluginAuthLenencData|ClientConnectAttrs, []byte{0}, "\x00caching_sha2_password\x00\x08\x03_os\x03lnx"),
+			HandshakeResponse{Capabilities: base | ClientPluginAuthLenencData | ClientConnectAttrs, AuthResponse: []byte{}, AuthPlugin: CachingSHA2Password, Attributes: []byte("\x03_os\x03lnx")},
+		},
+		{
+			"no database or plugin",
+			handshakeResponse(ClientProtocol41|ClientSecureConnection, append([]byte{20}, scramble...), ""),
+			HandshakeResponse{Capabilities: ClientProtocol41 | ClientSecureConnection, AuthResponse: scramble},
+		},
+		{
+			"old style auth response",
+			handshakeResponse(ClientProtocol41, []byte("pw\x00"), ""),
+			HandshakeResponse{Capabilities: ClientProtocol41, AuthResponse: []byte("pw")},
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParseHandshakeResponse(tt.payload)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		tt.want.MaxPacketSize, tt.want.Charset, tt.want.User = 1<<24, 45, "root"
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: decoded %#v, want %#v", tt.name, *got, tt.want)
+		}
+		if enc := got.Encode(nil); !bytes.Equal(enc, tt.payload) {
+			t.Errorf("%s: re-encoded %q, want %q", tt.name, enc, tt.payload)
+		}
+	}
+}
+
+func TestParseHandshakeResponseMalformed(t *testing.T) {
+	base := uint32(ClientProtocol41 | ClientSecureConnection)
+	for name, payload := range map[string][]byte{
+		"protocol 4.0":        handshakeResponse(ClientSecureConnection, []byte{0}, ""),
+		"short fixed part":    appendUint32(nil, base),
+		"long auth":           handshakeResponse(base, []byte{20, 1, 2}, ""),
+		"long lenenc auth":    handshakeResponse(base|ClientPluginAuthLenencData, []byte{0xfc, 0xff}, ""),
+		"long lenenc attrs":   handshakeResponse(base|ClientConnectAttrs, []byte{0}, "\x09ab"),
+		"missing auth length": handshakeResponse(base, nil, ""),
+	} {
+		if _, err := ParseHandshakeResponse(payload); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestSSLRequest(t *testing.T) {
+	r := &HandshakeResponse{Capabilities: ClientProtocol41 | ClientSSL, MaxPacketSize: 1 << 24, Charset: 45, User: "root"}
+	if req := r.EncodeSSLRequest(nil); !IsSSLRequest(req) {
+		t.Errorf("SSLRequest %q not recognised", req)
+	}
+	if IsSSLRequest(r.Encode(nil)) {
+		t.Errorf("full response taken for an SSLRequest")
+	}
+	r.Capabilities &^= ClientSSL
+	if IsSSLRequest(r.EncodeSSLRequest(nil)) {
+		t.Errorf("request without ClientSSL taken for an SSLRequest")
+	}
+}
+
+func TestAuthSwitchRequest(t *testing.T) {
+	want := &AuthSwitchRequest{Plugin: NativePassword, AuthData: []byte("abcdefghij0123456789")}
+	got, err := ParseAuthSwitchRequest(want.Encode(nil))
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %#v, %v", got, err)
+	}
+	if _, err := ParseAuthSwitchRequest([]byte{0x01, 'x'}); err == nil {
+		t.Errorf("AuthMoreData taken for an AuthSwitchRequest")
+	}
+}
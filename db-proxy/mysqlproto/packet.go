@@ -0,0 +1,310 @@
+// Package mysqlproto decodes and encodes the MySQL client/server protocol
+// (protocol version 10 with CLIENT_PROTOCOL_41) so the proxy can see what
+// it forwards.
+package mysqlproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrMalformed is returned when a packet is shorter than its fields claim.
+var ErrMalformed = errors.New("mysqlproto: malformed packet")
+
+// maxPayload is the largest payload one packet carries; longer payloads
+// are split, and a payload of exactly this size is followed by another
+// packet, empty if need be.
+const maxPayload = 1<<24 - 1
+
+// Commands, the first byte of a packet from the client in the command
+// phase.
+const (
+	ComQuit            = 0x01
+	ComInitDB          = 0x02
+	ComQuery           = 0x03
+	ComFieldList       = 0x04
+	ComStatistics      = 0x09
+	ComProcessInfo     = 0x0a
+	ComProcessKill     = 0x0c
+	ComDebug           = 0x0d
+	ComPing            = 0x0e
+	ComChangeUser      = 0x11
+	ComStmtPrepare     = 0x16
+	ComStmtExecute     = 0x17
+	ComStmtSendLong    = 0x18
+	ComStmtClose       = 0x19
+	ComStmtReset       = 0x1a
+	ComSetOption       = 0x1b
+	ComStmtFetch       = 0x1c
+	ComResetConnection = 0x1f
+)
+
+var commandNames = map[byte]string{
+	ComQuit:            "COM_QUIT",
+	ComInitDB:          "COM_INIT_DB",
+	ComQuery:           "COM_QUERY",
+	ComFieldList:       "COM_FIELD_LIST",
+	ComStatistics:      "COM_STATISTICS",
+	ComProcessInfo:     "COM_PROCESS_INFO",
+	ComProcessKill:     "COM_PROCESS_KILL",
+	ComDebug:           "COM_DEBUG",
+	ComPing:            "COM_PING",
+	ComChangeUser:      "COM_CHANGE_USER",
+	ComStmtPrepare:     "COM_STMT_PREPARE",
+	ComStmtExecute:     "COM_STMT_EXECUTE",
+	ComStmtSendLong:    "COM_STMT_SEND_LONG_DATA",
+	ComStmtClose:       "COM_STMT_CLOSE",
+	ComStmtReset:       "COM_STMT_RESET",
+	ComSetOption:       "COM_SET_OPTION",
+	ComStmtFetch:       "COM_STMT_FETCH",
+	ComResetConnection: "COM_RESET_CONNECTION",
+}
+
+// CommandName returns the name of command, such as COM_QUERY.
+func CommandName(command byte) string {
+	if name, ok := commandNames[command]; ok {
+		return name
+	}
+	return "COM_UNKNOWN"
+}
+
+// Conn reads and writes the packets of one connection and keeps their
+// sequence ids: every packet read or written moves the id on, and each
+// command starts it again from zero. Writes are buffered until Flush.
+type Conn struct {
+	r   *bufio.Reader
+	w   *bufio.Writer
+	seq byte
+}
+
+// NewConn reads packets from r and writes them to w. Buffered readers and
+// writers are used as they are.
+func NewConn(r io.Reader, w io.Writer) *Conn {
+	c := &Conn{}
+	c.Switch(r, w)
+	return c
+}
+
+// Switch moves c to a new transport, such as the same connection after a
+// TLS handshake, keeping the sequence id.
+func (c *Conn) Switch(r io.Reader, w io.Writer) {
+	var ok bool
+	if c.r, ok = r.(*bufio.Reader); !ok {
+		c.r = bufio.NewReader(r)
+	}
+	if c.w, ok = w.(*bufio.Writer); !ok {
+		c.w = bufio.NewWriter(w)
+	}
+}
+
+// ResetSeq starts a new command.
+func (c *Conn) ResetSeq() {
+	c.seq = 0
+}
+
+// Buffered returns how many bytes are waiting to be read.
+func (c *Conn) Buffered() int {
+	return c.r.Buffered()
+}
+
+// Reader returns the buffered reader packets are read from, for reading
+// what is not a packet, such as the TLS handshake a client starts right
+// after its SSLRequest.
+func (c *Conn) Reader() io.Reader {
+	return c.r
+}
+
+// ReadPacket reads one payload, joining the packets it was split into.
+func (c *Conn) ReadPacket() ([]byte, error) {
+	var payload []byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return nil, err
+		}
+		size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		c.seq = header[3] + 1
+		start := len(payload)
+		payload = append(payload, make([]byte, size)...)
+		if _, err := io.ReadFull(c.r, payload[start:]); err != nil {
+			return nil, err
+		}
+		if size < maxPayload {
+			return payload, nil
+		}
+	}
+}
+
+// WritePacket queues payload, split into as many packets as it takes.
+func (c *Conn) WritePacket(payload []byte) error {
+	for {
+		size := len(payload)
+		if size > maxPayload {
+			size = maxPayload
+		}
+		header := [4]byte{byte(size), byte(size >> 8), byte(size >> 16), c.seq}
+		c.seq++
+		if _, err := c.w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := c.w.Write(payload[:size]); err != nil {
+			return err
+		}
+		payload = payload[size:]
+		if size < maxPayload {
+			return nil
+		}
+	}
+}
+
+// Flush writes out the queued packets.
+func (c *Conn) Flush() error {
+	return c.w.Flush()
+}
+
+// decoder walks a payload field by field. The first failure sticks in err
+// so callers can read every field and check once at the end.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrMalformed
+	}
+	d.buf = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.buf) < 1 {
+		d.fail()
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if len(d.buf) < 2 {
+		d.fail()
+		return 0
+	}
+	v := binary.LittleEndian.Uint16(d.buf)
+	d.buf = d.buf[2:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	if len(d.buf) < 4 {
+		d.fail()
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return v
+}
+
+// lenenc reads a length-encoded integer.
+func (d *decoder) lenenc() uint64 {
+	b := d.byte()
+	var n int
+	switch b {
+	case 0xfc:
+		n = 2
+	case 0xfd:
+		n = 3
+	case 0xfe:
+		n = 8
+	default:
+		return uint64(b)
+	}
+	if len(d.buf) < n {
+		d.fail()
+		return 0
+	}
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(d.buf[i])
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// string reads a NUL-terminated string. A missing NUL ends the string at
+// the end of the payload, as some clients leave it out of the last field.
+func (d *decoder) string() string {
+	for i, b := range d.buf {
+		if b == 0 {
+			s := string(d.buf[:i])
+			d.buf = d.buf[i+1:]
+			return s
+		}
+	}
+	s := string(d.buf)
+	d.buf = nil
+	return s
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if n < 0 || len(d.buf) < n {
+		d.fail()
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.buf[:n])
+	d.buf = d.buf[n:]
+	return b
+}
+
+// lenencBytes reads a length-encoded string.
+func (d *decoder) lenencBytes() []byte {
+	n := d.lenenc()
+	if n > uint64(len(d.buf)) {
+		d.fail()
+		return nil
+	}
+	return d.bytes(int(n))
+}
+
+// rest returns a copy of whatever is left in the payload.
+func (d *decoder) rest() []byte {
+	return d.bytes(len(d.buf))
+}
+
+func appendUint16(dst []byte, v uint16) []byte {
+	return append(dst, byte(v), byte(v>>8))
+}
+
+func appendUint32(dst []byte, v uint32) []byte {
+	return append(dst, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendLenenc(dst []byte, v uint64) []byte {
+	switch {
+	case v < 0xfb:
+		return append(dst, byte(v))
+	case v < 1<<16:
+		return append(dst, 0xfc, byte(v), byte(v>>8))
+	case v < 1<<24:
+		return append(dst, 0xfd, byte(v), byte(v>>8), byte(v>>16))
+	}
+	dst = append(dst, 0xfe)
+	for i := 0; i < 8; i++ {
+		dst = append(dst, byte(v>>(8*i)))
+	}
+	return dst
+}
+
+func appendLenencBytes(dst, b []byte) []byte {
+	dst = appendLenenc(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = append(dst, s...)
+	return append(dst, 0)
+}
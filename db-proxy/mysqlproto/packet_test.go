@@ -0,0 +1,100 @@
+package mysqlproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketSplit(t *testing.T) {
+	tests := []struct {
+		size  int
+		sizes []int
+	}{
+		{0, []int{0}},
+		{10, []int{10}},
+		{maxPayload - 1, []int{maxPayload - 1}},
+		//a payload of exactly the maximum needs an empty packet after it
+		{maxPayload, []int{maxPayload, 0}},
+		{maxPayload + 5, []int{maxPayload, 5}},
+		{2 * maxPayload, []int{maxPayload, maxPayload, 0}},
+	}
+	for _, tt := range tests {
+		payload := bytes.Repeat([]byte{0xab}, tt.size)
+		var wire bytes.Buffer
+		w := NewConn(&bytes.Buffer{}, &wire)
+		w.seq = 3
+		if err := w.WritePacket(payload); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		//walk the headers
+		raw := wire.Bytes()
+		for i, want := range tt.sizes {
+			if len(raw) < 4 {
+				t.Fatalf("size %d: packet %d missing", tt.size, i)
+			}
+			size := int(raw[0]) | int(raw[1])<<8 | int(raw[2])<<16
+			if size != want || raw[3] != byte(3+i) {
+				t.Errorf("size %d: packet %d has size %d and id %d, want %d and %d", tt.size, i, size, raw[3], want, 3+i)
+			}
+			if size > len(raw)-4 {
+				t.Fatalf("size %d: packet %d cut short", tt.size, i)
+			}
+			raw = raw[4+size:]
+		}
+		if len(raw) != 0 {
+			t.Errorf("size %d: %d bytes after the last packet", tt.size, len(raw))
+		}
+
+		r := NewConn(bytes.NewReader(wire.Bytes()), &bytes.Buffer{})
+		got, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("size %d: %v", tt.size, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("size %d: read %d bytes back", tt.size, len(got))
+		}
+		if r.seq != w.seq {
+			t.Errorf("size %d: reader's next id %d, writer's %d", tt.size, r.seq, w.seq)
+		}
+	}
+}
+
+func TestPacketTruncated(t *testing.T) {
+	for _, wire := range [][]byte{
+		{},
+		{5, 0},
+		{5, 0, 0, 0, 'a', 'b'},
+		//the continuation of a full packet is missing
+		append([]byte{0xff, 0xff, 0xff, 0}, make([]byte, maxPayload)...),
+	} {
+		c := NewConn(bytes.NewReader(wire), &bytes.Buffer{})
+		if _, err := c.ReadPacket(); err == nil {
+			t.Errorf("%d bytes: no error", len(wire))
+		}
+	}
+}
+
+func TestLenenc(t *testing.T) {
+	for _, v := range []uint64{0, 250, 251, 1<<16 - 1, 1 << 16, 1<<24 - 1, 1 << 24, 1<<64 - 1} {
+		buf := appendLenenc(nil, v)
+		d := &decoder{buf: buf}
+		if got := d.lenenc(); got != v || d.err != nil || len(d.buf) != 0 {
+			t.Errorf("lenenc %d: read %d, %v, %d bytes left", v, got, d.err, len(d.buf))
+		}
+		d = &decoder{buf: buf[:len(buf)-1]}
+		if len(buf) > 1 {
+			if d.lenenc(); d.err == nil {
+				t.Errorf("lenenc %d cut short: no error", v)
+			}
+		}
+	}
+
+	d := &decoder{buf: []byte{5, 'a', 'b'}}
+	if d.lenencBytes(); d.err == nil {
+		t.Errorf("lenenc string longer than the payload: no error")
+	}
+}
@@ -0,0 +1,292 @@
+package mysqlproto
+
+import (
+	"fmt"
+)
+
+// Server status flags, sent in OK and EOF packets.
+const (
+	StatusInTrans            = 0x0001
+	StatusAutocommit         = 0x0002
+	StatusMoreResultsExist   = 0x0008
+	StatusCursorExists       = 0x0040
+	StatusSessionStateChange = 0x4000
+)
+
+// Error is an ERR packet.
+type Error struct {
+	Code     uint16
+	SQLState string
+	Message  string
+}
+
+// NewError builds an ERR packet with the given error number and SQLSTATE.
+func NewError(code uint16, sqlState, message string) *Error {
+	return &Error{Code: code, SQLState: sqlState, Message: message}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ERROR %d (%s): %s", e.Code, e.SQLState, e.Message)
+}
+
+// Encode appends the payload of the packet to dst.
+func (e *Error) Encode(dst []byte) []byte {
+	dst = append(dst, 0xff)
+	dst = appendUint16(dst, e.Code)
+	dst = append(dst, '#')
+	dst = append(dst, e.SQLState...)
+	return append(dst, e.Message...)
+}
+
+// ParseError decodes an ERR packet. A malformed one still yields an
+// Error, with what could be read of it.
+func ParseError(payload []byte) *Error {
+	d := &decoder{buf: payload}
+	d.byte()
+	e := &Error{Code: d.uint16(), SQLState: "HY000"}
+	if len(d.buf) > 0 && d.buf[0] == '#' {
+		d.byte()
+		e.SQLState = string(d.bytes(5))
+	}
+	e.Message = string(d.buf)
+	return e
+}
+
+// OK is an OK packet, or the EOF that ends a result set.
+type OK struct {
+	AffectedRows uint64
+	LastInsertID uint64
+	Status       uint16
+	Warnings     uint16
+}
+
+// Encode appends the payload of an OK packet to dst.
+func (m *OK) Encode(dst []byte) []byte {
+	dst = append(dst, 0x00)
+	dst = appendLenenc(dst, m.AffectedRows)
+	dst = appendLenenc(dst, m.LastInsertID)
+	dst = appendUint16(dst, m.Status)
+	return appendUint16(dst, m.Warnings)
+}
+
+// ParseOK decodes an OK packet, or an EOF packet in either its old form
+// or the OK form that replaces it with ClientDeprecateEOF.
+func ParseOK(payload []byte) (*OK, error) {
+	d := &decoder{buf: payload}
+	header := d.byte()
+	m := &OK{}
+	if header == 0xfe && len(payload) < 9 {
+		m.Warnings = d.uint16()
+		m.Status = d.uint16()
+		return m, d.err
+	}
+	m.AffectedRows = d.lenenc()
+	m.LastInsertID = d.lenenc()
+	m.Status = d.uint16()
+	m.Warnings = d.uint16()
+	return m, d.err
+}
+
+// Where a Response is in the answer to a command.
+const (
+	respFirst = iota
+	respInfile
+	respColumns
+	respColumnsEOF
+	respRows
+	respPrepare
+	respDefinitions
+	respFieldList
+	respDone
+)
+
+// Response follows the packets a server sends in answer to one command
+// and tells when the answer is complete, which for a query may take
+// several result sets.
+type Response struct {
+	command      byte
+	deprecateEOF bool
+	state        int
+	// left counts the column definitions still to come
+	left uint64
+
+	// Status is the server status of the last OK or EOF packet
+	Status uint16
+	// Err is set if the answer was an ERR packet
+	Err *Error
+	// StatementID is set by the answer to COM_STMT_PREPARE
+	StatementID uint32
+	// Rows counts the rows of every result set, and Affected the rows
+	// the statements changed
+	Rows     int64
+	Affected int64
+}
+
+// NewResponse starts following the answer to command, on a connection
+// with the given capabilities.
+func NewResponse(command byte, capabilities uint32) *Response {
+	r := &Response{command: command, deprecateEOF: capabilities&ClientDeprecateEOF != 0}
+	switch command {
+	case ComStmtPrepare:
+		r.state = respPrepare
+	case ComFieldList:
+		r.state = respFieldList
+	case ComStmtFetch:
+		r.state = respRows
+	}
+	return r
+}
+
+// Expected reports whether the server answers command at all.
+func Expected(command byte) bool {
+	switch command {
+	case ComQuit, ComStmtSendLong, ComStmtClose:
+		return false
+	}
+	return true
+}
+
+// Next takes the next packet of the answer and reports whether the
+// answer is complete.
+func (r *Response) Next(payload []byte) (bool, error) {
+	if len(payload) == 0 {
+		return false, ErrMalformed
+	}
+	//no definition or row starts with 0xff
+	if payload[0] == 0xff {
+		r.Err = ParseError(payload)
+		r.state = respDone
+		return true, nil
+	}
+	switch r.state {
+	case respFirst, respInfile:
+		switch {
+		case payload[0] == 0x00 || (payload[0] == 0xfe && r.command != ComQuery && r.command != ComStmtExecute):
+			//OK, or the EOF that answers COM_SET_OPTION and COM_DEBUG
+			if err := r.status(payload); err != nil {
+				return false, err
+			}
+			if r.Status&StatusMoreResultsExist == 0 || r.command != ComQuery && r.command != ComStmtExecute {
+				r.state = respDone
+			}
+		case payload[0] == 0xfb && r.command == ComQuery:
+			//LOCAL INFILE: the client sends the file before the final OK
+			r.state = respInfile
+		case r.command == ComQuery || r.command == ComStmtExecute || r.command == ComProcessInfo:
+			d := &decoder{buf: payload}
+			r.left = d.lenenc()
+			if d.err != nil {
+				return false, d.err
+			}
+			r.state = respColumns
+			if r.left == 0 {
+				r.endColumns()
+			}
+		default:
+			//COM_STATISTICS answers with a bare string
+			r.state = respDone
+		}
+
+	case respColumns:
+		r.left--
+		if r.left == 0 {
+			r.endColumns()
+		}
+
+	case respColumnsEOF:
+		if err := r.status(payload); err != nil {
+			return false, err
+		}
+		r.state = respRows
+		if r.Status&StatusCursorExists != 0 {
+			//the rows come with COM_STMT_FETCH
+			r.state = respDone
+		}
+
+	case respRows:
+		if !r.terminator(payload) {
+			r.Rows++
+			break
+		}
+		if err := r.status(payload); err != nil {
+			return false, err
+		}
+		r.state = respDone
+		if r.Status&StatusMoreResultsExist != 0 && r.command != ComStmtFetch {
+			r.state = respFirst
+		}
+
+	case respPrepare:
+		d := &decoder{buf: payload}
+		d.byte()
+		r.StatementID = d.uint32()
+		columns, params := uint64(d.uint16()), uint64(d.uint16())
+		if d.err != nil {
+			return false, d.err
+		}
+		for _, n := range []uint64{columns, params} {
+			if n > 0 {
+				r.left += n
+				if !r.deprecateEOF {
+					r.left++
+				}
+			}
+		}
+		r.state = respDefinitions
+		if r.left == 0 {
+			r.state = respDone
+		}
+
+	case respDefinitions:
+		//parameter and column definitions, each list with its EOF
+		r.left--
+		if r.left == 0 {
+			r.state = respDone
+		}
+
+	case respFieldList:
+		if r.terminator(payload) {
+			if err := r.status(payload); err != nil {
+				return false, err
+			}
+			r.state = respDone
+		}
+	}
+	return r.state == respDone, nil
+}
+
+// WantsData reports whether the server waits for the client to send the
+// contents of a LOCAL INFILE, ended by an empty packet.
+func (r *Response) WantsData() bool {
+	return r.state == respInfile
+}
+
+// endColumns moves on past the column definitions.
+func (r *Response) endColumns() {
+	r.state = respRows
+	if !r.deprecateEOF {
+		r.state = respColumnsEOF
+	}
+}
+
+// terminator reports whether payload ends the rows of a result set. Rows
+// never start with 0xfe unless they are at least 16MB long.
+func (r *Response) terminator(payload []byte) bool {
+	if payload[0] != 0xfe {
+		return false
+	}
+	if r.deprecateEOF {
+		return len(payload) < maxPayload
+	}
+	return len(payload) < 9
+}
+
+func (r *Response) status(payload []byte) error {
+	ok, err := ParseOK(payload)
+	if err != nil {
+		return err
+	}
+	r.Status = ok.Status
+	r.Affected += int64(ok.AffectedRows)
+	return nil
+}
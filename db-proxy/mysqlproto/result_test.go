@@ -0,0 +1,147 @@
+package mysqlproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Packets of server answers.
+var (
+	okPacket   = (&OK{Status: StatusAutocommit}).Encode(nil)
+	morePacket = (&OK{Status: StatusAutocommit | StatusMoreResultsExist}).Encode(nil)
+	errPacket  = NewError(1146, "42S02", "Table 'shop.t' doesn't exist").Encode(nil)
+	eofPacket  = []byte{0xfe, 0, 0, byte(StatusAutocommit), 0}
+	eofMore    = []byte{0xfe, 0, 0, byte(StatusAutocommit | StatusMoreResultsExist), 0}
+	//with ClientDeprecateEOF an OK with the EOF header ends the rows
+	okEOFPacket = append([]byte{0xfe}, (&OK{Status: StatusAutocommit}).Encode(nil)[1:]...)
+	column      = append([]byte{3}, "def"...)
+	row         = []byte{1, '1'}
+	infile      = append([]byte{0xfb}, "/tmp/data.csv"...)
+)
+
+func packets(ps ...[]byte) [][]byte { return ps }
+
+func TestResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		command      byte
+		capabilities uint32
+		packets      [][]byte
+		rows         int64
+		failed       bool
+	}{
+		{"ok", ComQuery, 0, packets(okPacket), 0, false},
+		{"error", ComQuery, 0, packets(errPacket), 0, true},
+		{"result set", ComQuery, 0, packets([]byte{2}, column, column, eofPacket, row, row, row, eofPacket), 3, false},
+		{"empty result set", ComQuery, 0, packets([]byte{1}, column, eofPacket, eofPacket), 0, false},
+		{"result set without EOF", ComQuery, ClientDeprecateEOF, packets([]byte{2}, column, column, row, okEOFPacket), 1, false},
+		{"error in the rows", ComQuery, 0, packets([]byte{1}, column, eofPacket, row, errPacket), 1, true},
+		{"several results", ComQuery, 0, packets(morePacket, []byte{1}, column, eofPacket, row, eofMore, okPacket), 1, false},
+		{"error after a result", ComQuery, 0, packets(morePacket, errPacket), 0, true},
+		{"LOCAL INFILE", ComQuery, 0, packets(infile, okPacket), 0, false},
+		{"LOCAL INFILE refused", ComQuery, 0, packets(infile, errPacket), 0, true},
+		{"execute", ComStmtExecute, 0, packets([]byte{1}, column, eofPacket, row, row, eofPacket), 2, false},
+		{"ping", ComPing, 0, packets(okPacket), 0, false},
+		{"set option", ComSetOption, 0, packets(eofPacket), 0, false},
+		{"statistics", ComStatistics, 0, packets([]byte("Uptime: 5")), 0, false},
+		{"field list", ComFieldList, 0, packets(column, column, eofPacket), 0, false},
+		{"prepare", ComStmtPrepare, 0, packets([]byte{0, 7, 0, 0, 0, 1, 0, 2, 0, 0, 0, 0}, column, column, eofPacket, column, eofPacket), 0, false},
+		{"prepare without EOF", ComStmtPrepare, ClientDeprecateEOF, packets([]byte{0, 7, 0, 0, 0, 1, 0, 2, 0, 0, 0, 0}, column, column, column), 0, false},
+		{"prepare without columns", ComStmtPrepare, 0, packets([]byte{0, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}), 0, false},
+		{"fetch", ComStmtFetch, 0, packets(row, row, eofPacket), 2, false},
+	}
+	for _, tt := range tests {
+		r := NewResponse(tt.command, tt.capabilities)
+		for i, p := range tt.packets {
+			done, err := r.Next(p)
+			if err != nil {
+				t.Errorf("%s: packet %d: %v", tt.name, i, err)
+				break
+			}
+			if last := i == len(tt.packets)-1; done != last {
+				t.Errorf("%s: packet %d of %d: done %v", tt.name, i+1, len(tt.packets), done)
+				break
+			}
+		}
+		if r.Rows != tt.rows || (r.Err != nil) != tt.failed {
+			t.Errorf("%s: %d rows, error %v; want %d rows, failed %v", tt.name, r.Rows, r.Err, tt.rows, tt.failed)
+		}
+	}
+}
+
+func TestResponseInfile(t *testing.T) {
+	r := NewResponse(ComQuery, 0)
+	if done, _ := r.Next(infile); done || !r.WantsData() {
+		t.Fatalf("LOCAL INFILE request: done %v, wants data %v", done, r.WantsData())
+	}
+	if done, _ := r.Next(okPacket); !done || r.WantsData() {
+		t.Errorf("OK after the file: done %v, wants data %v", done, r.WantsData())
+	}
+}
+
+func TestResponseDetails(t *testing.T) {
+	r := NewResponse(ComStmtPrepare, 0)
+	r.Next([]byte{0, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	if r.StatementID != 7 {
+		t.Errorf("statement id %d, want 7", r.StatementID)
+	}
+
+	r = NewResponse(ComQuery, 0)
+	r.Next(errPacket)
+	if r.Err == nil || r.Err.Code != 1146 || r.Err.SQLState != "42S02" || r.Err.Message != "Table 'shop.t' doesn't exist" {
+		t.Errorf("error %#v", r.Err)
+	}
+
+	//a cursor leaves the rows for COM_STMT_FETCH
+	r = NewResponse(ComStmtExecute, 0)
+	cursor := []byte{0xfe, 0, 0, byte(StatusAutocommit | StatusCursorExists), 0}
+	for _, p := range packets([]byte{1}, column) {
+		r.Next(p)
+	}
+	if done, _ := r.Next(cursor); !done {
+		t.Errorf("answer with a cursor not done after the columns")
+	}
+
+	//a row of 16MB may start with 0xfe
+	r = NewResponse(ComQuery, ClientDeprecateEOF)
+	big := append([]byte{0xfe}, bytes.Repeat([]byte{'x'}, maxPayload)...)
+	for _, p := range packets([]byte{1}, column, big) {
+		if done, _ := r.Next(p); done {
+			t.Fatal("long row taken for the end of the rows")
+		}
+	}
+
+	//statements that change rows say how many in their OK
+	r = NewResponse(ComQuery, 0)
+	for _, p := range packets((&OK{AffectedRows: 3, Status: StatusMoreResultsExist}).Encode(nil), (&OK{AffectedRows: 2}).Encode(nil)) {
+		r.Next(p)
+	}
+	if r.Affected != 5 || r.Rows != 0 {
+		t.Errorf("two updates: %d rows affected, %d returned; want 5 and 0", r.Affected, r.Rows)
+	}
+
+	if _, err := NewResponse(ComQuery, 0).Next(nil); err == nil {
+		t.Errorf("empty packet: no error")
+	}
+	if Expected(ComQuit) || Expected(ComStmtClose) || !Expected(ComQuery) {
+		t.Errorf("Expected is wrong about which commands get an answer")
+	}
+}
+
+func TestParseOK(t *testing.T) {
+	want := OK{AffectedRows: 300, LastInsertID: 1 << 20, Status: StatusInTrans, Warnings: 2}
+	got, err := ParseOK(want.Encode(nil))
+	if err != nil || *got != want {
+		t.Errorf("OK decoded %#v, %v", got, err)
+	}
+	got, err = ParseOK([]byte{0xfe, 3, 0, byte(StatusInTrans), 0})
+	if err != nil || got.Warnings != 3 || got.Status != StatusInTrans {
+		t.Errorf("EOF decoded %#v, %v", got, err)
+	}
+	if _, err := ParseOK([]byte{0x00, 0xfc}); err == nil {
+		t.Errorf("short OK: no error")
+	}
+	if e := ParseError([]byte{0xff, 0x10}); e.SQLState != "HY000" {
+		t.Errorf("short ERR decoded %#v", e)
+	}
+}
@@ -0,0 +1,188 @@
+package pgproto
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SCRAMSHA256 is the only SASL mechanism PostgreSQL offers for passwords.
+const SCRAMSHA256 = "SCRAM-SHA-256"
+
+// MD5Secret returns the value pg_authid stores for an MD5 password:
+// "md5" followed by hex(md5(password + user)).
+func MD5Secret(user, password string) string {
+	sum := md5.Sum([]byte(password + user))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+// MD5Response answers an AuthenticationMD5Password challenge. secret is
+// either the plain password or an MD5Secret for user.
+func MD5Response(user, secret string, salt []byte) string {
+	if !IsMD5Secret(secret) {
+		secret = MD5Secret(user, secret)
+	}
+	sum := md5.Sum(append([]byte(secret[3:]), salt...))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+// IsMD5Secret reports whether s looks like a stored MD5 password hash
+// rather than a plain password.
+func IsMD5Secret(s string) bool {
+	if len(s) != 35 || !strings.HasPrefix(s, "md5") {
+		return false
+	}
+	_, err := hex.DecodeString(s[3:])
+	return err == nil
+}
+
+// PasswordData encodes a cleartext or MD5 password for a PasswordMessage.
+func PasswordData(password string) []byte {
+	return append([]byte(password), 0)
+}
+
+// ParsePasswordData is the inverse of PasswordData.
+func ParsePasswordData(data []byte) (string, error) {
+	d := &decoder{buf: data}
+	s := d.string()
+	return s, d.err
+}
+
+// SASLMechanisms lists the mechanisms offered in an AuthenticationSASL body.
+func SASLMechanisms(data []byte) []string {
+	var mechs []string
+	d := &decoder{buf: data}
+	for {
+		m := d.string()
+		if d.err != nil || m == "" {
+			return mechs
+		}
+		mechs = append(mechs, m)
+	}
+}
+
+// SASLInitialResponse encodes the first client message of a SASL exchange.
+func SASLInitialResponse(mechanism string, data []byte) *PasswordMessage {
+	buf := appendString(nil, mechanism)
+	buf = appendInt32(buf, int32(len(data)))
+	buf = append(buf, data...)
+	return &PasswordMessage{Data: buf}
+}
+
+// SCRAMClient runs the client side of SCRAM-SHA-256 (RFC 5802, RFC 7677).
+// Channel binding is not used.
+type SCRAMClient struct {
+	password        string
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// NewSCRAMClient starts an exchange for password. PostgreSQL ignores the
+// SCRAM user name in favour of the one in the startup message, so none is sent.
+func NewSCRAMClient(password string) (*SCRAMClient, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	c := &SCRAMClient{password: password, clientNonce: base64.StdEncoding.EncodeToString(nonce)}
+	c.clientFirstBare = "n=,r=" + c.clientNonce
+	return c, nil
+}
+
+// ClientFirst returns the client-first-message.
+func (c *SCRAMClient) ClientFirst() []byte {
+	return []byte("n,," + c.clientFirstBare)
+}
+
+// ClientFinal takes the server-first-message and returns the
+// client-final-message with the proof.
+func (c *SCRAMClient) ClientFinal(serverFirst []byte) ([]byte, error) {
+	attrs := scramAttributes(string(serverFirst))
+	nonce, salt64, iter := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return nil, errors.New("scram: invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return nil, fmt.Errorf("scram: invalid salt: %w", err)
+	}
+	iterations, err := strconv.Atoi(iter)
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("scram: invalid iteration count %q", iter)
+	}
+
+	saltedPassword := scramHi([]byte(c.password), salt, iterations)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := scramHMAC(saltedPassword, "Server Key")
+
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	c.serverSignature = scramHMAC(serverKey, authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Verify checks the server-final-message so a server that does not know
+// the password cannot pretend to have accepted it.
+func (c *SCRAMClient) Verify(serverFinal []byte) error {
+	attrs := scramAttributes(string(serverFinal))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("scram: server error %q", e)
+	}
+	sig, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(sig, c.serverSignature) {
+		return errors.New("scram: invalid server signature")
+	}
+	return nil
+}
+
+func scramAttributes(msg string) map[string]string {
+	attrs := map[string]string{}
+	for _, part := range strings.Split(msg, ",") {
+		if len(part) >= 2 && part[1] == '=' {
+			attrs[part[:1]] = part[2:]
+		}
+	}
+	return attrs
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// scramHi is PBKDF2-HMAC-SHA-256 with a single output block.
+func scramHi(password, salt []byte, iterations int) []byte {
+	h := hmac.New(sha256.New, password)
+	h.Write(salt)
+	var one [4]byte
+	binary.BigEndian.PutUint32(one[:], 1)
+	h.Write(one[:])
+	u := h.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		h.Reset()
+		h.Write(u)
+		u = h.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
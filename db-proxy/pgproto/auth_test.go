@@ -0,0 +1,119 @@
+package pgproto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMD5Response(t *testing.T) {
+	salt := []byte{1, 2, 3, 4}
+	const secret = "md58213e4d0d5792b064442db7988e9f4c4"
+	const want = "md5b79948bbeb35dee03ab8fe15a839030b"
+	if got := MD5Secret("alice", "s3cret"); got != secret {
+		t.Errorf("MD5Secret = %q, want %q", got, secret)
+	}
+	if got := MD5Response("alice", "s3cret", salt); got != want {
+		t.Errorf("MD5Response(password) = %q, want %q", got, want)
+	}
+	if got := MD5Response("alice", secret, salt); got != want {
+		t.Errorf("MD5Response(secret) = %q, want %q", got, want)
+	}
+	if got := MD5Response("alice", "s3cret", []byte{4, 3, 2, 1}); got == want {
+		t.Errorf("MD5Response ignores the salt")
+	}
+}
+
+func TestIsMD5Secret(t *testing.T) {
+	tests := map[string]bool{
+		"md58213e4d0d5792b064442db7988e9f4c4":  true,
+		"md58213e4d0d5792b064442db7988e9f4c":   false,
+		"md58213e4d0d5792b064442db7988e9f4zz":  false,
+		"MD58213e4d0d5792b064442db7988e9f4c4":  false,
+		"s3cret":                               false,
+		"md58213e4d0d5792b064442db7988e9f4c4x": false,
+	}
+	for s, want := range tests {
+		if got := IsMD5Secret(s); got != want {
+			t.Errorf("IsMD5Secret(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+// rfc7677Client is the client of the example exchange in RFC 7677,
+// section 3, whose nonce is fixed and which names its user.
+func rfc7677Client() *SCRAMClient {
+	return &SCRAMClient{
+		password:        "pencil",
+		clientNonce:     "rOprNGfwEbeRWgbNEkqO",
+		clientFirstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO",
+	}
+}
+
+const (
+	rfc7677ServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfc7677ClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677ServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func TestSCRAMClient(t *testing.T) {
+	c := rfc7677Client()
+	if got := string(c.ClientFirst()); got != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("ClientFirst = %q", got)
+	}
+	final, err := c.ClientFinal([]byte(rfc7677ServerFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(final) != rfc7677ClientFinal {
+		t.Errorf("ClientFinal = %q, want %q", final, rfc7677ClientFinal)
+	}
+	if err := c.Verify([]byte(rfc7677ServerFinal)); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
+
+func TestSCRAMClientRejects(t *testing.T) {
+	c := rfc7677Client()
+	if _, err := c.ClientFinal([]byte(rfc7677ServerFirst)); err != nil {
+		t.Fatal(err)
+	}
+	for _, serverFinal := range []string{
+		"v=7rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4",
+		"v=",
+		"",
+		"e=invalid-proof",
+	} {
+		if err := c.Verify([]byte(serverFinal)); err == nil {
+			t.Errorf("Verify(%q) accepted", serverFinal)
+		}
+	}
+
+	for _, serverFirst := range []string{
+		//the server must extend the client's nonce
+		"r=rOprNGfwEbeRWgbNEkqO,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"r=someoneElsesNonce,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"r=rOprNGfwEbeRWgbNEkqOxyz,s=not base64,i=4096",
+		"r=rOprNGfwEbeRWgbNEkqOxyz,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+		"r=rOprNGfwEbeRWgbNEkqOxyz,s=W22ZaJ0SNY7soEsUEjb6gQ==",
+	} {
+		if _, err := rfc7677Client().ClientFinal([]byte(serverFirst)); err == nil {
+			t.Errorf("ClientFinal(%q) accepted", serverFirst)
+		}
+	}
+}
+
+func TestNewSCRAMClient(t *testing.T) {
+	a, err := NewSCRAMClient("pencil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewSCRAMClient("pencil")
+	if a.clientNonce == b.clientNonce {
+		t.Errorf("two clients share the nonce %q", a.clientNonce)
+	}
+	//PostgreSQL takes the user from the startup message
+	if first := string(a.ClientFirst()); !strings.HasPrefix(first, "n,,n=,r=") {
+		t.Errorf("ClientFirst = %q", first)
+	}
+}
@@ -0,0 +1,398 @@
+package pgproto
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Authentication request codes carried in an 'R' message.
+const (
+	AuthOK                = 0
+	AuthCleartextPassword = 3
+	AuthMD5Password       = 5
+	AuthSASL              = 10
+	AuthSASLContinue      = 11
+	AuthSASLFinal         = 12
+)
+
+// Transaction status reported by ReadyForQuery.
+const (
+	TxIdle   = 'I'
+	TxActive = 'T'
+	TxFailed = 'E'
+)
+
+// Authentication is any 'R' message. Data holds whatever follows the code:
+// the salt for MD5, mechanism names for SASL, or SASL server data.
+type Authentication struct {
+	Type uint32
+	Data []byte
+}
+
+func (m *Authentication) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'R')
+	dst = appendInt32(dst, int32(m.Type))
+	dst = append(dst, m.Data...)
+	return finishMessage(dst, start)
+}
+
+// ParameterStatus reports a run-time parameter such as server_version.
+type ParameterStatus struct {
+	Name  string
+	Value string
+}
+
+func (m *ParameterStatus) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'S')
+	dst = appendString(dst, m.Name)
+	dst = appendString(dst, m.Value)
+	return finishMessage(dst, start)
+}
+
+// BackendKeyData is the key a client needs to send a CancelRequest.
+type BackendKeyData struct {
+	ProcessID uint32
+	SecretKey uint32
+}
+
+func (m *BackendKeyData) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'K')
+	dst = appendInt32(dst, int32(m.ProcessID))
+	dst = appendInt32(dst, int32(m.SecretKey))
+	return finishMessage(dst, start)
+}
+
+// ReadyForQuery marks the end of a query cycle. TxStatus is TxIdle,
+// TxActive or TxFailed.
+type ReadyForQuery struct {
+	TxStatus byte
+}
+
+func (m *ReadyForQuery) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'Z')
+	dst = append(dst, m.TxStatus)
+	return finishMessage(dst, start)
+}
+
+// FieldDescription is one column of a RowDescription.
+type FieldDescription struct {
+	Name         string
+	TableOID     uint32
+	ColumnAttr   int16
+	DataTypeOID  uint32
+	DataTypeSize int16
+	TypeModifier int32
+	Format       int16
+}
+
+// RowDescription describes the columns of the rows that follow.
+type RowDescription struct {
+	Fields []FieldDescription
+}
+
+func (m *RowDescription) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'T')
+	dst = appendInt16(dst, int16(len(m.Fields)))
+	for _, f := range m.Fields {
+		dst = appendString(dst, f.Name)
+		dst = appendInt32(dst, int32(f.TableOID))
+		dst = appendInt16(dst, f.ColumnAttr)
+		dst = appendInt32(dst, int32(f.DataTypeOID))
+		dst = appendInt16(dst, f.DataTypeSize)
+		dst = appendInt32(dst, f.TypeModifier)
+		dst = appendInt16(dst, f.Format)
+	}
+	return finishMessage(dst, start)
+}
+
+// DataRow is one result row. A nil value is SQL NULL.
+type DataRow struct {
+	Values [][]byte
+}
+
+func (m *DataRow) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'D')
+	dst = appendInt16(dst, int16(len(m.Values)))
+	for _, v := range m.Values {
+		if v == nil {
+			dst = appendInt32(dst, -1)
+			continue
+		}
+		dst = appendInt32(dst, int32(len(v)))
+		dst = append(dst, v...)
+	}
+	return finishMessage(dst, start)
+}
+
+// CommandComplete ends one statement, e.g. "SELECT 3" or "INSERT 0 1".
+type CommandComplete struct {
+	Tag string
+}
+
+func (m *CommandComplete) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'C')
+	dst = appendString(dst, m.Tag)
+	return finishMessage(dst, start)
+}
+
+// Rows returns the row count at the end of the tag, or 0 if there is none.
+func (m *CommandComplete) Rows() int64 {
+	i := strings.LastIndexByte(m.Tag, ' ')
+	if i < 0 {
+		return 0
+	}
+	n, err := strconv.ParseInt(m.Tag[i+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// EmptyQueryResponse replaces CommandComplete for an empty query string.
+type EmptyQueryResponse struct{}
+
+func (m *EmptyQueryResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'I')
+	return finishMessage(dst, start)
+}
+
+// ErrorResponse reports an error. The common fields are broken out; anything
+// else the server sent is kept in Fields keyed by its field code.
+type ErrorResponse struct {
+	Severity string
+	Code     string
+	Message  string
+	Detail   string
+	Hint     string
+	Fields   map[byte]string
+}
+
+// NewErrorResponse builds an ERROR with the given SQLSTATE code.
+func NewErrorResponse(code, message string) *ErrorResponse {
+	return &ErrorResponse{Severity: "ERROR", Code: code, Message: message}
+}
+
+func (m *ErrorResponse) Error() string {
+	return m.Severity + ": " + m.Message + " (SQLSTATE " + m.Code + ")"
+}
+
+func (m *ErrorResponse) Encode(dst []byte) []byte {
+	return encodeNotice(dst, 'E', m)
+}
+
+// NoticeResponse carries a warning or informational notice. It has the same
+// layout as ErrorResponse.
+type NoticeResponse ErrorResponse
+
+func (m *NoticeResponse) Encode(dst []byte) []byte {
+	return encodeNotice(dst, 'N', (*ErrorResponse)(m))
+}
+
+func encodeNotice(dst []byte, t byte, m *ErrorResponse) []byte {
+	dst, start := beginMessage(dst, t)
+	appendField := func(code byte, value string) {
+		if value != "" {
+			dst = append(dst, code)
+			dst = appendString(dst, value)
+		}
+	}
+	appendField('S', m.Severity)
+	// newer clients expect the non-localized severity as well
+	if _, ok := m.Fields['V']; !ok {
+		appendField('V', m.Severity)
+	}
+	appendField('C', m.Code)
+	appendField('M', m.Message)
+	appendField('D', m.Detail)
+	appendField('H', m.Hint)
+	codes := make([]int, 0, len(m.Fields))
+	for c := range m.Fields {
+		codes = append(codes, int(c))
+	}
+	sort.Ints(codes)
+	for _, c := range codes {
+		appendField(byte(c), m.Fields[byte(c)])
+	}
+	dst = append(dst, 0)
+	return finishMessage(dst, start)
+}
+
+func decodeNotice(d *decoder) *ErrorResponse {
+	m := &ErrorResponse{}
+	for d.err == nil {
+		code := d.byte()
+		if code == 0 {
+			break
+		}
+		value := d.string()
+		switch code {
+		case 'S':
+			m.Severity = value
+		case 'C':
+			m.Code = value
+		case 'M':
+			m.Message = value
+		case 'D':
+			m.Detail = value
+		case 'H':
+			m.Hint = value
+		default:
+			if m.Fields == nil {
+				m.Fields = map[byte]string{}
+			}
+			m.Fields[code] = value
+		}
+	}
+	return m
+}
+
+// ParseComplete, BindComplete, CloseComplete, NoData and PortalSuspended are
+// bodiless acknowledgements in the extended protocol.
+type ParseComplete struct{}
+
+func (m *ParseComplete) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, '1')
+	return finishMessage(dst, start)
+}
+
+type BindComplete struct{}
+
+func (m *BindComplete) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, '2')
+	return finishMessage(dst, start)
+}
+
+type CloseComplete struct{}
+
+func (m *CloseComplete) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, '3')
+	return finishMessage(dst, start)
+}
+
+type NoData struct{}
+
+func (m *NoData) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'n')
+	return finishMessage(dst, start)
+}
+
+type PortalSuspended struct{}
+
+func (m *PortalSuspended) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 's')
+	return finishMessage(dst, start)
+}
+
+// ParameterDescription lists the parameter types of a described statement.
+type ParameterDescription struct {
+	ParameterOIDs []uint32
+}
+
+func (m *ParameterDescription) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 't')
+	dst = appendInt16(dst, int16(len(m.ParameterOIDs)))
+	for _, oid := range m.ParameterOIDs {
+		dst = appendInt32(dst, int32(oid))
+	}
+	return finishMessage(dst, start)
+}
+
+// NotificationResponse delivers a NOTIFY payload to a listening session.
+type NotificationResponse struct {
+	ProcessID uint32
+	Channel   string
+	Payload   string
+}
+
+func (m *NotificationResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'A')
+	dst = appendInt32(dst, int32(m.ProcessID))
+	dst = appendString(dst, m.Channel)
+	dst = appendString(dst, m.Payload)
+	return finishMessage(dst, start)
+}
+
+func decodeBackend(t byte, body []byte) (Message, error) {
+	d := &decoder{buf: body}
+	var msg Message
+	switch t {
+	case 'R':
+		msg = &Authentication{Type: d.uint32(), Data: d.rest()}
+	case 'S':
+		msg = &ParameterStatus{Name: d.string(), Value: d.string()}
+	case 'K':
+		msg = &BackendKeyData{ProcessID: d.uint32(), SecretKey: d.uint32()}
+	case 'Z':
+		msg = &ReadyForQuery{TxStatus: d.byte()}
+	case 'T':
+		m := &RowDescription{}
+		n := int(d.int16())
+		for i := 0; i < n && d.err == nil; i++ {
+			m.Fields = append(m.Fields, FieldDescription{
+				Name:         d.string(),
+				TableOID:     d.uint32(),
+				ColumnAttr:   d.int16(),
+				DataTypeOID:  d.uint32(),
+				DataTypeSize: d.int16(),
+				TypeModifier: d.int32(),
+				Format:       d.int16(),
+			})
+		}
+		msg = m
+	case 'D':
+		m := &DataRow{}
+		n := int(d.int16())
+		if n > 0 {
+			m.Values = make([][]byte, 0, n)
+		}
+		for i := 0; i < n && d.err == nil; i++ {
+			size := d.int32()
+			if size < 0 {
+				m.Values = append(m.Values, nil)
+				continue
+			}
+			m.Values = append(m.Values, d.bytes(int(size)))
+		}
+		msg = m
+	case 'C':
+		msg = &CommandComplete{Tag: d.string()}
+	case 'I':
+		msg = &EmptyQueryResponse{}
+	case 'E':
+		msg = decodeNotice(d)
+	case 'N':
+		msg = (*NoticeResponse)(decodeNotice(d))
+	case '1':
+		msg = &ParseComplete{}
+	case '2':
+		msg = &BindComplete{}
+	case '3':
+		msg = &CloseComplete{}
+	case 'n':
+		msg = &NoData{}
+	case 's':
+		msg = &PortalSuspended{}
+	case 't':
+		m := &ParameterDescription{}
+		n := int(d.int16())
+		for i := 0; i < n && d.err == nil; i++ {
+			m.ParameterOIDs = append(m.ParameterOIDs, d.uint32())
+		}
+		msg = m
+	case 'A':
+		msg = &NotificationResponse{ProcessID: d.uint32(), Channel: d.string(), Payload: d.string()}
+	case 'd':
+		msg = &CopyData{Data: d.rest()}
+	case 'c':
+		msg = &CopyDone{}
+	default:
+		// CopyInResponse, CopyOutResponse, NegotiateProtocolVersion and
+		// friends pass through untouched
+		msg = &Unknown{Type: t, Data: d.rest()}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
@@ -0,0 +1,77 @@
+package pgproto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestBackendRoundTrip(t *testing.T) {
+	msgs := []Message{
+		&Authentication{Type: AuthMD5Password, Data: []byte{1, 2, 3, 4}},
+		&Authentication{Type: AuthOK, Data: []byte{}},
+		&ParameterStatus{Name: "server_version", Value: "16.0"},
+		&BackendKeyData{ProcessID: 42, SecretKey: 0xfeedface},
+		&ReadyForQuery{TxStatus: TxActive},
+		&RowDescription{Fields: []FieldDescription{
+			{Name: "id", TableOID: 16384, ColumnAttr: 1, DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1},
+			{Name: "name", DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1, Format: 1},
+		}},
+		&DataRow{Values: [][]byte{[]byte("1"), nil, {}}},
+		&CommandComplete{Tag: "INSERT 0 3"},
+		&EmptyQueryResponse{},
+		&ErrorResponse{Severity: "ERROR", Code: "42P01", Message: "relation \"t\" does not exist", Hint: "create it", Fields: map[byte]string{'V': "ERROR", 'P': "15"}},
+		&NoticeResponse{Severity: "NOTICE", Code: "00000", Message: "hello", Detail: "more", Fields: map[byte]string{'V': "NOTICE"}},
+		&ParseComplete{},
+		&BindComplete{},
+		&CloseComplete{},
+		&NoData{},
+		&PortalSuspended{},
+		&ParameterDescription{ParameterOIDs: []uint32{23, 25}},
+		&NotificationResponse{ProcessID: 7, Channel: "jobs", Payload: "{}"},
+		&CopyData{Data: []byte("row\n")},
+		&CopyDone{},
+		&Unknown{Type: 'G', Data: []byte{0, 0, 1, 0, 0}},
+	}
+	for _, want := range msgs {
+		wire := want.Encode(nil)
+		got, err := ReadBackendMessage(bytes.NewReader(wire))
+		if err != nil {
+			t.Errorf("%T: %v", want, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: decoded %#v, want %#v", want, got, want)
+		}
+		if again := got.Encode(nil); !bytes.Equal(again, wire) {
+			t.Errorf("%T: re-encoded %q, want %q", want, again, wire)
+		}
+	}
+}
+
+func TestBackendMalformed(t *testing.T) {
+	bodies := []struct {
+		name string
+		t    byte
+		body []byte
+	}{
+		{"empty authentication", 'R', []byte{0, 0}},
+		{"parameter status without value", 'S', []byte("server_version\x00")},
+		{"short key data", 'K', []byte{0, 0, 0, 1, 0, 0}},
+		{"empty ready for query", 'Z', nil},
+		{"row description missing a field", 'T', []byte("\x00\x02id\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x17\x00\x04\xff\xff\xff\xff\x00\x00")},
+		{"data row with long value", 'D', []byte("\x00\x01\x00\x00\x01\x00abc")},
+		{"data row without values", 'D', []byte("\x00\x02")},
+		{"unterminated command tag", 'C', []byte("SELECT 1")},
+		{"unterminated error field", 'E', []byte("SERROR")},
+		{"short parameter description", 't', []byte("\x00\x01\x00\x00")},
+		{"notification without payload", 'A', []byte("\x00\x00\x00\x07jobs\x00")},
+	}
+	for _, b := range bodies {
+		wire := append([]byte{b.t}, appendInt32(nil, int32(len(b.body)+4))...)
+		wire = append(wire, b.body...)
+		if _, err := ReadBackendMessage(bytes.NewReader(wire)); err == nil {
+			t.Errorf("%s: no error", b.name)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package pgproto
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrMalformed is returned when a message body is shorter than its fields claim.
+var ErrMalformed = errors.New("pgproto: malformed message")
+
+// decoder walks a message body field by field. The first failure sticks in err
+// so callers can read every field and check once at the end.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrMalformed
+	}
+	d.buf = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.buf) < 1 {
+		d.fail()
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) int16() int16 {
+	if len(d.buf) < 2 {
+		d.fail()
+		return 0
+	}
+	v := int16(binary.BigEndian.Uint16(d.buf))
+	d.buf = d.buf[2:]
+	return v
+}
+
+func (d *decoder) int32() int32 {
+	if len(d.buf) < 4 {
+		d.fail()
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(d.buf))
+	d.buf = d.buf[4:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	return uint32(d.int32())
+}
+
+// string reads a NUL-terminated string.
+func (d *decoder) string() string {
+	for i, b := range d.buf {
+		if b == 0 {
+			s := string(d.buf[:i])
+			d.buf = d.buf[i+1:]
+			return s
+		}
+	}
+	d.fail()
+	return ""
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if n < 0 || len(d.buf) < n {
+		d.fail()
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.buf[:n])
+	d.buf = d.buf[n:]
+	return b
+}
+
+// rest returns a copy of whatever is left in the body.
+func (d *decoder) rest() []byte {
+	return d.bytes(len(d.buf))
+}
+
+// beginMessage appends a type byte and a length placeholder, returning the
+// offset of the length so finishMessage can patch it.
+func beginMessage(dst []byte, t byte) ([]byte, int) {
+	dst = append(dst, t)
+	start := len(dst)
+	return append(dst, 0, 0, 0, 0), start
+}
+
+// beginUntyped starts a startup-phase message, which has no type byte.
+func beginUntyped(dst []byte) ([]byte, int) {
+	start := len(dst)
+	return append(dst, 0, 0, 0, 0), start
+}
+
+func finishMessage(dst []byte, start int) []byte {
+	binary.BigEndian.PutUint32(dst[start:], uint32(len(dst)-start))
+	return dst
+}
+
+func appendInt16(dst []byte, v int16) []byte {
+	return append(dst, byte(v>>8), byte(v))
+}
+
+func appendInt32(dst []byte, v int32) []byte {
+	return append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = append(dst, s...)
+	return append(dst, 0)
+}
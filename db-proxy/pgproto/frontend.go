@@ -0,0 +1,323 @@
+package pgproto
+
+import (
+	"sort"
+)
+
+// Protocol version and special request codes sent in place of a version
+// in the first message of a connection.
+const (
+	ProtocolVersion3   = 196608 // 3.0
+	sslRequestCode     = 80877103
+	gssEncRequestCode  = 80877104
+	cancelRequestCode  = 80877102
+	maxStartupLength   = 10000
+	maxMessageLength   = 1 << 30
+	startupHeaderBytes = 8
+)
+
+// StartupMessage opens a session. Parameters carry user, database and any
+// run-time settings the client wants applied.
+type StartupMessage struct {
+	ProtocolVersion uint32
+	Parameters      map[string]string
+}
+
+func (m *StartupMessage) Encode(dst []byte) []byte {
+	dst, start := beginUntyped(dst)
+	dst = appendInt32(dst, int32(m.ProtocolVersion))
+	// sorted so the same startup always encodes to the same bytes
+	keys := make([]string, 0, len(m.Parameters))
+	for k := range m.Parameters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		dst = appendString(dst, k)
+		dst = appendString(dst, m.Parameters[k])
+	}
+	dst = append(dst, 0)
+	return finishMessage(dst, start)
+}
+
+// SSLRequest asks the server to switch to TLS. The answer is a single byte,
+// 'S' or 'N', not a regular message.
+type SSLRequest struct{}
+
+func (m *SSLRequest) Encode(dst []byte) []byte {
+	dst, start := beginUntyped(dst)
+	dst = appendInt32(dst, sslRequestCode)
+	return finishMessage(dst, start)
+}
+
+// GSSEncRequest asks the server to switch to GSSAPI encryption.
+type GSSEncRequest struct{}
+
+func (m *GSSEncRequest) Encode(dst []byte) []byte {
+	dst, start := beginUntyped(dst)
+	dst = appendInt32(dst, gssEncRequestCode)
+	return finishMessage(dst, start)
+}
+
+// CancelRequest is sent on a fresh connection to cancel a running query
+// identified by the key the server handed out in BackendKeyData.
+type CancelRequest struct {
+	ProcessID uint32
+	SecretKey uint32
+}
+
+func (m *CancelRequest) Encode(dst []byte) []byte {
+	dst, start := beginUntyped(dst)
+	dst = appendInt32(dst, cancelRequestCode)
+	dst = appendInt32(dst, int32(m.ProcessID))
+	dst = appendInt32(dst, int32(m.SecretKey))
+	return finishMessage(dst, start)
+}
+
+// Query is a simple-protocol query; String may hold several statements.
+type Query struct {
+	String string
+}
+
+func (m *Query) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'Q')
+	dst = appendString(dst, m.String)
+	return finishMessage(dst, start)
+}
+
+// Parse creates a prepared statement. An empty Name is the unnamed statement.
+type Parse struct {
+	Name          string
+	Query         string
+	ParameterOIDs []uint32
+}
+
+func (m *Parse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'P')
+	dst = appendString(dst, m.Name)
+	dst = appendString(dst, m.Query)
+	dst = appendInt16(dst, int16(len(m.ParameterOIDs)))
+	for _, oid := range m.ParameterOIDs {
+		dst = appendInt32(dst, int32(oid))
+	}
+	return finishMessage(dst, start)
+}
+
+// Bind creates a portal from a prepared statement and parameter values.
+// A nil entry in Parameters is SQL NULL.
+type Bind struct {
+	Portal               string
+	Statement            string
+	ParameterFormatCodes []int16
+	Parameters           [][]byte
+	ResultFormatCodes    []int16
+}
+
+func (m *Bind) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'B')
+	dst = appendString(dst, m.Portal)
+	dst = appendString(dst, m.Statement)
+	dst = appendInt16(dst, int16(len(m.ParameterFormatCodes)))
+	for _, f := range m.ParameterFormatCodes {
+		dst = appendInt16(dst, f)
+	}
+	dst = appendInt16(dst, int16(len(m.Parameters)))
+	for _, p := range m.Parameters {
+		if p == nil {
+			dst = appendInt32(dst, -1)
+			continue
+		}
+		dst = appendInt32(dst, int32(len(p)))
+		dst = append(dst, p...)
+	}
+	dst = appendInt16(dst, int16(len(m.ResultFormatCodes)))
+	for _, f := range m.ResultFormatCodes {
+		dst = appendInt16(dst, f)
+	}
+	return finishMessage(dst, start)
+}
+
+// Describe asks for a description of a statement ('S') or portal ('P').
+type Describe struct {
+	ObjectType byte
+	Name       string
+}
+
+func (m *Describe) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'D')
+	dst = append(dst, m.ObjectType)
+	dst = appendString(dst, m.Name)
+	return finishMessage(dst, start)
+}
+
+// Execute runs a portal. MaxRows of zero means no limit.
+type Execute struct {
+	Portal  string
+	MaxRows uint32
+}
+
+func (m *Execute) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'E')
+	dst = appendString(dst, m.Portal)
+	dst = appendInt32(dst, int32(m.MaxRows))
+	return finishMessage(dst, start)
+}
+
+// Close releases a statement ('S') or portal ('P').
+type Close struct {
+	ObjectType byte
+	Name       string
+}
+
+func (m *Close) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'C')
+	dst = append(dst, m.ObjectType)
+	dst = appendString(dst, m.Name)
+	return finishMessage(dst, start)
+}
+
+// Sync ends an extended-protocol batch; the server answers with ReadyForQuery.
+type Sync struct{}
+
+func (m *Sync) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'S')
+	return finishMessage(dst, start)
+}
+
+// Flush asks the server to send any pending output without ending the batch.
+type Flush struct{}
+
+func (m *Flush) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'H')
+	return finishMessage(dst, start)
+}
+
+// Terminate closes the session.
+type Terminate struct{}
+
+func (m *Terminate) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'X')
+	return finishMessage(dst, start)
+}
+
+// PasswordMessage covers every 'p' message: cleartext and MD5 passwords as
+// well as SASL initial and continuation responses. Which one it is depends
+// on the authentication request that came before, so the body stays raw.
+type PasswordMessage struct {
+	Data []byte
+}
+
+func (m *PasswordMessage) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'p')
+	dst = append(dst, m.Data...)
+	return finishMessage(dst, start)
+}
+
+// CopyFail aborts a COPY FROM STDIN.
+type CopyFail struct {
+	Message string
+}
+
+func (m *CopyFail) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'f')
+	dst = appendString(dst, m.Message)
+	return finishMessage(dst, start)
+}
+
+func decodeFrontend(t byte, body []byte) (Message, error) {
+	d := &decoder{buf: body}
+	var msg Message
+	switch t {
+	case 'Q':
+		msg = &Query{String: d.string()}
+	case 'P':
+		m := &Parse{Name: d.string(), Query: d.string()}
+		n := int(d.int16())
+		for i := 0; i < n && d.err == nil; i++ {
+			m.ParameterOIDs = append(m.ParameterOIDs, d.uint32())
+		}
+		msg = m
+	case 'B':
+		m := &Bind{Portal: d.string(), Statement: d.string()}
+		n := int(d.int16())
+		for i := 0; i < n && d.err == nil; i++ {
+			m.ParameterFormatCodes = append(m.ParameterFormatCodes, d.int16())
+		}
+		n = int(d.int16())
+		if n > 0 {
+			m.Parameters = make([][]byte, 0, n)
+		}
+		for i := 0; i < n && d.err == nil; i++ {
+			size := d.int32()
+			if size < 0 {
+				m.Parameters = append(m.Parameters, nil)
+				continue
+			}
+			m.Parameters = append(m.Parameters, d.bytes(int(size)))
+		}
+		n = int(d.int16())
+		for i := 0; i < n && d.err == nil; i++ {
+			m.ResultFormatCodes = append(m.ResultFormatCodes, d.int16())
+		}
+		msg = m
+	case 'D':
+		msg = &Describe{ObjectType: d.byte(), Name: d.string()}
+	case 'E':
+		msg = &Execute{Portal: d.string(), MaxRows: d.uint32()}
+	case 'C':
+		msg = &Close{ObjectType: d.byte(), Name: d.string()}
+	case 'S':
+		msg = &Sync{}
+	case 'H':
+		msg = &Flush{}
+	case 'X':
+		msg = &Terminate{}
+	case 'p':
+		msg = &PasswordMessage{Data: d.rest()}
+	case 'd':
+		msg = &CopyData{Data: d.rest()}
+	case 'c':
+		msg = &CopyDone{}
+	case 'f':
+		msg = &CopyFail{Message: d.string()}
+	default:
+		msg = &Unknown{Type: t, Data: d.rest()}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
+
+func decodeStartup(body []byte) (Message, error) {
+	d := &decoder{buf: body}
+	code := d.uint32()
+	if d.err != nil {
+		return nil, d.err
+	}
+	switch code {
+	case sslRequestCode:
+		return &SSLRequest{}, nil
+	case gssEncRequestCode:
+		return &GSSEncRequest{}, nil
+	case cancelRequestCode:
+		m := &CancelRequest{ProcessID: d.uint32(), SecretKey: d.uint32()}
+		if d.err != nil {
+			return nil, d.err
+		}
+		return m, nil
+	}
+
+	m := &StartupMessage{ProtocolVersion: code, Parameters: map[string]string{}}
+	for {
+		name := d.string()
+		if d.err != nil {
+			return nil, d.err
+		}
+		if name == "" {
+			break
+		}
+		m.Parameters[name] = d.string()
+	}
+	return m, nil
+}
@@ -0,0 +1,126 @@
+package pgproto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestFrontendRoundTrip(t *testing.T) {
+	msgs := []Message{
+		&Query{String: "SELECT 1; SELECT 2"},
+		&Parse{Name: "s1", Query: "SELECT $1::int", ParameterOIDs: []uint32{23}},
+		&Parse{Query: "SELECT 1"},
+		&Bind{Portal: "p", Statement: "s1", ParameterFormatCodes: []int16{0, 1}, Parameters: [][]byte{[]byte("42"), nil, {}}, ResultFormatCodes: []int16{1}},
+		&Bind{},
+		&Describe{ObjectType: 'S', Name: "s1"},
+		&Execute{Portal: "p", MaxRows: 100},
+		&Close{ObjectType: 'P', Name: "p"},
+		&Sync{},
+		&Flush{},
+		&Terminate{},
+		&PasswordMessage{Data: []byte("md5abc\x00")},
+		&CopyData{Data: []byte("1\tone\n")},
+		&CopyDone{},
+		&CopyFail{Message: "aborted"},
+		&Unknown{Type: 'F', Data: []byte{0, 0, 0, 1}},
+	}
+	for _, want := range msgs {
+		wire := want.Encode(nil)
+		got, err := ReadFrontendMessage(bytes.NewReader(wire))
+		if err != nil {
+			t.Errorf("%T: %v", want, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: decoded %#v, want %#v", want, got, want)
+		}
+		if again := got.Encode(nil); !bytes.Equal(again, wire) {
+			t.Errorf("%T: re-encoded %q, want %q", want, again, wire)
+		}
+	}
+}
+
+func TestStartupRoundTrip(t *testing.T) {
+	msgs := []Message{
+		&StartupMessage{ProtocolVersion: ProtocolVersion3, Parameters: map[string]string{"user": "app", "database": "db", "application_name": "x"}},
+		&SSLRequest{},
+		&GSSEncRequest{},
+		&CancelRequest{ProcessID: 1234, SecretKey: 0xdeadbeef},
+	}
+	for _, want := range msgs {
+		wire := want.Encode(nil)
+		got, err := ReadStartupMessage(bytes.NewReader(wire))
+		if err != nil {
+			t.Errorf("%T: %v", want, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: decoded %#v, want %#v", want, got, want)
+		}
+	}
+}
+
+func TestStartupLength(t *testing.T) {
+	for _, size := range []uint32{0, 4, startupHeaderBytes - 1, maxStartupLength + 1, 1 << 31} {
+		wire := appendInt32(nil, int32(size))
+		wire = append(wire, make([]byte, 16)...)
+		if _, err := ReadStartupMessage(bytes.NewReader(wire)); err == nil {
+			t.Errorf("length %d: no error", size)
+		}
+	}
+
+	//a startup message right at the limit is still read
+	m := &StartupMessage{ProtocolVersion: ProtocolVersion3, Parameters: map[string]string{"user": "app"}}
+	wire := m.Encode(nil)
+	pad := maxStartupLength - len(wire)
+	m.Parameters["options"] = string(bytes.Repeat([]byte("x"), pad-len("options")-2))
+	wire = m.Encode(nil)
+	if len(wire) != maxStartupLength {
+		t.Fatalf("startup message is %d bytes, want %d", len(wire), maxStartupLength)
+	}
+	if _, err := ReadStartupMessage(bytes.NewReader(wire)); err != nil {
+		t.Errorf("startup message of %d bytes: %v", len(wire), err)
+	}
+}
+
+func TestStartupMalformed(t *testing.T) {
+	bodies := map[string][]byte{
+		"short cancel":         appendInt32(appendInt32(nil, cancelRequestCode), 1),
+		"unterminated name":    append(appendInt32(nil, ProtocolVersion3), "user"...),
+		"unterminated value":   append(appendInt32(nil, ProtocolVersion3), "user\x00app"...),
+		"missing final NUL":    append(appendInt32(nil, ProtocolVersion3), "user\x00app\x00"...),
+		"version only, no NUL": appendInt32(nil, ProtocolVersion3),
+	}
+	for name, body := range bodies {
+		wire := append(appendInt32(nil, int32(len(body)+4)), body...)
+		if _, err := ReadStartupMessage(bytes.NewReader(wire)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestFrontendMalformed(t *testing.T) {
+	bodies := []struct {
+		name string
+		t    byte
+		body []byte
+	}{
+		{"unterminated query", 'Q', []byte("SELECT 1")},
+		{"parse without OID count", 'P', []byte("s\x00SELECT 1\x00")},
+		{"parse with missing OIDs", 'P', []byte("s\x00SELECT $1\x00\x00\x02\x00\x00\x00\x17")},
+		{"bind with long parameter", 'B', []byte("\x00\x00\x00\x00\x00\x01\x00\x00\x00\x10ab")},
+		{"bind without result formats", 'B', []byte("\x00\x00\x00\x00\x00\x00")},
+		{"empty describe", 'D', nil},
+		{"execute without row limit", 'E', []byte("p\x00\x00\x01")},
+		{"close without name", 'C', []byte("S")},
+		{"unterminated copy fail", 'f', []byte("boom")},
+	}
+	for _, b := range bodies {
+		wire := append([]byte{b.t}, appendInt32(nil, int32(len(b.body)+4))...)
+		wire = append(wire, b.body...)
+		if _, err := ReadFrontendMessage(bytes.NewReader(wire)); err == nil {
+			t.Errorf("%s: no error", b.name)
+		}
+	}
+}
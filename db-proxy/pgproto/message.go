@@ -0,0 +1,110 @@
+// Package pgproto decodes and encodes the PostgreSQL frontend/backend
+// protocol (version 3.0) so the proxy can see what it forwards.
+package pgproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Message is a decoded protocol message. Encode appends the wire form,
+// including the type byte and length, to dst.
+type Message interface {
+	Encode(dst []byte) []byte
+}
+
+// CopyData carries a chunk of COPY data in either direction.
+type CopyData struct {
+	Data []byte
+}
+
+func (m *CopyData) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'd')
+	dst = append(dst, m.Data...)
+	return finishMessage(dst, start)
+}
+
+// CopyDone ends a COPY in either direction.
+type CopyDone struct{}
+
+func (m *CopyDone) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'c')
+	return finishMessage(dst, start)
+}
+
+// Unknown is any message this package does not break down. It is forwarded
+// byte for byte.
+type Unknown struct {
+	Type byte
+	Data []byte
+}
+
+func (m *Unknown) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, m.Type)
+	dst = append(dst, m.Data...)
+	return finishMessage(dst, start)
+}
+
+// ReadStartupMessage reads the first message of a connection, which has no
+// type byte. It returns a *StartupMessage, *SSLRequest, *GSSEncRequest or
+// *CancelRequest.
+func ReadStartupMessage(r io.Reader) (Message, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint32(header[:]))
+	if size < startupHeaderBytes || size > maxStartupLength {
+		return nil, fmt.Errorf("pgproto: invalid startup message length %d", size)
+	}
+	body := make([]byte, size-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return decodeStartup(body)
+}
+
+// ReadFrontendMessage reads one message sent by a client.
+func ReadFrontendMessage(r io.Reader) (Message, error) {
+	t, body, err := readTyped(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeFrontend(t, body)
+}
+
+// ReadBackendMessage reads one message sent by a server.
+func ReadBackendMessage(r io.Reader) (Message, error) {
+	t, body, err := readTyped(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBackend(t, body)
+}
+
+func readTyped(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint32(header[1:]))
+	if size < 4 || size > maxMessageLength {
+		return 0, nil, fmt.Errorf("pgproto: invalid length %d for message %q", size, header[0])
+	}
+	body := make([]byte, size-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// Write encodes msgs and writes them to w in a single call.
+func Write(w io.Writer, msgs ...Message) error {
+	var buf []byte
+	for _, m := range msgs {
+		buf = m.Encode(buf)
+	}
+	_, err := w.Write(buf)
+	return err
+}
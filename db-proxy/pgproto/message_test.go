@@ -0,0 +1,71 @@
+package pgproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMessageLength(t *testing.T) {
+	for _, size := range []uint32{0, 3, maxMessageLength + 1, 1<<32 - 1} {
+		wire := append([]byte{'Q'}, appendInt32(nil, int32(size))...)
+		if _, err := ReadFrontendMessage(bytes.NewReader(wire)); err == nil {
+			t.Errorf("frontend length %d: no error", size)
+		}
+		wire[0] = 'C'
+		if _, err := ReadBackendMessage(bytes.NewReader(wire)); err == nil {
+			t.Errorf("backend length %d: no error", size)
+		}
+	}
+}
+
+func TestMessageTruncated(t *testing.T) {
+	wire := (&Query{String: "SELECT 1"}).Encode(nil)
+	for n := 1; n < len(wire); n++ {
+		if _, err := ReadFrontendMessage(bytes.NewReader(wire[:n])); err == nil {
+			t.Errorf("%d of %d bytes: no error", n, len(wire))
+		}
+	}
+}
+
+// TestDecodeShortBodies cuts every message short at each length in turn:
+// decoding must fail or succeed, never panic.
+func TestDecodeShortBodies(t *testing.T) {
+	frontend := []Message{
+		&Parse{Name: "s1", Query: "SELECT $1", ParameterOIDs: []uint32{23}},
+		&Bind{Portal: "p", Statement: "s1", ParameterFormatCodes: []int16{1}, Parameters: [][]byte{[]byte("42"), nil}, ResultFormatCodes: []int16{1}},
+		&Describe{ObjectType: 'S', Name: "s1"},
+		&Execute{Portal: "p", MaxRows: 1},
+		&Close{ObjectType: 'S', Name: "s1"},
+		&CopyFail{Message: "no"},
+	}
+	backend := []Message{
+		&RowDescription{Fields: []FieldDescription{{Name: "id", DataTypeOID: 23}}},
+		&DataRow{Values: [][]byte{[]byte("1"), nil}},
+		&ErrorResponse{Severity: "ERROR", Code: "XX000", Message: "boom"},
+		&ParameterDescription{ParameterOIDs: []uint32{23}},
+		&NotificationResponse{Channel: "c", Payload: "p"},
+		&BackendKeyData{ProcessID: 1, SecretKey: 2},
+	}
+	check := func(m Message, decode func(byte, []byte) (Message, error)) {
+		wire := m.Encode(nil)
+		body := wire[5:]
+		for n := 0; n < len(body); n++ {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("%T cut to %d bytes: panic %v", m, n, r)
+					}
+				}()
+				if _, err := decode(wire[0], body[:n]); err == nil {
+					t.Errorf("%T cut to %d bytes: no error", m, n)
+				}
+			}()
+		}
+	}
+	for _, m := range frontend {
+		check(m, decodeFrontend)
+	}
+	for _, m := range backend {
+		check(m, decodeBackend)
+	}
+}
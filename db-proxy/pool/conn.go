@@ -0,0 +1,192 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/mysqlproto"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+)
+
+// Credentials the proxy uses to log in to the server on its own.
+// Password may be a plain password or an MD5 secret ("md5...");
+// SCRAM needs the plain password.
+type Credentials struct {
+	User     string
+	Password string
+	Database string
+	// Options are further startup parameters, such as application_name,
+	// for a connection the proxy opens on behalf of one client
+	Options map[string]string
+	// ProxyHeader, if not nil, is sent before anything else, for servers
+	// that expect the PROXY protocol
+	ProxyHeader []byte
+
+	// Capabilities and Charset are what a MySQL client asked for at login.
+	// They decide what the server's answers look like, so connections
+	// are opened with the same.
+	Capabilities uint32
+	Charset      byte
+}
+
+// Conn is an authenticated server connection that is ready for a query.
+type Conn struct {
+	net.Conn
+	Reader *bufio.Reader
+	Writer *bufio.Writer
+	Addr   string
+
+	// Params holds the ParameterStatus values reported at login
+	Params map[string]string
+	// Key is what a CancelRequest for this connection must carry
+	Key pgproto.BackendKeyData
+	// ConnectionID is the MySQL connection id, which KILL QUERY takes, and
+	// Capabilities the capability flags in effect on it
+	ConnectionID uint32
+	Capabilities uint32
+	// Packets reads and writes the packets of a MySQL connection, through
+	// Reader and Writer
+	Packets *mysqlproto.Conn
+
+	// Prepared holds the named statements the proxy prepared on this
+	// connection and Unnamed identifies the query in the unnamed statement.
+	// They outlive each borrower, so the proxy can tell what is already
+	// there when it hands the connection to the next client.
+	Prepared map[string]bool
+	Unnamed  string
+
+	idleSince time.Time
+}
+
+// Connect dials addr and runs the startup and authentication exchange,
+// over TLS when tlsConfig is not nil. A deadline on ctx bounds the whole
+// login, not only the dial.
+func Connect(ctx context.Context, addr string, creds Credentials, tlsConfig *tls.Config) (*Conn, error) {
+	netConn, err := Dial(ctx, addr, creds.ProxyHeader, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+		defer netConn.SetDeadline(time.Time{})
+	}
+	c := &Conn{
+		Conn:   netConn,
+		Reader: bufio.NewReader(netConn),
+		Writer: bufio.NewWriter(netConn),
+		Addr:   addr,
+		Params: map[string]string{},
+
+		Prepared: map[string]bool{},
+	}
+	if err := c.startup(creds); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("login to %s as %q: %w", addr, creds.User, err)
+	}
+	return c, nil
+}
+
+func (c *Conn) startup(creds Credentials) error {
+	params := map[string]string{}
+	for name, value := range creds.Options {
+		params[name] = value
+	}
+	params["user"], params["database"] = creds.User, creds.Database
+	startup := &pgproto.StartupMessage{ProtocolVersion: pgproto.ProtocolVersion3, Parameters: params}
+	if err := pgproto.Write(c.Conn, startup); err != nil {
+		return err
+	}
+
+	var scram *pgproto.SCRAMClient
+	for {
+		msg, err := pgproto.ReadBackendMessage(c.Reader)
+		if err != nil {
+			return err
+		}
+		switch m := msg.(type) {
+		case *pgproto.Authentication:
+			var reply pgproto.Message
+			switch m.Type {
+			case pgproto.AuthOK:
+				continue
+			case pgproto.AuthCleartextPassword:
+				if pgproto.IsMD5Secret(creds.Password) {
+					return fmt.Errorf("server asked for a cleartext password but only an MD5 secret is configured")
+				}
+				reply = &pgproto.PasswordMessage{Data: pgproto.PasswordData(creds.Password)}
+			case pgproto.AuthMD5Password:
+				reply = &pgproto.PasswordMessage{Data: pgproto.PasswordData(pgproto.MD5Response(creds.User, creds.Password, m.Data))}
+			case pgproto.AuthSASL:
+				if !contains(pgproto.SASLMechanisms(m.Data), pgproto.SCRAMSHA256) {
+					return fmt.Errorf("server offered no supported SASL mechanism")
+				}
+				if pgproto.IsMD5Secret(creds.Password) {
+					return fmt.Errorf("SCRAM authentication needs a plain password")
+				}
+				if scram, err = pgproto.NewSCRAMClient(creds.Password); err != nil {
+					return err
+				}
+				reply = pgproto.SASLInitialResponse(pgproto.SCRAMSHA256, scram.ClientFirst())
+			case pgproto.AuthSASLContinue:
+				if scram == nil {
+					return fmt.Errorf("unexpected SASL continue")
+				}
+				final, err := scram.ClientFinal(m.Data)
+				if err != nil {
+					return err
+				}
+				reply = &pgproto.PasswordMessage{Data: final}
+			case pgproto.AuthSASLFinal:
+				if scram == nil {
+					return fmt.Errorf("unexpected SASL final")
+				}
+				if err := scram.Verify(m.Data); err != nil {
+					return err
+				}
+				continue
+			default:
+				return fmt.Errorf("unsupported authentication method %d", m.Type)
+			}
+			if err := pgproto.Write(c.Conn, reply); err != nil {
+				return err
+			}
+		case *pgproto.ParameterStatus:
+			c.Params[m.Name] = m.Value
+		case *pgproto.BackendKeyData:
+			c.Key = *m
+		case *pgproto.ErrorResponse:
+			return m
+		case *pgproto.ReadyForQuery:
+			return nil
+		}
+	}
+}
+
+// alive reports whether an idle connection still looks usable. A server
+// that closed the connection or sent something unsolicited is not.
+func (c *Conn) alive() bool {
+	if c.Reader.Buffered() > 0 {
+		return false
+	}
+	c.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer c.SetReadDeadline(time.Time{})
+	var b [1]byte
+	_, err := c.Conn.Read(b[:])
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/mysqlproto"
+)
+
+// mysqlCapabilities are the capabilities the proxy always logs in to
+// MySQL servers with, whatever the client asked for.
+const mysqlCapabilities = mysqlproto.ClientProtocol41 | mysqlproto.ClientSecureConnection | mysqlproto.ClientPluginAuth | mysqlproto.ClientPluginAuthLenencData | mysqlproto.ClientTransactions | mysqlproto.ClientLongPassword
+
+// DialMySQL connects to the MySQL server at addr, sending proxyHeader
+// first as Dial does, and reads its greeting. The connection is not
+// logged in yet; Packets has read the greeting, and Params holds the
+// server version.
+func DialMySQL(ctx context.Context, addr string, proxyHeader []byte) (*Conn, *mysqlproto.Handshake, error) {
+	netConn, err := Dial(ctx, addr, proxyHeader, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+		defer netConn.SetDeadline(time.Time{})
+	}
+	c := &Conn{
+		Conn:   netConn,
+		Reader: bufio.NewReader(netConn),
+		Writer: bufio.NewWriter(netConn),
+		Addr:   addr,
+		Params: map[string]string{},
+
+		Prepared: map[string]bool{},
+	}
+	c.Packets = mysqlproto.NewConn(c.Reader, c.Writer)
+	payload, err := c.Packets.ReadPacket()
+	if err != nil {
+		netConn.Close()
+		return nil, nil, err
+	}
+	greeting, err := mysqlproto.ParseHandshake(payload)
+	if err != nil {
+		netConn.Close()
+		return nil, nil, err
+	}
+	c.Params["server_version"] = greeting.ServerVersion
+	c.ConnectionID = greeting.ConnectionID
+	return c, greeting, nil
+}
+
+// StartMySQLTLS sends the SSLRequest for resp, whose capabilities must
+// include ClientSSL, and switches c to TLS. On failure c is closed.
+func (c *Conn) StartMySQLTLS(ctx context.Context, tlsConfig *tls.Config, resp *mysqlproto.HandshakeResponse) error {
+	c.Packets.WritePacket(resp.EncodeSSLRequest(nil))
+	if err := c.Packets.Flush(); err != nil {
+		c.Close()
+		return err
+	}
+	tlsConn, err := startTLS(ctx, c.Conn, c.Addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	c.Conn, c.Reader, c.Writer = tlsConn, bufio.NewReader(tlsConn), bufio.NewWriter(tlsConn)
+	c.Packets.Switch(c.Reader, c.Writer)
+	return nil
+}
+
+// ConnectMySQL dials the MySQL server at addr and logs in, over TLS when
+// tlsConfig is not nil. It supports mysql_native_password and
+// caching_sha2_password, which both need the plain password. A deadline
+// on ctx bounds the whole login, not only the dial.
+func ConnectMySQL(ctx context.Context, addr string, creds Credentials, tlsConfig *tls.Config) (*Conn, error) {
+	c, greeting, err := DialMySQL(ctx, addr, creds.ProxyHeader)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if err := c.loginMySQL(ctx, greeting, creds, tlsConfig); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("login to %s as %q: %w", addr, creds.User, err)
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *Conn) loginMySQL(ctx context.Context, greeting *mysqlproto.Handshake, creds Credentials, tlsConfig *tls.Config) error {
+	if greeting.Capabilities&mysqlproto.ClientProtocol41 == 0 {
+		return fmt.Errorf("server does not speak protocol 4.1")
+	}
+	resp := &mysqlproto.HandshakeResponse{
+		Capabilities:  (creds.Capabilities | mysqlCapabilities) & greeting.Capabilities &^ (mysqlproto.Unsupported | mysqlproto.ClientSSL | mysqlproto.ClientConnectAttrs | mysqlproto.ClientConnectWithDB),
+		MaxPacketSize: 1<<24 - 1,
+		Charset:       creds.Charset,
+		User:          creds.User,
+		Database:      creds.Database,
+		AuthPlugin:    greeting.AuthPlugin,
+	}
+	if resp.Charset == 0 {
+		resp.Charset = greeting.Charset
+	}
+	if creds.Database != "" {
+		resp.Capabilities |= mysqlproto.ClientConnectWithDB
+	}
+	if tlsConfig != nil {
+		if greeting.Capabilities&mysqlproto.ClientSSL == 0 {
+			return ErrTLSRefused
+		}
+		resp.Capabilities |= mysqlproto.ClientSSL
+		if err := c.StartMySQLTLS(ctx, tlsConfig, resp); err != nil {
+			return err
+		}
+	}
+	scramble := greeting.AuthData
+	var err error
+	if resp.AuthResponse, err = mysqlproto.Scramble(resp.AuthPlugin, scramble, creds.Password); err != nil {
+		return err
+	}
+	c.Packets.WritePacket(resp.Encode(nil))
+	if err := c.Packets.Flush(); err != nil {
+		return err
+	}
+
+	plugin := resp.AuthPlugin
+	for {
+		payload, err := c.Packets.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if len(payload) == 0 {
+			return mysqlproto.ErrMalformed
+		}
+		var reply []byte
+		switch payload[0] {
+		case 0x00:
+			c.Capabilities = resp.Capabilities
+			return nil
+		case 0xff:
+			return mysqlproto.ParseError(payload)
+		case 0xfe:
+			switchTo, err := mysqlproto.ParseAuthSwitchRequest(payload)
+			if err != nil {
+				return err
+			}
+			plugin, scramble = switchTo.Plugin, switchTo.AuthData
+			if plugin == mysqlproto.ClearPassword && tlsConfig == nil {
+				return fmt.Errorf("server asked for the password in clear over a connection without TLS")
+			}
+			if reply, err = mysqlproto.Scramble(plugin, scramble, creds.Password); err != nil {
+				return err
+			}
+		case 0x01:
+			if plugin != mysqlproto.CachingSHA2Password || len(payload) < 2 {
+				return fmt.Errorf("unexpected authentication data for %s", plugin)
+			}
+			switch {
+			case payload[1] == mysqlproto.FastAuthOK && len(payload) == 2:
+				continue
+			case payload[1] == mysqlproto.FullAuthRequired && len(payload) == 2:
+				if tlsConfig != nil {
+					reply = append([]byte(creds.Password), 0)
+				} else {
+					reply = mysqlproto.RequestPublicKey()
+				}
+			default:
+				//the server's public key
+				if reply, err = mysqlproto.EncryptPassword(creds.Password, scramble, payload[1:]); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unexpected packet 0x%02x during login", payload[0])
+		}
+		c.Packets.WritePacket(reply)
+		if err := c.Packets.Flush(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package pool keeps a bounded set of authenticated server connections
+// that clients borrow for the length of a transaction.
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by Acquire once the pool has been closed.
+var ErrClosed = errors.New("pool: closed")
+
+// ErrDialTimeout is wrapped in the error Acquire returns when a new
+// connection could not be opened within the pool's dial timeout.
+var ErrDialTimeout = errors.New("pool: dial timeout")
+
+// idleCheckAfter is how long a connection may sit idle before Acquire
+// checks that the server has not closed it in the meantime.
+const idleCheckAfter = time.Second
+
+// Connector opens a server connection and logs in, over TLS when
+// tlsConfig is not nil. A deadline on ctx bounds the whole login.
+type Connector func(ctx context.Context, addr string, creds Credentials, tlsConfig *tls.Config) (*Conn, error)
+
+// Pool hands out connections to one server as one user and database.
+// At most size connections are open at a time; Acquire waits for a free
+// slot when they are all in use.
+type Pool struct {
+	connect     Connector
+	addr        string
+	creds       Credentials
+	tls         *tls.Config
+	dialTimeout time.Duration
+	slots       chan struct{}
+
+	mu     sync.Mutex
+	idle   []*Conn
+	closed bool
+}
+
+// New creates an empty pool. Connections are opened on demand with
+// connect, Connect for PostgreSQL or ConnectMySQL, over TLS when
+// tlsConfig is not nil, and must be logged in within dialTimeout unless it
+// is zero.
+func New(connect Connector, addr string, creds Credentials, size int, tlsConfig *tls.Config, dialTimeout time.Duration) *Pool {
+	return &Pool{
+		connect:     connect,
+		addr:        addr,
+		creds:       creds,
+		tls:         tlsConfig,
+		dialTimeout: dialTimeout,
+		slots:       make(chan struct{}, size),
+	}
+}
+
+// Acquire returns an idle connection or opens a new one, waiting until
+// ctx is done if the pool is at its limit.
+func (p *Pool) Acquire(ctx context.Context) (*Conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		c, err := p.popIdle()
+		if err != nil {
+			<-p.slots
+			return nil, err
+		}
+		if c == nil {
+			break
+		}
+		if time.Since(c.idleSince) < idleCheckAfter || c.alive() {
+			return c, nil
+		}
+		c.Close()
+	}
+
+	dialCtx := ctx
+	if p.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, p.dialTimeout)
+		defer cancel()
+	}
+	c, err := p.connect(dialCtx, p.addr, p.creds, p.tls)
+	if err != nil {
+		<-p.slots
+		//a timeout is the dial timeout's doing unless ctx ran out as well
+		if IsTimeout(err) && ctx.Err() == nil {
+			return nil, fmt.Errorf("%w after %v: %v", ErrDialTimeout, p.dialTimeout, err)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *Pool) popIdle() (*Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrClosed
+	}
+	n := len(p.idle)
+	if n == 0 {
+		return nil, nil
+	}
+	// most recently used first, so surplus connections age out
+	c := p.idle[n-1]
+	p.idle = p.idle[:n-1]
+	return c, nil
+}
+
+// Release returns a connection that is idle (not inside a transaction and
+// with nothing left to read) so another client can use it.
+func (p *Pool) Release(c *Conn) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		c.Close()
+	} else {
+		c.idleSince = time.Now()
+		p.idle = append(p.idle, c)
+		p.mu.Unlock()
+	}
+	<-p.slots
+}
+
+// Discard closes a connection that cannot be reused, for instance because
+// its client went away in the middle of a transaction.
+func (p *Pool) Discard(c *Conn) {
+	c.Close()
+	<-p.slots
+}
+
+// CloseIdle closes the connections that have been idle for longer than
+// maxIdle and returns how many it closed.
+func (p *Pool) CloseIdle(maxIdle time.Duration) int {
+	p.mu.Lock()
+	var stale []*Conn
+	kept := p.idle[:0]
+	for _, c := range p.idle {
+		if time.Since(c.idleSince) > maxIdle {
+			stale = append(stale, c)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	p.idle = kept
+	p.mu.Unlock()
+	for _, c := range stale {
+		c.Close()
+	}
+	return len(stale)
+}
+
+// Close closes the idle connections and makes further Acquire calls fail.
+// Connections that are in use are closed when they are released.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+}
@@ -0,0 +1,36 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/metrics"
+)
+
+// DialRedis connects to the Redis server at addr, sending proxyHeader
+// first as Dial does, over TLS when tlsConfig is not nil; Redis starts TLS
+// right away rather than on request. There is no login: clients
+// authenticate with their own AUTH commands.
+func DialRedis(ctx context.Context, addr string, proxyHeader []byte, tlsConfig *tls.Config) (*Conn, error) {
+	start := time.Now()
+	netConn, err := dialTCP(ctx, addr, proxyHeader)
+	if err == nil && tlsConfig != nil {
+		netConn, err = startTLS(ctx, netConn, addr, tlsConfig)
+	}
+	if err != nil {
+		metrics.BackendDialErrors.WithLabelValues(addr).Inc()
+		return nil, err
+	}
+	metrics.BackendDialDuration.WithLabelValues(addr).Observe(time.Since(start).Seconds())
+	return &Conn{
+		Conn:   netConn,
+		Reader: bufio.NewReader(netConn),
+		Writer: bufio.NewWriter(netConn),
+		Addr:   addr,
+		Params: map[string]string{},
+
+		Prepared: map[string]bool{},
+	}, nil
+}
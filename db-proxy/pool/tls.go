@@ -0,0 +1,110 @@
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+)
+
+// ErrTLSRefused is returned by Dial when TLS is configured but the server
+// answered the SSLRequest with 'N'.
+var ErrTLSRefused = errors.New("server does not support TLS")
+
+// Dial opens a connection to the server at addr and sends proxyHeader, a
+// PROXY protocol header, if it is not nil. With a non-nil tlsConfig it
+// sends an SSLRequest and runs the TLS handshake before returning, so the
+// caller can go on with the startup message either way. If tlsConfig
+// checks host names and has no ServerName, the host part of addr is used.
+func Dial(ctx context.Context, addr string, proxyHeader []byte, tlsConfig *tls.Config) (net.Conn, error) {
+	start := time.Now()
+	conn, err := dial(ctx, addr, proxyHeader, tlsConfig)
+	if err != nil {
+		metrics.BackendDialErrors.WithLabelValues(addr).Inc()
+		return nil, err
+	}
+	metrics.BackendDialDuration.WithLabelValues(addr).Observe(time.Since(start).Seconds())
+	return conn, nil
+}
+
+// IsTimeout reports whether err comes from a deadline running out, be it
+// a context's or a connection's.
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func dial(ctx context.Context, addr string, proxyHeader []byte, tlsConfig *tls.Config) (net.Conn, error) {
+	netConn, err := dialTCP(ctx, addr, proxyHeader)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return netConn, nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+		defer netConn.SetDeadline(time.Time{})
+	}
+	if err := pgproto.Write(netConn, &pgproto.SSLRequest{}); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	var answer [1]byte
+	if _, err := io.ReadFull(netConn, answer[:]); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if answer[0] != 'S' {
+		netConn.Close()
+		return nil, ErrTLSRefused
+	}
+
+	return startTLS(ctx, netConn, addr, tlsConfig)
+}
+
+// dialTCP opens a TCP connection to addr and sends proxyHeader on it if
+// it is not nil.
+func dialTCP(ctx context.Context, addr string, proxyHeader []byte) (net.Conn, error) {
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil || proxyHeader == nil {
+		return netConn, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetWriteDeadline(deadline)
+	}
+	_, err = netConn.Write(proxyHeader)
+	netConn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return netConn, nil
+}
+
+// startTLS runs the client side of a TLS handshake on netConn, which the
+// server at addr expects. On failure netConn is closed.
+func startTLS(ctx context.Context, netConn net.Conn, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	if tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	tlsConn := tls.Client(netConn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
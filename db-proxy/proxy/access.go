@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/metrics"
+)
+
+// errTooManyConnections is returned by limiter.acquire when a client
+// cannot get a connection slot.
+var errTooManyConnections = errors.New("too many connections")
+
+// allowed reports whether a client from ip may connect. Deny wins over
+// Allow, and an empty Allow list lets everyone in.
+func (c *Config) allowed(ip net.IP) bool {
+	for _, n := range c.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(c.Allow) == 0 {
+		return true
+	}
+	for _, n := range c.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// limiter counts client connections, in total and per source IP.
+type limiter struct {
+	mu      sync.Mutex
+	total   int
+	perIP   map[string]int
+	waiting int
+	// freed is closed and replaced whenever a slot is released
+	freed chan struct{}
+}
+
+func newLimiter() *limiter {
+	return &limiter{perIP: map[string]int{}, freed: make(chan struct{})}
+}
+
+// acquire takes a connection slot for ip under the limits in cfg. If none
+// is free it queues for up to cfg.QueueTimeout, unless cfg.QueueSize
+// clients are queued already.
+func (l *limiter) acquire(cfg *Config, ip string) error {
+	var timeout <-chan time.Time
+	queued := false
+	defer func() {
+		if queued {
+			l.mu.Lock()
+			l.waiting--
+			l.mu.Unlock()
+			metrics.ConnectionsQueued.Dec()
+		}
+	}()
+
+	for {
+		l.mu.Lock()
+		if (cfg.MaxConnections <= 0 || l.total < cfg.MaxConnections) &&
+			(cfg.MaxConnectionsPerIP <= 0 || l.perIP[ip] < cfg.MaxConnectionsPerIP) {
+			l.total++
+			l.perIP[ip]++
+			l.mu.Unlock()
+			return nil
+		}
+		if !queued {
+			if l.waiting >= cfg.QueueSize || cfg.QueueTimeout <= 0 {
+				l.mu.Unlock()
+				return errTooManyConnections
+			}
+			l.waiting++
+			queued = true
+			metrics.ConnectionsQueued.Inc()
+			timer := time.NewTimer(cfg.QueueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		freed := l.freed
+		l.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-timeout:
+			return errTooManyConnections
+		}
+	}
+}
+
+// release gives back a slot taken by acquire.
+func (l *limiter) release(ip string) {
+	l.mu.Lock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	close(l.freed)
+	l.freed = make(chan struct{})
+	l.mu.Unlock()
+}
+
+// ParseNetworks parses CIDR blocks such as "10.0.0.0/8". A plain address
+// stands for itself alone.
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// remoteIP returns the address connection comes from, or nil if it is not
+// an IP address.
+func remoteIP(connection net.Conn) net.IP {
+	switch addr := connection.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(connection.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n clients are queued in l.
+func waitQueued(t *testing.T, l *limiter, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		waiting := l.waiting
+		l.mu.Unlock()
+		if waiting == n {
+			return
+		}
+	}
+	t.Fatalf("%d clients never queued", n)
+}
+
+func TestLimiter(t *testing.T) {
+	cfg := &Config{MaxConnections: 3, MaxConnectionsPerIP: 2}
+	l := newLimiter()
+	for _, ip := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"} {
+		if err := l.acquire(cfg, ip); err != nil {
+			t.Fatalf("acquire(%s): %v", ip, err)
+		}
+	}
+	if err := l.acquire(cfg, "10.0.0.3"); err != errTooManyConnections {
+		t.Errorf("acquire over the total limit = %v", err)
+	}
+	l.release("10.0.0.2")
+	if err := l.acquire(cfg, "10.0.0.1"); err != errTooManyConnections {
+		t.Errorf("acquire over the limit per IP = %v", err)
+	}
+	if err := l.acquire(cfg, "10.0.0.3"); err != nil {
+		t.Errorf("acquire of a released slot: %v", err)
+	}
+	l.release("10.0.0.1")
+	l.release("10.0.0.1")
+	l.release("10.0.0.3")
+	if l.total != 0 || len(l.perIP) != 0 {
+		t.Errorf("after releasing everything: total %d, per IP %v", l.total, l.perIP)
+	}
+
+	//no limits
+	if err := newLimiter().acquire(&Config{}, "10.0.0.1"); err != nil {
+		t.Errorf("acquire without limits: %v", err)
+	}
+}
+
+func TestLimiterQueue(t *testing.T) {
+	cfg := &Config{MaxConnections: 1, QueueSize: 1, QueueTimeout: time.Minute}
+	l := newLimiter()
+	if err := l.acquire(cfg, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan error)
+	go func() { admitted <- l.acquire(cfg, "10.0.0.2") }()
+	waitQueued(t, l, 1)
+	if err := l.acquire(cfg, "10.0.0.3"); err != errTooManyConnections {
+		t.Errorf("acquire with the queue full = %v", err)
+	}
+
+	l.release("10.0.0.1")
+	select {
+	case err := <-admitted:
+		if err != nil {
+			t.Errorf("queued client: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued client not admitted after a release")
+	}
+	if l.waiting != 0 || l.perIP["10.0.0.2"] != 1 {
+		t.Errorf("after admission: %d waiting, per IP %v", l.waiting, l.perIP)
+	}
+
+	//a queued client gives up after QueueTimeout
+	cfg.QueueTimeout = 20 * time.Millisecond
+	start := time.Now()
+	if err := l.acquire(cfg, "10.0.0.3"); err != errTooManyConnections {
+		t.Errorf("acquire after the queue timeout = %v", err)
+	}
+	if waited := time.Since(start); waited < cfg.QueueTimeout {
+		t.Errorf("gave up after %v, before the queue timeout", waited)
+	}
+	if l.waiting != 0 {
+		t.Errorf("%d still waiting after the timeout", l.waiting)
+	}
+
+	//without a queue timeout nobody queues
+	if err := l.acquire(&Config{MaxConnections: 1, QueueSize: 1}, "10.0.0.3"); err != errTooManyConnections {
+		t.Errorf("acquire without a queue timeout = %v", err)
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := ParseNetworks([]string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32", "2001:db8:1::5", "::ffff:198.51.100.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.7/32", "2001:db8::/32", "2001:db8:1::5/128", "198.51.100.1/32"}
+	for i, n := range nets {
+		if n.String() != want[i] {
+			t.Errorf("network %d = %s, want %s", i, n, want[i])
+		}
+	}
+
+	for _, s := range []string{"10.0.0.0/33", "10.0.0", "example.com", "", "2001:db8::/129"} {
+		if _, err := ParseNetworks([]string{s}); err == nil {
+			t.Errorf("ParseNetworks(%q) succeeded", s)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	allow, _ := ParseNetworks([]string{"10.0.0.0/8", "2001:db8::1"})
+	deny, _ := ParseNetworks([]string{"10.0.0.9"})
+	tests := []struct {
+		allow []*net.IPNet
+		ip    string
+		want  bool
+	}{
+		{allow, "10.1.2.3", true},
+		{allow, "10.0.0.9", false},
+		{allow, "192.0.2.1", false},
+		{allow, "2001:db8::1", true},
+		{allow, "2001:db8::2", false},
+		{allow, "::ffff:10.1.2.3", true},
+		{nil, "192.0.2.1", true},
+		{nil, "10.0.0.9", false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Allow: tt.allow, Deny: deny}
+		if got := cfg.allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("allowed(%s) with allow %v = %v, want %v", tt.ip, tt.allow, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"github.com/mu-wahba/db-proxy-go/cache"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/record"
+)
+
+// cacheAddr stands in for the server address in traces of queries the
+// cache answered.
+const cacheAddr = "cache"
+
+// fromCache answers a simple query from the result cache if it can. If
+// the query may be cached but is not, its result is collected on the way
+// back. It must be called with sess.mu held while the client holds no
+// server connection, so nothing else is on its way to the client.
+func (sess *session) fromCache(msg pgproto.Message) (answered bool, err error) {
+	sess.caching, sess.cached = nil, nil
+	c := sess.server.config().Cache
+	q, ok := msg.(*pgproto.Query)
+	if c == nil || !ok {
+		return false, nil
+	}
+	lookup, ok := c.Check(sess.user, cache.Key{User: sess.serverUser, Database: sess.database}, q.String)
+	if !ok {
+		return false, nil
+	}
+	msgs, ok := lookup.Get()
+	if !ok {
+		sess.caching, sess.cachedSize = lookup, 0
+		return false, nil
+	}
+	var buf []byte
+	for _, m := range append(msgs[:len(msgs):len(msgs)], &pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle}) {
+		sess.server.logMessage("server", m)
+		sess.recorder.Message(sess.rec.id, record.KindServer, m)
+		sess.trace.server(m, cacheAddr)
+		sess.shadow.server(m)
+		buf = m.Encode(buf)
+	}
+	if _, err := sess.clientW.Write(buf); err != nil {
+		return true, errClientGone
+	}
+	if err := sess.clientW.Flush(); err != nil {
+		return true, errClientGone
+	}
+	sess.rec.ready(pgproto.TxIdle)
+	return true, nil
+}
+
+// collect adds msg, size bytes encoded, to the result being cached and
+// stores the result at the ReadyForQuery that ends it. Anything but the
+// rows and completion of a single statement, or a result too big for the
+// cache, means nothing is stored. It must be called with sess.mu held.
+func (sess *session) collect(msg pgproto.Message, size int) {
+	switch m := msg.(type) {
+	case *pgproto.RowDescription, *pgproto.DataRow, *pgproto.CommandComplete:
+		sess.cached = append(sess.cached, msg)
+		sess.cachedSize += int64(size)
+		if sess.caching.Fits(sess.cachedSize) {
+			return
+		}
+	case *pgproto.ReadyForQuery:
+		//in a transaction the result may hold uncommitted writes
+		if m.TxStatus == pgproto.TxIdle {
+			sess.caching.Put(sess.cached, sess.cachedSize)
+		}
+	}
+	sess.caching, sess.cached = nil, nil
+}
+
+// invalidate drops the cached results that msg may make stale, and notes
+// the tables it writes to drop them again once the writes are committed.
+// It must be called with sess.mu held.
+func (sess *session) invalidate(msg pgproto.Message) {
+	c := sess.server.config().Cache
+	if c == nil {
+		return
+	}
+	var written []string
+	switch m := msg.(type) {
+	case *pgproto.Query:
+		_, _, written = classify(m.String)
+	case *pgproto.Bind:
+		//a Parse only prepares; the write happens when it is bound and run
+		if st := sess.statements[m.Statement]; st != nil {
+			written = st.written
+		}
+	}
+	if len(written) > 0 {
+		c.Invalidate(written)
+		sess.written = append(sess.written, written...)
+	}
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/cache"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+)
+
+func TestCacheCollect(t *testing.T) {
+	c := cache.New([]cache.Rule{{TTL: time.Minute}}, 1<<20)
+	s := NewServer(Config{Cache: c})
+	key := cache.Key{User: "app", Database: "db"}
+	reader := &session{server: s, statements: map[string]*preparedStatement{}}
+	writer := &session{server: s, statements: map[string]*preparedStatement{}}
+
+	rows := []pgproto.Message{
+		&pgproto.RowDescription{Fields: []pgproto.FieldDescription{{Name: "a"}}},
+		&pgproto.DataRow{Values: [][]byte{[]byte("1")}},
+		&pgproto.CommandComplete{Tag: "SELECT 1"},
+	}
+	run := func(write string, status byte) bool {
+		l, ok := c.Check("app", key, "SELECT * FROM t")
+		if !ok {
+			t.Fatal("statement not cacheable")
+		}
+		reader.caching, reader.cached, reader.cachedSize = l, nil, 0
+		for _, m := range rows {
+			reader.collect(m, len(m.Encode(nil)))
+		}
+		if write != "" {
+			writer.invalidate(&pgproto.Query{String: write})
+		}
+		reader.collect(&pgproto.ReadyForQuery{TxStatus: status}, 6)
+		_, ok = l.Get()
+		c.Invalidate([]string{"t"})
+		return ok
+	}
+
+	if !run("", pgproto.TxIdle) {
+		t.Errorf("result not stored")
+	}
+	if run("", pgproto.TxActive) {
+		t.Errorf("result read inside a transaction stored")
+	}
+	//another client's write lands while the result is on its way
+	if run("UPDATE public.t SET a = 2", pgproto.TxIdle) {
+		t.Errorf("result stored after a write to its table")
+	}
+	if !run("UPDATE u SET a = 2", pgproto.TxIdle) {
+		t.Errorf("write to another table kept the result out")
+	}
+	if len(writer.written) != 2 {
+		t.Errorf("writer noted %v as written", writer.written)
+	}
+}
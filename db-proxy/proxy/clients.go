@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/metrics"
+)
+
+// Protocols clients speak.
+const (
+	ProtocolPostgres = "postgres"
+	ProtocolMySQL    = "mysql"
+	ProtocolRedis    = "redis"
+)
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	ID         uint64 `json:"id"`
+	Protocol   string `json:"protocol"`
+	RemoteAddr string `json:"remote_addr"`
+	User       string `json:"user"`
+	Database   string `json:"database"`
+	TLS        bool   `json:"tls"`
+	// Backend is the server the client is using right now. In transaction
+	// mode it is empty while the client sits between transactions.
+	Backend   string    `json:"backend"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	Connected time.Time `json:"connected_at"`
+	Age       float64   `json:"age_seconds"`
+}
+
+// clientRecord is the bookkeeping for one accepted connection.
+type clientRecord struct {
+	id       uint64
+	protocol string
+	conn     *countingConn
+	started  time.Time
+
+	mu       sync.Mutex
+	user     string
+	database string
+	tls      bool
+	// client is the connection after any TLS handshake
+	client net.Conn
+	// waitingSince is when the proxy started waiting for the client to
+	// send something; it is zero while the client waits for the proxy
+	waitingSince time.Time
+	// txStatus is the transaction status the client last saw in a
+	// ReadyForQuery, zero before the first one
+	txStatus byte
+	// backend is set in session mode, sess in transaction mode; mysql
+	// is set for MySQL clients in either mode
+	backend *backend.Backend
+	sess    *session
+	mysql   *mysqlSession
+}
+
+// countingConn counts the bytes read from and written to a client.
+type countingConn struct {
+	net.Conn
+	in, out int64
+	// throttle, when above zero, limits writes to that many bytes per
+	// second
+	throttle int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.in, int64(n))
+	metrics.BytesIn.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	if bandwidth := atomic.LoadInt64(&c.throttle); bandwidth > 0 {
+		return c.writeThrottled(b, bandwidth)
+	}
+	return c.write(b)
+}
+
+func (c *countingConn) write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.out, int64(n))
+	metrics.BytesOut.Add(float64(n))
+	return n, err
+}
+
+// track starts the bookkeeping for a new connection speaking protocol.
+// From then on the connection is used through rec.conn, which counts the
+// bytes.
+func (s *Server) track(connection net.Conn, protocol string) *clientRecord {
+	now := time.Now()
+	rec := &clientRecord{protocol: protocol, conn: &countingConn{Conn: connection}, started: now, waitingSince: now}
+	s.mu.Lock()
+	s.nextClientID++
+	rec.id = s.nextClientID
+	s.clients[rec.id] = rec
+	s.mu.Unlock()
+	metrics.ConnectionsAccepted.Inc()
+	return rec
+}
+
+func (s *Server) untrack(rec *clientRecord) {
+	s.mu.Lock()
+	delete(s.clients, rec.id)
+	s.mu.Unlock()
+}
+
+func (rec *clientRecord) setStartup(client net.Conn, user, database string, tls bool) {
+	//MySQL has no default database
+	if database == "" && rec.protocol == ProtocolPostgres {
+		database = user
+	}
+	rec.mu.Lock()
+	rec.client = client
+	rec.user, rec.database, rec.tls = user, database, tls
+	rec.mu.Unlock()
+}
+
+// waiting notes that it is the client's turn to send something.
+func (rec *clientRecord) waiting() {
+	rec.mu.Lock()
+	rec.waitingSince = time.Now()
+	rec.mu.Unlock()
+}
+
+// ready notes that the client was sent a ReadyForQuery with txStatus.
+func (rec *clientRecord) ready(txStatus byte) {
+	rec.mu.Lock()
+	rec.waitingSince = time.Now()
+	rec.txStatus = txStatus
+	rec.mu.Unlock()
+}
+
+// busy notes that the client sent something and waits for an answer.
+func (rec *clientRecord) busy() {
+	rec.mu.Lock()
+	rec.waitingSince = time.Time{}
+	rec.mu.Unlock()
+}
+
+func (rec *clientRecord) setBackend(b *backend.Backend) {
+	rec.mu.Lock()
+	rec.backend = b
+	rec.mu.Unlock()
+}
+
+func (rec *clientRecord) setSession(sess *session) {
+	rec.mu.Lock()
+	rec.sess = sess
+	rec.mu.Unlock()
+}
+
+func (rec *clientRecord) setMySQL(sess *mysqlSession) {
+	rec.mu.Lock()
+	rec.mysql = sess
+	rec.mu.Unlock()
+}
+
+func (rec *clientRecord) info(now time.Time) ClientInfo {
+	rec.mu.Lock()
+	info := ClientInfo{
+		ID:         rec.id,
+		Protocol:   rec.protocol,
+		RemoteAddr: rec.conn.RemoteAddr().String(),
+		User:       rec.user,
+		Database:   rec.database,
+		TLS:        rec.tls,
+		Connected:  rec.started,
+		Age:        now.Sub(rec.started).Seconds(),
+	}
+	b, sess, mysql := rec.backend, rec.sess, rec.mysql
+	rec.mu.Unlock()
+
+	if sess != nil {
+		if conn := sess.serverConn(); conn != nil {
+			b = conn.backend
+		}
+	}
+	if mysql != nil {
+		if conn := mysql.serverConn(); conn != nil {
+			b = conn.backend
+		}
+	}
+	if b != nil {
+		info.Backend = b.Addr
+	}
+	info.BytesIn = atomic.LoadInt64(&rec.conn.in)
+	info.BytesOut = atomic.LoadInt64(&rec.conn.out)
+	return info
+}
+
+// Clients lists the connected clients, oldest first.
+func (s *Server) Clients() []ClientInfo {
+	recs := s.clientRecords()
+	now := time.Now()
+	infos := make([]ClientInfo, 0, len(recs))
+	for _, rec := range recs {
+		infos = append(infos, rec.info(now))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+func (s *Server) clientRecords() []*clientRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recs := make([]*clientRecord, 0, len(s.clients))
+	for _, rec := range s.clients {
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// CloseClient disconnects the client with id. A transaction it has open
+// is rolled back when its server connection is closed. It reports whether
+// the client was found.
+func (s *Server) CloseClient(id uint64) bool {
+	s.mu.Lock()
+	rec := s.clients[id]
+	s.mu.Unlock()
+	if rec == nil {
+		return false
+	}
+	rec.conn.Close()
+	return true
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/fault"
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+)
+
+// ErrFaultsDisabled is returned by SetFaults when fault injection is not
+// enabled in the configuration.
+var ErrFaultsDisabled = errors.New("fault injection is not enabled")
+
+// Faults returns the fault rules in effect.
+func (s *Server) Faults() []fault.Spec {
+	return s.config().Faults.Specs()
+}
+
+// SetFaults replaces the fault rules until the next reload, which brings
+// back those of the configuration. A nil in turns injection off.
+func (s *Server) SetFaults(in *fault.Injector) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg := *s.config()
+	if !cfg.FaultsEnabled {
+		return ErrFaultsDisabled
+	}
+	cfg.Faults = in
+	s.cfg.Store(&cfg)
+	return nil
+}
+
+// injectFault applies the fault the rules pick for the statement in msg,
+// if it carries one, and returns the message to send on in its place. It
+// returns nil if the fault closed the client connection.
+//
+// Injected errors take the way blocked statements do: the statement is
+// swapped for the fault marker and the server's error for the rule's.
+func (s *Server) injectFault(rec *clientRecord, user string, msg pgproto.Message) pgproto.Message {
+	var sql string
+	switch m := msg.(type) {
+	case *pgproto.Query:
+		sql = m.String
+	case *pgproto.Parse:
+		sql = m.Query
+	default:
+		return msg
+	}
+	f := s.applyFault(rec, user, sql)
+	if f == nil {
+		return msg
+	}
+	switch f.Kind {
+	case fault.Drop, fault.Reset:
+		return nil
+	case fault.Error:
+		marker := s.faultMarker + strconv.Itoa(f.Index)
+		if m, ok := msg.(*pgproto.Parse); ok {
+			return &pgproto.Parse{Name: m.Name, Query: marker}
+		}
+		return &pgproto.Query{String: marker}
+	}
+	return msg
+}
+
+// applyFault picks the fault for sql and carries out the ones that do
+// not depend on the protocol: latency and throttling are applied, and
+// for a drop or a reset the client connection is closed. It returns the
+// fault, or nil if there is none.
+func (s *Server) applyFault(rec *clientRecord, user, sql string) *fault.Fault {
+	//a throttle lasts until the next statement
+	rec.conn.setThrottle(0)
+	f := s.config().Faults.Pick(user, sql)
+	if f == nil {
+		return nil
+	}
+	log.Printf("Injecting %s fault from rule %q for %s: %q", f.Kind, f.Rule, user, sql)
+	metrics.FaultsInjected.WithLabelValues(f.Rule, f.Kind).Inc()
+
+	switch f.Kind {
+	case fault.Latency:
+		time.Sleep(f.Latency)
+	case fault.Throttle:
+		rec.conn.setThrottle(f.Bandwidth)
+	case fault.Drop:
+		rec.conn.Close()
+	case fault.Reset:
+		rec.conn.reset()
+	}
+	return f
+}
+
+// faultError returns the error of the rule whose index starts rest. If
+// the rules changed since, a generic error stands in.
+func (s *Server) faultError(rest string) *pgproto.ErrorResponse {
+	n := 0
+	for n < len(rest) && rest[n] >= '0' && rest[n] <= '9' {
+		n++
+	}
+	index, err := strconv.Atoi(rest[:n])
+	if err == nil {
+		if f := s.config().Faults.Rule(index); f != nil && f.Kind == fault.Error {
+			return pgproto.NewErrorResponse(f.Code, f.Message)
+		}
+	}
+	return pgproto.NewErrorResponse(fault.DefaultCode, fault.DefaultMessage)
+}
+
+// throttleSlices is how many writes a second a throttled connection makes.
+const throttleSlices = 10
+
+func (c *countingConn) setThrottle(bandwidth int64) {
+	atomic.StoreInt64(&c.throttle, bandwidth)
+}
+
+// writeThrottled writes b in slices, pausing after each so that no more
+// than bandwidth bytes go out per second.
+func (c *countingConn) writeThrottled(b []byte, bandwidth int64) (int, error) {
+	slice := int(bandwidth / throttleSlices)
+	if slice < 1 {
+		slice = 1
+	}
+	written := 0
+	for written < len(b) {
+		end := written + slice
+		if end > len(b) {
+			end = len(b)
+		}
+		n, err := c.write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		time.Sleep(time.Duration(int64(n) * int64(time.Second) / bandwidth))
+	}
+	return written, nil
+}
+
+// reset closes the connection with a TCP reset rather than an orderly
+// shutdown.
+func (c *countingConn) reset() {
+	//a client behind a load balancer has a *proxyproto.Conn
+	if conn, ok := c.Conn.(interface{ SetLinger(int) error }); ok {
+		conn.SetLinger(0)
+	}
+	c.Close()
+}
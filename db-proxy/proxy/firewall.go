@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/mu-wahba/db-proxy-go/firewall"
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+)
+
+// Blocked statements are not answered by the proxy itself: responses to
+// earlier pipelined messages may still be on their way, and an error
+// inside a transaction has to abort it. Instead the statement is replaced
+// with the server's marker, a bare identifier the server rejects with a
+// syntax error, and that error is swapped for the proxy's own on the way
+// back. If an earlier error makes the server skip the statement, there is
+// nothing to swap.
+
+// blockedError is what a client gets for a blocked statement.
+func blockedError() *pgproto.ErrorResponse {
+	return pgproto.NewErrorResponse("42501", "permission denied: statement blocked by firewall")
+}
+
+// screen checks the statement in msg, if it carries one, against the
+// firewall and returns msg or its stand-in.
+func (s *Server) screen(user string, connection net.Conn, msg pgproto.Message) pgproto.Message {
+	if s.config().Firewall == nil {
+		return msg
+	}
+	var sql string
+	switch m := msg.(type) {
+	case *pgproto.Query:
+		sql = m.String
+	case *pgproto.Parse:
+		sql = m.Query
+	default:
+		return msg
+	}
+	if !s.blocked(user, connection, sql) {
+		return msg
+	}
+	if m, ok := msg.(*pgproto.Parse); ok {
+		return &pgproto.Parse{Name: m.Name, Query: s.blockedMarker}
+	}
+	return &pgproto.Query{String: s.blockedMarker}
+}
+
+// blocked reports whether the firewall blocks sql from user on
+// connection, and counts it if it does.
+func (s *Server) blocked(user string, connection net.Conn, sql string) bool {
+	fw := s.config().Firewall
+	if fw == nil {
+		return false
+	}
+	ip := remoteIP(connection)
+	rule := fw.Check(firewall.Client{User: user, IP: ip}, sql)
+	if rule == "" {
+		return false
+	}
+	log.Printf("Blocked statement from %s at %v by firewall rule %q: %q", user, ip, rule, sql)
+	metrics.FirewallBlocked.WithLabelValues(rule).Inc()
+	return true
+}
+
+// unscreen replaces the server's error for a blocked statement or an
+// injected error.
+func (s *Server) unscreen(msg pgproto.Message) pgproto.Message {
+	e, ok := msg.(*pgproto.ErrorResponse)
+	if !ok || e.Code != "42601" {
+		return msg
+	}
+	if strings.Contains(e.Message, s.blockedMarker) {
+		return blockedError()
+	}
+	if i := strings.Index(e.Message, s.faultMarker); i >= 0 {
+		return s.faultError(e.Message[i+len(s.faultMarker):])
+	}
+	return msg
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mu-wahba/db-proxy-go/firewall"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+)
+
+// addrConn is a connection that only knows where it comes from.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestScreen(t *testing.T) {
+	s := NewServer(Config{Firewall: &firewall.Firewall{
+		Rules:   []firewall.Rule{{Name: "no-drop", Action: firewall.Deny, Commands: []string{"DROP"}}},
+		Default: firewall.Allow,
+	}})
+	client := addrConn{remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 50000}}
+
+	allowed := &pgproto.Query{String: "SELECT 1"}
+	if got := s.screen("app", client, allowed); got != allowed {
+		t.Errorf("screen(%q) = %#v, want it unchanged", allowed.String, got)
+	}
+	if got := s.screen("app", client, &pgproto.Sync{}); !reflect.DeepEqual(got, &pgproto.Sync{}) {
+		t.Errorf("screen(Sync) = %#v", got)
+	}
+
+	got := s.screen("app", client, &pgproto.Query{String: "DROP TABLE t"})
+	if q, ok := got.(*pgproto.Query); !ok || q.String != s.blockedMarker {
+		t.Fatalf("screen(DROP TABLE t) = %#v, want the marker", got)
+	}
+	got = s.screen("app", client, &pgproto.Parse{Name: "s1", Query: "DROP TABLE t"})
+	if p, ok := got.(*pgproto.Parse); !ok || p.Name != "s1" || p.Query != s.blockedMarker {
+		t.Fatalf("screen(Parse DROP TABLE t) = %#v, want the marker as s1", got)
+	}
+
+	//the server's syntax error for the marker turns into the firewall's error
+	syntax := &pgproto.ErrorResponse{Severity: "ERROR", Code: "42601", Message: `syntax error at or near "` + s.blockedMarker + `"`}
+	if got := s.unscreen(syntax); !reflect.DeepEqual(got, blockedError()) {
+		t.Errorf("unscreen(marker error) = %#v, want %#v", got, blockedError())
+	}
+	for _, msg := range []pgproto.Message{
+		&pgproto.ErrorResponse{Severity: "ERROR", Code: "42601", Message: `syntax error at or near "DROPP"`},
+		&pgproto.ErrorResponse{Severity: "ERROR", Code: "42P01", Message: s.blockedMarker},
+		&pgproto.CommandComplete{Tag: "SELECT 1"},
+	} {
+		if got := s.unscreen(msg); got != msg {
+			t.Errorf("unscreen(%#v) = %#v, want it unchanged", msg, got)
+		}
+	}
+}
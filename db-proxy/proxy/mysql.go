@@ -0,0 +1,448 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/mysqlproto"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/pool"
+)
+
+// MySQLConfig controls how MySQL clients are served. The rest of Config,
+// from the access lists to the firewall, applies to them as well.
+type MySQLConfig struct {
+	// Backends are the MySQL servers; they are all primaries
+	Backends []*backend.Backend
+	PoolMode string
+	// Users maps user names to plain passwords. In transaction mode the
+	// proxy checks clients against it and logs in with it.
+	Users map[string]string
+}
+
+// mysqlCharset is the collation the proxy announces in its own greeting,
+// utf8mb4_general_ci. Clients pick theirs in the handshake response.
+const mysqlCharset = 45
+
+// defaultMySQLVersion is announced in transaction mode when no backend
+// could be asked for its version.
+const defaultMySQLVersion = "8.0.0"
+
+// mysqlOffered are the capabilities the proxy offers MySQL clients in
+// transaction mode. Leaving out CLIENT_DEPRECATE_EOF and
+// CLIENT_SESSION_TRACK keeps the answers of every pooled connection in
+// the same shape.
+const mysqlOffered = mysqlproto.ClientLongPassword | mysqlproto.ClientFoundRows | mysqlproto.ClientLongFlag |
+	mysqlproto.ClientConnectWithDB | mysqlproto.ClientLocalFiles | mysqlproto.ClientProtocol41 |
+	mysqlproto.ClientInteractive | mysqlproto.ClientTransactions | mysqlproto.ClientSecureConnection |
+	mysqlproto.ClientMultiStatements | mysqlproto.ClientMultiResults | mysqlproto.ClientPSMultiResults |
+	mysqlproto.ClientPluginAuth | mysqlproto.ClientConnectAttrs | mysqlproto.ClientPluginAuthLenencData
+
+// mysqlPooled are the client capabilities pooled connections are opened
+// with; they change what the server sends back.
+const mysqlPooled = mysqlproto.ClientFoundRows | mysqlproto.ClientLongFlag | mysqlproto.ClientLocalFiles |
+	mysqlproto.ClientInteractive | mysqlproto.ClientMultiStatements | mysqlproto.ClientMultiResults |
+	mysqlproto.ClientPSMultiResults
+
+// MySQLBackends returns the MySQL backends of the current configuration.
+func (s *Server) MySQLBackends() []*backend.Backend {
+	return s.config().MySQL.Backends
+}
+
+// HandleMySQLConnection serves one MySQL client until it disconnects.
+func (s *Server) HandleMySQLConnection(connection net.Conn) {
+	connection, ok := s.acceptProxyHeader(connection)
+	if !ok {
+		return
+	}
+	rec := s.track(connection, ProtocolMySQL)
+	defer s.untrack(rec)
+	defer rec.conn.Close()
+	defer func() {
+		metrics.SessionDuration.Observe(time.Since(rec.started).Seconds())
+	}()
+
+	//the server speaks first, so rejections go out in place of the greeting
+	client := mysqlproto.NewConn(rec.conn, rec.conn)
+	ip := remoteIP(connection)
+	if !s.config().allowed(ip) {
+		log.Printf("Connection from %v not allowed", ip)
+		rejectMySQL(client, metrics.RejectACL, mysqlproto.NewError(1130, "HY000", "Host '"+ip.String()+"' is not allowed to connect to this proxy"))
+		return
+	}
+	if err := s.limits.acquire(s.config(), ip.String()); err != nil {
+		log.Printf("Error admitting client from %v: %v", ip, err)
+		rejectMySQL(client, metrics.RejectLimit, mysqlproto.NewError(1040, "08004", "Too many connections"))
+		return
+	}
+	defer s.limits.release(ip.String())
+	if s.isDraining() {
+		rejectMySQL(client, metrics.RejectShutdown, mysqlFatal(shutdownError()))
+		return
+	}
+
+	if s.config().MySQL.PoolMode == PoolModeTransaction {
+		s.serveMySQLTransaction(rec, client)
+		return
+	}
+	s.passthroughMySQL(rec, client)
+}
+
+// rejectMySQL turns a MySQL client away with e before its session starts.
+func rejectMySQL(client *mysqlproto.Conn, reason string, e *mysqlproto.Error) {
+	metrics.ConnectionsRejected.WithLabelValues(reason).Inc()
+	client.WritePacket(e.Encode(nil))
+	client.Flush()
+}
+
+// writeMySQLError sends e to a MySQL client outside of any command, as
+// the server does when it closes a connection.
+func writeMySQLError(connection net.Conn, e *mysqlproto.Error) error {
+	c := mysqlproto.NewConn(connection, connection)
+	c.WritePacket(e.Encode(nil))
+	return c.Flush()
+}
+
+// mysqlFatal turns one of the proxy's PostgreSQL errors for a closing
+// connection into its MySQL counterpart.
+func mysqlFatal(e *pgproto.ErrorResponse) *mysqlproto.Error {
+	switch e.Code {
+	case "57P01":
+		return mysqlproto.NewError(1053, "08S01", e.Message)
+	case "57P05", "25P03":
+		return mysqlproto.NewError(4031, "HY000", e.Message)
+	}
+	return mysqlproto.NewError(1105, "HY000", e.Message)
+}
+
+// readMySQLLogin reads the client's handshake response. An SSLRequest is
+// answered by switching the connection to TLS, which the greeting only
+// offers when ClientTLS is set, and the response follows on the new
+// connection.
+func (s *Server) readMySQLLogin(rec *clientRecord, client *mysqlproto.Conn) (*mysqlproto.HandshakeResponse, net.Conn, error) {
+	var connection net.Conn = rec.conn
+	rec.waiting()
+	defer rec.busy()
+	for {
+		payload, err := client.ReadPacket()
+		if err != nil {
+			return nil, connection, err
+		}
+		if !mysqlproto.IsSSLRequest(payload) {
+			resp, err := mysqlproto.ParseHandshakeResponse(payload)
+			return resp, connection, err
+		}
+		tlsConfig := s.config().ClientTLS
+		if _, secure := connection.(*tls.Conn); tlsConfig == nil || secure {
+			return nil, connection, errors.New("unexpected SSL request")
+		}
+		//the client does not wait for an answer, so the handshake may be buffered already
+		tlsConn := tls.Server(&handshakeConn{Conn: connection, r: client.Reader()}, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, connection, fmt.Errorf("TLS handshake with %v: %w", connection.RemoteAddr(), err)
+		}
+		connection = tlsConn
+		client.Switch(tlsConn, tlsConn)
+	}
+}
+
+// handshakeConn is a connection whose reads go through r.
+type handshakeConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// admitMySQL applies the TLS requirements to a client that sent resp and
+// records who it is. It reports whether the client proved to be the user
+// with a certificate, and turns the client away if ok is false.
+func (s *Server) admitMySQL(rec *clientRecord, client *mysqlproto.Conn, connection net.Conn, resp *mysqlproto.HandshakeResponse) (certified, ok bool) {
+	secure, certified, err := clientCertificate(connection, resp.User)
+	if s.config().RequireClientTLS && !secure {
+		rejectMySQL(client, metrics.RejectTLS, mysqlproto.NewError(3159, "HY000", "Connections using insecure transport are prohibited"))
+		return false, false
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		rejectMySQL(client, metrics.RejectAuth, accessDenied(resp.User, connection, true))
+		return false, false
+	}
+	rec.setStartup(connection, resp.User, resp.Database, secure)
+	return certified, true
+}
+
+func accessDenied(user string, connection net.Conn, password bool) *mysqlproto.Error {
+	using := "NO"
+	if password {
+		using = "YES"
+	}
+	return mysqlproto.NewError(1045, "28000", fmt.Sprintf("Access denied for user '%s'@'%v' (using password: %s)", user, remoteIP(connection), using))
+}
+
+// passthroughMySQL serves a MySQL client in session mode: it gets a
+// dedicated server connection and authenticates against the server
+// directly, through the greeting the server sent.
+func (s *Server) passthroughMySQL(rec *clientRecord, client *mysqlproto.Conn) {
+	tried := map[*backend.Backend]bool{}
+	var b *backend.Backend
+	var conn *pool.Conn
+	var greeting *mysqlproto.Handshake
+	for {
+		b = s.pickBackend(s.config().MySQL.Backends, backend.RolePrimary, tried)
+		if b == nil {
+			log.Printf("No healthy MySQL backend for client %v", rec.conn.RemoteAddr())
+			rejectMySQL(client, metrics.RejectNoBackend, mysqlproto.NewError(1105, "08S01", "no healthy database server available"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.config().DialTimeout)
+		var err error
+		conn, greeting, err = pool.DialMySQL(ctx, b.Addr, s.config().serverProxyHeader(rec.conn))
+		cancel()
+		if err == nil {
+			break
+		}
+		log.Printf("Error connecting to db %s: %v", b.Addr, err)
+		if pool.IsTimeout(err) {
+			metrics.ConnectionsTimedOut.WithLabelValues(metrics.TimeoutDial).Inc()
+		}
+		tried[b] = true
+	}
+	b.Inc()
+	server := &serverConn{Conn: conn, backend: b}
+	sess := &mysqlSession{server: s, rec: rec, client: client, conn: server}
+	defer sess.close()
+	rec.setBackend(b)
+	s.setMySQLVersion(greeting.ServerVersion)
+
+	serverCaps := greeting.Capabilities
+	greeting.Capabilities &^= mysqlproto.Unsupported | mysqlproto.ClientSSL
+	if s.config().ClientTLS != nil {
+		greeting.Capabilities |= mysqlproto.ClientSSL
+	}
+	client.WritePacket(greeting.Encode(nil))
+	if err := client.Flush(); err != nil {
+		return
+	}
+	resp, connection, err := s.readMySQLLogin(rec, client)
+	if err != nil {
+		log.Printf("Error reading MySQL handshake response: %v", err)
+		metrics.ConnectionsRejected.WithLabelValues(metrics.RejectStartup).Inc()
+		return
+	}
+	sess.connection = connection
+	if _, ok := s.admitMySQL(rec, client, connection, resp); !ok {
+		return
+	}
+	sess.creds = pool.Credentials{User: resp.User, Database: resp.Database}
+
+	resp.Capabilities &^= mysqlproto.Unsupported | mysqlproto.ClientSSL
+	if tlsConfig := s.config().ServerTLS; tlsConfig != nil {
+		if serverCaps&mysqlproto.ClientSSL == 0 {
+			log.Printf("Error connecting to db %s: %v", b.Addr, pool.ErrTLSRefused)
+			rejectMySQL(client, metrics.RejectNoBackend, mysqlproto.NewError(1105, "08S01", "server connection failed"))
+			return
+		}
+		resp.Capabilities |= mysqlproto.ClientSSL
+		ctx, cancel := context.WithTimeout(context.Background(), s.config().DialTimeout)
+		err := conn.StartMySQLTLS(ctx, tlsConfig, resp)
+		cancel()
+		if err != nil {
+			log.Printf("Error connecting to db %s: %v", b.Addr, err)
+			rejectMySQL(client, metrics.RejectNoBackend, mysqlproto.NewError(1105, "08S01", "server connection failed"))
+			return
+		}
+	}
+	conn.Capabilities = resp.Capabilities
+	conn.Packets.WritePacket(resp.Encode(nil))
+	if err := conn.Packets.Flush(); err != nil {
+		log.Printf("Error forwarding handshake response: %v", err)
+		return
+	}
+	if !sess.relayAuth() {
+		return
+	}
+	rec.ready(pgproto.TxIdle)
+	rec.setMySQL(sess)
+	sess.run()
+}
+
+// relayAuth passes the authentication exchange between the client and
+// its server connection and reports whether the server let the client in.
+func (sess *mysqlSession) relayAuth() bool {
+	server := sess.conn.Packets
+	for {
+		payload, err := server.ReadPacket()
+		if err != nil || len(payload) == 0 {
+			log.Printf("Error reading authentication from server %s: %v", sess.conn.Addr, err)
+			return false
+		}
+		sess.client.WritePacket(payload)
+		if err := sess.client.Flush(); err != nil {
+			return false
+		}
+		switch {
+		case payload[0] == 0x00:
+			return true
+		case payload[0] == 0xff:
+			log.Printf("MySQL login of %q refused by %s: %v", sess.rec.user, sess.conn.Addr, mysqlproto.ParseError(payload))
+			metrics.ConnectionsRejected.WithLabelValues(metrics.RejectAuth).Inc()
+			return false
+		case len(payload) == 2 && payload[0] == 0x01 && payload[1] == mysqlproto.FastAuthOK:
+			//the OK follows without a word from the client
+			continue
+		}
+		sess.rec.waiting()
+		reply, err := sess.client.ReadPacket()
+		sess.rec.busy()
+		if err != nil {
+			return false
+		}
+		server.WritePacket(reply)
+		if err := server.Flush(); err != nil {
+			return false
+		}
+	}
+}
+
+// serveMySQLTransaction serves a MySQL client in transaction mode. The
+// proxy greets and authenticates the client itself with
+// mysql_native_password, checking it against MySQL.Users. A certified
+// client already proved who it is with a TLS client certificate and its
+// password is not checked.
+func (s *Server) serveMySQLTransaction(rec *clientRecord, client *mysqlproto.Conn) {
+	capabilities := uint32(mysqlOffered)
+	if s.config().ClientTLS != nil {
+		capabilities |= mysqlproto.ClientSSL
+	}
+	scramble := mysqlproto.NewScramble()
+	greeting := &mysqlproto.Handshake{
+		ServerVersion: s.mysqlVersion(),
+		ConnectionID:  uint32(rec.id),
+		AuthData:      scramble,
+		Capabilities:  capabilities,
+		Charset:       mysqlCharset,
+		Status:        mysqlproto.StatusAutocommit,
+		AuthPlugin:    mysqlproto.NativePassword,
+	}
+	client.WritePacket(greeting.Encode(nil))
+	if err := client.Flush(); err != nil {
+		return
+	}
+	resp, connection, err := s.readMySQLLogin(rec, client)
+	if err != nil {
+		log.Printf("Error reading MySQL handshake response: %v", err)
+		metrics.ConnectionsRejected.WithLabelValues(metrics.RejectStartup).Inc()
+		return
+	}
+	certified, ok := s.admitMySQL(rec, client, connection, resp)
+	if !ok {
+		return
+	}
+
+	auth := resp.AuthResponse
+	if resp.Capabilities&mysqlproto.ClientPluginAuth != 0 && resp.AuthPlugin != "" && resp.AuthPlugin != mysqlproto.NativePassword {
+		//the client scrambled for another plugin; ask again
+		switchTo := &mysqlproto.AuthSwitchRequest{Plugin: mysqlproto.NativePassword, AuthData: scramble}
+		client.WritePacket(switchTo.Encode(nil))
+		if err := client.Flush(); err != nil {
+			return
+		}
+		rec.waiting()
+		auth, err = client.ReadPacket()
+		rec.busy()
+		if err != nil {
+			return
+		}
+	}
+	password, known := s.config().MySQL.Users[resp.User]
+	if !certified && (!known || !mysqlproto.CheckNativePassword(scramble, password, auth)) {
+		rejectMySQL(client, metrics.RejectAuth, accessDenied(resp.User, connection, len(auth) > 0))
+		return
+	}
+	if !known {
+		//certified, but the proxy cannot log in without a password
+		rejectMySQL(client, metrics.RejectAuth, accessDenied(resp.User, connection, false))
+		return
+	}
+
+	sess := &mysqlSession{
+		server:     s,
+		rec:        rec,
+		client:     client,
+		connection: connection,
+		creds: pool.Credentials{
+			User:         resp.User,
+			Password:     password,
+			Database:     resp.Database,
+			Capabilities: resp.Capabilities & mysqlPooled,
+			Charset:      resp.Charset,
+			//pooled connections are shared, so they are the proxy's own
+			ProxyHeader: s.config().serverProxyHeader(nil),
+		},
+		pooled: true,
+	}
+	rec.setMySQL(sess)
+
+	//borrow a connection once to be sure the login works on the server
+	conn, err := sess.acquire()
+	if err != nil {
+		log.Printf("Error getting server connection for %s/%s: %v", resp.User, resp.Database, err)
+		rejectMySQL(client, metrics.RejectNoBackend, mysqlproto.NewError(1105, "08S01", "could not get a server connection"))
+		return
+	}
+	s.setMySQLVersion(conn.Params["server_version"])
+	conn.release()
+
+	welcome := &mysqlproto.OK{Status: mysqlproto.StatusAutocommit}
+	client.WritePacket(welcome.Encode(nil))
+	if err := client.Flush(); err != nil {
+		return
+	}
+	rec.ready(pgproto.TxIdle)
+	sess.run()
+}
+
+// mysqlVersion returns the version the MySQL backends announce, asking
+// one of them if no client connected yet.
+func (s *Server) mysqlVersion() string {
+	s.mu.Lock()
+	version := s.mysqlServerVersion
+	s.mu.Unlock()
+	if version != "" {
+		return version
+	}
+	b := s.pickBackend(s.config().MySQL.Backends, backend.RolePrimary, nil)
+	if b == nil {
+		return defaultMySQLVersion
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.config().DialTimeout)
+	defer cancel()
+	conn, greeting, err := pool.DialMySQL(ctx, b.Addr, s.config().serverProxyHeader(nil))
+	if err != nil {
+		log.Printf("Error connecting to db %s: %v", b.Addr, err)
+		return defaultMySQLVersion
+	}
+	conn.Close()
+	s.setMySQLVersion(greeting.ServerVersion)
+	return greeting.ServerVersion
+}
+
+func (s *Server) setMySQLVersion(version string) {
+	if version == "" {
+		return
+	}
+	s.mu.Lock()
+	s.mysqlServerVersion = version
+	s.mu.Unlock()
+}
@@ -0,0 +1,468 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/fault"
+	"github.com/mu-wahba/db-proxy-go/mysqlproto"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/pool"
+	"github.com/mu-wahba/db-proxy-go/record"
+	"github.com/mu-wahba/db-proxy-go/sqlparse"
+)
+
+// errClientGone is returned by exchange when the answer could not be
+// written to the client. The server connection is in a clean state.
+var errClientGone = errors.New("client connection lost")
+
+// mysqlSession is a logged-in MySQL client. The protocol is strictly one
+// command, one answer, so commands are relayed one at a time. In session
+// mode conn is the client's own for good; in transaction mode it is
+// borrowed for the first command after the client was idle and goes back
+// once the client is outside a transaction with no prepared statement
+// open.
+type mysqlSession struct {
+	server *Server
+	rec    *clientRecord
+	client *mysqlproto.Conn
+	// connection is the client connection, after any TLS handshake
+	connection net.Conn
+	// creds are the client's own in session mode, and what pooled
+	// connections log in with in transaction mode
+	creds  pool.Credentials
+	pooled bool
+	// recorder, if not nil, records the session, and trace follows its
+	// statements
+	recorder *record.Recorder
+	trace    *sessionTrace
+
+	// mu guards conn, which is read by other goroutines
+	mu   sync.Mutex
+	conn *serverConn
+
+	// statements counts the prepared statements open on conn
+	statements int
+	// pinned is set once the client changed session state (SET, USE,
+	// table locks, ...); from then on it keeps its server connection
+	pinned bool
+	// status is the server status of the last complete answer
+	status uint16
+}
+
+// run relays client commands until the client disconnects.
+func (sess *mysqlSession) run() {
+	defer sess.close()
+	s := sess.server
+	sess.recorder = s.config().Recorder
+	sess.recorder.StartMySQL(sess.rec.id, sess.creds.User, sess.creds.Database)
+	defer sess.recorder.End(sess.rec.id)
+	sess.trace = s.startTrace(sess.rec, sess.creds.User, sess.creds.Database)
+	defer sess.trace.end()
+	if conn := sess.serverConn(); conn != nil {
+		sess.trace.setBackend(conn.Addr)
+	}
+
+	sess.status = mysqlproto.StatusAutocommit
+	for {
+		payload, err := sess.client.ReadPacket()
+		if err != nil || len(payload) == 0 {
+			return
+		}
+		sess.rec.busy()
+		s.logMySQLCommand(payload)
+		sess.recorder.Packet(sess.rec.id, record.KindClient, payload)
+		sess.trace.mysqlCommand(payload)
+		command := payload[0]
+		if command == mysqlproto.ComQuit {
+			//the server connection outlives the client
+			return
+		}
+		payload, reply := sess.filter(payload)
+		switch {
+		case reply != nil:
+			sess.recorder.Packet(sess.rec.id, record.KindServer, reply)
+			resp := mysqlproto.NewResponse(command, 0)
+			resp.Next(reply)
+			sess.trace.mysqlAnswer(command, resp, "")
+			sess.client.WritePacket(reply)
+			if sess.client.Flush() != nil {
+				return
+			}
+			sess.ready()
+			continue
+		case payload == nil:
+			//a fault closed the client
+			return
+		}
+		if err := sess.exchange(payload); err == errClientGone {
+			return
+		} else if err != nil {
+			log.Printf("Error forwarding to server: %v", err)
+			sess.client.WritePacket(mysqlproto.NewError(1152, "08S01", "server connection failed").Encode(nil))
+			sess.client.Flush()
+			return
+		}
+	}
+}
+
+// filter strips comments from a command and puts it through the firewall
+// and the fault rules. It returns the command to send on, or a reply the
+// proxy answers it with itself; both are nil if a fault closed the client.
+func (sess *mysqlSession) filter(payload []byte) ([]byte, []byte) {
+	s := sess.server
+	command := payload[0]
+	if command == mysqlproto.ComChangeUser || mysqlproto.CommandName(command) == "COM_UNKNOWN" ||
+		(sess.pooled && command == mysqlproto.ComProcessKill) {
+		//the proxy could not follow the answer, or it means nothing on a pooled connection
+		e := mysqlproto.NewError(1235, "42000", mysqlproto.CommandName(command)+" is not supported by the proxy")
+		return nil, e.Encode(nil)
+	}
+	if command != mysqlproto.ComQuery && command != mysqlproto.ComStmtPrepare {
+		return payload, nil
+	}
+
+	sql := string(payload[1:])
+	if s.config().StripSQLComments {
+		if _, rest, ok := sqlparse.TrailingComment(sql); ok {
+			sql = rest
+			payload = append([]byte{command}, rest...)
+		}
+	}
+	if s.blocked(sess.creds.User, sess.connection, sql) {
+		return nil, mysqlproto.NewError(1227, "42000", "permission denied: statement blocked by firewall").Encode(nil)
+	}
+	if f := s.applyFault(sess.rec, sess.creds.User, sql); f != nil {
+		switch f.Kind {
+		case fault.Drop, fault.Reset:
+			return nil, nil
+		case fault.Error:
+			return nil, mysqlproto.NewError(1105, f.Code, f.Message).Encode(nil)
+		}
+	}
+	if sess.pooled && command == mysqlproto.ComQuery {
+		if reply := sess.kill(sql); reply != nil {
+			return nil, reply
+		}
+	}
+	return payload, nil
+}
+
+// exchange sends a command to the server and relays the answer. In
+// transaction mode it borrows a connection first if the session holds
+// none, and gives it back if the answer leaves the client idle.
+func (sess *mysqlSession) exchange(payload []byte) error {
+	conn, err := sess.hold()
+	if err != nil {
+		return err
+	}
+	command := payload[0]
+	server := conn.Packets
+	server.ResetSeq()
+	server.WritePacket(payload)
+	if err := server.Flush(); err != nil {
+		return err
+	}
+	if !mysqlproto.Expected(command) {
+		if command == mysqlproto.ComStmtClose && sess.statements > 0 {
+			sess.statements--
+		}
+		sess.settle(conn)
+		return nil
+	}
+
+	//write errors stick in the client's buffer; the answer is read to the
+	//end regardless so the server connection stays usable
+	resp := mysqlproto.NewResponse(command, conn.Capabilities)
+	for {
+		packet, err := server.ReadPacket()
+		if err != nil {
+			return err
+		}
+		done, err := resp.Next(packet)
+		if err != nil {
+			return err
+		}
+		sess.recorder.Packet(sess.rec.id, record.KindServer, packet)
+		sess.client.WritePacket(packet)
+		if done {
+			break
+		}
+		if resp.WantsData() {
+			if err := sess.sendFile(server); err != nil {
+				return err
+			}
+			continue
+		}
+		if server.Buffered() == 0 {
+			sess.client.Flush()
+		}
+	}
+	sess.server.logMySQLResponse(resp)
+	sess.trace.mysqlAnswer(command, resp, conn.Addr)
+
+	switch command {
+	case mysqlproto.ComQuery:
+		if mysqlSessionState(string(payload[1:])) {
+			sess.pinned = true
+		}
+	case mysqlproto.ComStmtPrepare:
+		if resp.Err == nil {
+			sess.statements++
+			if mysqlSessionState(string(payload[1:])) {
+				sess.pinned = true
+			}
+		}
+	case mysqlproto.ComInitDB:
+		sess.pinned = true
+	case mysqlproto.ComResetConnection:
+		if resp.Err == nil {
+			sess.statements = 0
+			sess.pinned = false
+		}
+	}
+	//a prepared statement or COM_STATISTICS answer carries no status
+	if resp.Err == nil && command != mysqlproto.ComStmtPrepare && command != mysqlproto.ComStatistics {
+		sess.status = resp.Status
+	}
+	sess.settle(conn)
+	if err := sess.client.Flush(); err != nil {
+		return errClientGone
+	}
+	return nil
+}
+
+// sendFile relays the file the client sends for a LOAD DATA LOCAL INFILE,
+// which ends with an empty packet.
+func (sess *mysqlSession) sendFile(server *mysqlproto.Conn) error {
+	if err := sess.client.Flush(); err != nil {
+		return errClientGone
+	}
+	for {
+		packet, err := sess.client.ReadPacket()
+		if err != nil {
+			return errClientGone
+		}
+		sess.recorder.Packet(sess.rec.id, record.KindClient, packet)
+		server.WritePacket(packet)
+		if len(packet) == 0 {
+			return server.Flush()
+		}
+	}
+}
+
+// hold returns the session's server connection, borrowing one first in
+// transaction mode if it holds none.
+func (sess *mysqlSession) hold() (*serverConn, error) {
+	if conn := sess.serverConn(); conn != nil {
+		return conn, nil
+	}
+	conn, err := sess.acquire()
+	if err != nil {
+		return nil, err
+	}
+	sess.mu.Lock()
+	sess.conn = conn
+	sess.mu.Unlock()
+	return conn, nil
+}
+
+// acquire borrows a pooled connection for the session's credentials.
+func (sess *mysqlSession) acquire() (*serverConn, error) {
+	s := sess.server
+	return s.borrow(s.config().MySQL.Backends, []string{backend.RolePrimary}, sess.creds, pool.ConnectMySQL)
+}
+
+// settle notes that the client is waiting for its next command and, in
+// transaction mode, gives conn back if nothing ties the client to it.
+func (sess *mysqlSession) settle(conn *serverConn) {
+	sess.ready()
+	if !sess.pooled || sess.status&mysqlproto.StatusInTrans != 0 || sess.statements > 0 || sess.pinned {
+		return
+	}
+	sess.mu.Lock()
+	sess.conn = nil
+	sess.mu.Unlock()
+	conn.release()
+}
+
+// ready tells the client's bookkeeping whether it is in a transaction.
+func (sess *mysqlSession) ready() {
+	if sess.status&mysqlproto.StatusInTrans != 0 {
+		sess.rec.ready(pgproto.TxActive)
+		return
+	}
+	sess.rec.ready(pgproto.TxIdle)
+}
+
+// serverConn returns the connection the client currently holds, if any.
+func (sess *mysqlSession) serverConn() *serverConn {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.conn
+}
+
+// close gives back the server connection when the client leaves. In
+// session mode it is closed; in transaction mode one the client still
+// holds cannot be handed to anyone else and is closed too, which rolls
+// back what the client left open.
+func (sess *mysqlSession) close() {
+	sess.mu.Lock()
+	conn := sess.conn
+	sess.conn = nil
+	sess.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	if sess.pooled {
+		conn.discard()
+		return
+	}
+	//say goodbye, or the server counts an aborted connection
+	conn.Packets.ResetSeq()
+	conn.Packets.WritePacket([]byte{mysqlproto.ComQuit})
+	conn.Packets.Flush()
+	conn.Close()
+	conn.backend.Dec()
+}
+
+// kill answers KILL [QUERY | CONNECTION] id in transaction mode, where
+// clients know each other by the connection ids the proxy hands out
+// rather than the server's. It returns nil if sql is something else.
+func (sess *mysqlSession) kill(sql string) []byte {
+	tokens := sqlparse.Lex(sql)
+	if n := len(tokens); n > 0 && tokens[n-1].Kind == sqlparse.Punct && tokens[n-1].Text == ";" {
+		tokens = tokens[:n-1]
+	}
+	if len(tokens) < 2 || !tokens[0].Is("KILL") {
+		return nil
+	}
+	query := tokens[1].Is("QUERY")
+	if query || tokens[1].Is("CONNECTION") {
+		tokens = tokens[1:]
+	}
+	if len(tokens) != 2 || tokens[1].Kind != sqlparse.Number {
+		return nil
+	}
+	id, err := strconv.ParseUint(tokens[1].Text, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	s := sess.server
+	s.mu.Lock()
+	target := s.clients[id]
+	s.mu.Unlock()
+	if target == nil || target.protocol != ProtocolMySQL {
+		return mysqlproto.NewError(1094, "HY000", fmt.Sprintf("Unknown thread id: %d", id)).Encode(nil)
+	}
+	target.mu.Lock()
+	user, other := target.user, target.mysql
+	target.mu.Unlock()
+	if user != sess.creds.User {
+		return mysqlproto.NewError(1095, "HY000", fmt.Sprintf("You are not owner of thread %d", id)).Encode(nil)
+	}
+	if !query {
+		target.conn.Close()
+	} else if other != nil {
+		if conn := other.serverConn(); conn != nil {
+			s.killMySQLQuery(conn, other.creds)
+		}
+	}
+	ok := &mysqlproto.OK{Status: sess.status}
+	return ok.Encode(nil)
+}
+
+// killMySQLQuery stops the statement running on conn, from a connection
+// of its own.
+func (s *Server) killMySQLQuery(conn *serverConn, creds pool.Credentials) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	creds.ProxyHeader = s.config().serverProxyHeader(nil)
+	db, err := pool.ConnectMySQL(ctx, conn.Addr, creds, s.config().ServerTLS)
+	if err != nil {
+		log.Printf("Error connecting to db for KILL QUERY: %v", err)
+		return
+	}
+	defer db.Close()
+	deadline, _ := ctx.Deadline()
+	db.SetDeadline(deadline)
+	db.Packets.ResetSeq()
+	db.Packets.WritePacket(append([]byte{mysqlproto.ComQuery}, "KILL QUERY "+strconv.FormatUint(uint64(conn.ConnectionID), 10)...))
+	if err := db.Packets.Flush(); err != nil {
+		log.Printf("Error forwarding KILL QUERY: %v", err)
+		return
+	}
+	answer, err := db.Packets.ReadPacket()
+	if err == nil && len(answer) > 0 && answer[0] == 0xff {
+		err = mysqlproto.ParseError(answer)
+	}
+	if err != nil {
+		log.Printf("Error forwarding KILL QUERY: %v", err)
+	}
+}
+
+// mysqlSessionState reports whether sql leaves state behind on a MySQL
+// server connection: besides what sqlparse knows of, USE, table locks,
+// HANDLER and named locks.
+func mysqlSessionState(sql string) bool {
+	for _, st := range sqlparse.Parse(sql) {
+		if st.SessionState {
+			return true
+		}
+		switch st.Command {
+		case "USE", "LOCK", "HANDLER":
+			return true
+		}
+		for i, t := range st.Tokens {
+			if t.Is("GET_LOCK") && i+1 < len(st.Tokens) && st.Tokens[i+1].Text == "(" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// logMySQLCommand prints a client command when protocol logging is on.
+func (s *Server) logMySQLCommand(payload []byte) {
+	if !s.config().LogProtocol {
+		return
+	}
+	name := mysqlproto.CommandName(payload[0])
+	switch payload[0] {
+	case mysqlproto.ComQuery, mysqlproto.ComStmtPrepare, mysqlproto.ComInitDB:
+		log.Printf("client: %s %q", name, payload[1:])
+	case mysqlproto.ComStmtExecute, mysqlproto.ComStmtSendLong, mysqlproto.ComStmtClose, mysqlproto.ComStmtReset, mysqlproto.ComStmtFetch:
+		if len(payload) >= 5 {
+			log.Printf("client: %s statement=%d", name, binary.LittleEndian.Uint32(payload[1:]))
+			break
+		}
+		log.Printf("client: %s", name)
+	default:
+		log.Printf("client: %s", name)
+	}
+}
+
+// logMySQLResponse prints how the server answered a command when
+// protocol logging is on.
+func (s *Server) logMySQLResponse(resp *mysqlproto.Response) {
+	if !s.config().LogProtocol {
+		return
+	}
+	if resp.Err != nil {
+		log.Printf("server: ERR %v", resp.Err)
+		return
+	}
+	if resp.StatementID != 0 {
+		log.Printf("server: OK statement=%d", resp.StatementID)
+		return
+	}
+	log.Printf("server: OK status=0x%04x rows=%d", resp.Status, resp.Rows)
+}
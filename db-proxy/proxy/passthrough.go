@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/pool"
+	"github.com/mu-wahba/db-proxy-go/record"
+)
+
+// passthrough serves a client in session mode: it gets a dedicated server
+// connection and authenticates against the server directly. With
+// ProxyAuth the client logs in to the proxy instead, which logs in to the
+// server for it; certified is as for login.
+func (s *Server) passthrough(rec *clientRecord, connection net.Conn, client *bufio.Reader, startup *pgproto.StartupMessage, certified bool) {
+	user := startup.Parameters["user"]
+	var creds *pool.Credentials
+	if s.config().ProxyAuth {
+		password, ok := s.login(rec, connection, client, user, certified)
+		if !ok {
+			return
+		}
+		creds = s.sessionCredentials(startup, password)
+		creds.ProxyHeader = s.config().serverProxyHeader(connection)
+	}
+
+	//connect to actul db server, moving on to the next backend if one is down
+	tried := map[*backend.Backend]bool{}
+	var b *backend.Backend
+	var db net.Conn
+	var dbR *bufio.Reader
+	var loggedIn *pool.Conn
+	for {
+		b = s.pickBackend(s.config().Backends, backend.RolePrimary, tried)
+		if b == nil {
+			log.Printf("No healthy backend for client %v", connection.RemoteAddr())
+			reject(connection, metrics.RejectNoBackend, fatal("08006", "no healthy database server available"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.config().DialTimeout)
+		var err error
+		if creds != nil {
+			if loggedIn, err = pool.Connect(ctx, b.Addr, *creds, s.config().ServerTLS); err == nil {
+				db, dbR = loggedIn.Conn, loggedIn.Reader
+			}
+		} else if db, err = pool.Dial(ctx, b.Addr, s.config().serverProxyHeader(connection), s.config().ServerTLS); err == nil {
+			dbR = bufio.NewReader(db)
+		}
+		cancel()
+		if err == nil {
+			break
+		}
+		log.Printf("Error connecting to db %s: %v", b.Addr, err)
+		var e *pgproto.ErrorResponse
+		if errors.As(err, &e) {
+			//the server refused the login; the others would too
+			reject(connection, metrics.RejectNoBackend, fatal("08006", "could not get a server connection"))
+			return
+		}
+		if pool.IsTimeout(err) {
+			metrics.ConnectionsTimedOut.WithLabelValues(metrics.TimeoutDial).Inc()
+		}
+		tried[b] = true
+	}
+	b.Inc()
+	defer b.Dec()
+	rec.setBackend(b)
+
+	defer db.Close()
+
+	//recording starts once the login is over, so no password gets written
+	recorder := s.config().Recorder
+	var recording int32
+	if loggedIn != nil {
+		s.registerBackendKey(loggedIn.Key, b)
+		defer s.unregisterBackendKey(loggedIn.Key)
+		if err := pgproto.Write(connection, loginComplete(loggedIn.Params, loggedIn.Key)...); err != nil {
+			return
+		}
+		rec.ready(pgproto.TxIdle)
+		recording = 1
+		recorder.Start(rec.id, user, creds.Database)
+	} else if err := pgproto.Write(db, startup); err != nil {
+		log.Printf("Error forwarding startup message: %v", err)
+		return
+	}
+	tr := s.startTrace(rec, user, startup.Parameters["database"])
+	tr.setBackend(b.Addr)
+	defer tr.end()
+	//the shadow needs the user's password, which the server checked
+	var sh *shadowSession
+	if creds != nil {
+		sh = s.startShadow(user, *creds)
+	} else if password, ok := s.config().Users[user]; ok {
+		sh = s.startShadow(user, *s.sessionCredentials(startup, password))
+	}
+	defer sh.end()
+
+	go func() {
+		//from client to db in seperate
+		s.pipeMessages(db, client, pgproto.ReadFrontendMessage, "client", func(msg pgproto.Message) pgproto.Message {
+			rec.busy()
+			if atomic.LoadInt32(&recording) == 1 {
+				recorder.Message(rec.id, record.KindClient, msg)
+			}
+			tr.client(msg)
+			msg = s.screen(user, connection, s.stripComment(msg))
+			sh.client(msg)
+			return s.injectFault(rec, user, msg)
+		})
+		db.Close()
+	}()
+
+	var key *pgproto.BackendKeyData
+	s.pipeMessages(connection, dbR, pgproto.ReadBackendMessage, "server", func(msg pgproto.Message) pgproto.Message {
+		msg = s.unscreen(msg)
+		if atomic.LoadInt32(&recording) == 1 {
+			recorder.Message(rec.id, record.KindServer, msg)
+		}
+		tr.server(msg, b.Addr)
+		sh.server(msg)
+		switch m := msg.(type) {
+		case *pgproto.BackendKeyData:
+			key = m
+			s.registerBackendKey(*m, b)
+		case *pgproto.Authentication:
+			if m.Type != pgproto.AuthOK {
+				rec.waiting()
+			}
+		case *pgproto.ReadyForQuery:
+			//a shutdown may let the client go while it is idle
+			rec.ready(m.TxStatus)
+			if atomic.CompareAndSwapInt32(&recording, 0, 1) {
+				recorder.Start(rec.id, user, startup.Parameters["database"])
+			}
+		}
+		return msg
+	})
+	if key != nil {
+		s.unregisterBackendKey(*key)
+	}
+	if atomic.LoadInt32(&recording) == 1 {
+		recorder.End(rec.id)
+	}
+}
+
+// sessionCredentials returns what the proxy logs in to a server with for
+// a session-mode client that sent startup and has password in the user
+// list.
+func (s *Server) sessionCredentials(startup *pgproto.StartupMessage, password string) *pool.Credentials {
+	user := startup.Parameters["user"]
+	creds := &pool.Credentials{Database: startup.Parameters["database"], Options: map[string]string{}}
+	creds.User, creds.Password = s.config().serverLogin(user, password)
+	if creds.Database == "" {
+		creds.Database = user
+	}
+	for name, value := range startup.Parameters {
+		if name != "user" && name != "database" {
+			creds.Options[name] = value
+		}
+	}
+	return creds
+}
+
+// pipeMessages decodes messages from src and writes them to dst until
+// either side fails, passing each one through filter if it is not nil;
+// filter returns the message to write in its place, or nil to write
+// nothing. Output
+// is buffered and flushed whenever src has nothing more queued, so a burst
+// of DataRows goes out in one write.
+func (s *Server) pipeMessages(dst io.Writer, src *bufio.Reader, read func(io.Reader) (pgproto.Message, error), from string, filter func(pgproto.Message) pgproto.Message) error {
+	w := bufio.NewWriter(dst)
+	var buf []byte
+	for {
+		msg, err := read(src)
+		if err != nil {
+			return err
+		}
+		s.logMessage(from, msg)
+		if filter != nil {
+			if msg = filter(msg); msg == nil {
+				continue
+			}
+		}
+
+		buf = msg.Encode(buf[:0])
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		if src.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// logMessage prints the interesting messages when protocol logging is on.
+func (s *Server) logMessage(from string, msg pgproto.Message) {
+	if !s.config().LogProtocol {
+		return
+	}
+	switch m := msg.(type) {
+	case *pgproto.Query:
+		log.Printf("%s: Query %q", from, m.String)
+	case *pgproto.Parse:
+		log.Printf("%s: Parse %q %q", from, m.Name, m.Query)
+	case *pgproto.Bind:
+		log.Printf("%s: Bind portal=%q statement=%q params=%d", from, m.Portal, m.Statement, len(m.Parameters))
+	case *pgproto.Execute:
+		log.Printf("%s: Execute portal=%q", from, m.Portal)
+	case *pgproto.ErrorResponse:
+		log.Printf("%s: ErrorResponse %v", from, m)
+	case *pgproto.ReadyForQuery:
+		log.Printf("%s: ReadyForQuery %c", from, m.TxStatus)
+	case *pgproto.CommandComplete:
+		log.Printf("%s: CommandComplete %q", from, m.Tag)
+	}
+}
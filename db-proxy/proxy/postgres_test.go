@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+)
+
+// fakePostgres is a PostgreSQL server for tests. It logs everyone in
+// without a password and answers each statement with the rows answer
+// returns for it, in one text column, or with a command tag if answer
+// returns nil.
+type fakePostgres struct {
+	addr   string
+	answer func(sql string) []string
+	// hold, if not nil, holds up every answer until it is closed
+	hold chan struct{}
+
+	mu       sync.Mutex
+	received []fakeStatement
+}
+
+// fakeStatement is a statement the fake server ran and when it came in.
+type fakeStatement struct {
+	sql string
+	at  time.Time
+}
+
+func startFakePostgres(t *testing.T, answer func(sql string) []string) *fakePostgres {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakePostgres{addr: l.Addr().String(), answer: answer}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+	})
+	go func() {
+		for id := uint32(1); ; id++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+			go f.serve(c, id)
+		}
+	}()
+	return f
+}
+
+// statements returns the statements run so far and forgets them.
+func (f *fakePostgres) statements() []fakeStatement {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	received := f.received
+	f.received = nil
+	return received
+}
+
+func (f *fakePostgres) serve(c net.Conn, id uint32) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		msg, err := pgproto.ReadStartupMessage(r)
+		if err != nil {
+			return
+		}
+		if _, ok := msg.(*pgproto.StartupMessage); ok {
+			break
+		}
+		//no TLS here
+		c.Write([]byte{'N'})
+	}
+	w := bufio.NewWriter(c)
+	pgproto.Write(w, &pgproto.Authentication{Type: pgproto.AuthOK},
+		&pgproto.ParameterStatus{Name: "server_version", Value: "16.0"},
+		&pgproto.BackendKeyData{ProcessID: id, SecretKey: id},
+		&pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle})
+	w.Flush()
+
+	tx := byte(pgproto.TxIdle)
+	statements := map[string]string{}
+	portal := ""
+	for {
+		msg, err := pgproto.ReadFrontendMessage(r)
+		if err != nil {
+			return
+		}
+		switch m := msg.(type) {
+		case *pgproto.Query:
+			tx = f.run(w, m.String, tx, true)
+			pgproto.Write(w, &pgproto.ReadyForQuery{TxStatus: tx})
+			w.Flush()
+		case *pgproto.Parse:
+			statements[m.Name] = m.Query
+			pgproto.Write(w, &pgproto.ParseComplete{})
+		case *pgproto.Bind:
+			portal = statements[m.Statement]
+			pgproto.Write(w, &pgproto.BindComplete{})
+		case *pgproto.Describe:
+			pgproto.Write(w, &pgproto.NoData{})
+		case *pgproto.Execute:
+			tx = f.run(w, portal, tx, false)
+		case *pgproto.Sync:
+			pgproto.Write(w, &pgproto.ReadyForQuery{TxStatus: tx})
+			w.Flush()
+		case *pgproto.Flush:
+			w.Flush()
+		case *pgproto.Terminate:
+			return
+		}
+	}
+}
+
+// run answers sql, with a RowDescription first for a simple query, and
+// returns the transaction status after it.
+func (f *fakePostgres) run(w *bufio.Writer, sql string, tx byte, describe bool) byte {
+	f.mu.Lock()
+	f.received = append(f.received, fakeStatement{sql: sql, at: time.Now()})
+	f.mu.Unlock()
+	if f.hold != nil {
+		<-f.hold
+	}
+
+	rows := f.answer(sql)
+	if rows == nil {
+		command := strings.ToUpper(strings.Fields(sql + " x")[0])
+		switch command {
+		case "BEGIN":
+			tx = pgproto.TxActive
+		case "COMMIT", "ROLLBACK":
+			tx = pgproto.TxIdle
+		}
+		pgproto.Write(w, &pgproto.CommandComplete{Tag: command})
+		return tx
+	}
+	if describe {
+		pgproto.Write(w, &pgproto.RowDescription{Fields: []pgproto.FieldDescription{{Name: "a", DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1}}})
+	}
+	for _, row := range rows {
+		pgproto.Write(w, &pgproto.DataRow{Values: [][]byte{[]byte(row)}})
+	}
+	pgproto.Write(w, &pgproto.CommandComplete{Tag: "SELECT " + strconv.Itoa(len(rows))})
+	return tx
+}
+
+// selectAnswer answers SELECT statements with one row holding what
+// follows SELECT, and everything else with a command tag.
+func selectAnswer(sql string) []string {
+	if rest := strings.TrimPrefix(sql, "SELECT "); rest != sql {
+		return []string{rest}
+	}
+	return nil
+}
+
+// startProxy serves PostgreSQL clients with cfg, on backends for addrs,
+// and returns the server and the address to connect to.
+func startProxy(t *testing.T, cfg Config, addrs ...string) (*Server, string) {
+	t.Helper()
+	for _, addr := range addrs {
+		cfg.Backends = append(cfg.Backends, &backend.Backend{Addr: addr, Weight: 1, Role: backend.RolePrimary})
+	}
+	if cfg.Balancer == nil {
+		cfg.Balancer, _ = backend.NewBalancer(backend.RoundRobin)
+	}
+	if cfg.PoolMode == "" {
+		cfg.PoolMode = PoolModeSession
+	}
+	if cfg.PoolSize == 0 {
+		cfg.PoolSize = 10
+	}
+	if cfg.PoolWaitTimeout == 0 {
+		cfg.PoolWaitTimeout = 5 * time.Second
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	s := NewServer(cfg)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.HandleConnection(c)
+		}
+	}()
+	return s, l.Addr().String()
+}
+
+// waitClients waits until the proxy has n clients.
+func waitClients(t *testing.T, s *Server, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		s.mu.Lock()
+		clients := len(s.clients)
+		s.mu.Unlock()
+		if clients == n {
+			return
+		}
+	}
+	t.Fatalf("proxy never got to %d clients", n)
+}
+
+// pgClient is a PostgreSQL client for tests.
+type pgClient struct {
+	t *testing.T
+	net.Conn
+	r *bufio.Reader
+}
+
+// dialPostgres logs in to addr as user, with no password, and waits for
+// the first ReadyForQuery.
+func dialPostgres(t *testing.T, addr, user string) *pgClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &pgClient{t: t, Conn: conn, r: bufio.NewReader(conn)}
+	c.send(&pgproto.StartupMessage{ProtocolVersion: pgproto.ProtocolVersion3, Parameters: map[string]string{"user": user, "database": "db"}})
+	c.ready()
+	return c
+}
+
+func (c *pgClient) send(msgs ...pgproto.Message) {
+	c.t.Helper()
+	if err := pgproto.Write(c.Conn, msgs...); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// ready reads up to the next ReadyForQuery and returns what came before
+// it, failing the test on an error or if nothing comes within a few
+// seconds.
+func (c *pgClient) ready() []pgproto.Message {
+	c.t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msgs []pgproto.Message
+	for {
+		msg, err := pgproto.ReadBackendMessage(c.r)
+		if err != nil {
+			c.t.Fatalf("waiting for ReadyForQuery: %v", err)
+		}
+		switch m := msg.(type) {
+		case *pgproto.ErrorResponse:
+			if m.Severity == "FATAL" {
+				c.t.Fatalf("%s %s", m.Code, m.Message)
+			}
+		case *pgproto.ReadyForQuery:
+			return msgs
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// query runs sql and returns the values of the rows it got.
+func (c *pgClient) query(sql string) []string {
+	c.t.Helper()
+	c.send(&pgproto.Query{String: sql})
+	var rows []string
+	for _, msg := range c.ready() {
+		if row, ok := msg.(*pgproto.DataRow); ok {
+			rows = append(rows, string(row.Values[0]))
+		}
+	}
+	return rows
+}
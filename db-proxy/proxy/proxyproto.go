@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/proxyproto"
+)
+
+// proxyHeaderTimeout bounds how long a load balancer may take to send the
+// PROXY header of a connection.
+const proxyHeaderTimeout = 10 * time.Second
+
+// acceptProxyHeader reads the PROXY header a load balancer sends ahead of
+// a client connection, if the configuration expects one from where the
+// connection comes from, and returns the connection with the addresses of
+// the original client. A connection without a valid header is closed.
+func (s *Server) acceptProxyHeader(connection net.Conn) (net.Conn, bool) {
+	cfg := s.config()
+	if !cfg.ProxyProtocol {
+		return connection, true
+	}
+	if len(cfg.ProxyProtocolFrom) > 0 && !inNetworks(cfg.ProxyProtocolFrom, remoteIP(connection)) {
+		//not from a load balancer, so the client itself
+		return connection, true
+	}
+	connection.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	src, dst, err := proxyproto.ReadHeader(connection)
+	connection.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("Error reading PROXY header from %v: %v", connection.RemoteAddr(), err)
+		metrics.ConnectionsRejected.WithLabelValues(metrics.RejectProxyProtocol).Inc()
+		connection.Close()
+		return nil, false
+	}
+	if src == nil {
+		//the load balancer's own connection, e.g. a health check
+		return connection, true
+	}
+	log.Printf("Connection from %v through %v", src, connection.RemoteAddr())
+	return &proxyproto.Conn{Conn: connection, Source: src, Destination: dst}, true
+}
+
+// serverProxyHeader returns the PROXY header to send ahead of a server
+// connection opened for client, or for the proxy itself if client is nil,
+// or nil if no header is to be sent.
+func (c *Config) serverProxyHeader(client net.Conn) []byte {
+	if c.ServerProxyProtocol == 0 {
+		return nil
+	}
+	if client == nil {
+		return proxyproto.Header(c.ServerProxyProtocol, nil, nil)
+	}
+	return proxyproto.Header(c.ServerProxyProtocol, client.RemoteAddr(), client.LocalAddr())
+}
+
+func inNetworks(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/record"
+)
+
+// A session recorded through the proxy replays with the same messages and
+// the recorded timing.
+func TestRecordReplay(t *testing.T) {
+	fake := startFakePostgres(t, selectAnswer)
+	path := filepath.Join(t.TempDir(), "rec.jsonl")
+	recorder, err := record.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr := startProxy(t, Config{Recorder: recorder}, fake.addr)
+
+	const pause = 200 * time.Millisecond
+	c := dialPostgres(t, addr, "app")
+	if rows := c.query("SELECT 1"); !reflect.DeepEqual(rows, []string{"1"}) {
+		t.Fatalf("SELECT 1 = %q", rows)
+	}
+	time.Sleep(pause)
+	c.send(&pgproto.Parse{Name: "s1", Query: "SELECT 2"}, &pgproto.Bind{Statement: "s1"}, &pgproto.Execute{}, &pgproto.Sync{})
+	c.ready()
+	c.query("UPDATE t SET a = 1")
+	c.send(&pgproto.Terminate{})
+	c.Close()
+	waitClients(t, s, 0)
+	recorder.Close()
+
+	sessions, err := record.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].User != "app" || sessions[0].Database != "db" {
+		t.Fatalf("recorded sessions %+v", sessions)
+	}
+	var kinds []string
+	for _, e := range sessions[0].Events {
+		var msg pgproto.Message
+		if e.Kind == record.KindClient {
+			msg, err = pgproto.ReadFrontendMessage(strings.NewReader(string(e.Message)))
+		} else {
+			msg, err = pgproto.ReadBackendMessage(strings.NewReader(string(e.Message)))
+		}
+		if err != nil {
+			t.Fatalf("recorded %s message: %v", e.Kind, err)
+		}
+		kinds = append(kinds, e.Kind[:1]+strings.TrimPrefix(fmt.Sprintf("%T", msg), "*pgproto."))
+	}
+	want := []string{
+		"cQuery", "sRowDescription", "sDataRow", "sCommandComplete", "sReadyForQuery",
+		"cParse", "cBind", "cExecute", "cSync", "sParseComplete", "sBindComplete", "sDataRow", "sCommandComplete", "sReadyForQuery",
+		"cQuery", "sCommandComplete", "sReadyForQuery",
+		"cTerminate",
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("recorded %v\nwant %v", kinds, want)
+	}
+	fake.statements()
+
+	//at the recorded speed the pause is kept
+	results := record.Replay(sessions, record.Options{Addr: fake.addr, Speed: 1, Timeout: 5 * time.Second})
+	if res := results[0]; res.Err != nil || res.Batches != 3 || res.Differences != 0 {
+		t.Fatalf("replay: %d responses, %d differences %q, error %v", res.Batches, res.Differences, res.Diffs, res.Err)
+	}
+	replayed := fake.statements()
+	var sqls []string
+	for _, st := range replayed {
+		sqls = append(sqls, st.sql)
+	}
+	if want := []string{"SELECT 1", "SELECT 2", "UPDATE t SET a = 1"}; !reflect.DeepEqual(sqls, want) {
+		t.Fatalf("replayed %q, want %q", sqls, want)
+	}
+	if gap := replayed[1].at.Sub(replayed[0].at); gap < pause*9/10 {
+		t.Errorf("replayed at speed 1 %v apart, recorded %v apart", gap, pause)
+	}
+
+	//at speed 0 nothing waits
+	record.Replay(sessions, record.Options{Addr: fake.addr, Timeout: 5 * time.Second})
+	replayed = fake.statements()
+	if gap := replayed[1].at.Sub(replayed[0].at); gap >= pause/2 {
+		t.Errorf("replayed at speed 0 %v apart", gap)
+	}
+
+	//a server that answers differently is reported
+	fake.answer = func(sql string) []string {
+		if sql == "SELECT 2" {
+			return []string{"two"}
+		}
+		return selectAnswer(sql)
+	}
+	res := record.Replay(sessions, record.Options{Addr: fake.addr, Timeout: 5 * time.Second})[0]
+	if res.Err != nil || res.Differences != 1 || len(res.Diffs) != 1 ||
+		res.Diffs[0] != `response 2 (SELECT 2): recorded DataRow("2"), got DataRow("two")` {
+		t.Errorf("replay against another answer: %d differences %q, error %v", res.Differences, res.Diffs, res.Err)
+	}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/pool"
+	"github.com/mu-wahba/db-proxy-go/resp"
+)
+
+// RedisConfig controls how Redis clients are served. The access lists,
+// limits and timeouts of Config apply to them as well.
+type RedisConfig struct {
+	// Backends are the Redis servers, primaries and replicas
+	Backends []*backend.Backend
+	// ReadFromReplicas sends commands that only read data to a replica,
+	// outside MULTI and WATCH
+	ReadFromReplicas bool
+	// Blocked holds the commands clients may not run, in lower case: a
+	// command name, such as "flushall", or a name and a subcommand, such
+	// as "config set". Only commands clients send are checked, not those
+	// scripts and functions run: EVAL and FCALL get past a blocked command
+	// unless they are blocked too.
+	Blocked map[string]bool
+}
+
+// RedisBackends returns the Redis backends of the current configuration.
+func (s *Server) RedisBackends() []*backend.Backend {
+	return s.config().Redis.Backends
+}
+
+// HandleRedisConnection serves one Redis client until it disconnects. The
+// client gets a connection to a primary of its own, and one to a replica
+// as well once it reads something with ReadFromReplicas set.
+func (s *Server) HandleRedisConnection(connection net.Conn) {
+	connection, ok := s.acceptProxyHeader(connection)
+	if !ok {
+		return
+	}
+	rec := s.track(connection, ProtocolRedis)
+	defer s.untrack(rec)
+	defer rec.conn.Close()
+	defer func() {
+		metrics.SessionDuration.Observe(time.Since(rec.started).Seconds())
+	}()
+
+	//clients speak first, so a rejection is what they read in answer
+	ip := remoteIP(connection)
+	if !s.config().allowed(ip) {
+		log.Printf("Connection from %v not allowed", ip)
+		rejectRedis(rec.conn, metrics.RejectACL, "ERR connection from "+ip.String()+" not allowed")
+		return
+	}
+	if err := s.limits.acquire(s.config(), ip.String()); err != nil {
+		log.Printf("Error admitting client from %v: %v", ip, err)
+		rejectRedis(rec.conn, metrics.RejectLimit, "ERR max number of clients reached")
+		return
+	}
+	defer s.limits.release(ip.String())
+	if s.isDraining() {
+		rejectRedis(rec.conn, metrics.RejectShutdown, "ERR "+shutdownError().Message)
+		return
+	}
+
+	primary, err := s.dialRedis(backend.RolePrimary, rec.conn)
+	if err != nil {
+		log.Printf("No healthy Redis backend for client %v", rec.conn.RemoteAddr())
+		rejectRedis(rec.conn, metrics.RejectNoBackend, "ERR no healthy database server available")
+		return
+	}
+	sess := &redisSession{
+		server:   s,
+		rec:      rec,
+		clientR:  bufio.NewReader(rec.conn),
+		clientW:  bufio.NewWriter(rec.conn),
+		primary:  primary,
+		user:     redisDefaultUser,
+		database: "0",
+	}
+	defer sess.close()
+	//Redis has a default user and database until AUTH and SELECT
+	rec.setStartup(rec.conn, sess.user, sess.database, false)
+	rec.setBackend(primary.backend)
+	rec.ready(pgproto.TxIdle)
+	sess.run()
+}
+
+// redisDefaultUser is who a Redis client is before it authenticates.
+const redisDefaultUser = "default"
+
+// rejectRedis turns a Redis client away with an error before its session
+// starts.
+func rejectRedis(connection net.Conn, reason, msg string) {
+	metrics.ConnectionsRejected.WithLabelValues(reason).Inc()
+	writeRedisError(connection, msg)
+}
+
+// writeRedisError sends an error to a Redis client outside of any command,
+// as the server does when it closes a connection.
+func writeRedisError(connection net.Conn, msg string) error {
+	_, err := connection.Write(resp.AppendError(nil, msg))
+	return err
+}
+
+// dialRedis opens a connection to a Redis backend with role for client,
+// trying every healthy one until one can be reached.
+func (s *Server) dialRedis(role string, client net.Conn) (*serverConn, error) {
+	tried := map[*backend.Backend]bool{}
+	for {
+		b := s.pickBackend(s.config().Redis.Backends, role, tried)
+		if b == nil {
+			return nil, errNoBackend
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.config().DialTimeout)
+		conn, err := pool.DialRedis(ctx, b.Addr, s.config().serverProxyHeader(client), s.config().ServerTLS)
+		cancel()
+		if err == nil {
+			b.Inc()
+			return &serverConn{Conn: conn, backend: b}, nil
+		}
+		log.Printf("Error connecting to db %s: %v", b.Addr, err)
+		if pool.IsTimeout(err) {
+			metrics.ConnectionsTimedOut.WithLabelValues(metrics.TimeoutDial).Inc()
+		}
+		tried[b] = true
+	}
+}
+
+// redisBlocked returns the entry of blocked that the command in args
+// matches, by its name or by its name and subcommand, or an empty string.
+func redisBlocked(blocked map[string]bool, args [][]byte) string {
+	if len(blocked) == 0 {
+		return ""
+	}
+	name := strings.ToLower(string(args[0]))
+	if blocked[name] {
+		return name
+	}
+	if len(args) > 1 && blocked[name+" "+strings.ToLower(string(args[1]))] {
+		return name + " " + strings.ToLower(string(args[1]))
+	}
+	return ""
+}
+
+// redisBlockedError is the error a client gets for a blocked command.
+func redisBlockedError(command string) string {
+	return fmt.Sprintf("ERR command '%s' is blocked by the proxy", command)
+}
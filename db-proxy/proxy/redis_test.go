@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestRedisBlocked(t *testing.T) {
+	blocked := map[string]bool{"flushall": true, "config set": true}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"FLUSHALL"}, "flushall"},
+		{[]string{"flushall", "ASYNC"}, "flushall"},
+		{[]string{"CONFIG", "SET", "maxmemory", "1"}, "config set"},
+		{[]string{"config", "Set"}, "config set"},
+		{[]string{"CONFIG", "GET", "maxmemory"}, ""},
+		{[]string{"CONFIG"}, ""},
+		{[]string{"FLUSHDB"}, ""},
+		{[]string{"GET", "flushall"}, ""},
+		//a subcommand only counts after its own command
+		{[]string{"SET", "config set"}, ""},
+	}
+	for _, tt := range tests {
+		args := make([][]byte, len(tt.args))
+		for i, a := range tt.args {
+			args[i] = []byte(a)
+		}
+		if got := redisBlocked(blocked, args); got != tt.want {
+			t.Errorf("redisBlocked(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if got := redisBlocked(nil, [][]byte{[]byte("FLUSHALL")}); got != "" {
+		t.Errorf("redisBlocked with nothing blocked = %q", got)
+	}
+}
@@ -0,0 +1,494 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/resp"
+)
+
+// errQuit ends a Redis session after the client's QUIT was answered.
+var errQuit = errors.New("client quit")
+
+// maxRedisPipeline is how many pipelined commands are sent on before
+// their replies are relayed.
+const maxRedisPipeline = 1024
+
+// replicaRetryInterval is how long a Redis client reads from the primary
+// after no replica could be reached, before it tries again.
+const replicaRetryInterval = 5 * time.Second
+
+// redisSession relays the commands of one Redis client. Commands are sent
+// on as they arrive, so pipelines stay pipelines, and the replies are
+// relayed in the order of the commands once the client has sent all it
+// had.
+type redisSession struct {
+	server  *Server
+	rec     *clientRecord
+	clientR *bufio.Reader
+	clientW *bufio.Writer
+
+	// primary gets every command but the reads that go to replica
+	primary *serverConn
+	replica *serverConn
+	// replicaRetry is when to try a replica again after none could be
+	// reached
+	replicaRetry time.Time
+	// setup are the commands that set up the primary connection, such as
+	// AUTH and SELECT; a replica connection gets them first
+	setup []redisSetup
+	// user and database are who the client authenticated as and the
+	// database it selected
+	user     string
+	database string
+
+	// pending are the commands whose replies have not been relayed yet
+	pending []redisPending
+	// multi is set between MULTI and EXEC, and watching after WATCH;
+	// either keeps reads on the primary. aborted is set when the proxy
+	// refused a command queued in MULTI, so EXEC has to fail.
+	multi    bool
+	watching bool
+	aborted  bool
+
+	// writeMu serializes writes to the client once the server sends
+	// messages of its own, see stream
+	writeMu sync.Mutex
+}
+
+// redisSetup is a command that changes the state of a connection, under
+// a key that a later command of the same kind replaces it by.
+type redisSetup struct {
+	key  string
+	args [][]byte
+}
+
+// redisPending is a command waiting for its reply.
+type redisPending struct {
+	// command is the name for the metrics
+	command string
+	// conn is where the command went; it is nil when the proxy answers
+	// the command itself with reply
+	conn  *serverConn
+	reply []byte
+	sent  time.Time
+}
+
+// run relays client commands until the client disconnects.
+func (sess *redisSession) run() {
+	for {
+		args, err := resp.ReadCommand(sess.clientR)
+		if err == resp.ErrMalformed {
+			sess.clientW.Write(resp.AppendError(nil, "ERR Protocol error"))
+			sess.flush()
+		}
+		if err != nil {
+			return
+		}
+		sess.rec.busy()
+		err = sess.command(args)
+		if err == nil && sess.clientR.Buffered() > 0 && len(sess.pending) < maxRedisPipeline {
+			//more of the pipeline is there; keep sending
+			continue
+		}
+		if err == nil {
+			err = sess.drain()
+		}
+		switch {
+		case err == errClientGone || err == errQuit:
+			return
+		case err != nil:
+			log.Printf("Error forwarding to server: %v", err)
+			sess.clientW.Write(resp.AppendError(nil, "ERR server connection failed"))
+			sess.flush()
+			return
+		}
+		sess.ready()
+	}
+}
+
+// command handles one client command: it answers it, sends it on, or
+// for the commands that change the connection waits for the reply.
+func (sess *redisSession) command(args [][]byte) error {
+	s := sess.server
+	cfg := s.config()
+	s.logRedisCommand(args)
+	name := resp.CommandName(args[0])
+	if blocked := redisBlocked(cfg.Redis.Blocked, args); blocked != "" {
+		metrics.RedisCommands.WithLabelValues(name, metrics.RouteBlocked).Inc()
+		log.Printf("Blocked Redis command %s from %s", strings.ToUpper(blocked), sess.rec.conn.RemoteAddr())
+		if sess.multi {
+			sess.aborted = true
+		}
+		sess.pending = append(sess.pending, redisPending{command: name, reply: resp.AppendError(nil, redisBlockedError(blocked))})
+		return nil
+	}
+
+	subcommand := ""
+	if len(args) > 1 {
+		subcommand = strings.ToLower(string(args[1]))
+	}
+	switch {
+	case name == "quit":
+		metrics.RedisCommands.WithLabelValues(name, metrics.RoutePrimary).Inc()
+		sess.pending = append(sess.pending, redisPending{command: name, reply: []byte("+OK\r\n")})
+		if err := sess.drain(); err != nil {
+			return err
+		}
+		return errQuit
+	case name == "client" && subcommand == "reply":
+		//the proxy could not tell which commands get a reply
+		metrics.RedisCommands.WithLabelValues(name, metrics.RouteBlocked).Inc()
+		msg := "ERR CLIENT REPLY is not supported by the proxy"
+		sess.pending = append(sess.pending, redisPending{command: name, reply: resp.AppendError(nil, msg)})
+		return nil
+	case name == "subscribe" || name == "psubscribe" || name == "ssubscribe" || name == "monitor" ||
+		name == "client" && subcommand == "tracking":
+		if err := sess.drain(); err != nil {
+			return err
+		}
+		return sess.stream(args)
+	case name == "auth" || name == "hello" || name == "select" || name == "reset" ||
+		name == "client" && (subcommand == "setname" || subcommand == "setinfo"):
+		return sess.setUp(name, args)
+	case name == "exec" && sess.aborted:
+		//discard what the server queued instead
+		metrics.RedisCommands.WithLabelValues(name, metrics.RoutePrimary).Inc()
+		sess.send(sess.primary, name, [][]byte{[]byte("DISCARD")})
+		sess.pending[len(sess.pending)-1].reply = resp.AppendError(nil, "EXECABORT Transaction discarded because of previous errors.")
+		sess.multi, sess.watching, sess.aborted = false, false, false
+		return nil
+	}
+
+	conn, route := sess.primary, metrics.RoutePrimary
+	if cfg.Redis.ReadFromReplicas && resp.IsRead(name) && !sess.multi && !sess.watching {
+		if replica := sess.replicaConn(); replica != nil {
+			conn, route = replica, metrics.RouteReplica
+		}
+	}
+	metrics.RedisCommands.WithLabelValues(name, route).Inc()
+	sess.send(conn, name, args)
+
+	//the server's state changes as soon as it gets the command, and so
+	//does where the next ones go
+	switch name {
+	case "multi":
+		sess.multi = true
+	case "exec", "discard":
+		sess.multi, sess.watching, sess.aborted = false, false, false
+	case "watch":
+		sess.watching = true
+	case "unwatch":
+		sess.watching = false
+	}
+	return nil
+}
+
+// send writes a command to conn, to be flushed by drain.
+func (sess *redisSession) send(conn *serverConn, name string, args [][]byte) {
+	conn.Writer.Write(resp.AppendCommand(nil, args...))
+	sess.pending = append(sess.pending, redisPending{command: name, conn: conn, sent: time.Now()})
+}
+
+// setUp runs a command that changes the connection, such as AUTH or
+// SELECT, on the primary and waits for the reply. If it worked it is kept
+// for replica connections, and any open replica connection is closed so
+// the next read opens one that is set up the same way.
+func (sess *redisSession) setUp(name string, args [][]byte) error {
+	if err := sess.drain(); err != nil {
+		return err
+	}
+	metrics.RedisCommands.WithLabelValues(name, metrics.RoutePrimary).Inc()
+	sess.send(sess.primary, name, args)
+	multi := sess.multi
+	reply, err := sess.drainReply()
+	if err != nil {
+		return err
+	}
+	//inside MULTI the command is only queued, except for RESET
+	if reply.IsError() || multi && name != "reset" {
+		return nil
+	}
+	sess.closeReplica()
+	sess.replicaRetry = time.Time{}
+
+	key := name
+	switch name {
+	case "reset":
+		sess.setup = nil
+		sess.multi, sess.watching, sess.aborted = false, false, false
+		sess.user, sess.database = redisDefaultUser, "0"
+	case "auth":
+		sess.user = redisDefaultUser
+		if len(args) > 2 {
+			sess.user = string(args[1])
+		}
+	case "hello":
+		for i := 2; i+2 < len(args); i++ {
+			if strings.EqualFold(string(args[i]), "AUTH") {
+				sess.user = string(args[i+1])
+				break
+			}
+		}
+	case "select":
+		sess.database = string(args[1])
+	case "client":
+		//CLIENT SETINFO sets one attribute at a time
+		key += " " + strings.ToLower(string(args[1]))
+		if len(args) > 2 && strings.EqualFold(string(args[1]), "SETINFO") {
+			key += " " + strings.ToLower(string(args[2]))
+		}
+	}
+	sess.rec.setStartup(sess.rec.conn, sess.user, sess.database, false)
+	if name == "reset" {
+		return nil
+	}
+	for i := range sess.setup {
+		if sess.setup[i].key == key {
+			sess.setup[i].args = args
+			return nil
+		}
+	}
+	sess.setup = append(sess.setup, redisSetup{key: key, args: args})
+	return nil
+}
+
+// drainReply drains the pending commands, the last of which went to a
+// server, and returns the reply to that last one.
+func (sess *redisSession) drainReply() (resp.Reply, error) {
+	var last resp.Reply
+	n := len(sess.pending)
+	err := sess.relay(func(i int, reply resp.Reply) {
+		if i == n-1 {
+			last = reply
+		}
+	})
+	return last, err
+}
+
+// drain flushes the commands sent so far and relays their replies to the
+// client, in order.
+func (sess *redisSession) drain() error {
+	return sess.relay(nil)
+}
+
+// relay is drain, calling seen with each server reply if it is not nil.
+func (sess *redisSession) relay(seen func(i int, reply resp.Reply)) error {
+	for _, conn := range []*serverConn{sess.primary, sess.replica} {
+		if conn != nil && conn.Writer.Buffered() > 0 {
+			if err := conn.Writer.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	pending := sess.pending
+	sess.pending = sess.pending[:0]
+	for i, p := range pending {
+		out := p.reply
+		if p.conn != nil {
+			reply, err := sess.readReply(p.conn)
+			if err != nil {
+				return err
+			}
+			metrics.RedisCommandDuration.WithLabelValues(p.command).Observe(time.Since(p.sent).Seconds())
+			if reply.IsError() {
+				metrics.RedisCommandErrors.WithLabelValues(p.command).Inc()
+			}
+			sess.server.logRedisReply(reply)
+			if seen != nil {
+				seen(i, reply)
+			}
+			if out == nil {
+				out = reply.Raw
+			}
+		}
+		sess.clientW.Write(out)
+	}
+	return sess.flush()
+}
+
+// readReply reads the reply to the next command sent on conn. RESP3 push
+// messages that come first are passed on to the client.
+func (sess *redisSession) readReply(conn *serverConn) (resp.Reply, error) {
+	for {
+		reply, err := resp.ReadReply(conn.Reader)
+		if err != nil || !reply.IsPush() {
+			return reply, err
+		}
+		sess.clientW.Write(reply.Raw)
+	}
+}
+
+func (sess *redisSession) flush() error {
+	if err := sess.clientW.Flush(); err != nil {
+		return errClientGone
+	}
+	return nil
+}
+
+// stream serves the rest of the session of a client that subscribed to
+// messages, runs MONITOR or turned on client tracking: the server now
+// sends messages of its own, so everything it sends is relayed as it
+// arrives instead of one reply per command. Commands still go through the
+// block list, and all of them go to the primary.
+func (sess *redisSession) stream(args [][]byte) error {
+	s := sess.server
+	sess.closeReplica()
+	primary := sess.primary
+	go func() {
+		for {
+			reply, err := resp.ReadReply(primary.Reader)
+			if err != nil {
+				//the server closed the connection, or the session ended
+				sess.rec.conn.Close()
+				return
+			}
+			s.logRedisReply(reply)
+			sess.writeMu.Lock()
+			sess.clientW.Write(reply.Raw)
+			if primary.Reader.Buffered() == 0 {
+				sess.clientW.Flush()
+			}
+			sess.writeMu.Unlock()
+		}
+	}()
+
+	for {
+		name := resp.CommandName(args[0])
+		if blocked := redisBlocked(s.config().Redis.Blocked, args); blocked != "" {
+			metrics.RedisCommands.WithLabelValues(name, metrics.RouteBlocked).Inc()
+			log.Printf("Blocked Redis command %s from %s", strings.ToUpper(blocked), sess.rec.conn.RemoteAddr())
+			sess.writeMu.Lock()
+			sess.clientW.Write(resp.AppendError(nil, redisBlockedError(blocked)))
+			err := sess.flush()
+			sess.writeMu.Unlock()
+			if err != nil {
+				return err
+			}
+		} else {
+			metrics.RedisCommands.WithLabelValues(name, metrics.RoutePrimary).Inc()
+			primary.Writer.Write(resp.AppendCommand(nil, args...))
+			if err := primary.Writer.Flush(); err != nil {
+				//the relay has the client now; it closes it
+				log.Printf("Error forwarding to server: %v", err)
+				return errClientGone
+			}
+		}
+		sess.rec.ready(pgproto.TxIdle)
+
+		var err error
+		if args, err = resp.ReadCommand(sess.clientR); err != nil {
+			return errClientGone
+		}
+		sess.rec.busy()
+		s.logRedisCommand(args)
+	}
+}
+
+// replicaConn returns the connection reads go to, opening one to a
+// replica first if need be. It returns nil when no replica can be
+// reached, and the primary answers reads as well.
+func (sess *redisSession) replicaConn() *serverConn {
+	if sess.replica != nil || time.Now().Before(sess.replicaRetry) {
+		return sess.replica
+	}
+	s := sess.server
+	conn, err := s.dialRedis(backend.RoleReplica, sess.rec.conn)
+	if err != nil {
+		sess.replicaRetry = time.Now().Add(replicaRetryInterval)
+		return nil
+	}
+	//the replica connection has to look like the primary one
+	conn.SetDeadline(time.Now().Add(s.config().DialTimeout))
+	for _, c := range sess.setup {
+		conn.Writer.Write(resp.AppendCommand(nil, c.args...))
+	}
+	err = conn.Writer.Flush()
+	for i := 0; i < len(sess.setup) && err == nil; i++ {
+		var reply resp.Reply
+		if reply, err = resp.ReadReply(conn.Reader); err == nil && reply.IsError() {
+			err = errors.New(reply.ErrorMessage())
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		log.Printf("Error setting up Redis connection to %s: %v", conn.Addr, err)
+		conn.Close()
+		conn.backend.Dec()
+		sess.replicaRetry = time.Now().Add(replicaRetryInterval)
+		return nil
+	}
+	sess.replica = conn
+	return conn
+}
+
+func (sess *redisSession) closeReplica() {
+	if sess.replica != nil {
+		sess.replica.Close()
+		sess.replica.backend.Dec()
+		sess.replica = nil
+	}
+}
+
+// ready tells the client's bookkeeping whether it is in a transaction.
+func (sess *redisSession) ready() {
+	if sess.multi {
+		sess.rec.ready(pgproto.TxActive)
+		return
+	}
+	sess.rec.ready(pgproto.TxIdle)
+}
+
+// close closes the server connections when the client leaves.
+func (sess *redisSession) close() {
+	sess.closeReplica()
+	sess.primary.Close()
+	sess.primary.backend.Dec()
+}
+
+// logRedisCommand prints a client command when protocol logging is on.
+// Passwords are left out, and long arguments cut short.
+func (s *Server) logRedisCommand(args [][]byte) {
+	if !s.config().LogProtocol {
+		return
+	}
+	name := strings.ToUpper(string(args[0]))
+	var b strings.Builder
+	b.WriteString(name)
+	for i, arg := range args[1:] {
+		switch {
+		//args[i] comes right before arg; a HELLO password follows AUTH and the user
+		case name == "AUTH", name == "HELLO" && i > 1 && strings.EqualFold(string(args[i-1]), "AUTH"):
+			b.WriteString(" ****")
+			continue
+		case len(arg) > 64:
+			fmt.Fprintf(&b, " %q...", arg[:64])
+		default:
+			fmt.Fprintf(&b, " %q", arg)
+		}
+	}
+	log.Printf("client: %s", b.String())
+}
+
+// logRedisReply prints a server reply when protocol logging is on.
+func (s *Server) logRedisReply(reply resp.Reply) {
+	if !s.config().LogProtocol {
+		return
+	}
+	switch {
+	case reply.IsError():
+		log.Printf("server: %s", reply.ErrorMessage())
+	case reply.IsPush():
+		log.Printf("server: push message (%d bytes)", len(reply.Raw))
+	default:
+		log.Printf("server: %c reply (%d bytes)", reply.Kind, len(reply.Raw))
+	}
+}
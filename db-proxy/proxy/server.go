@@ -0,0 +1,496 @@
+// Package proxy accepts PostgreSQL, MySQL and Redis clients and forwards
+// their sessions to the database, either one server connection per client
+// or through a transaction pool.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/cache"
+	"github.com/mu-wahba/db-proxy-go/fault"
+	"github.com/mu-wahba/db-proxy-go/firewall"
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/pool"
+	"github.com/mu-wahba/db-proxy-go/record"
+	"github.com/mu-wahba/db-proxy-go/slowlog"
+	"github.com/mu-wahba/db-proxy-go/stats"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Pool modes.
+const (
+	// PoolModeSession gives every client its own server connection for
+	// as long as it stays connected. This is how the proxy always worked.
+	PoolModeSession = "session"
+	// PoolModeTransaction lends a pooled server connection to a client
+	// only until its transaction ends.
+	PoolModeTransaction = "transaction"
+)
+
+// Config controls how clients are served.
+type Config struct {
+	Backends []*backend.Backend
+	// Balancer picks a backend for each new server connection
+	Balancer backend.Balancer
+	PoolMode string
+	// ReadWriteSplit sends read-only statements outside a transaction to
+	// replicas. It needs transaction mode.
+	ReadWriteSplit bool
+	// PoolSize caps the server connections per user and database
+	PoolSize int
+	// PoolWaitTimeout bounds how long a client waits for a free connection
+	PoolWaitTimeout time.Duration
+	// Users maps user names to passwords (or MD5 secrets). In transaction
+	// mode, and in session mode with ProxyAuth, the proxy checks clients
+	// against it and logs in with it.
+	Users map[string]string
+	// UserMappings holds the users that log in to the servers as another
+	// user, with a password clients never see
+	UserMappings map[string]UserMapping
+	// ProxyAuth has the proxy check passwords and log in for session-mode
+	// clients too, rather than relaying their login to the server
+	ProxyAuth   bool
+	LogProtocol bool
+
+	// ClientTLS terminates TLS for clients that send an SSLRequest; with a
+	// nil ClientTLS the request is declined. If it verifies client
+	// certificates, the certificate's common name must match the user.
+	ClientTLS *tls.Config
+	// RequireClientTLS turns away clients that do not use TLS
+	RequireClientTLS bool
+	// ServerTLS is used for connections to the backends when it is not nil
+	ServerTLS *tls.Config
+	// ProxyProtocol expects a PROXY protocol header, version 1 or 2, on
+	// every client connection from ProxyProtocolFrom, or from anywhere if
+	// that is empty, and takes the client's address from it
+	ProxyProtocol     bool
+	ProxyProtocolFrom []*net.IPNet
+	// ServerProxyProtocol is the version of the PROXY protocol header
+	// sent to PostgreSQL backends, 1 or 2; 0 sends none
+	ServerProxyProtocol int
+
+	// Allow and Deny restrict the client addresses. Deny takes precedence;
+	// an empty Allow admits any address not denied.
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+	// MaxConnections and MaxConnectionsPerIP cap the clients, in total
+	// and per source address; zero means no limit
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	// QueueSize is how many clients over a limit may wait up to
+	// QueueTimeout for a slot; the rest are turned away at once
+	QueueSize    int
+	QueueTimeout time.Duration
+
+	// Firewall screens the statements clients send; nil lets everything
+	// through
+	Firewall *firewall.Firewall
+	// Cache answers repeated queries of transaction-mode clients; nil
+	// turns caching off
+	Cache *cache.Cache
+	// Recorder records every session when it is not nil
+	Recorder *record.Recorder
+	// Tracer gets a span for every session and query; nil turns tracing
+	// off
+	Tracer trace.Tracer
+	// Stats counts the statements of PostgreSQL clients by fingerprint;
+	// nil turns the statistics off
+	Stats *stats.Collector
+	// SlowLog gets the statements of PostgreSQL clients that take
+	// SlowQueryThreshold or longer, redacted as SlowLogRedact says; nil
+	// turns the log off
+	SlowLog            *slowlog.Logger
+	SlowQueryThreshold time.Duration
+	SlowLogRedact      string
+	// Shadow, if not empty, is the address of a PostgreSQL server that
+	// gets a copy of what PostgreSQL clients send: the read-only
+	// statements, or everything if ShadowMirror is ShadowAll. Its answers
+	// are thrown away, or with ShadowCompare checked against the
+	// backends'. Each session queues up to ShadowQueue requests for the
+	// shadow and drops the rest. ShadowStats counts the statements as
+	// the shadow ran them.
+	Shadow        string
+	ShadowMirror  string
+	ShadowCompare bool
+	ShadowQueue   int
+	ShadowStats   *stats.Collector
+	// StripSQLComments removes sqlcommenter comments from statements
+	// before they go to the server
+	StripSQLComments bool
+	// Faults are injected into client sessions when FaultsEnabled is
+	// set; SetFaults replaces them until the next reload
+	FaultsEnabled bool
+	Faults        *fault.Injector
+
+	// DialTimeout bounds opening a server connection, TLS handshake
+	// included, and for pooled connections the login too
+	DialTimeout time.Duration
+	// ClientIdleTimeout disconnects clients that leave the proxy waiting
+	// for their next message this long
+	ClientIdleTimeout time.Duration
+	// ServerIdleTimeout closes pooled server connections left unused
+	// this long, so it only does anything in transaction mode
+	ServerIdleTimeout time.Duration
+	// MaxSessionLifetime disconnects clients connected this long, once
+	// they are outside a transaction with no query running
+	MaxSessionLifetime time.Duration
+
+	// MySQL serves MySQL clients, and Redis Redis clients, on listeners
+	// of their own
+	MySQL MySQLConfig
+	Redis RedisConfig
+}
+
+// cancelTimeout bounds connecting to a server to cancel a query.
+const cancelTimeout = 10 * time.Second
+
+// errNoBackend is returned when every backend is ejected or unreachable.
+var errNoBackend = errors.New("no healthy backend available")
+
+type poolKey struct {
+	backend  *backend.Backend
+	user     string
+	database string
+	// capabilities and charset are set for MySQL
+	capabilities uint32
+	charset      byte
+}
+
+// Server handles client connections. It is safe for concurrent use.
+type Server struct {
+	// cfg holds the current *Config; Reload swaps it
+	cfg atomic.Value
+
+	mu       sync.Mutex
+	pools    map[poolKey]*pool.Pool
+	sessions map[pgproto.BackendKeyData]*session
+	// backendKeys remembers which backend handed out a key in session
+	// mode, so a CancelRequest can be sent to the right server
+	backendKeys map[pgproto.BackendKeyData]*backend.Backend
+	// clients are the open client connections by ID
+	clients      map[uint64]*clientRecord
+	nextClientID uint64
+	// draining is set once Shutdown has been called
+	draining bool
+	limits   *limiter
+	// done is closed when Shutdown returns
+	done chan struct{}
+	// blockedMarker stands in for statements the firewall blocks, and
+	// faultMarker followed by a rule index for injected errors
+	blockedMarker string
+	faultMarker   string
+	// mysqlServerVersion is what the MySQL backends announce, for the
+	// greeting of transaction-mode clients
+	mysqlServerVersion string
+}
+
+// NewServer creates a Server for cfg.
+func NewServer(cfg Config) *Server {
+	s := &Server{
+		pools:       map[poolKey]*pool.Pool{},
+		sessions:    map[pgproto.BackendKeyData]*session{},
+		backendKeys: map[pgproto.BackendKeyData]*backend.Backend{},
+		clients:     map[uint64]*clientRecord{},
+		limits:      newLimiter(),
+		done:        make(chan struct{}),
+	}
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	s.blockedMarker = "dbproxy_blocked_" + hex.EncodeToString(nonce[:])
+	s.faultMarker = "dbproxy_fault_" + hex.EncodeToString(nonce[:]) + "_"
+	s.cfg.Store(&cfg)
+	go s.enforceTimeouts()
+	return s
+}
+
+// config returns the current configuration. It must not be modified.
+func (s *Server) config() *Config {
+	return s.cfg.Load().(*Config)
+}
+
+// Backends returns the backends of the current configuration.
+func (s *Server) Backends() []*backend.Backend {
+	return s.config().Backends
+}
+
+// Stats returns the statement statistics, or nil if they are off.
+func (s *Server) Stats() *stats.Collector {
+	return s.config().Stats
+}
+
+// ShadowStats returns the statement statistics of the shadow server, or
+// nil if there is none.
+func (s *Server) ShadowStats() *stats.Collector {
+	if s.config().Shadow == "" {
+		return nil
+	}
+	return s.config().ShadowStats
+}
+
+// HandleConnection serves one client until it disconnects.
+func (s *Server) HandleConnection(connection net.Conn) {
+	connection, ok := s.acceptProxyHeader(connection)
+	if !ok {
+		return
+	}
+	rec := s.track(connection, ProtocolPostgres)
+	defer s.untrack(rec)
+
+	ip := remoteIP(connection)
+	//a denied client still gets a proper error, but no TLS handshake
+	allowed := s.config().allowed(ip)
+	tlsConfig := s.config().ClientTLS
+	if !allowed {
+		tlsConfig = nil
+	}
+	startup, connection, client, err := s.readStartup(rec.conn, tlsConfig)
+	//connection may have switched to TLS by now
+	defer connection.Close()
+	if err == io.EOF {
+		//hung up without starting, e.g. after its SSLRequest was declined
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading startup message: %v", err)
+		metrics.ConnectionsRejected.WithLabelValues(metrics.RejectStartup).Inc()
+		return
+	}
+	rec.busy()
+
+	switch m := startup.(type) {
+	case *pgproto.CancelRequest:
+		//cancels are short-lived and not held to the connection limits
+		if allowed {
+			s.cancel(m)
+		}
+	case *pgproto.StartupMessage:
+		defer func() {
+			metrics.SessionDuration.Observe(time.Since(rec.started).Seconds())
+		}()
+		if !allowed {
+			log.Printf("Connection from %v not allowed", ip)
+			reject(connection, metrics.RejectACL, fatal("28000", "connection from "+ip.String()+" not allowed"))
+			return
+		}
+		if err := s.limits.acquire(s.config(), ip.String()); err != nil {
+			log.Printf("Error admitting client from %v: %v", ip, err)
+			reject(connection, metrics.RejectLimit, fatal("53300", "sorry, too many clients already"))
+			return
+		}
+		defer s.limits.release(ip.String())
+		user := m.Parameters["user"]
+		secure, certified, err := clientCertificate(connection, user)
+		if s.config().RequireClientTLS && !secure {
+			reject(connection, metrics.RejectTLS, fatal("28000", "SSL connection is required"))
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			reject(connection, metrics.RejectAuth, fatal("28000", "certificate authentication failed for user \""+user+"\""))
+			return
+		}
+		rec.setStartup(connection, user, m.Parameters["database"], secure)
+		if s.isDraining() {
+			reject(connection, metrics.RejectShutdown, shutdownError())
+			return
+		}
+		if s.config().PoolMode == PoolModeTransaction {
+			s.serveTransaction(rec, connection, client, m, certified)
+			return
+		}
+		s.passthrough(rec, connection, client, m, certified)
+	}
+}
+
+// reject turns a client away with a FATAL error before its session starts.
+func reject(connection net.Conn, reason string, e *pgproto.ErrorResponse) {
+	metrics.ConnectionsRejected.WithLabelValues(reason).Inc()
+	pgproto.Write(connection, e)
+}
+
+// readStartup reads the first message from the client. An SSLRequest is
+// answered by switching the connection to TLS when tlsConfig is set, and
+// declined otherwise; GSSAPI encryption is always declined. Either way the
+// client carries on with a regular startup, on the connection returned.
+func (s *Server) readStartup(connection net.Conn, tlsConfig *tls.Config) (pgproto.Message, net.Conn, *bufio.Reader, error) {
+	client := bufio.NewReader(connection)
+	for {
+		msg, err := pgproto.ReadStartupMessage(client)
+		if err != nil {
+			return nil, connection, client, err
+		}
+		switch msg.(type) {
+		case *pgproto.SSLRequest:
+			_, secure := connection.(*tls.Conn)
+			if tlsConfig == nil || secure {
+				if _, err := connection.Write([]byte{'N'}); err != nil {
+					return nil, connection, client, err
+				}
+				continue
+			}
+			//anything sent before the handshake was not protected by it
+			if client.Buffered() > 0 {
+				return nil, connection, client, errors.New("unencrypted data after SSL request")
+			}
+			if _, err := connection.Write([]byte{'S'}); err != nil {
+				return nil, connection, client, err
+			}
+			tlsConn := tls.Server(connection, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, connection, client, fmt.Errorf("TLS handshake with %v: %w", connection.RemoteAddr(), err)
+			}
+			connection, client = tlsConn, bufio.NewReader(tlsConn)
+			continue
+		case *pgproto.GSSEncRequest:
+			if _, err := connection.Write([]byte{'N'}); err != nil {
+				return nil, connection, client, err
+			}
+			continue
+		}
+		return msg, connection, client, nil
+	}
+}
+
+// clientCertificate reports whether connection uses TLS and whether the
+// client proved to be user with a certificate. A verified certificate
+// for someone else is an error.
+func clientCertificate(connection net.Conn, user string) (secure, certified bool, err error) {
+	tlsConn, secure := connection.(*tls.Conn)
+	if !secure {
+		return false, false, nil
+	}
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 {
+		return true, false, nil
+	}
+	if name := chains[0][0].Subject.CommonName; name != user {
+		return true, false, fmt.Errorf("client certificate for %q used by user %q", name, user)
+	}
+	return true, true, nil
+}
+
+// pickBackend returns a backend with role from backends for a new server
+// connection, leaving out ejected backends and any already tried. It
+// returns nil if none is left.
+func (s *Server) pickBackend(backends []*backend.Backend, role string, tried map[*backend.Backend]bool) *backend.Backend {
+	var candidates []*backend.Backend
+	for _, b := range backend.Healthy(backends) {
+		if b.Role == role && !tried[b] {
+			candidates = append(candidates, b)
+		}
+	}
+	return s.config().Balancer.Pick(candidates)
+}
+
+// serverLogin returns the user and password the proxy logs in to the
+// servers with for user, who has password in the user list.
+func (c *Config) serverLogin(user, password string) (string, string) {
+	if m, ok := c.UserMappings[user]; ok {
+		return m.User, m.Password
+	}
+	return user, password
+}
+
+// pool returns the pool for creds on b, creating it on first use with
+// connect.
+func (s *Server) pool(b *backend.Backend, creds pool.Credentials, connect pool.Connector) *pool.Pool {
+	key := poolKey{backend: b, user: creds.User, database: creds.Database, capabilities: creds.Capabilities, charset: creds.Charset}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pools[key]
+	if !ok {
+		p = pool.New(connect, b.Addr, creds, s.config().PoolSize, s.config().ServerTLS, s.config().DialTimeout)
+		s.pools[key] = p
+	}
+	return p
+}
+
+// register hands out the key a pooled client uses to cancel its queries.
+// Clients never see the server's own key because the server behind them
+// changes from one transaction to the next.
+func (s *Server) register(sess *session) pgproto.BackendKeyData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		var b [8]byte
+		rand.Read(b[:])
+		key := pgproto.BackendKeyData{
+			ProcessID: binary.BigEndian.Uint32(b[:4]),
+			SecretKey: binary.BigEndian.Uint32(b[4:]),
+		}
+		if _, taken := s.sessions[key]; !taken {
+			s.sessions[key] = sess
+			return key
+		}
+	}
+}
+
+func (s *Server) unregister(key pgproto.BackendKeyData) {
+	s.mu.Lock()
+	delete(s.sessions, key)
+	s.mu.Unlock()
+}
+
+// registerBackendKey records the key a server sent to a session-mode client.
+func (s *Server) registerBackendKey(key pgproto.BackendKeyData, b *backend.Backend) {
+	s.mu.Lock()
+	s.backendKeys[key] = b
+	s.mu.Unlock()
+}
+
+func (s *Server) unregisterBackendKey(key pgproto.BackendKeyData) {
+	s.mu.Lock()
+	delete(s.backendKeys, key)
+	s.mu.Unlock()
+}
+
+// cancel forwards a CancelRequest to the server that is running the
+// client's current query, if there is one.
+func (s *Server) cancel(req *pgproto.CancelRequest) {
+	key := pgproto.BackendKeyData{ProcessID: req.ProcessID, SecretKey: req.SecretKey}
+	s.mu.Lock()
+	sess := s.sessions[key]
+	b := s.backendKeys[key]
+	s.mu.Unlock()
+
+	if b != nil {
+		//session mode: the key belongs to the server itself
+		s.sendCancel(b.Addr, req)
+		return
+	}
+	if sess == nil {
+		return
+	}
+	if conn := sess.serverConn(); conn != nil {
+		s.sendCancel(conn.Addr, &pgproto.CancelRequest{ProcessID: conn.Key.ProcessID, SecretKey: conn.Key.SecretKey})
+	}
+}
+
+func (s *Server) sendCancel(addr string, req *pgproto.CancelRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	db, err := pool.Dial(ctx, addr, s.config().serverProxyHeader(nil), s.config().ServerTLS)
+	if err != nil {
+		log.Printf("Error connecting to db for cancel: %v", err)
+		return
+	}
+	defer db.Close()
+	if err := pgproto.Write(db, req); err != nil {
+		log.Printf("Error forwarding cancel request: %v", err)
+	}
+}
@@ -0,0 +1,505 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/cache"
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/pool"
+	"github.com/mu-wahba/db-proxy-go/record"
+)
+
+// session is a client served in transaction mode. It borrows a server
+// connection when the client sends its first message after being idle and
+// returns it once the server reports ReadyForQuery outside a transaction.
+type session struct {
+	server   *Server
+	client   net.Conn
+	clientR  *bufio.Reader
+	user     string
+	database string
+	// serverUser and password are what the proxy logs in with: the
+	// client's own, or those the user list maps it to
+	serverUser string
+	password   string
+
+	// mu guards conn, pending, pinned, writing and idle, and serialises
+	// writes to clientW
+	mu      sync.Mutex
+	clientW *bufio.Writer
+	conn    *serverConn
+	// released is signalled whenever conn goes back to the pool
+	released *sync.Cond
+	// pending counts Query and Sync messages still waiting for their
+	// ReadyForQuery; the connection is only released when it hits zero
+	pending int
+	// pinned is set once the client changed session state (SET, temporary
+	// tables, ...); from then on it keeps its server connection
+	pinned bool
+	// writing is set while forward writes to conn without holding mu.
+	// idle is set when the server finished the transaction meanwhile:
+	// relay then waits for forward to give the connection back.
+	writing bool
+	idle    bool
+
+	// statements are the client's prepared statements by client name
+	statements map[string]*preparedStatement
+	// parses are the Parse messages still waiting for their ParseComplete
+	parses []parseSent
+	// batches counts messages answered with ReadyForQuery that were sent,
+	// answered counts the ReadyForQuery messages received
+	batches, answered int
+	// drained is set when a shutdown or a timeout disconnected the client
+	drained bool
+
+	// caching is set while the result of a query is collected for the
+	// cache in cached, which is cachedSize bytes so far. written are the
+	// tables written since the client was last idle; their results are
+	// dropped again once the writes are committed and others see them.
+	caching    *cache.Lookup
+	cached     []pgproto.Message
+	cachedSize int64
+	written    []string
+
+	// rec is the client's bookkeeping; the recorder, if not nil, records
+	// the session under its ID
+	rec      *clientRecord
+	recorder *record.Recorder
+	trace    *sessionTrace
+	shadow   *shadowSession
+}
+
+// serveTransaction serves a client in transaction mode, which logs in to
+// the proxy; certified is as for login.
+func (s *Server) serveTransaction(rec *clientRecord, connection net.Conn, client *bufio.Reader, startup *pgproto.StartupMessage, certified bool) {
+	user := startup.Parameters["user"]
+	database := startup.Parameters["database"]
+	if database == "" {
+		database = user
+	}
+
+	password, ok := s.login(rec, connection, client, user, certified)
+	if !ok {
+		return
+	}
+	serverUser, password := s.config().serverLogin(user, password)
+
+	sess := &session{
+		server:     s,
+		client:     connection,
+		clientR:    client,
+		clientW:    bufio.NewWriter(connection),
+		user:       user,
+		database:   database,
+		serverUser: serverUser,
+		password:   password,
+
+		statements: map[string]*preparedStatement{},
+		rec:        rec,
+		recorder:   s.config().Recorder,
+	}
+	sess.released = sync.NewCond(&sess.mu)
+	rec.setSession(sess)
+
+	//borrow a connection once to learn the server's parameters
+	conn, err := sess.acquire(false)
+	if err != nil {
+		log.Printf("Error getting server connection for %s/%s: %v", user, database, err)
+		reject(connection, metrics.RejectNoBackend, fatal("08006", "could not get a server connection"))
+		return
+	}
+	params := conn.Params
+	conn.release()
+
+	key := s.register(sess)
+	defer s.unregister(key)
+
+	if err := pgproto.Write(connection, loginComplete(params, key)...); err != nil {
+		return
+	}
+	rec.ready(pgproto.TxIdle)
+
+	sess.recorder.Start(sess.rec.id, user, database)
+	defer sess.recorder.End(sess.rec.id)
+	sess.trace = s.startTrace(rec, user, database)
+	defer sess.trace.end()
+	sess.shadow = s.startShadow(user, pool.Credentials{User: serverUser, Password: password, Database: database})
+	defer sess.shadow.end()
+	sess.run()
+}
+
+// login authenticates a client the proxy logs in for, turning it away if
+// that fails, and returns its password from the user list. A certified
+// client already proved who it is with a TLS client certificate and is
+// not asked for a password.
+func (s *Server) login(rec *clientRecord, connection net.Conn, client *bufio.Reader, user string, certified bool) (string, bool) {
+	password, ok := s.config().Users[user]
+	if !certified {
+		rec.waiting()
+		password, ok = s.authenticate(connection, client, user)
+		rec.busy()
+	}
+	if !ok {
+		reject(connection, metrics.RejectAuth, fatal("28P01", "password authentication failed for user \""+user+"\""))
+	}
+	return password, ok
+}
+
+// loginComplete is what tells a client the proxy logged in for that its
+// login is over: the server's parameters, key and ReadyForQuery.
+func loginComplete(params map[string]string, key pgproto.BackendKeyData) []pgproto.Message {
+	msgs := []pgproto.Message{&pgproto.Authentication{Type: pgproto.AuthOK}}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		msgs = append(msgs, &pgproto.ParameterStatus{Name: name, Value: params[name]})
+	}
+	return append(msgs, &key, &pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle})
+}
+
+// authenticate checks the client's password against the user list with an
+// MD5 challenge and returns the password to use towards the server.
+func (s *Server) authenticate(connection net.Conn, client *bufio.Reader, user string) (string, bool) {
+	password, known := s.config().Users[user]
+
+	//challenge unknown users too, so probing for names gains nothing
+	salt := make([]byte, 4)
+	rand.Read(salt)
+	if err := pgproto.Write(connection, &pgproto.Authentication{Type: pgproto.AuthMD5Password, Data: salt}); err != nil {
+		return "", false
+	}
+	msg, err := pgproto.ReadFrontendMessage(client)
+	if err != nil {
+		return "", false
+	}
+	reply, ok := msg.(*pgproto.PasswordMessage)
+	if !ok {
+		return "", false
+	}
+	got, err := pgproto.ParsePasswordData(reply.Data)
+	if err != nil || !known {
+		return "", false
+	}
+	want := pgproto.MD5Response(user, password, salt)
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return "", false
+	}
+	return password, true
+}
+
+// run forwards client messages until the client disconnects.
+func (sess *session) run() {
+	defer sess.close()
+	for {
+		msg, err := pgproto.ReadFrontendMessage(sess.clientR)
+		if err != nil {
+			return
+		}
+		sess.rec.busy()
+		sess.server.logMessage("client", msg)
+		sess.recorder.Message(sess.rec.id, record.KindClient, msg)
+		sess.trace.client(msg)
+		if _, ok := msg.(*pgproto.Terminate); ok {
+			//the server connection outlives the client
+			return
+		}
+		msg = sess.server.stripComment(msg)
+		msg = sess.server.screen(sess.user, sess.client, msg)
+		sess.shadow.client(msg)
+		if msg = sess.server.injectFault(sess.rec, sess.user, msg); msg == nil {
+			return
+		}
+		if err := sess.forward(msg); err == errDrained || err == errClientGone {
+			return
+		} else if err != nil {
+			log.Printf("Error forwarding to server: %v", err)
+			sess.mu.Lock()
+			sess.clientW.Write(fatal("08006", "server connection failed").Encode(nil))
+			sess.clientW.Flush()
+			sess.mu.Unlock()
+			return
+		}
+	}
+}
+
+// forward sends msg to the session's server connection, borrowing one
+// from the pool first if the client does not hold one. With read/write
+// splitting, a read-only statement outside a transaction borrows from a
+// replica and everything else from the primary.
+func (sess *session) forward(msg pgproto.Message) error {
+	conn, buf, err := sess.prepare(msg)
+	if conn == nil || err != nil {
+		return err
+	}
+
+	//write without mu: a server busy sending results only reads again
+	//once relay, which needs mu, has passed them on to the client
+	_, err = conn.Writer.Write(buf)
+	if err == nil && sess.clientR.Buffered() == 0 {
+		err = conn.Writer.Flush()
+	}
+	sess.mu.Lock()
+	sess.writing = false
+	if sess.idle {
+		//the server answered before the write returned
+		sess.idle = false
+		if err == nil && sess.conn == conn && sess.pending == 0 && !sess.pinned {
+			sess.conn = nil
+			conn.release()
+		}
+		sess.released.Broadcast()
+	}
+	sess.mu.Unlock()
+	return err
+}
+
+// prepare does the bookkeeping for forwarding msg and returns the server
+// connection to write buf to, or none if msg was answered from the cache.
+func (sess *session) prepare(msg pgproto.Message) (*serverConn, []byte, error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.drained {
+		return nil, nil, errDrained
+	}
+
+	if sess.conn == nil {
+		if answered, err := sess.fromCache(msg); answered {
+			return nil, nil, err
+		}
+	}
+	sess.invalidate(msg)
+
+	readOnly, sessionState, ok := sess.route(msg)
+	if ok {
+		if !readOnly && sess.conn != nil && sess.conn.backend.Role == backend.RoleReplica && sess.pending > 0 {
+			//a write pipelined behind a read must wait for the replica to finish
+			for sess.conn != nil {
+				sess.released.Wait()
+			}
+		}
+	}
+
+	if sess.conn == nil {
+		//waiting for the pool must not hold up relay either
+		read := readOnly && !sess.pinned && sess.server.config().ReadWriteSplit
+		sess.mu.Unlock()
+		conn, err := sess.acquire(read)
+		sess.mu.Lock()
+		if err != nil {
+			return nil, nil, err
+		}
+		if sess.drained {
+			conn.release()
+			return nil, nil, errDrained
+		}
+		sess.conn = conn
+		go sess.relay(conn)
+	}
+	if sessionState {
+		sess.pinned = true
+	}
+
+	var buf []byte
+	for _, out := range sess.rewrite(msg) {
+		buf = out.Encode(buf)
+	}
+	switch m := msg.(type) {
+	case *pgproto.Query, *pgproto.Sync:
+		sess.pending++
+		sess.batches++
+	case *pgproto.Unknown:
+		//FunctionCall is answered with ReadyForQuery too
+		if m.Type == 'F' {
+			sess.pending++
+			sess.batches++
+		}
+	}
+	sess.writing = true
+	return sess.conn, buf, nil
+}
+
+// relay copies server messages to the client until the transaction ends
+// and conn goes back to the pool, or until either side fails.
+func (sess *session) relay(conn *serverConn) {
+	var buf []byte
+	for {
+		msg, err := pgproto.ReadBackendMessage(conn.Reader)
+		if err != nil {
+			sess.mu.Lock()
+			owned := sess.conn == conn
+			if owned {
+				sess.conn = nil
+				sess.parses = nil
+				sess.answered = sess.batches
+				conn.discard()
+				sess.released.Broadcast()
+			}
+			sess.mu.Unlock()
+			if owned {
+				//the server dropped us mid-transaction, the client cannot recover
+				log.Printf("Error reading from server %s: %v", conn.Addr, err)
+				sess.client.Close()
+			}
+			return
+		}
+		sess.server.logMessage("server", msg)
+
+		sess.mu.Lock()
+		if _, ok := msg.(*pgproto.ParseComplete); !ok || sess.parseCompleted() {
+			//the client never sees the answers to Parse messages the proxy injected
+			msg = sess.server.unscreen(msg)
+			sess.recorder.Message(sess.rec.id, record.KindServer, msg)
+			sess.trace.server(msg, conn.Addr)
+			sess.shadow.server(msg)
+			buf = msg.Encode(buf[:0])
+			_, err = sess.clientW.Write(buf)
+			if sess.caching != nil {
+				sess.collect(msg, len(buf))
+			}
+		}
+		released := false
+		if rfq, ok := msg.(*pgproto.ReadyForQuery); ok {
+			sess.forgetFailedParses(conn)
+			if sess.pending > 0 {
+				sess.pending--
+			}
+			if rfq.TxStatus == pgproto.TxIdle && len(sess.written) > 0 {
+				sess.server.config().Cache.Invalidate(sess.written)
+				if sess.pending == 0 {
+					sess.written = nil
+				}
+			}
+			if sess.pending == 0 {
+				sess.rec.ready(rfq.TxStatus)
+			}
+			if sess.pending == 0 && rfq.TxStatus == pgproto.TxIdle && !sess.pinned {
+				//a message still being written is forward's to finish
+				if sess.writing {
+					sess.idle = true
+				} else {
+					sess.conn = nil
+					released = true
+				}
+			}
+		}
+		if err == nil && (released || sess.idle || conn.Reader.Buffered() == 0) {
+			err = sess.clientW.Flush()
+		}
+		if released {
+			conn.release()
+			sess.released.Broadcast()
+		}
+		for sess.idle {
+			sess.released.Wait()
+		}
+		done := sess.conn != conn
+		sess.mu.Unlock()
+
+		if err != nil {
+			//client is gone; run notices and cleans up
+			sess.client.Close()
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// serverConn returns the connection the client currently holds, if any.
+func (sess *session) serverConn() *serverConn {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.conn
+}
+
+// close gives back the server connection when the client leaves. One still
+// inside a transaction cannot be handed to anyone else, so it is closed.
+func (sess *session) close() {
+	sess.mu.Lock()
+	conn := sess.conn
+	sess.conn = nil
+	sess.mu.Unlock()
+	if conn != nil {
+		conn.discard()
+	}
+}
+
+// serverConn is a pooled connection on loan to a session.
+type serverConn struct {
+	*pool.Conn
+	pool    *pool.Pool
+	backend *backend.Backend
+}
+
+// acquire borrows a connection from a backend picked by the balancer,
+// trying the other healthy backends if that one cannot be reached. A read
+// goes to a replica when one is available and to the primary otherwise.
+func (sess *session) acquire(read bool) (*serverConn, error) {
+	roles := []string{backend.RolePrimary}
+	if read {
+		roles = []string{backend.RoleReplica, backend.RolePrimary}
+	}
+	//pooled connections are shared, so they are the proxy's own
+	creds := pool.Credentials{User: sess.serverUser, Password: sess.password, Database: sess.database, ProxyHeader: sess.server.config().serverProxyHeader(nil)}
+	return sess.server.borrow(sess.server.config().Backends, roles, creds, pool.Connect)
+}
+
+// borrow gets a connection for creds from one of backends, trying the
+// roles in order and, within a role, every healthy backend until one
+// can be reached. Connections are opened with connect.
+func (s *Server) borrow(backends []*backend.Backend, roles []string, creds pool.Credentials, connect pool.Connector) (*serverConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config().PoolWaitTimeout)
+	defer cancel()
+
+	tried := map[*backend.Backend]bool{}
+	err := errNoBackend
+	for _, role := range roles {
+		for ctx.Err() == nil {
+			b := s.pickBackend(backends, role, tried)
+			if b == nil {
+				break
+			}
+			p := s.pool(b, creds, connect)
+			var conn *pool.Conn
+			if conn, err = p.Acquire(ctx); err == nil {
+				b.Inc()
+				return &serverConn{Conn: conn, pool: p, backend: b}, nil
+			}
+			log.Printf("Error getting server connection from %s: %v", b.Addr, err)
+			if errors.Is(err, pool.ErrDialTimeout) {
+				metrics.ConnectionsTimedOut.WithLabelValues(metrics.TimeoutDial).Inc()
+			}
+			tried[b] = true
+		}
+	}
+	return nil, err
+}
+
+func (c *serverConn) release() {
+	c.pool.Release(c.Conn)
+	c.backend.Dec()
+}
+
+func (c *serverConn) discard() {
+	c.pool.Discard(c.Conn)
+	c.backend.Dec()
+}
+
+func fatal(code, message string) *pgproto.ErrorResponse {
+	e := pgproto.NewErrorResponse(code, message)
+	e.Severity = "FATAL"
+	return e
+}
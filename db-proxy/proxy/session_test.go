@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/pool"
+)
+
+// slowWriter passes writes on but only returns once wait is closed.
+type slowWriter struct {
+	net.Conn
+	wait chan struct{}
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	n, err := w.Conn.Write(p)
+	<-w.wait
+	return n, err
+}
+
+// A server that answers before forward's write returns must not leave the
+// connection with the idle client.
+func TestReleaseAfterSlowWrite(t *testing.T) {
+	serverSide, proxySide := net.Pipe()
+	answered := make(chan struct{})
+	connect := func(context.Context, string, pool.Credentials, *tls.Config) (*pool.Conn, error) {
+		return &pool.Conn{
+			Conn:     proxySide,
+			Reader:   bufio.NewReader(proxySide),
+			Writer:   bufio.NewWriter(slowWriter{proxySide, answered}),
+			Prepared: map[string]bool{},
+		}, nil
+	}
+	p := pool.New(connect, "server", pool.Credentials{}, 1, nil, 0)
+	c, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the server answers a Query with ReadyForQuery
+	go func() {
+		r := bufio.NewReader(serverSide)
+		for {
+			if _, err := pgproto.ReadFrontendMessage(r); err != nil {
+				return
+			}
+			pgproto.Write(serverSide, &pgproto.CommandComplete{Tag: "SET"}, &pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle})
+		}
+	}()
+	//the write returns once the client got the answer
+	clientSide, proxyClient := net.Pipe()
+	go func() {
+		r := bufio.NewReader(clientSide)
+		for {
+			msg, err := pgproto.ReadBackendMessage(r)
+			if err != nil {
+				return
+			}
+			if _, ok := msg.(*pgproto.ReadyForQuery); ok {
+				close(answered)
+			}
+		}
+	}()
+
+	sess := &session{
+		server:     NewServer(Config{}),
+		client:     proxyClient,
+		clientR:    bufio.NewReader(strings.NewReader("")),
+		clientW:    bufio.NewWriter(proxyClient),
+		statements: map[string]*preparedStatement{},
+		rec:        &clientRecord{},
+	}
+	sess.released = sync.NewCond(&sess.mu)
+	conn := &serverConn{Conn: c, pool: p, backend: &backend.Backend{Addr: "server"}}
+	sess.conn = conn
+	conn.backend.Inc()
+	relayed := make(chan struct{})
+	go func() {
+		sess.relay(conn)
+		close(relayed)
+	}()
+
+	if err := sess.forward(&pgproto.Query{String: "SELECT 1"}); err != nil {
+		t.Fatal(err)
+	}
+	if sess.serverConn() != nil {
+		t.Fatal("idle client still holds the server connection")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := p.Acquire(ctx); err != nil {
+		t.Errorf("connection not back in the pool: %v", err)
+	}
+	select {
+	case <-relayed:
+	case <-time.After(time.Second):
+		t.Errorf("relay still running")
+	}
+}
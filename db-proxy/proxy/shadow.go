@@ -0,0 +1,469 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/pool"
+	"github.com/mu-wahba/db-proxy-go/sqlparse"
+	"github.com/mu-wahba/db-proxy-go/stats"
+)
+
+// What ShadowMirror sends to the shadow server.
+const (
+	// ShadowReads mirrors the statements read/write splitting would send
+	// to a replica
+	ShadowReads = "reads"
+	// ShadowAll mirrors everything, writes and transactions included,
+	// except COPY and function calls
+	ShadowAll = "all"
+)
+
+const (
+	// shadowRetry is how long a session waits before connecting to the
+	// shadow again after it failed
+	shadowRetry = 5 * time.Second
+	// maxShadowRequest caps the size of a mirrored request; the messages
+	// of larger ones are not kept around for the shadow
+	maxShadowRequest = 1 << 20
+	// shadowLogInterval is the least time between two logged mismatches,
+	// so a statement that always differs does not flood the log
+	shadowLogInterval = time.Second
+)
+
+// lastMismatchLog is when a mismatch was last logged, in Unix nanoseconds.
+var lastMismatchLog int64
+
+// shadowSession mirrors the requests of one client session to the shadow
+// server, over a connection of its own that it logs in to like the
+// session does to the backends. A request is a simple query, or the
+// extended-protocol messages up to a Sync. The client's side only queues
+// requests; a goroutine of the shadow session sends them and reads the
+// answers, so a slow or failing shadow never holds up the client.
+type shadowSession struct {
+	proxy   *Server
+	addr    string
+	all     bool
+	compare bool
+	creds   pool.Credentials
+	// trace times the statements as the shadow runs them, for the
+	// shadow's statistics
+	trace *sessionTrace
+
+	// msgs, data and sql collect the request on its way from the client:
+	// its messages, encoded in data, and its first statement; skip is set
+	// once one of them is not to be mirrored. known holds the statements
+	// the shadow was sent, by client name, and parsed those this request
+	// prepares. They are only used on the client's side.
+	msgs   []pgproto.Message
+	data   []byte
+	sql    string
+	skip   bool
+	known  map[string]string
+	parsed []string
+
+	// mu guards queue, closed, answers and result
+	mu     sync.Mutex
+	queue  chan *shadowRequest
+	closed bool
+	// answers are the requests waiting for the backend's answer, nil for
+	// those not mirrored, and result sums up that answer so far. They are
+	// only kept when comparing.
+	answers []*shadowRequest
+	result  resultDigest
+}
+
+// shadowRequest is a request on its way to the shadow. When comparing,
+// the digests of both answers are put in it, and whichever comes second
+// compares them.
+type shadowRequest struct {
+	msgs []pgproto.Message
+	data []byte
+	sql  string
+
+	mu              sync.Mutex
+	primary, shadow *resultDigest
+}
+
+// startShadow starts mirroring a client session of user that logs in to
+// the servers with creds. It returns nil if there is no shadow server.
+func (s *Server) startShadow(user string, creds pool.Credentials) *shadowSession {
+	cfg := s.config()
+	if cfg.Shadow == "" {
+		return nil
+	}
+	//like pooled connections, the shadow's is the proxy's own
+	creds.ProxyHeader = cfg.serverProxyHeader(nil)
+	sh := &shadowSession{
+		proxy:   s,
+		addr:    cfg.Shadow,
+		all:     cfg.ShadowMirror == ShadowAll,
+		compare: cfg.ShadowCompare,
+		creds:   creds,
+		trace: &sessionTrace{
+			stats:      cfg.ShadowStats,
+			user:       user,
+			database:   creds.Database,
+			statements: map[string]string{},
+			portals:    map[string]tracePortal{},
+		},
+		known: map[string]string{},
+		queue: make(chan *shadowRequest, cfg.ShadowQueue),
+	}
+	go sh.run()
+	return sh
+}
+
+// client follows a message from the client, as the firewall let it
+// through.
+func (sh *shadowSession) client(msg pgproto.Message) {
+	if sh == nil {
+		return
+	}
+	switch m := msg.(type) {
+	case *pgproto.Query:
+		sh.add(m, m.String, sh.mirrors(m.String))
+		//a simple query destroys the unnamed statement
+		delete(sh.known, "")
+		sh.send()
+	case *pgproto.Parse:
+		sh.add(m, m.Query, sh.mirrors(m.Query))
+		sh.known[m.Name] = m.Query
+		sh.parsed = append(sh.parsed, m.Name)
+	case *pgproto.Bind:
+		sql, ok := sh.known[m.Statement]
+		sh.add(m, sql, ok)
+	case *pgproto.Describe:
+		_, ok := sh.known[m.Name]
+		sh.add(m, "", ok || m.ObjectType != 'S')
+	case *pgproto.Close:
+		sh.add(m, "", true)
+		if m.ObjectType == 'S' {
+			delete(sh.known, m.Name)
+		}
+	case *pgproto.Execute, *pgproto.Flush:
+		sh.add(m, "", true)
+	case *pgproto.Sync:
+		sh.add(m, "", true)
+		sh.send()
+	case *pgproto.Unknown:
+		//a FunctionCall is not mirrored, but answered like a request
+		if m.Type == 'F' {
+			sh.skip = true
+			sh.send()
+		}
+	}
+}
+
+// mirrors reports whether sql goes to the shadow.
+func (sh *shadowSession) mirrors(sql string) bool {
+	stmts := sqlparse.Parse(sql)
+	for _, st := range stmts {
+		//COPY goes on with messages of its own
+		if st.Command == "COPY" || (!sh.all && !st.ReadOnly) {
+			return false
+		}
+	}
+	return len(stmts) > 0
+}
+
+// add adds msg, which runs sql if that is not empty, to the request being
+// collected, unless mirror is false: then the request is not mirrored.
+func (sh *shadowSession) add(msg pgproto.Message, sql string, mirror bool) {
+	if sh.skip {
+		return
+	}
+	sh.data = msg.Encode(sh.data)
+	if !mirror || len(sh.data) > maxShadowRequest {
+		sh.msgs, sh.data, sh.sql, sh.skip = nil, nil, "", true
+		return
+	}
+	sh.msgs = append(sh.msgs, msg)
+	if sh.sql == "" {
+		sh.sql = sql
+	}
+}
+
+// send queues the request collected so far for the shadow, unless it is
+// not to be mirrored, and notes that the backend's answer is due.
+func (sh *shadowSession) send() {
+	var req *shadowRequest
+	if !sh.skip && len(sh.msgs) > 0 {
+		req = &shadowRequest{msgs: sh.msgs, data: sh.data, sql: sh.sql}
+	}
+	parsed := sh.parsed
+	sh.msgs, sh.data, sh.sql, sh.skip, sh.parsed = nil, nil, "", false, nil
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.closed {
+		return
+	}
+	if req != nil {
+		select {
+		case sh.queue <- req:
+		default:
+			metrics.ShadowRequests.WithLabelValues(metrics.ShadowDropped).Inc()
+			req = nil
+		}
+	}
+	if req == nil {
+		//the shadow never sees the statements prepared on the way
+		for _, name := range parsed {
+			delete(sh.known, name)
+		}
+	}
+	if sh.compare {
+		sh.answers = append(sh.answers, req)
+	}
+}
+
+// server follows a message a backend sent to the client.
+func (sh *shadowSession) server(msg pgproto.Message) {
+	if sh == nil || !sh.compare {
+		return
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if len(sh.answers) == 0 {
+		//the login, or something outside any request
+		return
+	}
+	if _, ok := msg.(*pgproto.ReadyForQuery); !ok {
+		if sh.answers[0] != nil {
+			sh.result.add(msg)
+		}
+		return
+	}
+	req := sh.answers[0]
+	sh.answers = sh.answers[1:]
+	result := sh.result
+	sh.result = resultDigest{}
+	if req != nil {
+		sh.answered(req, &result, true)
+	}
+}
+
+// end stops mirroring when the client leaves. Requests already queued
+// still go to the shadow.
+func (sh *shadowSession) end() {
+	if sh == nil {
+		return
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if !sh.closed {
+		sh.closed = true
+		close(sh.queue)
+	}
+}
+
+// run sends the queued requests to the shadow until the session ends and
+// the queue is empty. It connects when the first request comes, and again
+// shadowRetry after losing the connection; meanwhile requests are counted
+// as unavailable.
+func (sh *shadowSession) run() {
+	var conn *pool.Conn
+	var retry time.Time
+	//prepared are the named statements the shadow has, to prepare again
+	//on a new connection
+	prepared := map[string]*pgproto.Parse{}
+	defer func() {
+		if conn != nil {
+			pgproto.Write(conn, &pgproto.Terminate{})
+			conn.Close()
+		}
+	}()
+	for req := range sh.queue {
+		if conn == nil && !time.Now().Before(retry) {
+			var err error
+			if conn, err = sh.connect(prepared); err != nil {
+				log.Printf("Error connecting to shadow %s: %v", sh.addr, err)
+				retry = time.Now().Add(shadowRetry)
+			}
+		}
+		if conn == nil {
+			metrics.ShadowRequests.WithLabelValues(metrics.ShadowUnavailable).Inc()
+			continue
+		}
+		if err := sh.exchange(conn, req); err != nil {
+			log.Printf("Error mirroring to shadow %s: %v", sh.addr, err)
+			metrics.ShadowRequests.WithLabelValues(metrics.ShadowUnavailable).Inc()
+			conn.Close()
+			conn, retry = nil, time.Now().Add(shadowRetry)
+			//forget the statements left unanswered
+			sh.trace.end()
+		}
+		for _, msg := range req.msgs {
+			switch m := msg.(type) {
+			case *pgproto.Parse:
+				if m.Name != "" {
+					prepared[m.Name] = m
+				}
+			case *pgproto.Close:
+				if m.ObjectType == 'S' {
+					delete(prepared, m.Name)
+				}
+			}
+		}
+	}
+}
+
+// connect logs in to the shadow and prepares the statements the client
+// prepared on an earlier connection.
+func (sh *shadowSession) connect(prepared map[string]*pgproto.Parse) (*pool.Conn, error) {
+	cfg := sh.proxy.config()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DialTimeout)
+	defer cancel()
+	conn, err := pool.Connect(ctx, sh.addr, sh.creds, cfg.ServerTLS)
+	if err != nil || len(prepared) == 0 {
+		return conn, err
+	}
+	var buf []byte
+	for _, parse := range prepared {
+		buf = parse.Encode(buf)
+	}
+	buf = (&pgproto.Sync{}).Encode(buf)
+	if _, err = conn.Writer.Write(buf); err == nil {
+		err = conn.Writer.Flush()
+	}
+	for err == nil {
+		var msg pgproto.Message
+		if msg, err = pgproto.ReadBackendMessage(conn.Reader); err == nil {
+			if _, ok := msg.(*pgproto.ReadyForQuery); ok {
+				return conn, nil
+			}
+		}
+	}
+	conn.Close()
+	return nil, err
+}
+
+// exchange sends req to the shadow on conn and reads the answer, up to
+// its ReadyForQuery.
+func (sh *shadowSession) exchange(conn *pool.Conn, req *shadowRequest) error {
+	for _, msg := range req.msgs {
+		sh.trace.client(msg)
+	}
+	start := time.Now()
+	if _, err := conn.Writer.Write(req.data); err != nil {
+		return err
+	}
+	if err := conn.Writer.Flush(); err != nil {
+		return err
+	}
+	var result resultDigest
+	for {
+		msg, err := pgproto.ReadBackendMessage(conn.Reader)
+		if err != nil {
+			return err
+		}
+		//blocked statements fail the same way as on the backend
+		msg = sh.proxy.unscreen(msg)
+		sh.trace.server(msg, sh.addr)
+		if _, ok := msg.(*pgproto.ReadyForQuery); ok {
+			break
+		}
+		result.add(msg)
+	}
+	metrics.ShadowDuration.Observe(time.Since(start).Seconds())
+	switch {
+	case sh.compare:
+		sh.answered(req, &result, false)
+	case result.failed:
+		metrics.ShadowRequests.WithLabelValues(metrics.ShadowError).Inc()
+	default:
+		metrics.ShadowRequests.WithLabelValues(metrics.ShadowOK).Inc()
+	}
+	return nil
+}
+
+// answered puts the digest of the backend's answer to req, if primary, or
+// else the shadow's, in req, and compares the two once both are there.
+func (sh *shadowSession) answered(req *shadowRequest, d *resultDigest, primary bool) {
+	req.mu.Lock()
+	if primary {
+		req.primary = d
+	} else {
+		req.shadow = d
+	}
+	p, s := req.primary, req.shadow
+	req.mu.Unlock()
+	if p == nil || s == nil {
+		return
+	}
+	if p.String() == s.String() {
+		metrics.ShadowRequests.WithLabelValues(metrics.ShadowMatch).Inc()
+		return
+	}
+	metrics.ShadowRequests.WithLabelValues(metrics.ShadowMismatch).Inc()
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&lastMismatchLog)
+	if now-last >= int64(shadowLogInterval) && atomic.CompareAndSwapInt64(&lastMismatchLog, last, now) {
+		log.Printf("Shadow %s answered %q differently: %s, where the backend answered %s", sh.addr, stats.Fingerprint(req.sql), s, p)
+	}
+}
+
+// resultDigest sums up an answer for comparing it with another: the
+// command tag, or the SQLSTATE of the error, of every statement, with its
+// rows. The rows are hashed and the hashes added up, so the same rows in
+// a different order, as another plan may return them, sum up the same.
+type resultDigest struct {
+	results []string
+	rows    int64
+	sum     uint64
+	// failed is set if a statement failed
+	failed bool
+}
+
+// add adds msg, a message of the answer, to the digest.
+func (d *resultDigest) add(msg pgproto.Message) {
+	switch m := msg.(type) {
+	case *pgproto.DataRow:
+		h := fnv.New64a()
+		var n [4]byte
+		for _, v := range m.Values {
+			//the length sets NULL apart from an empty value
+			size := int32(len(v))
+			if v == nil {
+				size = -1
+			}
+			binary.BigEndian.PutUint32(n[:], uint32(size))
+			h.Write(n[:])
+			h.Write(v)
+		}
+		d.rows++
+		d.sum += h.Sum64()
+	case *pgproto.CommandComplete:
+		d.end(m.Tag)
+	case *pgproto.EmptyQueryResponse:
+		d.end("empty query")
+	case *pgproto.PortalSuspended:
+		d.end("portal suspended")
+	case *pgproto.ErrorResponse:
+		d.failed = true
+		d.end("error " + m.Code)
+	}
+}
+
+// end ends the result of a statement.
+func (d *resultDigest) end(tag string) {
+	d.results = append(d.results, fmt.Sprintf("%s (%d rows, %016x)", tag, d.rows, d.sum))
+	d.rows, d.sum = 0, 0
+}
+
+func (d *resultDigest) String() string {
+	if len(d.results) == 0 {
+		return "nothing"
+	}
+	return strings.Join(d.results, "; ")
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counterValue returns the value of the counter name with the label
+// values given.
+func counterValue(t *testing.T, name string, labels ...string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			var values []string
+			for _, l := range m.GetLabel() {
+				values = append(values, l.GetValue())
+			}
+			if reflect.DeepEqual(values, labels) {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+// shadowed waits until the shadow ran last and returns what it ran.
+func shadowed(t *testing.T, shadow *fakePostgres, last string) []string {
+	t.Helper()
+	var sqls []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		for _, st := range shadow.statements() {
+			sqls = append(sqls, st.sql)
+		}
+		if len(sqls) > 0 && sqls[len(sqls)-1] == last {
+			return sqls
+		}
+	}
+	t.Fatalf("shadow never ran %q, only %q", last, sqls)
+	return nil
+}
+
+func TestShadowMirror(t *testing.T) {
+	primary := startFakePostgres(t, selectAnswer)
+	shadow := startFakePostgres(t, selectAnswer)
+	for _, tt := range []struct {
+		mirror string
+		want   []string
+	}{
+		{ShadowReads, []string{"SELECT 1", "SELECT 2", "SELECT 3"}},
+		{ShadowAll, []string{"SELECT 1", "UPDATE t SET a = 1", "BEGIN", "SELECT 2", "COMMIT", "DELETE FROM t", "SELECT 3"}},
+	} {
+		_, addr := startProxy(t, Config{Users: map[string]string{"app": "secret"}, Shadow: shadow.addr, ShadowMirror: tt.mirror, ShadowQueue: 16}, primary.addr)
+		c := dialPostgres(t, addr, "app")
+		for _, sql := range []string{"SELECT 1", "UPDATE t SET a = 1", "BEGIN", "SELECT 2", "COMMIT"} {
+			c.query(sql)
+		}
+		c.send(&pgproto.Parse{Query: "DELETE FROM t"}, &pgproto.Bind{}, &pgproto.Execute{}, &pgproto.Sync{})
+		c.ready()
+		c.send(&pgproto.Parse{Query: "SELECT 3"}, &pgproto.Bind{}, &pgproto.Execute{}, &pgproto.Sync{})
+		c.ready()
+
+		if got := shadowed(t, shadow, "SELECT 3"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mirroring %s, the shadow ran %q, want %q", tt.mirror, got, tt.want)
+		}
+		c.Close()
+	}
+}
+
+// A shadow that does not keep up has requests dropped; the client does
+// not wait for it.
+func TestShadowQueueFull(t *testing.T) {
+	primary := startFakePostgres(t, selectAnswer)
+	shadow := startFakePostgres(t, selectAnswer)
+	shadow.hold = make(chan struct{})
+	defer close(shadow.hold)
+	_, addr := startProxy(t, Config{Users: map[string]string{"app": "secret"}, Shadow: shadow.addr, ShadowMirror: ShadowReads, ShadowQueue: 1}, primary.addr)
+
+	dropped := counterValue(t, "dbproxy_shadow_requests_total", metrics.ShadowDropped)
+	c := dialPostgres(t, addr, "app")
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if rows := c.query("SELECT 1"); len(rows) != 1 {
+			t.Fatalf("query %d got %q", i, rows)
+		}
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("queries took %v with the shadow stuck", took)
+	}
+	//one request is with the shadow and one queued; the rest are dropped
+	if got := counterValue(t, "dbproxy_shadow_requests_total", metrics.ShadowDropped) - dropped; got < 3 {
+		t.Errorf("%v requests dropped, want at least 3", got)
+	}
+}
+
+// syncBuffer is a buffer that the log and the test may use at once.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestShadowCompare(t *testing.T) {
+	var logged syncBuffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	lastMismatchLog = 0
+
+	primary := startFakePostgres(t, selectAnswer)
+	shadow := startFakePostgres(t, func(sql string) []string {
+		if sql == "SELECT 2" {
+			return []string{"two"}
+		}
+		return selectAnswer(sql)
+	})
+	_, addr := startProxy(t, Config{Users: map[string]string{"app": "secret"}, Shadow: shadow.addr, ShadowMirror: ShadowReads, ShadowCompare: true, ShadowQueue: 16}, primary.addr)
+
+	match := counterValue(t, "dbproxy_shadow_requests_total", metrics.ShadowMatch)
+	mismatch := counterValue(t, "dbproxy_shadow_requests_total", metrics.ShadowMismatch)
+	c := dialPostgres(t, addr, "app")
+	for _, sql := range []string{"SELECT 1", "SELECT 2", "SELECT 3"} {
+		c.query(sql)
+	}
+	shadowed(t, shadow, "SELECT 3")
+	//the shadow's answer may be compared just after it came in
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if counterValue(t, "dbproxy_shadow_requests_total", metrics.ShadowMatch)-match == 2 {
+			break
+		}
+	}
+	if got := counterValue(t, "dbproxy_shadow_requests_total", metrics.ShadowMatch) - match; got != 2 {
+		t.Errorf("%v matches, want 2", got)
+	}
+	if got := counterValue(t, "dbproxy_shadow_requests_total", metrics.ShadowMismatch) - mismatch; got != 1 {
+		t.Errorf("%v mismatches, want 1", got)
+	}
+	want := `answered "SELECT ?" differently: SELECT 1 (1 rows, `
+	if !strings.Contains(logged.String(), want) {
+		t.Errorf("log %q does not report the difference", logged.String())
+	}
+}
+
+func TestResultDigest(t *testing.T) {
+	digest := func(msgs ...pgproto.Message) string {
+		var d resultDigest
+		for _, m := range msgs {
+			d.add(m)
+		}
+		return d.String()
+	}
+	row := func(values ...[]byte) pgproto.Message { return &pgproto.DataRow{Values: values} }
+	done := &pgproto.CommandComplete{Tag: "SELECT 2"}
+	a, b := []byte("a"), []byte("b")
+
+	if digest(row(a), row(b), done) != digest(row(b), row(a), done) {
+		t.Errorf("rows in another order digest differently")
+	}
+	if digest(row(a), row(b), done) == digest(row(a), row(a), done) {
+		t.Errorf("other rows digest the same")
+	}
+	if digest(row(nil), done) == digest(row([]byte{}), done) {
+		t.Errorf("NULL and an empty value digest the same")
+	}
+	if digest(row(a, b), done) == digest(row(b, a), done) {
+		t.Errorf("columns in another order digest the same")
+	}
+	failed := digest(row(a), &pgproto.ErrorResponse{Code: "22012"})
+	if strings.TrimPrefix(failed, "error 22012") != strings.TrimPrefix(digest(row(a), done), "SELECT 2") {
+		t.Errorf("failed statement digests as %q", failed)
+	}
+	if digest() != "nothing" {
+		t.Errorf("empty answer digests as %q", digest())
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/pool"
+)
+
+// errDrained is returned by forward once the proxy closed the session,
+// for a shutdown or a timeout.
+var errDrained = errors.New("session closed by the proxy")
+
+// drainPollInterval is how often Shutdown looks for clients it can let go.
+const drainPollInterval = 100 * time.Millisecond
+
+// Shutdown drains the server: new clients are turned away, and connected
+// ones are disconnected as soon as they are idle, that is outside a
+// transaction with no query running. Clients still busy when ctx is done
+// are closed by force. The listener must already be closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+	defer close(s.done)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		recs := s.clientRecords()
+		if len(recs) == 0 {
+			s.closePools()
+			return nil
+		}
+		for _, rec := range recs {
+			rec.closeIfIdle(shutdownError())
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Drain timeout, closing %d client connections", len(recs))
+			for _, rec := range recs {
+				rec.conn.Close()
+			}
+			s.closePools()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Reload switches to cfg. Clients keep running; they see the new settings
+// from their next transaction (transaction mode) or not at all (session
+// mode, where only new clients are affected). The pools are replaced so
+// new server connections use the new backends, credentials and pool size;
+// connections in use go away when they are released.
+func (s *Server) Reload(cfg Config) {
+	s.mu.Lock()
+	s.cfg.Store(&cfg)
+	s.mu.Unlock()
+	s.closePools()
+}
+
+// closePools drops every pool. Later borrowers get fresh ones.
+func (s *Server) closePools() {
+	s.mu.Lock()
+	pools := s.pools
+	s.pools = map[poolKey]*pool.Pool{}
+	s.mu.Unlock()
+	for _, p := range pools {
+		p.Close()
+	}
+}
+
+// closeIfIdle disconnects the client with e if it is between
+// transactions, and reports whether it did.
+func (rec *clientRecord) closeIfIdle(e *pgproto.ErrorResponse) bool {
+	rec.mu.Lock()
+	client, sess := rec.client, rec.sess
+	idle := rec.txStatus == pgproto.TxIdle && !rec.waitingSince.IsZero()
+	rec.mu.Unlock()
+
+	if sess != nil {
+		return sess.closeIfIdle(e)
+	}
+	if client != nil && idle {
+		rec.farewell(client, e)
+		client.Close()
+		return true
+	}
+	return false
+}
+
+// disconnect sends the client e and closes its connection, whatever it is
+// doing. A client that has not sent its startup message yet cannot read
+// an error and is only closed.
+func (rec *clientRecord) disconnect(e *pgproto.ErrorResponse) {
+	rec.mu.Lock()
+	client, sess := rec.client, rec.sess
+	rec.mu.Unlock()
+
+	switch {
+	case sess != nil:
+		sess.disconnect(e)
+	case client != nil:
+		rec.farewell(client, e)
+		client.Close()
+	default:
+		rec.conn.Close()
+	}
+}
+
+// farewell sends e to a client that is about to be disconnected, in the
+// client's protocol.
+func (rec *clientRecord) farewell(client net.Conn, e *pgproto.ErrorResponse) {
+	switch rec.protocol {
+	case ProtocolMySQL:
+		writeMySQLError(client, mysqlFatal(e))
+	case ProtocolRedis:
+		writeRedisError(client, "ERR "+e.Message)
+	default:
+		pgproto.Write(client, e)
+	}
+}
+
+// closeIfIdle disconnects a transaction-mode client that holds no server
+// connection. Holding mu keeps it from starting a transaction meanwhile.
+func (sess *session) closeIfIdle(e *pgproto.ErrorResponse) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.conn != nil || sess.drained {
+		return false
+	}
+	sess.closeWith(e)
+	return true
+}
+
+// disconnect disconnects a transaction-mode client even in the middle of
+// a transaction, which is rolled back when run discards the connection.
+func (sess *session) disconnect(e *pgproto.ErrorResponse) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if !sess.drained {
+		sess.closeWith(e)
+	}
+}
+
+// closeWith sends e and closes the client. The caller holds mu.
+func (sess *session) closeWith(e *pgproto.ErrorResponse) {
+	sess.drained = true
+	sess.clientW.Write(e.Encode(nil))
+	sess.clientW.Flush()
+	sess.client.Close()
+}
+
+func shutdownError() *pgproto.ErrorResponse {
+	return fatal("57P01", "terminating connection due to administrator command")
+}
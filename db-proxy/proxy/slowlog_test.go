@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/slowlog"
+)
+
+func TestSlowLogRedaction(t *testing.T) {
+	//parameters hides only what comes in a Bind, literals hides both
+	query := "SELECT * FROM users WHERE name = 'alice' AND password = 'hunter2'"
+	prepared := "SELECT * FROM users WHERE name = $1 AND password = $2 AND token = $3"
+	tests := []struct {
+		redact     string
+		query      string
+		prepared   string
+		parameters []interface{}
+	}{
+		{slowlog.RedactNone, query, prepared, []interface{}{"s3cret", nil, `\x6869`}},
+		{slowlog.RedactParameters, query, prepared, nil},
+		{slowlog.RedactLiterals, "SELECT * FROM USERS WHERE NAME = ? AND PASSWORD = ?", "SELECT * FROM USERS WHERE NAME = $1 AND PASSWORD = $2 AND TOKEN = $3", nil},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "slow.jsonl")
+		l, err := slowlog.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := &sessionTrace{
+			user:       "app",
+			database:   "db",
+			slowLog:    l,
+			redact:     tt.redact,
+			clientAddr: "10.0.0.5:50000",
+			statements: map[string]string{},
+			portals:    map[string]tracePortal{},
+		}
+		tr.client(&pgproto.Query{String: query})
+		tr.server(&pgproto.CommandComplete{Tag: "SELECT 1"}, "db1:5432")
+		tr.server(&pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle}, "db1:5432")
+		tr.client(&pgproto.Parse{Name: "s1", Query: prepared})
+		//the second parameter is NULL, the third sent in binary
+		tr.client(&pgproto.Bind{Statement: "s1", ParameterFormatCodes: []int16{0, 0, 1}, Parameters: [][]byte{[]byte("s3cret"), nil, []byte("hi")}})
+		tr.client(&pgproto.Execute{})
+		tr.client(&pgproto.Sync{})
+		tr.server(&pgproto.CommandComplete{Tag: "SELECT 0"}, "db1:5432")
+		tr.server(&pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle}, "db1:5432")
+		l.Close()
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.redact != slowlog.RedactNone && strings.Contains(string(data), "s3cret") {
+			t.Errorf("redacting %s, the log shows a parameter: %s", tt.redact, data)
+		}
+		if tt.redact == slowlog.RedactLiterals && strings.Contains(string(data), "hunter2") {
+			t.Errorf("redacting %s, the log shows a literal: %s", tt.redact, data)
+		}
+		var entries []map[string]interface{}
+		dec := json.NewDecoder(strings.NewReader(string(data)))
+		for dec.More() {
+			var e map[string]interface{}
+			if err := dec.Decode(&e); err != nil {
+				t.Fatal(err)
+			}
+			delete(e, "time")
+			delete(e, "duration_ms")
+			entries = append(entries, e)
+		}
+		want := []map[string]interface{}{
+			{"client": "10.0.0.5:50000", "user": "app", "database": "db", "backend": "db1:5432", "rows": 1.0, "statement": tt.query},
+			{"client": "10.0.0.5:50000", "user": "app", "database": "db", "backend": "db1:5432", "rows": 0.0, "statement": tt.prepared},
+		}
+		if tt.parameters != nil {
+			want[1]["parameters"] = tt.parameters
+		}
+		if !reflect.DeepEqual(entries, want) {
+			t.Errorf("redacting %s, logged\n%v\nwant\n%v", tt.redact, entries, want)
+		}
+	}
+}
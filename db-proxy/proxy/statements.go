@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/sqlparse"
+)
+
+// noopStatement is closed in place of a client's named statement. Closing
+// a statement that does not exist is not an error, so the server answers
+// with the CloseComplete the client expects while the real statement stays
+// prepared for other clients of the same server connection.
+const noopStatement = "dbproxy_noop"
+
+// preparedStatement is a statement a client prepared through the proxy.
+// In transaction mode the server connection changes between transactions,
+// so the proxy keeps the Parse around and replays it on whichever
+// connection the client holds when it binds the statement.
+type preparedStatement struct {
+	// parse is what gets sent to a server. Named statements are renamed to
+	// a hash of their query, so clients preparing the same query share one
+	// server statement and names picked by different clients cannot clash.
+	parse        *pgproto.Parse
+	hash         string
+	readOnly     bool
+	sessionState bool
+	// written are the tables the statement writes to, for the cache
+	written []string
+}
+
+func newPreparedStatement(m *pgproto.Parse) *preparedStatement {
+	h := sha256.New()
+	h.Write([]byte(m.Query))
+	var oid [4]byte
+	for _, o := range m.ParameterOIDs {
+		binary.BigEndian.PutUint32(oid[:], o)
+		h.Write(oid[:])
+	}
+	st := &preparedStatement{
+		parse: &pgproto.Parse{Query: m.Query, ParameterOIDs: m.ParameterOIDs},
+		hash:  hex.EncodeToString(h.Sum(nil))[:24],
+	}
+	if m.Name != "" {
+		st.parse.Name = "dbproxy_" + st.hash
+	}
+	st.readOnly, st.sessionState, st.written = classify(m.Query)
+	return st
+}
+
+// parseSent is a Parse on its way to the server. Its ParseComplete is
+// dropped if the proxy injected it, and the server-side bookkeeping is
+// rolled back if it never completes.
+type parseSent struct {
+	name     string
+	injected bool
+	// batch is the number of Sync, Query and FunctionCall messages sent
+	// before it; the Parse is dealt with by the ReadyForQuery that ends it
+	batch int
+}
+
+// rewrite turns a client message into what should go to the held server
+// connection: statement names are mapped to server names, and a statement
+// prepared on an earlier connection is prepared again first.
+// It must be called with sess.mu held.
+func (sess *session) rewrite(msg pgproto.Message) []pgproto.Message {
+	conn := sess.conn
+	switch m := msg.(type) {
+	case *pgproto.Parse:
+		st := newPreparedStatement(m)
+		sess.statements[m.Name] = st
+		parse := st.parse
+		if parse.Name != "" && conn.Prepared[parse.Name] {
+			//already there; an unnamed Parse still yields the ParseComplete
+			parse = &pgproto.Parse{Query: m.Query, ParameterOIDs: m.ParameterOIDs}
+		}
+		sess.noteParse(parse, st.hash, false)
+		return []pgproto.Message{parse}
+
+	case *pgproto.Bind:
+		if st := sess.statements[m.Statement]; st != nil {
+			bind := *m
+			bind.Statement = st.parse.Name
+			return append(sess.ensurePrepared(st), &bind)
+		}
+
+	case *pgproto.Describe:
+		if st := sess.statements[m.Name]; m.ObjectType == 'S' && st != nil {
+			return append(sess.ensurePrepared(st), &pgproto.Describe{ObjectType: 'S', Name: st.parse.Name})
+		}
+
+	case *pgproto.Close:
+		if m.ObjectType != 'S' {
+			break
+		}
+		delete(sess.statements, m.Name)
+		if m.Name == "" {
+			conn.Unnamed = ""
+			break
+		}
+		return []pgproto.Message{&pgproto.Close{ObjectType: 'S', Name: noopStatement}}
+
+	case *pgproto.Query:
+		//a simple query destroys the unnamed statement
+		conn.Unnamed = ""
+	}
+	return []pgproto.Message{msg}
+}
+
+// ensurePrepared returns the Parse to inject if st is not prepared on the
+// held connection.
+func (sess *session) ensurePrepared(st *preparedStatement) []pgproto.Message {
+	conn := sess.conn
+	if st.parse.Name == "" && conn.Unnamed == st.hash {
+		return nil
+	}
+	if st.parse.Name != "" && conn.Prepared[st.parse.Name] {
+		return nil
+	}
+	sess.noteParse(st.parse, st.hash, true)
+	return []pgproto.Message{st.parse}
+}
+
+// noteParse records a Parse being sent on the held connection.
+func (sess *session) noteParse(parse *pgproto.Parse, hash string, injected bool) {
+	conn := sess.conn
+	if parse.Name == "" {
+		conn.Unnamed = hash
+	} else {
+		conn.Prepared[parse.Name] = true
+	}
+	sess.parses = append(sess.parses, parseSent{name: parse.Name, injected: injected, batch: sess.batches})
+}
+
+// parseCompleted pops the oldest Parse in flight and reports whether its
+// ParseComplete should reach the client.
+func (sess *session) parseCompleted() bool {
+	if len(sess.parses) == 0 {
+		return true
+	}
+	p := sess.parses[0]
+	sess.parses = sess.parses[1:]
+	return !p.injected
+}
+
+// forgetFailedParses runs at ReadyForQuery. A Parse of the batch it ends
+// that is still in flight was skipped because of an error, so the
+// statement does not exist on the server after all.
+func (sess *session) forgetFailedParses(conn *serverConn) {
+	for len(sess.parses) > 0 && sess.parses[0].batch <= sess.answered {
+		p := sess.parses[0]
+		sess.parses = sess.parses[1:]
+		if p.name == "" {
+			conn.Unnamed = ""
+		} else {
+			delete(conn.Prepared, p.name)
+		}
+	}
+	sess.answered++
+}
+
+// route reports whether msg may run on a replica and whether it leaves
+// session state behind. ok is false for messages that carry no statement.
+func (sess *session) route(msg pgproto.Message) (readOnly, sessionState, ok bool) {
+	switch m := msg.(type) {
+	case *pgproto.Query:
+		readOnly, sessionState, _ = classify(m.String)
+		return readOnly, sessionState, true
+	case *pgproto.Parse:
+		readOnly, sessionState, _ = classify(m.Query)
+		return readOnly, sessionState, true
+	case *pgproto.Bind:
+		if st := sess.statements[m.Statement]; st != nil {
+			return st.readOnly, st.sessionState, true
+		}
+	case *pgproto.Describe:
+		if st := sess.statements[m.Name]; m.ObjectType == 'S' && st != nil {
+			return st.readOnly, st.sessionState, true
+		}
+	}
+	return false, false, false
+}
+
+// classify reports whether sql can run on a replica and whether it leaves
+// session state behind on the server connection, and returns the tables
+// named by its statements that may write.
+func classify(sql string) (readOnly, sessionState bool, written []string) {
+	stmts := sqlparse.Parse(sql)
+	readOnly = len(stmts) > 0
+	for _, st := range stmts {
+		readOnly = readOnly && st.ReadOnly
+		sessionState = sessionState || st.SessionState
+		if !st.ReadOnly {
+			written = append(written, st.Tables...)
+		}
+	}
+	return readOnly, sessionState, written
+}
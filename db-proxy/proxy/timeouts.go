@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"log"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/pool"
+)
+
+// timeoutCheckInterval is how often the idle and lifetime timeouts are
+// checked, and so how late they may fire.
+const timeoutCheckInterval = time.Second
+
+// enforceTimeouts disconnects idle clients and clients past their
+// lifetime, and closes idle pooled connections, until Shutdown returns.
+func (s *Server) enforceTimeouts() {
+	ticker := time.NewTicker(timeoutCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		cfg := s.config()
+		now := time.Now()
+		if cfg.ClientIdleTimeout > 0 || cfg.MaxSessionLifetime > 0 {
+			for _, rec := range s.clientRecords() {
+				rec.checkTimeouts(cfg, now)
+			}
+		}
+		if cfg.ServerIdleTimeout > 0 {
+			for _, p := range s.poolList() {
+				if n := p.CloseIdle(cfg.ServerIdleTimeout); n > 0 {
+					metrics.ConnectionsTimedOut.WithLabelValues(metrics.TimeoutServerIdle).Add(float64(n))
+				}
+			}
+		}
+	}
+}
+
+// checkTimeouts disconnects the client if it has been idle for too long,
+// or if it has been connected for too long and is between transactions.
+func (rec *clientRecord) checkTimeouts(cfg *Config, now time.Time) {
+	rec.mu.Lock()
+	waitingSince, txStatus := rec.waitingSince, rec.txStatus
+	rec.mu.Unlock()
+
+	if cfg.ClientIdleTimeout > 0 && !waitingSince.IsZero() && now.Sub(waitingSince) > cfg.ClientIdleTimeout {
+		log.Printf("Closing client %d from %v, idle for %v", rec.id, rec.conn.RemoteAddr(), now.Sub(waitingSince).Round(time.Second))
+		e := fatal("57P05", "terminating connection due to idle-session timeout")
+		if txStatus == pgproto.TxActive || txStatus == pgproto.TxFailed {
+			e = fatal("25P03", "terminating connection due to idle-in-transaction timeout")
+		}
+		rec.disconnect(e)
+		//no longer waiting for it, so it is not counted again
+		rec.busy()
+		metrics.ConnectionsTimedOut.WithLabelValues(metrics.TimeoutClientIdle).Inc()
+		return
+	}
+	if cfg.MaxSessionLifetime > 0 && now.Sub(rec.started) > cfg.MaxSessionLifetime {
+		if rec.closeIfIdle(fatal("57P01", "terminating connection due to maximum session lifetime")) {
+			rec.busy()
+			log.Printf("Closed client %d from %v after its maximum session lifetime", rec.id, rec.conn.RemoteAddr())
+			metrics.ConnectionsTimedOut.WithLabelValues(metrics.TimeoutSessionLifetime).Inc()
+		}
+	}
+}
+
+// poolList returns the current pools.
+func (s *Server) poolList() []*pool.Pool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pools := make([]*pool.Pool, 0, len(s.pools))
+	for _, p := range s.pools {
+		pools = append(pools, p)
+	}
+	return pools
+}
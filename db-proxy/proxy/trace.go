@@ -0,0 +1,500 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/mysqlproto"
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/slowlog"
+	"github.com/mu-wahba/db-proxy-go/sqlparse"
+	"github.com/mu-wahba/db-proxy-go/stats"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Errors for the spans of requests that were never answered.
+var (
+	errNoResponse = errors.New("connection closed before the response")
+	errSkipped    = errors.New("skipped after an earlier error")
+)
+
+// sessionTrace follows the statements of a client session. With tracing
+// on, it reports the session as a span, with a child span for every
+// simple query and every Execute; with statement statistics on, it times
+// those and counts them by fingerprint, and with the slow query log on,
+// it logs those that took too long. It follows both directions of the
+// conversation, which may be fed from different goroutines, and pairs the
+// answers with the requests in order. MySQL sessions are followed one
+// command at a time instead, and each COM_QUERY and COM_STMT_EXECUTE is
+// treated like a simple query.
+type sessionTrace struct {
+	// tracer and span are nil when only statistics are kept
+	tracer trace.Tracer
+	ctx    context.Context
+	span   trace.Span
+	// stats counts the statements of user on database, if it is not nil
+	stats    *stats.Collector
+	user     string
+	database string
+	// slowLog gets the statements that take threshold or longer,
+	// redacted as redact says, with clientAddr as the client's address
+	slowLog    *slowlog.Logger
+	threshold  time.Duration
+	redact     string
+	clientAddr string
+	// mysql is set for a MySQL client
+	mysql bool
+
+	mu sync.Mutex
+	// statements and portals remember what the client prepared and
+	// bound, by name; for MySQL, statements are by statement id
+	statements map[string]string
+	portals    map[string]tracePortal
+	// since is when the first Parse or Bind leading up to the next
+	// Execute arrived
+	since time.Time
+	// ops are the requests still waiting for their answers
+	ops []traceOp
+}
+
+// traceOp is a request that gets an answer: a Query, an Execute, a Sync
+// or a FunctionCall, or for MySQL a COM_QUERY ('Q'), COM_STMT_EXECUTE
+// ('E') or COM_STMT_PREPARE ('P').
+type traceOp struct {
+	msg byte
+	// span is set for a Query and an Execute when tracing
+	span trace.Span
+	// sql, start, done, rows and code describe a Query or an Execute:
+	// done is when the last CommandComplete or error arrived, and code
+	// the SQLSTATE of the error
+	sql         string
+	start, done time.Time
+	rows        int64
+	code        string
+	// bind is set for an Execute when the slow query log writes
+	// parameters
+	bind *pgproto.Bind
+}
+
+// tracePortal is a portal the client bound: the text of its statement
+// and, if the slow query log writes parameters, the Bind.
+type tracePortal struct {
+	sql  string
+	bind *pgproto.Bind
+}
+
+// startTrace starts following a client session. It returns nil if
+// tracing, statement statistics and the slow query log are all off.
+func (s *Server) startTrace(rec *clientRecord, user, database string) *sessionTrace {
+	cfg := s.config()
+	tracer := cfg.Tracer
+	if tracer == nil && cfg.Stats == nil && cfg.SlowLog == nil {
+		return nil
+	}
+	mysql := rec.protocol == ProtocolMySQL
+	if database == "" && !mysql {
+		database = user
+	}
+	t := &sessionTrace{
+		stats:      cfg.Stats,
+		user:       user,
+		database:   database,
+		slowLog:    cfg.SlowLog,
+		threshold:  cfg.SlowQueryThreshold,
+		redact:     cfg.SlowLogRedact,
+		clientAddr: rec.conn.RemoteAddr().String(),
+		mysql:      mysql,
+		statements: map[string]string{},
+		portals:    map[string]tracePortal{},
+	}
+	if tracer == nil {
+		return t
+	}
+	attrs := []attribute.KeyValue{
+		t.system(),
+		semconv.DBUserKey.String(user),
+		semconv.DBNameKey.String(database),
+	}
+	if host, port, err := net.SplitHostPort(rec.conn.RemoteAddr().String()); err == nil {
+		attrs = append(attrs, semconv.NetSockPeerAddrKey.String(host))
+		if n, err := strconv.Atoi(port); err == nil {
+			attrs = append(attrs, semconv.NetSockPeerPortKey.Int(n))
+		}
+	}
+	t.tracer = tracer
+	t.ctx, t.span = tracer.Start(context.Background(), "db-proxy session",
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+	return t
+}
+
+// client follows a message from the client.
+func (t *sessionTrace) client(msg pgproto.Message) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch m := msg.(type) {
+	case *pgproto.Query:
+		t.ops = append(t.ops, t.startOp('Q', m.String, now))
+	case *pgproto.Parse:
+		t.statements[m.Name] = m.Query
+		if t.since.IsZero() {
+			t.since = now
+		}
+	case *pgproto.Bind:
+		p := tracePortal{sql: t.statements[m.Statement]}
+		if t.slowLog != nil && t.redact == slowlog.RedactNone {
+			p.bind = m
+		}
+		t.portals[m.Portal] = p
+		if t.since.IsZero() {
+			t.since = now
+		}
+	case *pgproto.Execute:
+		start := t.since
+		if start.IsZero() {
+			start = now
+		}
+		t.since = time.Time{}
+		p := t.portals[m.Portal]
+		op := t.startOp('E', p.sql, start)
+		op.bind = p.bind
+		t.ops = append(t.ops, op)
+	case *pgproto.Sync:
+		t.since = time.Time{}
+		t.ops = append(t.ops, traceOp{msg: 'S'})
+	case *pgproto.Unknown:
+		//FunctionCall is answered with ReadyForQuery too
+		if m.Type == 'F' {
+			t.ops = append(t.ops, traceOp{msg: 'F'})
+		}
+	case *pgproto.Close:
+		if m.ObjectType == 'S' {
+			delete(t.statements, m.Name)
+		} else {
+			delete(t.portals, m.Name)
+		}
+	}
+}
+
+// startOp returns the request for a Query or an Execute of sql, with its
+// span if tracing is on.
+func (t *sessionTrace) startOp(msg byte, sql string, start time.Time) traceOp {
+	op := traceOp{msg: msg, sql: sql, start: start}
+	if t.tracer != nil {
+		op.span = t.startQuery(sql)
+	}
+	return op
+}
+
+// startQuery starts the span for sql. If the application put its trace
+// context in a sqlcommenter comment, the span joins the application's
+// trace and links back to the session.
+func (t *sessionTrace) startQuery(sql string) trace.Span {
+	name := "query"
+	if st := sqlparse.Parse(sql); len(st) > 0 && st[0].Command != "" {
+		name = st[0].Command
+	}
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(t.system(), semconv.DBStatementKey.String(sql)),
+	}
+	parent := t.ctx
+	if tags, _, ok := sqlparse.TrailingComment(sql); ok {
+		ctx := propagation.TraceContext{}.Extract(t.ctx, propagation.MapCarrier(tags))
+		if remote := trace.SpanContextFromContext(ctx); remote.IsRemote() {
+			parent = ctx
+			opts = append(opts, trace.WithLinks(trace.Link{SpanContext: t.span.SpanContext()}))
+		}
+	}
+	_, span := t.tracer.Start(parent, name, opts...)
+	return span
+}
+
+// server follows a message the server at addr sent to the client.
+func (t *sessionTrace) server(msg pgproto.Message, addr string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch m := msg.(type) {
+	case *pgproto.CommandComplete, *pgproto.EmptyQueryResponse, *pgproto.PortalSuspended:
+		if len(t.ops) == 0 {
+			return
+		}
+		if cc, ok := m.(*pgproto.CommandComplete); ok {
+			t.ops[0].rows += cc.Rows()
+		}
+		t.ops[0].done = now
+		if t.ops[0].msg == 'E' {
+			t.endOp(addr, nil)
+		}
+	case *pgproto.ErrorResponse:
+		if len(t.ops) == 0 || t.ops[0].msg == 'S' {
+			//a Parse or Bind failed, or something outside any request
+			if t.span != nil {
+				t.span.RecordError(m)
+			}
+			return
+		}
+		t.ops[0].done = now
+		t.ops[0].code = m.Code
+		if t.ops[0].msg != 'E' {
+			//a simple query ends at its ReadyForQuery
+			if t.ops[0].span != nil {
+				setError(t.ops[0].span, m)
+			}
+			return
+		}
+		t.endOp(addr, m)
+		//the server skips the rest up to the Sync
+		for len(t.ops) > 0 && t.ops[0].msg == 'E' {
+			t.endOp(addr, errSkipped)
+		}
+	case *pgproto.ReadyForQuery:
+		//ends everything up to the request it answers
+		for len(t.ops) > 0 {
+			last := t.ops[0].msg != 'E'
+			t.endOp(addr, nil)
+			if last {
+				break
+			}
+		}
+	}
+}
+
+// mysqlCommand follows a command from a MySQL client.
+func (t *sessionTrace) mysqlCommand(payload []byte) {
+	if t == nil || len(payload) == 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch payload[0] {
+	case mysqlproto.ComQuery:
+		t.ops = append(t.ops, t.startOp('Q', string(payload[1:]), now))
+	case mysqlproto.ComStmtPrepare:
+		t.ops = append(t.ops, traceOp{msg: 'P', sql: string(payload[1:])})
+	case mysqlproto.ComStmtExecute:
+		if len(payload) >= 5 {
+			t.ops = append(t.ops, t.startOp('E', t.statements[mysqlStatementID(payload)], now))
+		}
+	case mysqlproto.ComStmtClose:
+		if len(payload) >= 5 {
+			delete(t.statements, mysqlStatementID(payload))
+		}
+	case mysqlproto.ComResetConnection:
+		t.statements = map[string]string{}
+	}
+}
+
+// mysqlAnswer follows the complete answer to a MySQL command, from the
+// server at addr, or from the proxy itself if addr is empty.
+func (t *sessionTrace) mysqlAnswer(command byte, resp *mysqlproto.Response, addr string) {
+	if t == nil {
+		return
+	}
+	switch command {
+	case mysqlproto.ComQuery, mysqlproto.ComStmtPrepare, mysqlproto.ComStmtExecute:
+	default:
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.ops) == 0 {
+		return
+	}
+	op := &t.ops[0]
+	op.done = now
+	op.rows = resp.Rows + resp.Affected
+	if resp.Err != nil {
+		op.code = resp.Err.SQLState
+		t.endOp(addr, resp.Err)
+		return
+	}
+	if op.msg == 'P' {
+		t.statements[strconv.FormatUint(uint64(resp.StatementID), 10)] = op.sql
+	}
+	t.endOp(addr, nil)
+}
+
+// mysqlStatementID returns the statement id of a COM_STMT_* command as
+// the key of statements.
+func mysqlStatementID(payload []byte) string {
+	return strconv.FormatUint(uint64(binary.LittleEndian.Uint32(payload[1:])), 10)
+}
+
+// endOp pops the oldest request, ends its span, with err if not nil, and
+// unless it was skipped counts it in the statistics and logs it if it
+// was slow.
+func (t *sessionTrace) endOp(addr string, err error) {
+	op := t.ops[0]
+	t.ops = t.ops[1:]
+	if (op.msg == 'Q' || op.msg == 'E') && op.sql != "" && err != errSkipped {
+		if op.done.IsZero() {
+			op.done = time.Now()
+		}
+		d := op.done.Sub(op.start)
+		if t.stats != nil {
+			key := stats.Key{Fingerprint: t.fingerprint(op.sql), User: t.user, Database: t.database}
+			t.stats.Add(key, d, op.rows, op.code != "" || err != nil)
+		}
+		if t.slowLog != nil && d >= t.threshold {
+			t.logSlow(op, addr, d)
+		}
+	}
+	if op.span == nil {
+		return
+	}
+	if err != nil {
+		setError(op.span, err)
+	}
+	if addr != "" {
+		op.span.SetAttributes(peerAttributes(addr)...)
+	}
+	op.span.End()
+}
+
+// fingerprint returns the fingerprint of sql by the rules of the client's
+// protocol.
+func (t *sessionTrace) fingerprint(sql string) string {
+	if t.mysql {
+		return stats.FingerprintMySQL(sql)
+	}
+	return stats.Fingerprint(sql)
+}
+
+// system returns the db.system attribute for the client's protocol.
+func (t *sessionTrace) system() attribute.KeyValue {
+	if t.mysql {
+		return semconv.DBSystemMySQL
+	}
+	return semconv.DBSystemPostgreSQL
+}
+
+// logSlow writes op, which took d on the server at addr, to the slow
+// query log.
+func (t *sessionTrace) logSlow(op traceOp, addr string, d time.Duration) {
+	e := slowlog.Entry{
+		Client:     t.clientAddr,
+		User:       t.user,
+		Database:   t.database,
+		Backend:    addr,
+		DurationMS: float64(d) / float64(time.Millisecond),
+		Rows:       op.rows,
+		Error:      op.code,
+		Statement:  op.sql,
+	}
+	switch t.redact {
+	case slowlog.RedactLiterals:
+		e.Statement = t.fingerprint(op.sql)
+	case slowlog.RedactNone:
+		if op.bind != nil {
+			e.Parameters = bindParameters(op.bind)
+		}
+	}
+	t.slowLog.Write(e)
+}
+
+// bindParameters returns the parameter values of b as the slow query log
+// writes them: text as it is, binary in hex, NULL as nil.
+func bindParameters(b *pgproto.Bind) []*string {
+	params := make([]*string, len(b.Parameters))
+	for i, v := range b.Parameters {
+		if v == nil {
+			continue
+		}
+		//one format code applies to every parameter, none means text
+		var format int16
+		if len(b.ParameterFormatCodes) == 1 {
+			format = b.ParameterFormatCodes[0]
+		} else if i < len(b.ParameterFormatCodes) {
+			format = b.ParameterFormatCodes[i]
+		}
+		text := string(v)
+		if format != 0 {
+			text = `\x` + hex.EncodeToString(v)
+		}
+		params[i] = &text
+	}
+	return params
+}
+
+// end ends the session span and any request left unanswered.
+func (t *sessionTrace) end() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, op := range t.ops {
+		if op.span != nil {
+			setError(op.span, errNoResponse)
+			op.span.End()
+		}
+	}
+	t.ops = nil
+	if t.span != nil {
+		t.span.End()
+	}
+}
+
+// setBackend notes the server a session-mode client is connected to.
+func (t *sessionTrace) setBackend(addr string) {
+	if t != nil && t.span != nil {
+		t.span.SetAttributes(peerAttributes(addr)...)
+	}
+}
+
+// stripComment removes a sqlcommenter comment from the statement in msg
+// if the configuration asks for it, so statements that differ only in
+// their trace context look the same to the server.
+func (s *Server) stripComment(msg pgproto.Message) pgproto.Message {
+	if !s.config().StripSQLComments {
+		return msg
+	}
+	switch m := msg.(type) {
+	case *pgproto.Query:
+		if _, rest, ok := sqlparse.TrailingComment(m.String); ok {
+			return &pgproto.Query{String: rest}
+		}
+	case *pgproto.Parse:
+		if _, rest, ok := sqlparse.TrailingComment(m.Query); ok {
+			return &pgproto.Parse{Name: m.Name, Query: rest, ParameterOIDs: m.ParameterOIDs}
+		}
+	}
+	return msg
+}
+
+func setError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+func peerAttributes(addr string) []attribute.KeyValue {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []attribute.KeyValue{semconv.NetPeerNameKey.String(addr)}
+	}
+	attrs := []attribute.KeyValue{semconv.NetPeerNameKey.String(host)}
+	if n, err := strconv.Atoi(port); err == nil {
+		attrs = append(attrs, semconv.NetPeerPortKey.Int(n))
+	}
+	return attrs
+}
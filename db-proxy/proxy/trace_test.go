@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mu-wahba/db-proxy-go/mysqlproto"
+	"github.com/mu-wahba/db-proxy-go/slowlog"
+	"github.com/mu-wahba/db-proxy-go/stats"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestStartQueryTraceparent(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+	st := &sessionTrace{tracer: tracer}
+	st.ctx, st.span = tracer.Start(context.Background(), "db-proxy session")
+	session := st.span.SpanContext()
+
+	app, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	tests := []struct {
+		sql   string
+		trace trace.TraceID
+	}{
+		{"SELECT 1 /*traceparent='00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01'*/", app},
+		{"SELECT 1 /*tracestate='a%3Db',traceparent='00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01'*/", app},
+		//a malformed traceparent leaves the query in the session's trace
+		{"SELECT 1 /*traceparent='00-0af7651916cd43dd8448eb211c80319c-b7ad6b71692033-01'*/", session.TraceID()},
+		{"SELECT 1 /*traceparent='00-00000000000000000000000000000000-b7ad6b7169203331-01'*/", session.TraceID()},
+		{"SELECT 1 /*traceparent='ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01'*/", session.TraceID()},
+		{"SELECT 1 /*traceparent=00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01*/", session.TraceID()},
+		{"SELECT 1", session.TraceID()},
+	}
+	for _, tt := range tests {
+		span := st.startQuery(tt.sql)
+		span.End()
+		got := span.SpanContext().TraceID()
+		if got != tt.trace {
+			t.Errorf("startQuery(%q) in trace %s, want %s", tt.sql, got, tt.trace)
+		}
+		ended := spans.Ended()
+		links := ended[len(ended)-1].Links()
+		if joined := tt.trace == app; joined != (len(links) == 1 && links[0].SpanContext.SpanID() == session.SpanID()) {
+			t.Errorf("startQuery(%q) links %v", tt.sql, links)
+		}
+	}
+}
+
+func TestMySQLTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slow.jsonl")
+	l, err := slowlog.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &sessionTrace{
+		stats:      stats.New(100),
+		user:       "app",
+		slowLog:    l,
+		redact:     slowlog.RedactLiterals,
+		clientAddr: "10.0.0.5:50000",
+		mysql:      true,
+		statements: map[string]string{},
+	}
+	spans := tracetest.NewSpanRecorder()
+	st.tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+	st.ctx, st.span = st.tracer.Start(context.Background(), "db-proxy session")
+	ok := func(affected uint64) *mysqlproto.Response {
+		return &mysqlproto.Response{Affected: int64(affected)}
+	}
+	statement := func(command byte, id uint32) []byte {
+		return []byte{command, byte(id), 0, 0, 0}
+	}
+	exchange := func(payload []byte, resp *mysqlproto.Response, addr string) {
+		st.mysqlCommand(payload)
+		st.mysqlAnswer(payload[0], resp, addr)
+	}
+
+	exchange(append([]byte{mysqlproto.ComQuery}, `UPDATE users SET password = "it\"s hunter2" WHERE id = 1`...), ok(2), "db1:3306")
+	exchange(append([]byte{mysqlproto.ComStmtPrepare}, "SELECT * FROM users WHERE id = ?"...), &mysqlproto.Response{StatementID: 7}, "db1:3306")
+	exchange(statement(mysqlproto.ComStmtExecute, 7), &mysqlproto.Response{Rows: 3}, "db1:3306")
+	exchange(statement(mysqlproto.ComStmtExecute, 7), &mysqlproto.Response{Rows: 1}, "db1:3306")
+	//a ping runs no statement
+	exchange([]byte{mysqlproto.ComPing}, ok(0), "db1:3306")
+	//nor is an unknown statement
+	st.mysqlCommand(statement(mysqlproto.ComStmtClose, 7))
+	exchange(statement(mysqlproto.ComStmtExecute, 7), &mysqlproto.Response{Err: mysqlproto.NewError(1243, "HY000", "Unknown prepared statement handler")}, "db1:3306")
+	//the proxy answers blocked statements itself
+	exchange(append([]byte{mysqlproto.ComQuery}, "DROP TABLE users"...), &mysqlproto.Response{Err: mysqlproto.NewError(1227, "42000", "permission denied")}, "")
+	st.end()
+	l.Close()
+
+	var names []string
+	for _, span := range spans.Ended() {
+		failed := span.Status().Code == codes.Error
+		names = append(names, fmt.Sprintf("%s %v", span.Name(), failed))
+		if !failed && span.Name() != "db-proxy session" && !hasAttribute(span, semconv.DBSystemMySQL) {
+			t.Errorf("span %s has attributes %v", span.Name(), span.Attributes())
+		}
+	}
+	if got, want := strings.Join(names, ", "), "UPDATE false, SELECT false, SELECT false, query true, DROP true, db-proxy session false"; got != want {
+		t.Errorf("spans %s, want %s", got, want)
+	}
+
+	got := map[string]stats.Statement{}
+	for _, s := range st.stats.Snapshot(stats.SortCalls) {
+		got[s.Fingerprint] = s
+	}
+	want := []stats.Statement{
+		{Fingerprint: "UPDATE USERS SET PASSWORD = ? WHERE ID = ?", User: "app", Calls: 1, Rows: 2},
+		{Fingerprint: "SELECT * FROM USERS WHERE ID = ?", User: "app", Calls: 2, Rows: 4},
+		{Fingerprint: "DROP TABLE USERS", User: "app", Calls: 1, Errors: 1},
+	}
+	if len(got) != len(want) {
+		t.Errorf("%d fingerprints, want %d: %v", len(got), len(want), got)
+	}
+	for _, w := range want {
+		g := got[w.Fingerprint]
+		if g.User != w.User || g.Database != "" || g.Calls != w.Calls || g.Errors != w.Errors || g.Rows != w.Rows {
+			t.Errorf("%q: user %q, database %q, %d calls, %d errors, %d rows; want %q, \"\", %d, %d, %d",
+				w.Fingerprint, g.User, g.Database, g.Calls, g.Errors, g.Rows, w.User, w.Calls, w.Errors, w.Rows)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Errorf("redacting literals, the log shows a secret: %s", data)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("%d slow log entries, want 4:\n%s", len(lines), data)
+	}
+	for i, part := range []string{
+		`"rows":2,"statement":"UPDATE USERS SET PASSWORD = ? WHERE ID = ?"}`,
+		`"rows":3,"statement":"SELECT * FROM USERS WHERE ID = ?"}`,
+		`"rows":1,"statement":"SELECT * FROM USERS WHERE ID = ?"}`,
+		`"backend":"","duration_ms":`,
+	} {
+		if !strings.Contains(lines[i], part) {
+			t.Errorf("slow log entry %d = %s, want it to contain %s", i+1, lines[i], part)
+		}
+	}
+	if want := `"rows":0,"error":"42000","statement":"DROP TABLE USERS"}`; !strings.HasSuffix(lines[3], want) {
+		t.Errorf("slow log entry 4 = %s, want it to end with %s", lines[3], want)
+	}
+}
+
+func hasAttribute(span sdktrace.ReadOnlySpan, kv attribute.KeyValue) bool {
+	for _, a := range span.Attributes() {
+		if a == kv {
+			return true
+		}
+	}
+	return false
+}
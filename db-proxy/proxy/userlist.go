@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// UserMapping is the server user a client user is mapped to, and the
+// password the proxy logs in with on its behalf.
+type UserMapping struct {
+	User     string
+	Password string
+}
+
+// LoadUserList reads a pgbouncer-style auth file: one `"user" "password"`
+// pair per line, where the password may also be an MD5 secret
+// ("md5" + md5(password + user)). A line may map the user to a server
+// user and its password with two more fields, which go into mappings.
+// Blank lines and lines starting with ';' or '#' are skipped.
+func LoadUserList(path string) (users map[string]string, mappings map[string]UserMapping, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	users = map[string]string{}
+	mappings = map[string]UserMapping{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		fields, err := quotedFields(line)
+		if err != nil || (len(fields) != 2 && len(fields) != 4) {
+			return nil, nil, fmt.Errorf("%s:%d: expected \"user\" \"password\", optionally followed by \"server user\" \"server password\"", path, n)
+		}
+		users[fields[0]] = fields[1]
+		if len(fields) == 4 {
+			mappings[fields[0]] = UserMapping{User: fields[2], Password: fields[3]}
+		}
+	}
+	return users, mappings, scanner.Err()
+}
+
+// quotedFields splits a line of double-quoted strings. A doubled quote
+// inside a string stands for a literal quote.
+func quotedFields(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return fields, nil
+		}
+		if line[0] != '"' {
+			return nil, fmt.Errorf("unquoted field")
+		}
+		var b strings.Builder
+		i := 1
+		for ; i < len(line); i++ {
+			if line[i] != '"' {
+				b.WriteByte(line[i])
+				continue
+			}
+			if i+1 < len(line) && line[i+1] == '"' {
+				b.WriteByte('"')
+				i++
+				continue
+			}
+			break
+		}
+		if i >= len(line) {
+			return nil, fmt.Errorf("unterminated quote")
+		}
+		fields = append(fields, b.String())
+		line = line[i+1:]
+	}
+}
@@ -0,0 +1,219 @@
+// Package proxyproto reads and writes the headers of HAProxy's PROXY
+// protocol, versions 1 and 2, with which a load balancer or proxy tells
+// the server it connects to whose connection it is passing on.
+// See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// v2Signature starts every version 2 header, and v1Prefix every version 1
+// header.
+var (
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	v1Prefix    = []byte("PROXY ")
+)
+
+// v1MaxLength is the longest a version 1 header may be, CRLF included.
+const v1MaxLength = 107
+
+// Version 2 commands and address families.
+const (
+	v2Local = 0x20
+	v2Proxy = 0x21
+	tcp4    = 0x11
+	tcp6    = 0x21
+)
+
+// ErrNoHeader is returned by ReadHeader when the connection does not start
+// with a PROXY header.
+var ErrNoHeader = errors.New("no PROXY protocol header")
+
+// ReadHeader reads a version 1 or 2 header from r, which should not be
+// buffered: nothing past the header is read. It returns the addresses of
+// the original connection, or nil ones for a header that has none, as the
+// health checks of load balancers send (LOCAL, UNKNOWN), or that has
+// other than TCP addresses.
+func ReadHeader(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	start := make([]byte, len(v1Prefix))
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case bytes.Equal(start, v1Prefix):
+		return readV1(r)
+	case bytes.Equal(start, v2Signature[:len(start)]):
+		return readV2(r)
+	}
+	return nil, nil, ErrNoHeader
+}
+
+// readV1 reads the rest of a version 1 header, after "PROXY ". The header
+// ends at CRLF, so it is read a byte at a time not to read past it.
+func readV1(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	line := make([]byte, 0, v1MaxLength)
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == v1MaxLength-len(v1Prefix) {
+			return nil, nil, errors.New("PROXY header too long")
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY header %q", line)
+	}
+	if src, err = v1Addr(fields[1], fields[3]); err == nil {
+		dst, err = v1Addr(fields[2], fields[4])
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid PROXY header %q: %w", line, err)
+	}
+	return src, dst, nil
+}
+
+func v1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", host)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(n)}, nil
+}
+
+// readV2 reads the rest of a version 2 header, after the first bytes of
+// its signature.
+func readV2(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	head := make([]byte, len(v2Signature)+4-len(v1Prefix))
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(head[:len(v2Signature)-len(v1Prefix)], v2Signature[len(v1Prefix):]) {
+		return nil, nil, ErrNoHeader
+	}
+	head = head[len(v2Signature)-len(v1Prefix):]
+	command, family := head[0], head[1]
+	body := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch command {
+	case v2Local:
+		return nil, nil, nil
+	case v2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("invalid PROXY header version or command %#x", command)
+	}
+	//the addresses may be followed by TLVs, which are of no use here
+	size := 0
+	switch family {
+	case tcp4:
+		size = net.IPv4len
+	case tcp6:
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("PROXY header too short for its addresses")
+	}
+	src = &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(body[2*size:]))}
+	dst = &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(body[2*size+2:]))}
+	return src, dst, nil
+}
+
+// Header returns a version 1 or 2 header for a connection from src to
+// dst. Unless both are TCP addresses it says that the connection is the
+// sender's own: a LOCAL header in version 2 and an UNKNOWN one in
+// version 1.
+func Header(version int, src, dst net.Addr) []byte {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	local := !sok || !dok
+	var srcIP, dstIP net.IP
+	family := byte(tcp4)
+	if !local {
+		srcIP, dstIP = s.IP.To4(), d.IP.To4()
+		if srcIP == nil || dstIP == nil {
+			//one of them is IPv6, so both are written that way
+			srcIP, dstIP, family = s.IP.To16(), d.IP.To16(), tcp6
+		}
+	}
+
+	if version == 1 {
+		if local {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		if family == tcp4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, s.Port, d.Port))
+		}
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", v6String(srcIP), v6String(dstIP), s.Port, d.Port))
+	}
+
+	buf := append([]byte{}, v2Signature...)
+	if local {
+		return append(buf, v2Local, 0, 0, 0)
+	}
+	buf = append(buf, v2Proxy, family)
+	buf = appendUint16(buf, uint16(2*len(srcIP)+4))
+	buf = append(buf, srcIP...)
+	buf = append(buf, dstIP...)
+	buf = appendUint16(buf, uint16(s.Port))
+	return appendUint16(buf, uint16(d.Port))
+}
+
+// v6String formats ip in IPv6 notation, which net.IP.String does not use
+// for IPv4-mapped addresses.
+func v6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+// Conn is a connection passed on by a load balancer, with the addresses
+// of the original connection from its PROXY header.
+type Conn struct {
+	net.Conn
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// RemoteAddr returns the address of the original client.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.Source
+}
+
+// LocalAddr returns the address the original client connected to.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.Destination
+}
+
+// SetLinger sets SO_LINGER on the underlying TCP connection, if it is one.
+func (c *Conn) SetLinger(sec int) error {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		return tcp.SetLinger(sec)
+	}
+	return nil
+}
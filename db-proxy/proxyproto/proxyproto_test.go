@@ -0,0 +1,130 @@
+package proxyproto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func addr(s string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		src, dst string
+		v1       string
+	}{
+		{"192.0.2.1:51234", "198.51.100.7:5432", "PROXY TCP4 192.0.2.1 198.51.100.7 51234 5432\r\n"},
+		{"[2001:db8::1]:51234", "[2001:db8::2]:6379", "PROXY TCP6 2001:db8::1 2001:db8::2 51234 6379\r\n"},
+		//one IPv6 address makes both IPv6
+		{"192.0.2.1:1", "[2001:db8::2]:3306", "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 1 3306\r\n"},
+		{"[2001:db8::1]:65535", "198.51.100.7:3306", "PROXY TCP6 2001:db8::1 ::ffff:198.51.100.7 65535 3306\r\n"},
+		//IPv4-mapped addresses are IPv4
+		{"[::ffff:192.0.2.1]:1", "[::ffff:198.51.100.7]:2", "PROXY TCP4 192.0.2.1 198.51.100.7 1 2\r\n"},
+	}
+	for _, tt := range tests {
+		src, dst := addr(tt.src), addr(tt.dst)
+		if got := string(Header(1, src, dst)); got != tt.v1 {
+			t.Errorf("Header(1, %s, %s) = %q, want %q", src, dst, got, tt.v1)
+		}
+		for _, version := range []int{1, 2} {
+			//what follows the header must be left unread
+			r := bytes.NewReader(append(Header(version, src, dst), "payload"...))
+			gotSrc, gotDst, err := ReadHeader(r)
+			if err != nil {
+				t.Errorf("v%d %s %s: %v", version, src, dst, err)
+				continue
+			}
+			if !gotSrc.IP.Equal(src.IP) || gotSrc.Port != src.Port || !gotDst.IP.Equal(dst.IP) || gotDst.Port != dst.Port {
+				t.Errorf("v%d: ReadHeader = %s %s, want %s %s", version, gotSrc, gotDst, src, dst)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("v%d: left %q after the header", version, rest)
+			}
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	unix := &net.UnixAddr{Name: "/run/dbproxy.sock", Net: "unix"}
+	if got := string(Header(1, unix, addr("127.0.0.1:5432"))); got != "PROXY UNKNOWN\r\n" {
+		t.Errorf("v1 header for a unix socket = %q", got)
+	}
+	if got := Header(2, nil, nil); !bytes.Equal(got, append(append([]byte{}, v2Signature...), v2Local, 0, 0, 0)) {
+		t.Errorf("v2 header without addresses = %q", got)
+	}
+
+	headers := map[string][]byte{
+		"v1 UNKNOWN":                []byte("PROXY UNKNOWN\r\n"),
+		"v1 UNKNOWN with addresses": []byte("PROXY UNKNOWN 192.0.2.1 198.51.100.7 1 2\r\n"),
+		"v2 LOCAL":                  Header(2, nil, nil),
+		"v2 LOCAL with addresses":   append(append([]byte{}, v2Signature...), v2Local, tcp4, 0, 12, 1, 2, 3, 4, 5, 6, 7, 8, 0, 1, 0, 2),
+		"v2 unix socket":            append(append(append([]byte{}, v2Signature...), v2Proxy, 0x31, 0, 216), make([]byte, 216)...),
+	}
+	for name, h := range headers {
+		r := bytes.NewReader(append(h, 'x'))
+		src, dst, err := ReadHeader(r)
+		if err != nil || src != nil || dst != nil {
+			t.Errorf("%s: ReadHeader = %v, %v, %v; want no addresses", name, src, dst, err)
+		}
+		if r.Len() != 1 {
+			t.Errorf("%s: %d bytes left after the header, want 1", name, r.Len())
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	v2 := Header(2, addr("192.0.2.1:1"), addr("198.51.100.7:2"))
+	//a length too short for the addresses of its family
+	short := append([]byte{}, v2[:len(v2)-4]...)
+	short[len(v2Signature)+3] -= 4
+	//a length longer than what follows
+	truncated := v2[:len(v2)-1]
+	badCommand := append([]byte{}, v2...)
+	badCommand[len(v2Signature)] = 0x22
+
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"v1 too long", []byte("PROXY TCP6 " + strings.Repeat("1", 100) + "\r\n")},
+		{"v1 without CRLF", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 1 2")},
+		{"v1 short", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 1\r\n")},
+		{"v1 protocol", []byte("PROXY UDP4 192.0.2.1 198.51.100.7 1 2\r\n")},
+		{"v1 address", []byte("PROXY TCP4 192.0.2 198.51.100.7 1 2\r\n")},
+		{"v1 port", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 1 65536\r\n")},
+		{"v2 addresses cut", short},
+		{"v2 truncated", truncated},
+		{"v2 signature cut", v2Signature[:9]},
+		{"v2 command", badCommand},
+	}
+	for _, tt := range tests {
+		if src, dst, err := ReadHeader(bytes.NewReader(tt.header)); err == nil || err == ErrNoHeader {
+			t.Errorf("%s: ReadHeader = %v, %v, %v; want an error", tt.name, src, dst, err)
+		}
+	}
+
+	//the longest v1 header allowed is read
+	longest := "PROXY UNKNOWN ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"
+	if len(longest) != v1MaxLength {
+		t.Fatalf("longest header is %d bytes", len(longest))
+	}
+	if _, _, err := ReadHeader(strings.NewReader(longest)); err != nil {
+		t.Errorf("longest v1 header: %v", err)
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	for _, s := range []string{"\x00\x00\x00\x08\x04\xd2\x16\x2f", "GET / HTTP/1.1\r\n", "\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x00"} {
+		if _, _, err := ReadHeader(strings.NewReader(s)); err != ErrNoHeader {
+			t.Errorf("ReadHeader(%q) = %v, want ErrNoHeader", s, err)
+		}
+	}
+}
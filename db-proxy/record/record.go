@@ -0,0 +1,164 @@
+// Package record writes client sessions to a file and replays them
+// against a database to compare the responses.
+//
+// A recording is a JSON Lines file with one Event per line. Sessions are
+// recorded from the moment they are ready for their first query, so the
+// login, and the password with it, is never written. MySQL sessions are
+// recorded as packets; they cannot be replayed.
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+)
+
+// Event kinds.
+const (
+	KindStart  = "start"
+	KindClient = "client"
+	KindServer = "server"
+	KindEnd    = "end"
+)
+
+// ProtocolMySQL is the protocol of a MySQL session. PostgreSQL sessions
+// have none.
+const ProtocolMySQL = "mysql"
+
+// flushInterval is how often recorded events are written out.
+const flushInterval = time.Second
+
+// Event is one line of a recording.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Session tells the sessions of a recording apart. IDs start over when
+	// the proxy restarts; a start event always begins a new session.
+	Session  uint64 `json:"session"`
+	Kind     string `json:"kind"`
+	User     string `json:"user,omitempty"`
+	Database string `json:"database,omitempty"`
+	// Protocol is set on the start event of a session that is not
+	// PostgreSQL's
+	Protocol string `json:"protocol,omitempty"`
+	// Message is the wire form of a client or server message, or the
+	// payload of a MySQL packet
+	Message []byte `json:"message,omitempty"`
+}
+
+// Recorder appends events to a file. It is safe for concurrent use, and
+// its methods do nothing on a nil or closed Recorder.
+type Recorder struct {
+	Path string
+
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	enc    *json.Encoder
+	err    error
+	closed bool
+	done   chan struct{}
+}
+
+// Open opens path for appending, creating it if needed.
+func Open(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{Path: path, file: file, w: bufio.NewWriter(file), done: make(chan struct{})}
+	r.enc = json.NewEncoder(r.w)
+	go r.flushLoop()
+	return r, nil
+}
+
+// Start records that a session began.
+func (r *Recorder) Start(session uint64, user, database string) {
+	r.write(Event{Session: session, Kind: KindStart, User: user, Database: database})
+}
+
+// Message records a message from the client (KindClient) or the server
+// (KindServer). Password messages are left out.
+func (r *Recorder) Message(session uint64, kind string, msg pgproto.Message) {
+	if r == nil {
+		return
+	}
+	if _, ok := msg.(*pgproto.PasswordMessage); ok {
+		return
+	}
+	r.write(Event{Session: session, Kind: kind, Message: msg.Encode(nil)})
+}
+
+// StartMySQL records that a MySQL session began.
+func (r *Recorder) StartMySQL(session uint64, user, database string) {
+	r.write(Event{Session: session, Kind: KindStart, User: user, Database: database, Protocol: ProtocolMySQL})
+}
+
+// Packet records a MySQL packet from the client (KindClient) or the
+// server (KindServer).
+func (r *Recorder) Packet(session uint64, kind string, payload []byte) {
+	r.write(Event{Session: session, Kind: kind, Message: payload})
+}
+
+// End records that a session ended.
+func (r *Recorder) End(session uint64) {
+	r.write(Event{Session: session, Kind: KindEnd})
+}
+
+func (r *Recorder) write(e Event) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.err != nil {
+		return
+	}
+	e.Time = time.Now()
+	if r.err = r.enc.Encode(e); r.err != nil {
+		log.Printf("Error recording to %s, recording stopped: %v", r.Path, r.err)
+	}
+}
+
+func (r *Recorder) flushLoop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			if r.err == nil {
+				if r.err = r.w.Flush(); r.err != nil {
+					log.Printf("Error recording to %s, recording stopped: %v", r.Path, r.err)
+				}
+			}
+			r.mu.Unlock()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Close writes out what is buffered and closes the file. Sessions still
+// running are not recorded any further.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	err := r.w.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
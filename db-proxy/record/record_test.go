@@ -0,0 +1,154 @@
+package record
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+)
+
+func TestRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rec.jsonl")
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start(2, "late", "db")
+	r.Start(1, "app", "db")
+	r.Message(1, KindClient, &pgproto.Query{String: "SELECT 1"})
+	r.Message(1, KindClient, &pgproto.PasswordMessage{Data: []byte("secret\x00")})
+	r.Message(1, KindServer, &pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle})
+	r.End(1)
+	//after its end a session ID may be used again
+	r.Message(1, KindClient, &pgproto.Query{String: "SELECT 2"})
+	r.Message(3, KindClient, &pgproto.Query{String: "SELECT 3"})
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r.Start(4, "closed", "db")
+	var nilRecorder *Recorder
+	nilRecorder.Message(1, KindClient, &pgproto.Sync{})
+	if err := nilRecorder.Close(); err != nil {
+		t.Errorf("closing a nil Recorder: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "c2VjcmV0") {
+		t.Errorf("password recorded: %s", data)
+	}
+	sessions, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []string
+	for _, s := range sessions {
+		users = append(users, s.User)
+	}
+	if !reflect.DeepEqual(users, []string{"late", "app"}) {
+		t.Fatalf("loaded sessions of %q", users)
+	}
+	events := sessions[1].Events
+	if len(events) != 2 || events[0].Kind != KindClient || events[1].Kind != KindServer ||
+		string(events[0].Message) != string((&pgproto.Query{String: "SELECT 1"}).Encode(nil)) {
+		t.Errorf("loaded events %+v", events)
+	}
+
+	os.WriteFile(path, append(data, "{not json\n"...), 0o600)
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "event 8") {
+		t.Errorf("Load of a broken recording = %v", err)
+	}
+}
+
+func TestRecordMySQL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rec.jsonl")
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := append([]byte{0x03}, "SELECT 1"...)
+	r.StartMySQL(1, "app", "shop")
+	r.Packet(1, KindClient, query)
+	r.Packet(1, KindServer, []byte{0, 0, 0, 2, 0, 0, 0})
+	r.End(1)
+	r.Close()
+
+	sessions, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Protocol != ProtocolMySQL || sessions[0].User != "app" || sessions[0].Database != "shop" {
+		t.Fatalf("loaded sessions %+v", sessions)
+	}
+	events := sessions[0].Events
+	if len(events) != 2 || events[0].Kind != KindClient || string(events[0].Message) != string(query) || events[1].Kind != KindServer {
+		t.Errorf("loaded events %+v", events)
+	}
+	res := Replay(sessions, Options{Addr: "127.0.0.1:1", Timeout: time.Second})
+	if res[0].Err == nil || res[0].Err.Error() != "cannot replay mysql sessions" {
+		t.Errorf("replaying a MySQL session: %v", res[0].Err)
+	}
+}
+
+func TestLoadOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rec.jsonl")
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339Nano)
+	later := time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC).Format(time.RFC3339Nano)
+	os.WriteFile(path, []byte(
+		`{"time":"`+later+`","session":1,"kind":"start","user":"b"}`+"\n"+
+			`{"time":"`+base+`","session":2,"kind":"start","user":"a"}`+"\n"+
+			`{"time":"`+later+`","session":9,"kind":"client","message":"UQAAAA1TRUxFQ1QgMQA="}`+"\n"), 0o600)
+	sessions, err := Load(path)
+	if err != nil || len(sessions) != 2 || sessions[0].User != "a" || sessions[1].User != "b" {
+		t.Fatalf("Load = %+v, %v", sessions, err)
+	}
+	for _, s := range sessions {
+		if len(s.Events) != 0 {
+			t.Errorf("session %d has events %+v", s.ID, s.Events)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	row := func(v string) pgproto.Message { return &pgproto.DataRow{Values: [][]byte{[]byte(v)}} }
+	rfq := &pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle}
+	done := &pgproto.CommandComplete{Tag: "SELECT 1"}
+	recorded := []pgproto.Message{
+		row("1"), done, rfq,
+		&pgproto.ParameterStatus{Name: "TimeZone", Value: "UTC"},
+		&pgproto.ErrorResponse{Severity: "ERROR", Code: "42P01", Message: `relation "t" does not exist`}, rfq,
+		&pgproto.RowDescription{Fields: []pgproto.FieldDescription{{Name: "a", TableOID: 1, DataTypeOID: 25}}}, row("2"), done, rfq,
+	}
+	//what differs between servers by nature is not a difference
+	replayed := []pgproto.Message{
+		row("1"), done, rfq,
+		&pgproto.ErrorResponse{Severity: "ERROR", Code: "42P01", Message: `relation "t" does not exist (other text)`}, rfq,
+		&pgproto.RowDescription{Fields: []pgproto.FieldDescription{{Name: "a", TableOID: 2, DataTypeOID: 25}}}, row("2"), done, rfq,
+	}
+	queries := []string{"SELECT 1", "SELECT * FROM t", "SELECT a\n  FROM u"}
+	if n, differences, diffs := compare(recorded, replayed, queries); n != 3 || differences != 0 {
+		t.Errorf("compare of equal responses = %d, %d, %q", n, differences, diffs)
+	}
+
+	replayed[0] = row("one")
+	replayed[6] = row("3")
+	n, differences, diffs := compare(recorded, replayed, queries)
+	want := []string{
+		`response 1 (SELECT 1): recorded DataRow("1"), got DataRow("one")`,
+		`response 3 (SELECT a FROM u): recorded DataRow("2"), got DataRow("3")`,
+	}
+	if n != 3 || differences != 2 || !reflect.DeepEqual(diffs, want) {
+		t.Errorf("compare = %d, %d, %q, want %q", n, differences, diffs, want)
+	}
+	//a response cut short, and one that never came
+	want = []string{
+		`response 1 ((no statement)): missing CommandComplete("SELECT 1")`,
+		`response 2 ((no statement)): missing ErrorResponse(42P01 relation "t" does not exist)`,
+	}
+	if _, _, diffs := compare(recorded[:6], recorded[:1], nil); !reflect.DeepEqual(diffs, want) {
+		t.Errorf("compare of a cut response = %q, want %q", diffs, want)
+	}
+}
@@ -0,0 +1,407 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/pgproto"
+	"github.com/mu-wahba/db-proxy-go/pool"
+)
+
+// maxDiffs caps the differences reported per session.
+const maxDiffs = 10
+
+// Session is one recorded client session.
+type Session struct {
+	ID       uint64
+	User     string
+	Database string
+	// Protocol is ProtocolMySQL for a MySQL session, empty for PostgreSQL
+	Protocol string
+	Start    time.Time
+	// Events are the client and server events in the order they happened
+	Events []Event
+}
+
+// Load reads a recording. Sessions are returned in the order they started;
+// events of a session that never got its start event are skipped.
+func Load(path string) ([]*Session, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var sessions []*Session
+	open := map[uint64]*Session{}
+	dec := json.NewDecoder(file)
+	for line := 1; ; line++ {
+		var e Event
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: event %d: %w", path, line, err)
+		}
+		switch e.Kind {
+		case KindStart:
+			s := &Session{ID: e.Session, User: e.User, Database: e.Database, Protocol: e.Protocol, Start: e.Time}
+			open[e.Session] = s
+			sessions = append(sessions, s)
+		case KindClient, KindServer:
+			if s := open[e.Session]; s != nil {
+				s.Events = append(s.Events, e)
+			}
+		case KindEnd:
+			delete(open, e.Session)
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].Start.Before(sessions[j].Start)
+	})
+	return sessions, nil
+}
+
+// Options control a replay.
+type Options struct {
+	// Addr is the database to replay against
+	Addr string
+	TLS  *tls.Config
+	// Passwords holds passwords by user; Password is used for the others
+	Passwords map[string]string
+	Password  string
+	// Speed scales the recorded timing: 2 replays twice as fast, and 0
+	// sends each message as soon as the one before it was answered
+	Speed float64
+	// Serial replays the sessions one after another instead of at their
+	// recorded start times
+	Serial bool
+	// Timeout bounds logging in and waiting for each response
+	Timeout time.Duration
+}
+
+// Result is the outcome of replaying one session.
+type Result struct {
+	Session *Session
+	// Batches is the number of ReadyForQuery-terminated responses compared
+	Batches int
+	// Differences counts the responses that differ from the recording;
+	// Diffs describes the first few
+	Differences int
+	Diffs       []string
+	// Err is set if the session could not be replayed to the end
+	Err error
+}
+
+// Replay sends the client messages of sessions to opts.Addr and compares
+// the responses with the recorded ones. Only PostgreSQL sessions can be
+// replayed; the others fail.
+//
+// Each client message is sent once the responses that came before it in
+// the recording have arrived, and not before its recorded time (scaled by
+// Speed) has come, so every session sees the same conversation it did
+// when it was recorded.
+func Replay(sessions []*Session, opts Options) []Result {
+	results := make([]Result, len(sessions))
+	if opts.Serial {
+		for i, s := range sessions {
+			results[i] = replaySession(s, opts, s.Start, time.Now())
+		}
+		return results
+	}
+	if len(sessions) == 0 {
+		return results
+	}
+	origin, start := sessions[0].Start, time.Now()
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		wg.Add(1)
+		go func(i int, s *Session) {
+			defer wg.Done()
+			results[i] = replaySession(s, opts, origin, start)
+		}(i, s)
+	}
+	wg.Wait()
+	return results
+}
+
+// replaySession replays s with its recorded time origin mapped to start.
+func replaySession(s *Session, opts Options, origin, start time.Time) Result {
+	res := Result{Session: s}
+	if s.Protocol != "" {
+		res.Err = fmt.Errorf("cannot replay %s sessions", s.Protocol)
+		return res
+	}
+	due := func(t time.Time) time.Time {
+		if opts.Speed <= 0 {
+			return start
+		}
+		return start.Add(time.Duration(float64(t.Sub(origin)) / opts.Speed))
+	}
+	time.Sleep(time.Until(due(s.Start)))
+
+	password, ok := opts.Passwords[s.User]
+	if !ok {
+		password = opts.Password
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	conn, err := pool.Connect(ctx, opts.Addr, pool.Credentials{User: s.User, Password: password, Database: s.Database}, opts.TLS)
+	cancel()
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer conn.Close()
+
+	got := make(chan pgproto.Message, 256)
+	go func() {
+		defer close(got)
+		for {
+			msg, err := pgproto.ReadBackendMessage(conn.Reader)
+			if err != nil {
+				return
+			}
+			got <- msg
+		}
+	}()
+	var replayed []pgproto.Message
+	answered := 0
+	//await collects responses until n ReadyForQuery messages have arrived
+	await := func(n int) error {
+		timeout := time.NewTimer(opts.Timeout)
+		defer timeout.Stop()
+		for answered < n {
+			select {
+			case msg, ok := <-got:
+				if !ok {
+					return errors.New("server closed the connection")
+				}
+				replayed = append(replayed, msg)
+				if _, ok := msg.(*pgproto.ReadyForQuery); ok {
+					answered++
+				}
+			case <-timeout.C:
+				return fmt.Errorf("no response after %v", opts.Timeout)
+			}
+		}
+		return nil
+	}
+
+	var recorded []pgproto.Message
+	//queries labels each batch with its statement for the report
+	var queries []string
+	batchQuery := ""
+	prepared := map[string]string{}
+	expected := 0
+	for _, e := range s.Events {
+		if e.Kind == KindServer {
+			msg, err := pgproto.ReadBackendMessage(bytes.NewReader(e.Message))
+			if err != nil {
+				res.Err = fmt.Errorf("recorded server message: %w", err)
+				return res
+			}
+			recorded = append(recorded, msg)
+			if _, ok := msg.(*pgproto.ReadyForQuery); ok {
+				expected++
+			}
+			continue
+		}
+		msg, err := pgproto.ReadFrontendMessage(bytes.NewReader(e.Message))
+		if err != nil {
+			res.Err = fmt.Errorf("recorded client message: %w", err)
+			return res
+		}
+		switch m := msg.(type) {
+		case *pgproto.Terminate:
+			continue
+		case *pgproto.Query:
+			queries = append(queries, m.String)
+		case *pgproto.Parse:
+			prepared[m.Name] = m.Query
+			if batchQuery == "" {
+				batchQuery = m.Query
+			}
+		case *pgproto.Bind:
+			if batchQuery == "" {
+				batchQuery = prepared[m.Statement]
+			}
+		case *pgproto.Sync:
+			queries = append(queries, batchQuery)
+			batchQuery = ""
+		case *pgproto.Unknown:
+			if m.Type == 'F' {
+				queries = append(queries, "function call")
+			}
+		}
+
+		if res.Err == nil {
+			res.Err = await(expected)
+		}
+		if res.Err != nil {
+			continue
+		}
+		time.Sleep(time.Until(due(e.Time)))
+		if err := pgproto.Write(conn.Writer, msg); err == nil {
+			err = conn.Writer.Flush()
+		}
+		if err != nil {
+			res.Err = err
+		}
+	}
+	if res.Err == nil {
+		res.Err = await(expected)
+	}
+	pgproto.Write(conn, &pgproto.Terminate{})
+
+	res.Batches, res.Differences, res.Diffs = compare(recorded, replayed, queries)
+	return res
+}
+
+// compare matches recorded and replayed responses batch by batch, so a
+// difference in one query's results does not throw off the next ones.
+func compare(recorded, replayed []pgproto.Message, queries []string) (n, differences int, diffs []string) {
+	want, got := batches(recorded), batches(replayed)
+	n = len(want)
+	if len(got) > n {
+		n = len(got)
+	}
+	for i := 0; i < n; i++ {
+		var w, g []pgproto.Message
+		if i < len(want) {
+			w = want[i]
+		}
+		if i < len(got) {
+			g = got[i]
+		}
+		diff := compareBatch(w, g)
+		if diff == "" {
+			continue
+		}
+		differences++
+		if len(diffs) == maxDiffs {
+			continue
+		}
+		query := ""
+		if i < len(queries) {
+			query = queries[i]
+		}
+		diffs = append(diffs, fmt.Sprintf("response %d (%s): %s", i+1, shorten(query), diff))
+	}
+	return n, differences, diffs
+}
+
+func compareBatch(want, got []pgproto.Message) string {
+	for i := 0; i < len(want) || i < len(got); i++ {
+		switch {
+		case i >= len(got):
+			return fmt.Sprintf("missing %s", describe(want[i]))
+		case i >= len(want):
+			return fmt.Sprintf("unexpected %s", describe(got[i]))
+		case !same(want[i], got[i]):
+			return fmt.Sprintf("recorded %s, got %s", describe(want[i]), describe(got[i]))
+		}
+	}
+	return ""
+}
+
+// batches splits messages after each ReadyForQuery, leaving out those
+// that differ between servers by nature.
+func batches(msgs []pgproto.Message) [][]pgproto.Message {
+	var out [][]pgproto.Message
+	var cur []pgproto.Message
+	for _, msg := range msgs {
+		switch msg.(type) {
+		case *pgproto.ParameterStatus, *pgproto.BackendKeyData:
+			continue
+		}
+		cur = append(cur, msg)
+		if _, ok := msg.(*pgproto.ReadyForQuery); ok {
+			out = append(out, cur)
+			cur = nil
+		}
+	}
+	if len(cur) > 0 {
+		out = append(out, cur)
+	}
+	return out
+}
+
+// same compares two server messages, ignoring what is expected to differ
+// from one database to another: error texts, table OIDs and process IDs.
+func same(a, b pgproto.Message) bool {
+	switch a := a.(type) {
+	case *pgproto.ErrorResponse:
+		b, ok := b.(*pgproto.ErrorResponse)
+		return ok && a.Severity == b.Severity && a.Code == b.Code
+	case *pgproto.NoticeResponse:
+		b, ok := b.(*pgproto.NoticeResponse)
+		return ok && a.Severity == b.Severity && a.Code == b.Code
+	case *pgproto.RowDescription:
+		b, ok := b.(*pgproto.RowDescription)
+		if !ok || len(a.Fields) != len(b.Fields) {
+			return false
+		}
+		for i, f := range a.Fields {
+			g := b.Fields[i]
+			if f.Name != g.Name || f.DataTypeOID != g.DataTypeOID || f.Format != g.Format {
+				return false
+			}
+		}
+		return true
+	case *pgproto.NotificationResponse:
+		b, ok := b.(*pgproto.NotificationResponse)
+		return ok && a.Channel == b.Channel && a.Payload == b.Payload
+	}
+	return bytes.Equal(a.Encode(nil), b.Encode(nil))
+}
+
+// describe renders a server message for a difference report.
+func describe(msg pgproto.Message) string {
+	switch m := msg.(type) {
+	case *pgproto.DataRow:
+		values := make([]string, len(m.Values))
+		for i, v := range m.Values {
+			if v == nil {
+				values[i] = "NULL"
+			} else {
+				values[i] = fmt.Sprintf("%q", v)
+			}
+		}
+		return shorten("DataRow(" + strings.Join(values, ", ") + ")")
+	case *pgproto.CommandComplete:
+		return fmt.Sprintf("CommandComplete(%q)", m.Tag)
+	case *pgproto.ErrorResponse:
+		return fmt.Sprintf("ErrorResponse(%s %s)", m.Code, shorten(m.Message))
+	case *pgproto.NoticeResponse:
+		return fmt.Sprintf("NoticeResponse(%s %s)", m.Code, shorten(m.Message))
+	case *pgproto.RowDescription:
+		names := make([]string, len(m.Fields))
+		for i, f := range m.Fields {
+			names[i] = f.Name
+		}
+		return "RowDescription(" + strings.Join(names, ", ") + ")"
+	case *pgproto.ReadyForQuery:
+		return fmt.Sprintf("ReadyForQuery(%c)", m.TxStatus)
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", msg), "*pgproto.")
+}
+
+func shorten(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > 80 {
+		return s[:77] + "..."
+	}
+	if s == "" {
+		return "(no statement)"
+	}
+	return s
+}
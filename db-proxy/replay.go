@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/proxy"
+	"github.com/mu-wahba/db-proxy-go/record"
+)
+
+// replayMain runs the replay subcommand and returns the exit status: 0 if
+// every session replayed with the recorded responses, 1 if not, 2 for
+// usage errors.
+func replayMain(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s replay -target host:port [flags] recording.jsonl\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	target := flags.String("target", "", "database to replay against, host:port")
+	authFile := flags.String("auth-file", "", "user list with the passwords to log in with, as for pool.auth_file")
+	password := flags.String("password", os.Getenv("PGPASSWORD"), "password for users not in -auth-file")
+	speed := flags.Float64("speed", 1, "replay speed; 2 is twice as fast, 0 does not wait between messages")
+	serial := flags.Bool("serial", false, "replay sessions one at a time instead of at their recorded times")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long to wait for a login or a response")
+	tlsMode := flags.String("tls-mode", tlsDisable, "TLS to the target, as server_tls.mode")
+	tlsCAFile := flags.String("tls-ca-file", "", "CA for -tls-mode verify-ca or verify-full")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	opts := record.Options{
+		Addr:     *target,
+		Password: *password,
+		Speed:    *speed,
+		Serial:   *serial,
+		Timeout:  *timeout,
+	}
+	var err error
+	if *authFile != "" {
+		if opts.Passwords, _, err = proxy.LoadUserList(*authFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading auth file: %v\n", err)
+			return 2
+		}
+	}
+	if opts.TLS, err = serverTLSConfig(serverTLSSettings{Mode: *tlsMode, CAFile: *tlsCAFile}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error in TLS settings: %v\n", err)
+		return 2
+	}
+	sessions, err := record.Load(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading recording: %v\n", err)
+		return 2
+	}
+	//the target is a PostgreSQL server
+	postgres := sessions[:0]
+	for _, s := range sessions {
+		if s.Protocol == "" {
+			postgres = append(postgres, s)
+		}
+	}
+	if skipped := len(sessions) - len(postgres); skipped > 0 {
+		fmt.Printf("Skipping %d MySQL sessions\n", skipped)
+	}
+	sessions = postgres
+
+	differing, failed := 0, 0
+	for _, res := range record.Replay(sessions, opts) {
+		s := res.Session
+		fmt.Printf("session %d %s/%s: %d responses", s.ID, s.User, s.Database, res.Batches)
+		switch {
+		case res.Err != nil:
+			failed++
+			fmt.Printf(", error: %v\n", res.Err)
+		case res.Differences > 0:
+			fmt.Printf(", %d differences\n", res.Differences)
+		default:
+			fmt.Printf(", OK\n")
+		}
+		if res.Differences > 0 {
+			differing++
+		}
+		for _, d := range res.Diffs {
+			fmt.Printf("  %s\n", d)
+		}
+		if more := res.Differences - len(res.Diffs); more > 0 {
+			fmt.Printf("  and %d more\n", more)
+		}
+	}
+	fmt.Printf("Replayed %d sessions: %d with differences, %d failed\n", len(sessions), differing, failed)
+	if differing > 0 || failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package resp
+
+import "strings"
+
+// commands are the Redis commands the proxy knows by name, set to true
+// for those that only read data and may be answered by a replica.
+var commands = map[string]bool{
+	//strings and keys
+	"get": true, "mget": true, "getrange": true, "substr": true, "strlen": true, "lcs": true,
+	"exists": true, "type": true, "ttl": true, "pttl": true, "expiretime": true, "pexpiretime": true,
+	"keys": true, "scan": true, "randomkey": true, "dbsize": true, "dump": true, "touch": true,
+	"bitcount": true, "bitpos": true, "getbit": true, "bitfield_ro": true, "sort_ro": true,
+	"set": false, "setnx": false, "setex": false, "psetex": false, "getset": false, "getdel": false,
+	"getex": false, "append": false, "incr": false, "decr": false, "incrby": false, "decrby": false,
+	"incrbyfloat": false, "mset": false, "msetnx": false, "setrange": false, "setbit": false,
+	"bitop": false, "bitfield": false, "del": false, "unlink": false, "expire": false, "pexpire": false,
+	"expireat": false, "pexpireat": false, "persist": false, "rename": false, "renamenx": false,
+	"move": false, "copy": false, "restore": false, "sort": false, "object": false, "migrate": false,
+	//lists
+	"lrange": true, "llen": true, "lindex": true, "lpos": true,
+	"lpush": false, "rpush": false, "lpushx": false, "rpushx": false, "lpop": false, "rpop": false,
+	"lset": false, "lrem": false, "ltrim": false, "linsert": false, "lmove": false, "blmove": false,
+	"rpoplpush": false, "brpoplpush": false, "blpop": false, "brpop": false, "lmpop": false, "blmpop": false,
+	//sets
+	"scard": true, "smembers": true, "sismember": true, "smismember": true, "srandmember": true,
+	"sinter": true, "sintercard": true, "sunion": true, "sdiff": true, "sscan": true,
+	"sadd": false, "srem": false, "spop": false, "smove": false, "sinterstore": false,
+	"sunionstore": false, "sdiffstore": false,
+	//sorted sets
+	"zcard": true, "zcount": true, "zlexcount": true, "zrange": true, "zrangebylex": true,
+	"zrevrangebylex": true, "zrangebyscore": true, "zrevrangebyscore": true, "zrank": true,
+	"zrevrank": true, "zrevrange": true, "zscore": true, "zmscore": true, "zrandmember": true,
+	"zscan": true, "zinter": true, "zintercard": true, "zunion": true, "zdiff": true,
+	"zadd": false, "zincrby": false, "zrem": false, "zremrangebyrank": false, "zremrangebyscore": false,
+	"zremrangebylex": false, "zpopmin": false, "zpopmax": false, "bzpopmin": false, "bzpopmax": false,
+	"zmpop": false, "bzmpop": false, "zunionstore": false, "zinterstore": false, "zdiffstore": false,
+	"zrangestore": false,
+	//hashes
+	"hget": true, "hmget": true, "hgetall": true, "hkeys": true, "hvals": true, "hlen": true,
+	"hexists": true, "hstrlen": true, "hrandfield": true, "hscan": true,
+	"hset": false, "hsetnx": false, "hmset": false, "hdel": false, "hincrby": false, "hincrbyfloat": false,
+	//hyperloglogs, geo and streams
+	"pfcount": true, "geodist": true, "geohash": true, "geopos": true, "georadius_ro": true,
+	"georadiusbymember_ro": true, "geosearch": true, "xrange": true, "xrevrange": true, "xlen": true,
+	"xread": true, "xinfo": true, "xpending": true,
+	"pfadd": false, "pfmerge": false, "geoadd": false, "georadius": false, "georadiusbymember": false,
+	"geosearchstore": false, "xadd": false, "xdel": false, "xtrim": false, "xgroup": false, "xack": false,
+	"xclaim": false, "xautoclaim": false, "xsetid": false, "xreadgroup": false,
+	//scripting
+	"eval_ro": true, "evalsha_ro": true, "fcall_ro": true,
+	"eval": false, "evalsha": false, "fcall": false, "function": false, "script": false,
+	//transactions and pub/sub
+	"multi": false, "exec": false, "discard": false, "watch": false, "unwatch": false,
+	"publish": false, "spublish": false, "pubsub": false, "subscribe": false, "unsubscribe": false,
+	"psubscribe": false, "punsubscribe": false, "ssubscribe": false, "sunsubscribe": false,
+	//connection and server
+	"auth": false, "hello": false, "select": false, "ping": false, "echo": false, "quit": false,
+	"reset": false, "client": false, "readonly": false, "readwrite": false, "wait": false, "waitaof": false,
+	"config": false, "info": false, "time": false, "lastsave": false, "save": false, "bgsave": false,
+	"bgrewriteaof": false, "flushdb": false, "flushall": false, "swapdb": false, "shutdown": false,
+	"replicaof": false, "slaveof": false, "role": false, "failover": false, "sync": false, "psync": false,
+	"replconf": false, "debug": false, "monitor": false, "command": false, "latency": false,
+	"slowlog": false, "memory": false, "module": false, "acl": false, "cluster": false, "lolwut": false,
+}
+
+// CommandName returns the lower case name of a command the proxy knows,
+// and "unknown" for any other, so names from clients cannot grow a
+// metric without bound.
+func CommandName(name []byte) string {
+	lower := strings.ToLower(string(name))
+	if _, ok := commands[lower]; ok {
+		return lower
+	}
+	return "unknown"
+}
+
+// IsRead reports whether the command with the lower case name only reads
+// data, so a replica can answer it.
+func IsRead(name string) bool {
+	return commands[name]
+}
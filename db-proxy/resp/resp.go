@@ -0,0 +1,279 @@
+// Package resp reads and writes the Redis serialization protocol, RESP2
+// and RESP3, as far as the proxy needs it: commands from clients, and
+// whole replies from servers, which are relayed as they were sent.
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// ErrMalformed is returned for data that is not valid RESP.
+var ErrMalformed = errors.New("resp: malformed data")
+
+// Types, the first byte of every value.
+const (
+	SimpleString = '+'
+	Error        = '-'
+	Integer      = ':'
+	BulkString   = '$'
+	Array        = '*'
+	// RESP3 only
+	Null           = '_'
+	Boolean        = '#'
+	Double         = ','
+	BigNumber      = '('
+	BlobError      = '!'
+	VerbatimString = '='
+	Map            = '%'
+	Set            = '~'
+	Attribute      = '|'
+	Push           = '>'
+)
+
+// Limits, the same as the Redis server's defaults.
+const (
+	// maxBulk is the longest bulk string accepted
+	maxBulk = 512 << 20
+	// maxInline is the longest inline command or simple value line
+	maxInline = 64 << 10
+	// maxElements is the most elements an aggregate may claim
+	maxElements = 1<<31 - 1
+)
+
+// ReadCommand reads one command: an array of bulk strings, as clients
+// send them, or an inline command, a line of words as typed into telnet.
+// Empty lines are skipped. The command name is args[0].
+func ReadCommand(r *bufio.Reader) ([][]byte, error) {
+	var args [][]byte
+	for {
+		line, err := readLine(r, maxInline)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != Array {
+			//line is only good until the next read
+			if args = bytes.Fields(append([]byte(nil), line...)); len(args) == 0 {
+				continue
+			}
+			return args, nil
+		}
+		n, err := parseLength(line[1:], maxElements)
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			continue
+		}
+		args = make([][]byte, 0, capacity(n))
+		for i := 0; i < n; i++ {
+			header, err := readLine(r, maxInline)
+			if err != nil {
+				return nil, err
+			}
+			if len(header) == 0 || header[0] != BulkString {
+				return nil, ErrMalformed
+			}
+			size, err := parseLength(header[1:], maxBulk)
+			if err != nil || size < 0 {
+				return nil, ErrMalformed
+			}
+			arg := make([]byte, size+2)
+			if _, err := io.ReadFull(r, arg); err != nil {
+				return nil, err
+			}
+			if !bytes.HasSuffix(arg, []byte("\r\n")) {
+				return nil, ErrMalformed
+			}
+			args = append(args, arg[:size])
+		}
+		return args, nil
+	}
+}
+
+// AppendCommand appends args encoded as a command to b.
+func AppendCommand(b []byte, args ...[]byte) []byte {
+	b = appendHeader(b, Array, len(args))
+	for _, arg := range args {
+		b = appendHeader(b, BulkString, len(arg))
+		b = append(b, arg...)
+		b = append(b, "\r\n"...)
+	}
+	return b
+}
+
+// AppendError appends an error reply to b; msg starts with the error
+// code, such as "ERR unknown command".
+func AppendError(b []byte, msg string) []byte {
+	b = append(b, Error)
+	for i := 0; i < len(msg); i++ {
+		//a line break would end the error early
+		if c := msg[i]; c != '\r' && c != '\n' {
+			b = append(b, c)
+		} else {
+			b = append(b, ' ')
+		}
+	}
+	return append(b, "\r\n"...)
+}
+
+func appendHeader(b []byte, kind byte, n int) []byte {
+	b = append(b, kind)
+	b = strconv.AppendInt(b, int64(n), 10)
+	return append(b, "\r\n"...)
+}
+
+// Reply is one complete reply as the server sent it.
+type Reply struct {
+	// Kind is the type of the value, after any attributes
+	Kind byte
+	Raw  []byte
+	// value is where the value starts in Raw, past any attributes
+	value int
+}
+
+// IsError reports whether the reply is an error.
+func (r Reply) IsError() bool {
+	return r.Kind == Error || r.Kind == BlobError
+}
+
+// IsPush reports whether the reply is a RESP3 push, which servers send on
+// their own rather than in answer to a command.
+func (r Reply) IsPush() bool {
+	return r.Kind == Push
+}
+
+// IsOK reports whether the reply is the simple string OK.
+func (r Reply) IsOK() bool {
+	return bytes.Equal(r.Raw, []byte("+OK\r\n"))
+}
+
+// ErrorMessage returns the text of an error reply, such as
+// "ERR unknown command", and an empty string for other replies.
+func (r Reply) ErrorMessage() string {
+	raw := r.Raw[r.value : len(r.Raw)-2]
+	switch r.Kind {
+	case Error:
+		return string(raw[1:])
+	case BlobError:
+		return string(raw[bytes.IndexByte(raw, '\n')+1:])
+	}
+	return ""
+}
+
+// ReadReply reads one complete reply, including what an aggregate
+// contains. Streamed RESP3 aggregates, which Redis does not send, are
+// not supported.
+func ReadReply(r *bufio.Reader) (Reply, error) {
+	var raw []byte
+	for {
+		value := len(raw)
+		kind, err := readValue(r, &raw)
+		if err != nil {
+			return Reply{}, err
+		}
+		//the value an attribute describes follows it
+		if kind != Attribute {
+			return Reply{Kind: kind, Raw: raw, value: value}, nil
+		}
+	}
+}
+
+// readValue appends one value to raw and returns its type.
+func readValue(r *bufio.Reader, raw *[]byte) (byte, error) {
+	line, err := readLine(r, maxInline)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) == 0 {
+		return 0, ErrMalformed
+	}
+	*raw = append(append(*raw, line...), "\r\n"...)
+	kind := line[0]
+	switch kind {
+	case SimpleString, Error, Integer, Null, Boolean, Double, BigNumber:
+		return kind, nil
+	case BulkString, BlobError, VerbatimString:
+		size, err := parseLength(line[1:], maxBulk)
+		if err != nil {
+			return 0, err
+		}
+		if size < 0 {
+			//RESP2's null bulk string
+			return kind, nil
+		}
+		start := len(*raw)
+		*raw = append(*raw, make([]byte, size+2)...)
+		if _, err := io.ReadFull(r, (*raw)[start:]); err != nil {
+			return 0, err
+		}
+		if !bytes.HasSuffix(*raw, []byte("\r\n")) {
+			return 0, ErrMalformed
+		}
+		return kind, nil
+	case Array, Set, Push, Map, Attribute:
+		n, err := parseLength(line[1:], maxElements)
+		if err != nil {
+			return 0, err
+		}
+		if kind == Map || kind == Attribute {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			if _, err := readValue(r, raw); err != nil {
+				return 0, err
+			}
+		}
+		return kind, nil
+	}
+	return 0, ErrMalformed
+}
+
+// readLine reads up to the next CRLF, which it leaves out, allowing lines
+// of up to limit bytes.
+func readLine(r *bufio.Reader, limit int) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		//longer than the buffer; collect it
+		long := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull && len(long) <= limit {
+			line, err = r.ReadSlice('\n')
+			long = append(long, line...)
+		}
+		line = long
+	}
+	if err == bufio.ErrBufferFull || len(line) > limit+2 {
+		return nil, ErrMalformed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrMalformed
+	}
+	return line[:len(line)-2], nil
+}
+
+// parseLength parses the length in a header; -1 stands for null.
+func parseLength(b []byte, limit int) (int, error) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || n < -1 || n > int64(limit) {
+		return 0, ErrMalformed
+	}
+	return int(n), nil
+}
+
+// capacity caps the space set aside for n elements, since n comes from
+// the other side.
+func capacity(n int) int {
+	if n > 1024 {
+		return 1024
+	}
+	return n
+}
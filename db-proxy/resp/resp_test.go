@@ -0,0 +1,157 @@
+package resp
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func reader(s string) *bufio.Reader {
+	return bufio.NewReader(strings.NewReader(s))
+}
+
+func words(ws ...string) [][]byte {
+	args := make([][]byte, len(ws))
+	for i, w := range ws {
+		args[i] = []byte(w)
+	}
+	return args
+}
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		in   string
+		want [][]byte
+	}{
+		{"*1\r\n$4\r\nPING\r\n", words("PING")},
+		{"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\na\r\nb\n\r\n", words("SET", "k", "a\r\nb\n")},
+		{"*2\r\n$3\r\nGET\r\n$0\r\n\r\n", words("GET", "")},
+		{"PING\r\n", words("PING")},
+		{"  set  k   v \r\n", words("set", "k", "v")},
+		//empty lines, empty and null arrays are skipped
+		{"\r\n \r\n*0\r\n*-1\r\nPING\r\n", words("PING")},
+	}
+	for _, tt := range tests {
+		got, err := ReadCommand(reader(tt.in))
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReadCommand(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+
+	//commands follow each other without anything in between
+	r := reader("*1\r\n$4\r\nPING\r\nECHO hi\r\n*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n")
+	for _, want := range [][][]byte{words("PING"), words("ECHO", "hi"), words("ECHO", "hi")} {
+		if got, err := ReadCommand(r); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadCommand = %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := ReadCommand(r); err != io.EOF {
+		t.Errorf("ReadCommand at the end = %v, want EOF", err)
+	}
+}
+
+func TestReadCommandMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want error
+	}{
+		{"negative count", "*-2\r\n", ErrMalformed},
+		{"count too large", "*2147483648\r\n", ErrMalformed},
+		{"count not a number", "*x\r\n", ErrMalformed},
+		{"negative length", "*1\r\n$-2\r\n", ErrMalformed},
+		{"null argument", "*1\r\n$-1\r\n", ErrMalformed},
+		{"length too large", "*1\r\n$536870913\r\n", ErrMalformed},
+		{"argument not a bulk string", "*1\r\n:1\r\n", ErrMalformed},
+		{"argument without CRLF", "*1\r\n$4\r\nPINGxx", ErrMalformed},
+		{"argument cut short", "*1\r\n$4\r\nPI", io.ErrUnexpectedEOF},
+		{"line without CR", "PING\n", ErrMalformed},
+		{"inline command too long", strings.Repeat("a", maxInline+1) + "\r\n", ErrMalformed},
+		{"missing arguments", "*2\r\n$4\r\nECHO\r\n", io.EOF},
+	}
+	for _, tt := range tests {
+		if got, err := ReadCommand(reader(tt.in)); err != tt.want {
+			t.Errorf("%s: ReadCommand = %q, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		in    string
+		kind  byte
+		value string
+	}{
+		{"+OK\r\n", SimpleString, "+OK\r\n"},
+		{"-ERR unknown command\r\n", Error, "-ERR unknown command\r\n"},
+		{":42\r\n", Integer, ":42\r\n"},
+		{"$5\r\nhello\r\n", BulkString, "$5\r\nhello\r\n"},
+		{"$-1\r\n", BulkString, "$-1\r\n"},
+		{"*-1\r\n", Array, "*-1\r\n"},
+		{"*2\r\n$1\r\na\r\n*1\r\n:1\r\n", Array, "*2\r\n$1\r\na\r\n*1\r\n:1\r\n"},
+		{"%1\r\n+k\r\n_\r\n", Map, "%1\r\n+k\r\n_\r\n"},
+		{">2\r\n+message\r\n$2\r\nhi\r\n", Push, ">2\r\n+message\r\n$2\r\nhi\r\n"},
+		//an attribute is kept in Raw, but the reply is the value after it
+		{"|1\r\n+ttl\r\n:3\r\n#t\r\n", Boolean, "#t\r\n"},
+	}
+	for _, tt := range tests {
+		//what follows the reply is left for the next
+		r := reader(tt.in + "+next\r\n")
+		got, err := ReadReply(r)
+		if err != nil {
+			t.Errorf("ReadReply(%q): %v", tt.in, err)
+			continue
+		}
+		if got.Kind != tt.kind || string(got.Raw) != tt.in || string(got.Raw[got.value:]) != tt.value {
+			t.Errorf("ReadReply(%q) = %c %q, want %c", tt.in, got.Kind, got.Raw, tt.kind)
+		}
+		if next, err := ReadReply(r); err != nil || string(next.Raw) != "+next\r\n" {
+			t.Errorf("ReadReply(%q) read past the reply: %q, %v", tt.in, next.Raw, err)
+		}
+	}
+}
+
+func TestReadReplyMalformed(t *testing.T) {
+	for _, in := range []string{
+		"\r\n",
+		"?1\r\n",
+		"$-2\r\n",
+		"$536870913\r\n",
+		"$5\r\nhelloxx",
+		"*-2\r\n",
+		"*1\r\n\r\n",
+		"+" + strings.Repeat("a", maxInline+1) + "\r\n",
+	} {
+		if _, err := ReadReply(reader(in)); err != ErrMalformed {
+			t.Errorf("ReadReply(%.20q) = %v, want ErrMalformed", in, err)
+		}
+	}
+	if _, err := ReadReply(reader("*2\r\n:1\r\n")); err != io.EOF {
+		t.Errorf("ReadReply of a cut array = %v, want EOF", err)
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	for in, want := range map[string]string{
+		"-ERR unknown command\r\n":         "ERR unknown command",
+		"!21\r\nSYNTAX invalid syntax\r\n": "SYNTAX invalid syntax",
+		"|1\r\n+a\r\n+b\r\n-NOAUTH\r\n":    "NOAUTH",
+		"+OK\r\n":                          "",
+	} {
+		r, err := ReadReply(reader(in))
+		if err != nil || r.ErrorMessage() != want || r.IsError() != (want != "") {
+			t.Errorf("ReadReply(%q).ErrorMessage() = %q, %v, want %q", in, r.ErrorMessage(), err, want)
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	if got := string(AppendCommand(nil, words("SET", "k", "")...)); got != "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n" {
+		t.Errorf("AppendCommand = %q", got)
+	}
+	if got := string(AppendError(nil, "ERR bad\r\nthing")); got != "-ERR bad  thing\r\n" {
+		t.Errorf("AppendError = %q", got)
+	}
+}
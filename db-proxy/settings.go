@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/mu-wahba/db-proxy-go/backend"
+	"github.com/mu-wahba/db-proxy-go/fault"
+	"github.com/mu-wahba/db-proxy-go/slowlog"
+	"github.com/mu-wahba/db-proxy-go/tracing"
+	"gopkg.in/yaml.v3"
+)
+
+// settings is the config file as written, see dbproxy.yaml.sample. Every
+// field with an env tag can be overridden by that environment variable.
+type settings struct {
+	Listen         listenSettings    `yaml:"listen"`
+	Admin          adminSettings     `yaml:"admin"`
+	Backends       []backendSettings `yaml:"backends"`
+	LoadBalancing  string            `yaml:"load_balancing" env:"LB_STRATEGY"`
+	ReadWriteSplit bool              `yaml:"read_write_split" env:"READ_WRITE_SPLIT"`
+	ServerTLS      serverTLSSettings `yaml:"server_tls"`
+	ServerProxy    int               `yaml:"server_proxy_protocol" env:"SERVER_PROXY_PROTOCOL"`
+	Pool           poolSettings      `yaml:"pool"`
+	HealthCheck    healthSettings    `yaml:"health_check"`
+	Timeouts       timeoutSettings   `yaml:"timeouts"`
+	Access         accessSettings    `yaml:"access"`
+	Limits         limitSettings     `yaml:"limits"`
+	Firewall       firewallSettings  `yaml:"firewall"`
+	Cache          cacheSettings     `yaml:"cache"`
+	Record         recordSettings    `yaml:"record"`
+	Stats          statsSettings     `yaml:"stats"`
+	SlowLog        slowLogSettings   `yaml:"slow_log"`
+	Shadow         shadowSettings    `yaml:"shadow"`
+	Faults         faultSettings     `yaml:"faults"`
+	Tracing        tracingSettings   `yaml:"tracing"`
+	MySQL          mysqlSettings     `yaml:"mysql"`
+	Redis          redisSettings     `yaml:"redis"`
+	LogProtocol    bool              `yaml:"log_protocol" env:"LOG_PROTOCOL"`
+}
+
+type listenSettings struct {
+	// Address is host:port; LOCAL_PORT overrides the port only
+	Address string            `yaml:"address" env:"LISTEN_ADDR"`
+	TLS     clientTLSSettings `yaml:"tls"`
+	// ProxyProtocol expects a PROXY header on the connections to every
+	// listener from ProxyProtocolFrom, or from anywhere if it is empty
+	ProxyProtocol     bool     `yaml:"proxy_protocol" env:"PROXY_PROTOCOL"`
+	ProxyProtocolFrom []string `yaml:"proxy_protocol_from" env:"PROXY_PROTOCOL_FROM"`
+}
+
+type clientTLSSettings struct {
+	// Mode defaults to allow when a certificate is set, disable otherwise
+	Mode           string `yaml:"mode" env:"CLIENT_TLS_MODE"`
+	CertFile       string `yaml:"cert_file" env:"CLIENT_TLS_CERT_FILE"`
+	KeyFile        string `yaml:"key_file" env:"CLIENT_TLS_KEY_FILE"`
+	ClientCertMode string `yaml:"client_cert_mode" env:"CLIENT_CERT_MODE"`
+	ClientCAFile   string `yaml:"client_ca_file" env:"CLIENT_TLS_CA_FILE"`
+}
+
+type adminSettings struct {
+	Address string `yaml:"address" env:"ADMIN_LISTEN"`
+	Token   string `yaml:"token" env:"ADMIN_TOKEN"`
+}
+
+type backendSettings struct {
+	Address string `yaml:"address"`
+	Weight  int    `yaml:"weight"`
+	Role    string `yaml:"role"`
+}
+
+type serverTLSSettings struct {
+	Mode     string `yaml:"mode" env:"SERVER_TLS_MODE"`
+	CAFile   string `yaml:"ca_file" env:"SERVER_TLS_CA_FILE"`
+	CertFile string `yaml:"cert_file" env:"SERVER_TLS_CERT_FILE"`
+	KeyFile  string `yaml:"key_file" env:"SERVER_TLS_KEY_FILE"`
+}
+
+type poolSettings struct {
+	Mode        string        `yaml:"mode" env:"POOL_MODE"`
+	Size        int           `yaml:"size" env:"POOL_SIZE"`
+	WaitTimeout time.Duration `yaml:"wait_timeout" env:"POOL_WAIT_TIMEOUT"`
+	AuthFile    string        `yaml:"auth_file" env:"AUTH_FILE"`
+	// ProxyAuth has session-mode clients log in to the proxy too
+	ProxyAuth bool `yaml:"proxy_auth" env:"PROXY_AUTH"`
+}
+
+type healthSettings struct {
+	// Interval zero turns health checks off
+	Interval time.Duration `yaml:"interval" env:"HEALTH_CHECK_INTERVAL"`
+	Timeout  time.Duration `yaml:"timeout" env:"HEALTH_CHECK_TIMEOUT"`
+	Fall     int           `yaml:"fall" env:"HEALTH_CHECK_FALL"`
+	Rise     int           `yaml:"rise" env:"HEALTH_CHECK_RISE"`
+	User     string        `yaml:"user" env:"HEALTH_CHECK_USER"`
+	Password string        `yaml:"password" env:"HEALTH_CHECK_PASSWORD"`
+	Database string        `yaml:"database" env:"HEALTH_CHECK_DATABASE"`
+}
+
+type timeoutSettings struct {
+	Drain time.Duration `yaml:"drain" env:"DRAIN_TIMEOUT"`
+	Dial  time.Duration `yaml:"dial" env:"DIAL_TIMEOUT"`
+	// ClientIdle, ServerIdle and MaxSession are off when zero
+	ClientIdle time.Duration `yaml:"client_idle" env:"CLIENT_IDLE_TIMEOUT"`
+	ServerIdle time.Duration `yaml:"server_idle" env:"SERVER_IDLE_TIMEOUT"`
+	MaxSession time.Duration `yaml:"max_session" env:"MAX_SESSION_LIFETIME"`
+}
+
+type accessSettings struct {
+	// Allow and Deny are CIDR blocks or single addresses
+	Allow []string `yaml:"allow" env:"ACL_ALLOW"`
+	Deny  []string `yaml:"deny" env:"ACL_DENY"`
+}
+
+type limitSettings struct {
+	MaxConnections      int           `yaml:"max_connections" env:"MAX_CONNECTIONS"`
+	MaxConnectionsPerIP int           `yaml:"max_connections_per_ip" env:"MAX_CONNECTIONS_PER_IP"`
+	QueueSize           int           `yaml:"queue_size" env:"CONNECTION_QUEUE_SIZE"`
+	QueueTimeout        time.Duration `yaml:"queue_timeout" env:"CONNECTION_QUEUE_TIMEOUT"`
+}
+
+type firewallSettings struct {
+	// Default is allow or deny, for statements no rule matches
+	Default string         `yaml:"default" env:"FIREWALL_DEFAULT"`
+	Rules   []ruleSettings `yaml:"rules"`
+}
+
+type ruleSettings struct {
+	Name     string   `yaml:"name"`
+	Action   string   `yaml:"action"`
+	Commands []string `yaml:"commands"`
+	Tables   []string `yaml:"tables"`
+	Pattern  string   `yaml:"pattern"`
+	Users    []string `yaml:"users"`
+	Clients  []string `yaml:"clients"`
+}
+
+type cacheSettings struct {
+	Enabled     bool `yaml:"enabled" env:"CACHE_ENABLED"`
+	MaxMemoryMB int  `yaml:"max_memory_mb" env:"CACHE_MAX_MEMORY_MB"`
+	// Rules decide what is cached and for how long; the first that
+	// matches a statement applies
+	Rules []cacheRuleSettings `yaml:"rules"`
+}
+
+type cacheRuleSettings struct {
+	Name    string        `yaml:"name"`
+	Tables  []string      `yaml:"tables"`
+	Pattern string        `yaml:"pattern"`
+	Users   []string      `yaml:"users"`
+	TTL     time.Duration `yaml:"ttl"`
+}
+
+type recordSettings struct {
+	// File is where sessions are recorded; empty turns recording off
+	File string `yaml:"file" env:"RECORD_FILE"`
+}
+
+type statsSettings struct {
+	Enabled       bool `yaml:"enabled" env:"STATS_ENABLED"`
+	MaxStatements int  `yaml:"max_statements" env:"STATS_MAX_STATEMENTS"`
+	// File gets the statistics as JSON every FileInterval; empty turns
+	// the export off
+	File         string        `yaml:"file" env:"STATS_FILE"`
+	FileInterval time.Duration `yaml:"file_interval" env:"STATS_FILE_INTERVAL"`
+}
+
+type slowLogSettings struct {
+	// File is where slow statements are logged; empty turns the log off
+	File      string        `yaml:"file" env:"SLOW_LOG_FILE"`
+	Threshold time.Duration `yaml:"threshold" env:"SLOW_LOG_THRESHOLD"`
+	// Redact is none, parameters or literals
+	Redact string `yaml:"redact" env:"SLOW_LOG_REDACT"`
+}
+
+type shadowSettings struct {
+	// Address is the shadow server; empty turns mirroring off
+	Address string `yaml:"address" env:"SHADOW_ADDR"`
+	// Mirror is reads or all
+	Mirror    string `yaml:"mirror" env:"SHADOW_MIRROR"`
+	Compare   bool   `yaml:"compare" env:"SHADOW_COMPARE"`
+	QueueSize int    `yaml:"queue_size" env:"SHADOW_QUEUE_SIZE"`
+}
+
+type tracingSettings struct {
+	// Exporter is none, otlp, stdout or file
+	Exporter string `yaml:"exporter" env:"TRACING_EXPORTER"`
+	// Endpoint is the OTLP HTTP collector as host:port
+	Endpoint    string  `yaml:"endpoint" env:"TRACING_ENDPOINT"`
+	Insecure    bool    `yaml:"insecure" env:"TRACING_INSECURE"`
+	File        string  `yaml:"file" env:"TRACING_FILE"`
+	ServiceName string  `yaml:"service_name" env:"TRACING_SERVICE_NAME"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+	// StripComments removes sqlcommenter comments before statements go
+	// to the server, whether tracing is on or not
+	StripComments bool `yaml:"strip_comments" env:"TRACING_STRIP_COMMENTS"`
+}
+
+type faultSettings struct {
+	// Enabled allows fault injection at all, from Rules or the admin API
+	Enabled bool         `yaml:"enabled" env:"FAULTS_ENABLED"`
+	Rules   []fault.Spec `yaml:"rules"`
+}
+
+type mysqlSettings struct {
+	// Listen is host:port for MySQL clients; empty turns MySQL off
+	Listen string `yaml:"listen" env:"MYSQL_LISTEN"`
+	// Backends are primaries only; MYSQL_BACKENDS replaces them
+	Backends []backendSettings `yaml:"backends"`
+	PoolMode string            `yaml:"pool_mode" env:"MYSQL_POOL_MODE"`
+	AuthFile string            `yaml:"auth_file" env:"MYSQL_AUTH_FILE"`
+}
+
+type redisSettings struct {
+	// Listen is host:port for Redis clients; empty turns Redis off
+	Listen string `yaml:"listen" env:"REDIS_LISTEN"`
+	// Backends may include replicas; REDIS_BACKENDS and REDIS_REPLICAS
+	// replace the primaries and the replicas
+	Backends         []backendSettings `yaml:"backends"`
+	ReadFromReplicas bool              `yaml:"read_from_replicas" env:"REDIS_READ_FROM_REPLICAS"`
+	// BlockedCommands are command names, or names and subcommands such
+	// as "CONFIG SET"
+	BlockedCommands []string `yaml:"blocked_commands" env:"REDIS_BLOCKED_COMMANDS"`
+}
+
+// defaultSettings are used for anything neither the file nor the
+// environment sets.
+func defaultSettings() settings {
+	return settings{
+		Listen:        listenSettings{Address: "0.0.0.0:6432"},
+		LoadBalancing: "round-robin",
+		Pool: poolSettings{
+			Mode:        "session",
+			Size:        20,
+			WaitTimeout: 30 * time.Second,
+		},
+		HealthCheck: healthSettings{
+			Interval: 5 * time.Second,
+			Timeout:  2 * time.Second,
+			Fall:     3,
+			Rise:     2,
+		},
+		Timeouts: timeoutSettings{Drain: 30 * time.Second, Dial: 5 * time.Second},
+		Limits:   limitSettings{QueueTimeout: 10 * time.Second},
+		Tracing:  tracingSettings{Exporter: tracing.ExporterNone, ServiceName: "db-proxy", SampleRatio: 1},
+		Cache:    cacheSettings{MaxMemoryMB: 64},
+		Stats:    statsSettings{MaxStatements: 5000, FileInterval: time.Minute},
+		SlowLog:  slowLogSettings{Threshold: time.Second, Redact: slowlog.RedactLiterals},
+		Shadow:   shadowSettings{Mirror: "reads", QueueSize: 100},
+		MySQL:    mysqlSettings{PoolMode: "session"},
+		Redis:    redisSettings{BlockedCommands: []string{"FLUSHALL", "CONFIG", "KEYS"}},
+	}
+}
+
+// loadSettings reads the config file at path, if there is one, on top of
+// the defaults and then applies the environment. A missing file is only
+// an error if required is set.
+func loadSettings(path string, required bool) (settings, error) {
+	s := defaultSettings()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && !required:
+		case err != nil:
+			return s, err
+		default:
+			dec := yaml.NewDecoder(bytes.NewReader(data))
+			dec.KnownFields(true)
+			if err := dec.Decode(&s); err != nil && err != io.EOF {
+				return s, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(&s).Elem()); err != nil {
+		return s, err
+	}
+	if port := os.Getenv("LOCAL_PORT"); port != "" {
+		host := "0.0.0.0"
+		if i := strings.LastIndex(s.Listen.Address, ":"); i >= 0 {
+			host = s.Listen.Address[:i]
+		}
+		s.Listen.Address = host + ":" + port
+	}
+	return s, applyBackendEnv(&s)
+}
+
+// applyEnv overrides the fields of v that have an env tag with the
+// variables that are set.
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(value); err != nil {
+				return err
+			}
+			continue
+		}
+		name := field.Tag.Get("env")
+		raw, ok := os.LookupEnv(name)
+		if name == "" || !ok || raw == "" {
+			continue
+		}
+		if err := setFromString(value, raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setFromString(v reflect.Value, raw string) error {
+	switch v.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		//comma separated, like BACKENDS
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported setting type %s", v.Type())
+		}
+		var list []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// applyBackendEnv lets BACKENDS and REPLICAS replace the primaries and the
+// replicas from the file, MYSQL_BACKENDS the MySQL backends, and
+// REDIS_BACKENDS and REDIS_REPLICAS the Redis primaries and replicas.
+// REMOTE_DB_HOST/REMOTE_DB_PORT still work for a single primary.
+func applyBackendEnv(s *settings) error {
+	primaries := os.Getenv("BACKENDS")
+	if primaries == "" && os.Getenv("REMOTE_DB_HOST") != "" {
+		primaries = os.Getenv("REMOTE_DB_HOST") + ":" + os.Getenv("REMOTE_DB_PORT")
+	}
+	overrides := []struct {
+		backends *[]backendSettings
+		role     string
+		//variable names the list in errors, where the list is not obvious
+		variable string
+		list     string
+	}{
+		{&s.Backends, backend.RolePrimary, "", primaries},
+		{&s.Backends, backend.RoleReplica, "", os.Getenv("REPLICAS")},
+		{&s.Redis.Backends, backend.RolePrimary, "REDIS_BACKENDS", os.Getenv("REDIS_BACKENDS")},
+		{&s.Redis.Backends, backend.RoleReplica, "REDIS_REPLICAS", os.Getenv("REDIS_REPLICAS")},
+	}
+	for _, o := range overrides {
+		role, list := o.role, o.list
+		if list == "" {
+			continue
+		}
+		kept := (*o.backends)[:0:0]
+		for _, b := range *o.backends {
+			if backendRole(b) != role {
+				kept = append(kept, b)
+			}
+		}
+		parsed, err := backend.ParseList(list)
+		if err != nil && o.variable != "" {
+			return fmt.Errorf("%s: %w", o.variable, err)
+		}
+		if err != nil {
+			return err
+		}
+		for _, b := range parsed {
+			kept = append(kept, backendSettings{Address: b.Addr, Weight: b.Weight, Role: role})
+		}
+		*o.backends = kept
+	}
+	if list := os.Getenv("MYSQL_BACKENDS"); list != "" {
+		parsed, err := backend.ParseList(list)
+		if err != nil {
+			return fmt.Errorf("MYSQL_BACKENDS: %w", err)
+		}
+		s.MySQL.Backends = nil
+		for _, b := range parsed {
+			s.MySQL.Backends = append(s.MySQL.Backends, backendSettings{Address: b.Addr, Weight: b.Weight})
+		}
+	}
+	return nil
+}
+
+func backendRole(b backendSettings) string {
+	if b.Role == "" {
+		return backend.RolePrimary
+	}
+	return b.Role
+}
+
+// processEnv holds the variables set before .env was first read. They
+// take precedence over the file, on reloads too.
+var processEnv = envNames()
+
+// fileEnv holds the variables the last loadEnvFile set from .env.
+var fileEnv = map[string]bool{}
+
+// loadEnvFile (re)reads .env, if there is one, into the environment.
+// Variables that were removed from the file since the last call are unset
+// again.
+func loadEnvFile() error {
+	values, err := godotenv.Read()
+	if errors.Is(err, fs.ErrNotExist) {
+		values, err = map[string]string{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	for name := range fileEnv {
+		if _, ok := values[name]; !ok {
+			os.Unsetenv(name)
+		}
+	}
+	fileEnv = map[string]bool{}
+	for name, value := range values {
+		if processEnv[name] {
+			continue
+		}
+		os.Setenv(name, value)
+		fileEnv[name] = true
+	}
+	return nil
+}
+
+func envNames() map[string]bool {
+	names := map[string]bool{}
+	for _, kv := range os.Environ() {
+		names[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+	return names
+}
@@ -0,0 +1,96 @@
+// Package slowlog writes the statements that ran longer than a threshold
+// to a file, one JSON object per line.
+package slowlog
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// How much of a statement is redacted before it is written.
+const (
+	// RedactNone writes the statement as sent, with the values of its
+	// parameters
+	RedactNone = "none"
+	// RedactParameters writes the statement as sent, without the values
+	// of its parameters
+	RedactParameters = "parameters"
+	// RedactLiterals writes the statement's fingerprint, its literals
+	// replaced by placeholders, and no parameters
+	RedactLiterals = "literals"
+)
+
+// Entry is one line of the log.
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Client is the client's address, Backend the server's, or "cache"
+	// for an answer from the query cache
+	Client     string  `json:"client"`
+	User       string  `json:"user"`
+	Database   string  `json:"database"`
+	Backend    string  `json:"backend"`
+	DurationMS float64 `json:"duration_ms"`
+	Rows       int64   `json:"rows"`
+	// Error is the SQLSTATE of the error the statement ended with
+	Error     string `json:"error,omitempty"`
+	Statement string `json:"statement"`
+	// Parameters are the values bound to an extended-protocol statement,
+	// in text or, for values sent in binary, hex with a \x prefix as
+	// bytea is written; nil stands for NULL
+	Parameters []*string `json:"parameters,omitempty"`
+}
+
+// Logger appends entries to a file. It is safe for concurrent use, and
+// its methods do nothing on a nil or closed Logger.
+type Logger struct {
+	Path string
+
+	mu     sync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+	err    error
+	closed bool
+}
+
+// Open opens path for appending, creating it if needed.
+func Open(path string) (*Logger, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	//slow statements are few, so every entry goes straight to the file
+	return &Logger{Path: path, file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Write appends e, stamped with the current time.
+func (l *Logger) Write(e Entry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || l.err != nil {
+		return
+	}
+	e.Time = time.Now()
+	if l.err = l.enc.Encode(e); l.err != nil {
+		log.Printf("Error writing slow query log %s, logging stopped: %v", l.Path, l.err)
+	}
+}
+
+// Close closes the file. Entries written afterwards are dropped.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.file.Close()
+}
@@ -0,0 +1,45 @@
+package slowlog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slow.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := "42"
+	l.Write(Entry{Client: "10.0.0.5:50000", User: "app", Database: "db", Backend: "db1:5432", DurationMS: 1500.5, Rows: 3,
+		Statement: "SELECT * FROM t WHERE id = $1 AND b = $2", Parameters: []*string{&text, nil}})
+	l.Write(Entry{Client: "10.0.0.5:50000", User: "app", Database: "db", Backend: "cache", DurationMS: 2, Error: "57014", Statement: "SELECT pg_sleep(?)"})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l.Write(Entry{Statement: "after close"})
+	var none *Logger
+	none.Write(Entry{Statement: "nil logger"})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("log has %d lines: %s", len(lines), data)
+	}
+	//the time comes first and changes; the rest is fixed
+	want := []string{
+		`"client":"10.0.0.5:50000","user":"app","database":"db","backend":"db1:5432","duration_ms":1500.5,"rows":3,"statement":"SELECT * FROM t WHERE id = $1 AND b = $2","parameters":["42",null]}`,
+		`"client":"10.0.0.5:50000","user":"app","database":"db","backend":"cache","duration_ms":2,"rows":0,"error":"57014","statement":"SELECT pg_sleep(?)"}`,
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, `{"time":"`) || !strings.HasSuffix(line, `",`+want[i]) {
+			t.Errorf("line %d = %s\nwant {\"time\":...,%s", i+1, line, want[i])
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package sqlparse
+
+import (
+	"net/url"
+	"strings"
+)
+
+// TrailingComment finds a sqlcommenter comment, /*key='value',...*/, after
+// the last statement in sql. It returns the tags in the comment, decoded,
+// and sql without the comment. ok is false if there is no such comment.
+func TrailingComment(sql string) (tags map[string]string, rest string, ok bool) {
+	tokens := Lex(sql)
+	last := 0
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if tokens[i].Kind != Punct || tokens[i].Text != ";" {
+			last = tokens[i].End
+			break
+		}
+	}
+	start := strings.Index(sql[last:], "/*")
+	if start < 0 {
+		return nil, sql, false
+	}
+	start += last
+	end := strings.Index(sql[start:], "*/")
+	if end < 0 {
+		return nil, sql, false
+	}
+	end += start
+	if tags, ok = commentTags(sql[start+2 : end]); !ok {
+		return nil, sql, false
+	}
+	return tags, strings.TrimRight(sql[:start], " \t\r\n") + sql[end+2:], true
+}
+
+// commentTags decodes the key='value' pairs of a sqlcommenter comment.
+// Keys and values are URL encoded, and quotes in values escaped with a
+// backslash.
+func commentTags(s string) (map[string]string, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, false
+	}
+	tags := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		eq := strings.IndexByte(pair, '=')
+		if eq < 0 {
+			return nil, false
+		}
+		key, value := strings.TrimSpace(pair[:eq]), strings.TrimSpace(pair[eq+1:])
+		if key == "" || len(value) < 2 || value[0] != '\'' || value[len(value)-1] != '\'' {
+			return nil, false
+		}
+		value = strings.ReplaceAll(value[1:len(value)-1], `\'`, `'`)
+		var err error
+		if key, err = url.PathUnescape(key); err != nil {
+			return nil, false
+		}
+		if value, err = url.PathUnescape(value); err != nil {
+			return nil, false
+		}
+		tags[key] = value
+	}
+	return tags, true
+}
@@ -0,0 +1,57 @@
+package sqlparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+func TestTrailingComment(t *testing.T) {
+	tests := []struct {
+		sql  string
+		tags map[string]string
+		rest string
+	}{
+		{"SELECT 1 /*traceparent='" + traceparent + "'*/", map[string]string{"traceparent": traceparent}, "SELECT 1"},
+		{"SELECT 1 /*action='list',controller='users'*/;", map[string]string{"action": "list", "controller": "users"}, "SELECT 1;"},
+		{"SELECT 1; /*app='x'*/", map[string]string{"app": "x"}, "SELECT 1;"},
+		{"SELECT 1/* app = 'x' */\n", map[string]string{"app": "x"}, "SELECT 1\n"},
+		//keys and values are URL encoded, quotes escaped
+		{"SELECT 1 /*route='%2Fusers%2F%7Bid%7D',db%20driver='pg%3A1',q='it\\'s'*/", map[string]string{"route": "/users/{id}", "db driver": "pg:1", "q": "it's"}, "SELECT 1"},
+		//a comment marker inside a string is part of the string
+		{"SELECT '*/', '/*' /*app='x'*/", map[string]string{"app": "x"}, "SELECT '*/', '/*'"},
+	}
+	for _, tt := range tests {
+		tags, rest, ok := TrailingComment(tt.sql)
+		if !ok || !reflect.DeepEqual(tags, tt.tags) || rest != tt.rest {
+			t.Errorf("TrailingComment(%q) = %v, %q, %v, want %v, %q", tt.sql, tags, rest, ok, tt.tags, tt.rest)
+		}
+	}
+}
+
+func TestTrailingCommentNone(t *testing.T) {
+	for _, sql := range []string{
+		"SELECT 1",
+		"SELECT 1 -- app='x'",
+		//not after the last statement
+		"/*app='x'*/ SELECT 1",
+		"SELECT /*app='x'*/ 1",
+		"SELECT 1 /*app='x'*/; SELECT 2",
+		//inside a string
+		"SELECT '/*app=''x''*/'",
+		"SELECT 1 /*app='x'",
+		//not key='value' pairs
+		"SELECT 1 /* just a note */",
+		"SELECT 1 /**/",
+		"SELECT 1 /*traceparent=" + traceparent + "*/",
+		"SELECT 1 /*traceparent='" + traceparent + "*/",
+		"SELECT 1 /*='x'*/",
+		"SELECT 1 /*app='x',*/",
+		"SELECT 1 /*traceparent='%zz'*/",
+	} {
+		if tags, rest, ok := TrailingComment(sql); ok || tags != nil || rest != sql {
+			t.Errorf("TrailingComment(%q) = %v, %q, %v, want no comment", sql, tags, rest, ok)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Package sqlparse is a lightweight SQL tokenizer and classifier. It does
+// not build a syntax tree; it knows just enough about PostgreSQL's lexical
+// rules (quoting, dollar quoting, comments) to split statements and tell
+// reads from writes without being fooled by keywords inside strings.
+// MySQL's backquoted identifiers are understood too, and LexMySQL follows
+// MySQL's rules for strings and comments.
+package sqlparse
+
+import (
+	"strings"
+)
+
+// TokenKind says what a token is.
+type TokenKind int
+
+const (
+	// Word is a keyword or unquoted identifier
+	Word TokenKind = iota
+	// QuotedIdent is a "double quoted" or `backquoted` identifier, Text
+	// without the quotes
+	QuotedIdent
+	// String is a string literal, Text as written including quotes
+	String
+	Number
+	// Param is a positional parameter such as $1
+	Param
+	// Punct is a single character of punctuation: ( ) , ; . [ ]
+	Punct
+	// Operator is a run of operator characters such as = or ::
+	Operator
+)
+
+// Token is one lexical element of a statement.
+type Token struct {
+	Kind TokenKind
+	Text string
+	// Pos is the byte offset of the token in the input, End the offset
+	// just past it
+	Pos, End int
+}
+
+// Is reports whether t is the keyword kw, ignoring case.
+func (t Token) Is(kw string) bool {
+	return t.Kind == Word && strings.EqualFold(t.Text, kw)
+}
+
+// Upper returns the text of a Word in upper case.
+func (t Token) Upper() string {
+	return strings.ToUpper(t.Text)
+}
+
+// Lex splits sql into tokens, dropping whitespace and comments.
+// Unterminated strings and comments run to the end of the input.
+func Lex(sql string) []Token {
+	return lex(sql, false)
+}
+
+// LexMySQL is Lex for MySQL, where strings may be in double quotes as
+// well, backslash escapes work in every string and # starts a comment.
+func LexMySQL(sql string) []Token {
+	return lex(sql, true)
+}
+
+func lex(sql string, mysql bool) []Token {
+	var tokens []Token
+	i := 0
+	for i < len(sql) {
+		c := sql[i]
+		start := i
+		switch {
+		case isSpace(c):
+			i++
+			continue
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+			continue
+		case mysql && c == '#':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '\'' || (mysql && c == '"'):
+			i = skipQuoted(sql, i, c, mysql)
+			tokens = append(tokens, Token{Kind: String, Text: sql[start:i], Pos: start})
+		case !mysql && (c == 'E' || c == 'e') && i+1 < len(sql) && sql[i+1] == '\'':
+			i = skipQuoted(sql, i+1, '\'', true)
+			tokens = append(tokens, Token{Kind: String, Text: sql[start:i], Pos: start})
+		case c == '"' || c == '`':
+			i = skipQuoted(sql, i, c, false)
+			text := sql[start+1 : i]
+			if strings.HasSuffix(text, string(c)) {
+				text = text[:len(text)-1]
+			}
+			tokens = append(tokens, Token{Kind: QuotedIdent, Text: strings.ReplaceAll(text, string(c)+string(c), string(c)), Pos: start})
+		case c == '$' && i+1 < len(sql) && isDigit(sql[i+1]):
+			i++
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+			tokens = append(tokens, Token{Kind: Param, Text: sql[start:i], Pos: start})
+		case c == '$':
+			if end, ok := skipDollarQuoted(sql, i); ok {
+				i = end
+				tokens = append(tokens, Token{Kind: String, Text: sql[start:i], Pos: start})
+				break
+			}
+			i++
+			tokens = append(tokens, Token{Kind: Operator, Text: "$", Pos: start})
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+			i = skipNumber(sql, i)
+			tokens = append(tokens, Token{Kind: Number, Text: sql[start:i], Pos: start})
+		case isIdentStart(c):
+			for i < len(sql) && isIdentChar(sql[i]) {
+				i++
+			}
+			tokens = append(tokens, Token{Kind: Word, Text: sql[start:i], Pos: start})
+		case strings.IndexByte("(),;.[]", c) >= 0:
+			i++
+			tokens = append(tokens, Token{Kind: Punct, Text: sql[start:i], Pos: start})
+		default:
+			for i < len(sql) && isOperatorChar(sql[i]) {
+				if strings.HasPrefix(sql[i:], "--") || strings.HasPrefix(sql[i:], "/*") {
+					break
+				}
+				i++
+			}
+			if i == start {
+				i++
+			}
+			tokens = append(tokens, Token{Kind: Operator, Text: sql[start:i], Pos: start})
+		}
+		tokens[len(tokens)-1].End = i
+	}
+	return tokens
+}
+
+// skipQuoted returns the offset just past the quoted text starting at
+// sql[i]. A doubled quote is an escaped quote; with backslash set, so is
+// a backslash-escaped one (E'...' strings).
+func skipQuoted(sql string, i int, quote byte, backslash bool) int {
+	i++
+	for i < len(sql) {
+		switch {
+		case backslash && sql[i] == '\\':
+			i += 2
+		case sql[i] == quote:
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		default:
+			i++
+		}
+	}
+	return len(sql)
+}
+
+// skipDollarQuoted handles $$...$$ and $tag$...$tag$.
+func skipDollarQuoted(sql string, i int) (int, bool) {
+	j := i + 1
+	for j < len(sql) && sql[j] != '$' {
+		if !isIdentChar(sql[j]) {
+			return 0, false
+		}
+		j++
+	}
+	if j >= len(sql) {
+		return 0, false
+	}
+	tag := sql[i : j+1]
+	end := strings.Index(sql[j+1:], tag)
+	if end < 0 {
+		return len(sql), true
+	}
+	return j + 1 + end + len(tag), true
+}
+
+// skipBlockComment skips a /* */ comment; they nest in PostgreSQL.
+func skipBlockComment(sql string, i int) int {
+	depth := 0
+	for i < len(sql) {
+		switch {
+		case strings.HasPrefix(sql[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(sql[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return len(sql)
+}
+
+func skipNumber(sql string, i int) int {
+	for i < len(sql) && (isDigit(sql[i]) || sql[i] == '.' || sql[i] == '_') {
+		i++
+	}
+	if i < len(sql) && (sql[i] == 'e' || sql[i] == 'E') {
+		j := i + 1
+		if j < len(sql) && (sql[j] == '+' || sql[j] == '-') {
+			j++
+		}
+		if j < len(sql) && isDigit(sql[j]) {
+			i = j
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '$'
+}
+
+func isOperatorChar(c byte) bool {
+	return strings.IndexByte("+-*/<>=~!@#%^&|?:", c) >= 0
+}
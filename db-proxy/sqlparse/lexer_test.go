@@ -0,0 +1,57 @@
+package sqlparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want []Token
+	}{
+		{"SELECT 1", []Token{{Word, "SELECT", 0, 6}, {Number, "1", 7, 8}}},
+		{"a.b::int", []Token{{Word, "a", 0, 1}, {Punct, ".", 1, 2}, {Word, "b", 2, 3}, {Operator, "::", 3, 5}, {Word, "int", 5, 8}}},
+		{"x = $1", []Token{{Word, "x", 0, 1}, {Operator, "=", 2, 3}, {Param, "$1", 4, 6}}},
+		{"'it''s; x'", []Token{{String, "'it''s; x'", 0, 10}}},
+		{`E'it\'s; x'`, []Token{{String, `E'it\'s; x'`, 0, 11}}},
+		{`e'\\' x`, []Token{{String, `e'\\'`, 0, 5}, {Word, "x", 6, 7}}},
+		{`'\' x`, []Token{{String, `'\'`, 0, 3}, {Word, "x", 4, 5}}},
+		{"$$a; 'b$$", []Token{{String, "$$a; 'b$$", 0, 9}}},
+		{"$fn$ $$; $fn$ x", []Token{{String, "$fn$ $$; $fn$", 0, 13}, {Word, "x", 14, 15}}},
+		{"$x", []Token{{Operator, "$", 0, 1}, {Word, "x", 1, 2}}},
+		{"a$b", []Token{{Word, "a$b", 0, 3}}},
+		{`"Weird ""name"""`, []Token{{QuotedIdent, `Weird "name"`, 0, 16}}},
+		{"`my``t`", []Token{{QuotedIdent, "my`t", 0, 7}}},
+		{"/* a /* b */ c */ x", []Token{{Word, "x", 18, 19}}},
+		{"x -- y\nz", []Token{{Word, "x", 0, 1}, {Word, "z", 7, 8}}},
+		{"1-- c", []Token{{Number, "1", 0, 1}}},
+		{"1.5e-3 .5", []Token{{Number, "1.5e-3", 0, 6}, {Number, ".5", 7, 9}}},
+		{"'open", []Token{{String, "'open", 0, 5}}},
+		{"x /* open", []Token{{Word, "x", 0, 1}}},
+	}
+	for _, tt := range tests {
+		if got := Lex(tt.sql); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lex(%q) = %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestLexMySQL(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want []Token
+	}{
+		{`'it\'s; x'`, []Token{{String, `'it\'s; x'`, 0, 10}}},
+		{`"a \" b" x`, []Token{{String, `"a \" b"`, 0, 8}, {Word, "x", 9, 10}}},
+		{`'\\' x`, []Token{{String, `'\\'`, 0, 4}, {Word, "x", 5, 6}}},
+		{"x # y; z\nw", []Token{{Word, "x", 0, 1}, {Word, "w", 9, 10}}},
+		{"`a\\` = ?", []Token{{QuotedIdent, "a\\", 0, 4}, {Operator, "=", 5, 6}, {Operator, "?", 7, 8}}},
+		{"e'x'", []Token{{Word, "e", 0, 1}, {String, "'x'", 1, 4}}},
+	}
+	for _, tt := range tests {
+		if got := LexMySQL(tt.sql); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LexMySQL(%q) = %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
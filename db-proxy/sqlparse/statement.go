@@ -0,0 +1,245 @@
+package sqlparse
+
+// Statement describes one SQL statement.
+type Statement struct {
+	// Command is the leading keyword in upper case: SELECT, INSERT, SET...
+	// For WITH queries it is the command of the main query.
+	Command string
+	// Text is the statement as written, without the semicolon
+	Text   string
+	Tokens []Token
+	// Tables are the tables and sequences the statement names, see
+	// tableNames
+	Tables []string
+	// ReadOnly is set for statements a read replica can answer: plain
+	// SELECTs and friends that neither lock rows nor call functions with
+	// side effects.
+	ReadOnly bool
+	// SessionState is set for statements whose effect outlives the
+	// transaction on that server connection: SET, temporary tables,
+	// prepared statements, LISTEN, session advisory locks.
+	SessionState bool
+}
+
+// readOnlyCommands can run on a replica unless something inside them
+// says otherwise.
+var readOnlyCommands = map[string]bool{
+	"SELECT":  true,
+	"SHOW":    true,
+	"VALUES":  true,
+	"TABLE":   true,
+	"EXPLAIN": true,
+}
+
+// writeFunctions have side effects or must see the primary's state, so a
+// SELECT calling them is not read-only.
+var writeFunctions = map[string]bool{
+	"NEXTVAL":                     true,
+	"SETVAL":                      true,
+	"CURRVAL":                     true,
+	"LASTVAL":                     true,
+	"SET_CONFIG":                  true,
+	"PG_NOTIFY":                   true,
+	"TXID_CURRENT":                true,
+	"PG_CURRENT_XACT_ID":          true,
+	"PG_ADVISORY_LOCK":            true,
+	"PG_ADVISORY_LOCK_SHARED":     true,
+	"PG_TRY_ADVISORY_LOCK":        true,
+	"PG_TRY_ADVISORY_LOCK_SHARED": true,
+	"PG_ADVISORY_UNLOCK":          true,
+	"PG_ADVISORY_UNLOCK_SHARED":   true,
+	"PG_ADVISORY_UNLOCK_ALL":      true,
+	"PG_ADVISORY_XACT_LOCK":       true,
+	"LO_CREATE":                   true,
+	"LO_IMPORT":                   true,
+	"LO_UNLINK":                   true,
+}
+
+// sessionFunctions leave state behind on the server connection.
+var sessionFunctions = map[string]bool{
+	"SET_CONFIG":                  true,
+	"PG_ADVISORY_LOCK":            true,
+	"PG_ADVISORY_LOCK_SHARED":     true,
+	"PG_TRY_ADVISORY_LOCK":        true,
+	"PG_TRY_ADVISORY_LOCK_SHARED": true,
+}
+
+// Split cuts tokens into statements at top-level semicolons. Empty
+// statements are dropped.
+func Split(tokens []Token) [][]Token {
+	var stmts [][]Token
+	start := 0
+	depth := 0
+	for i, t := range tokens {
+		if t.Kind != Punct {
+			continue
+		}
+		switch t.Text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case ";":
+			if depth <= 0 {
+				if i > start {
+					stmts = append(stmts, tokens[start:i])
+				}
+				start = i + 1
+				depth = 0
+			}
+		}
+	}
+	if start < len(tokens) {
+		stmts = append(stmts, tokens[start:])
+	}
+	return stmts
+}
+
+// Parse splits sql into statements and classifies each of them.
+func Parse(sql string) []Statement {
+	var stmts []Statement
+	for _, tokens := range Split(Lex(sql)) {
+		st := classify(tokens)
+		st.Text = sql[tokens[0].Pos:tokens[len(tokens)-1].End]
+		stmts = append(stmts, st)
+	}
+	return stmts
+}
+
+// ReadOnly reports whether every statement in sql can go to a replica.
+// An empty string is not read-only; there is nothing to route.
+func ReadOnly(sql string) bool {
+	stmts := Parse(sql)
+	for _, s := range stmts {
+		if !s.ReadOnly {
+			return false
+		}
+	}
+	return len(stmts) > 0
+}
+
+// SessionState reports whether any statement in sql leaves state behind
+// on the server connection.
+func SessionState(sql string) bool {
+	for _, s := range Parse(sql) {
+		if s.SessionState {
+			return true
+		}
+	}
+	return false
+}
+
+func classify(tokens []Token) Statement {
+	s := Statement{Tokens: tokens, Tables: tableNames(tokens)}
+	words := leadingWords(tokens)
+	if len(words) == 0 {
+		return s
+	}
+	s.Command = words[0]
+	if s.Command == "WITH" {
+		s.Command = mainCommand(tokens)
+	}
+
+	s.ReadOnly = readOnlyCommands[s.Command]
+	for i, t := range tokens {
+		if t.Kind != Word {
+			continue
+		}
+		upper := t.Upper()
+		switch upper {
+		case "INSERT", "UPDATE", "DELETE", "MERGE":
+			//a data-modifying CTE or EXPLAIN ANALYZE of a write
+			s.ReadOnly = false
+		case "INTO":
+			//SELECT ... INTO creates a table
+			if s.Command == "SELECT" {
+				s.ReadOnly = false
+			}
+		case "FOR":
+			//row locks: FOR UPDATE, FOR SHARE, FOR NO KEY UPDATE, FOR KEY SHARE
+			if next := wordAt(tokens, i+1); next == "UPDATE" || next == "SHARE" || next == "NO" || next == "KEY" {
+				s.ReadOnly = false
+			}
+		}
+		if i+1 < len(tokens) && tokens[i+1].Kind == Punct && tokens[i+1].Text == "(" {
+			if writeFunctions[upper] {
+				s.ReadOnly = false
+			}
+			if sessionFunctions[upper] {
+				s.SessionState = true
+			}
+		}
+	}
+
+	switch s.Command {
+	case "SET":
+		//SET LOCAL and SET TRANSACTION only last until the transaction ends
+		if len(words) < 2 || (words[1] != "LOCAL" && words[1] != "TRANSACTION") {
+			s.SessionState = true
+		}
+	case "RESET", "PREPARE", "LISTEN", "LOAD":
+		s.SessionState = true
+	case "CREATE":
+		for _, w := range words[1:] {
+			if w == "TEMP" || w == "TEMPORARY" {
+				s.SessionState = true
+				break
+			}
+		}
+	case "DECLARE":
+		for i, t := range tokens {
+			if t.Is("WITH") && wordAt(tokens, i+1) == "HOLD" {
+				s.SessionState = true
+			}
+		}
+	}
+	return s
+}
+
+// leadingWords returns the upper-cased words at the start of a statement,
+// skipping any opening parentheses, up to the first other token.
+func leadingWords(tokens []Token) []string {
+	var words []string
+	for _, t := range tokens {
+		if t.Kind == Punct && t.Text == "(" && len(words) == 0 {
+			continue
+		}
+		if t.Kind != Word {
+			break
+		}
+		words = append(words, t.Upper())
+	}
+	return words
+}
+
+// mainCommand finds the statement a WITH clause leads into: the first
+// command keyword at parenthesis depth zero after the CTE list.
+func mainCommand(tokens []Token) string {
+	depth := 0
+	for _, t := range tokens[1:] {
+		if t.Kind == Punct {
+			switch t.Text {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			}
+			continue
+		}
+		if depth != 0 || t.Kind != Word {
+			continue
+		}
+		switch u := t.Upper(); u {
+		case "SELECT", "INSERT", "UPDATE", "DELETE", "MERGE", "VALUES", "TABLE":
+			return u
+		}
+	}
+	return "WITH"
+}
+
+func wordAt(tokens []Token, i int) string {
+	if i >= 0 && i < len(tokens) && tokens[i].Kind == Word {
+		return tokens[i].Upper()
+	}
+	return ""
+}
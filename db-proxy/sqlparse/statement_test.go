@@ -0,0 +1,145 @@
+package sqlparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want []string
+	}{
+		{"SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{";; SELECT ';'", []string{"SELECT ';'"}},
+		{"SELECT $$;$$; SELECT E'\\';'", []string{"SELECT $$;$$", "SELECT E'\\';'"}},
+		{"SELECT 1 /* ; /* ; */ ; */; SELECT 2 -- ;", []string{"SELECT 1", "SELECT 2"}},
+		{"CREATE RULE r AS ON INSERT TO t DO (INSERT INTO a VALUES (1); INSERT INTO b VALUES (2))", []string{"CREATE RULE r AS ON INSERT TO t DO (INSERT INTO a VALUES (1); INSERT INTO b VALUES (2))"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, st := range Parse(tt.sql) {
+			got = append(got, st.Text)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) texts = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		sql          string
+		command      string
+		readOnly     bool
+		sessionState bool
+	}{
+		{"SELECT 1", "SELECT", true, false},
+		{"(SELECT 1) UNION (SELECT 2)", "SELECT", true, false},
+		{"show search_path", "SHOW", true, false},
+		{"VALUES (1), (2)", "VALUES", true, false},
+		{"TABLE t", "TABLE", true, false},
+		{"EXPLAIN SELECT * FROM t", "EXPLAIN", true, false},
+		{"EXPLAIN ANALYZE DELETE FROM t", "EXPLAIN", false, false},
+		{"INSERT INTO t VALUES (1)", "INSERT", false, false},
+		{"UPDATE t SET a = 1", "UPDATE", false, false},
+
+		//keywords inside literals and comments do not count
+		{"SELECT 'DELETE FROM t'", "SELECT", true, false},
+		{"SELECT $$ DELETE FROM t $$", "SELECT", true, false},
+		{"SELECT $body$ UPDATE t SET a = $$x$$ $body$", "SELECT", true, false},
+		{`SELECT E'\' FOR UPDATE'`, "SELECT", true, false},
+		{`SELECT E'\\', 'nextval(1)'`, "SELECT", true, false},
+		{"SELECT /* DELETE /* nested */ FOR UPDATE */ 1", "SELECT", true, false},
+		{"SELECT 1 -- INTO t", "SELECT", true, false},
+		{`SELECT "delete" FROM t`, "SELECT", true, false},
+
+		//WITH takes the command of the main query
+		{"WITH x AS (SELECT 1) SELECT * FROM x", "SELECT", true, false},
+		{"WITH x AS (SELECT 1) DELETE FROM t USING x", "DELETE", false, false},
+		{"WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d", "SELECT", false, false},
+		{"WITH RECURSIVE r(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM r) SELECT * FROM r", "SELECT", true, false},
+		{"WITH u AS (UPDATE t SET a = 1 RETURNING a) INSERT INTO log SELECT * FROM u", "INSERT", false, false},
+
+		//row locks
+		{"SELECT * FROM t FOR UPDATE", "SELECT", false, false},
+		{"SELECT * FROM t FOR NO KEY UPDATE SKIP LOCKED", "SELECT", false, false},
+		{"SELECT * FROM t FOR SHARE", "SELECT", false, false},
+		{"SELECT * FROM t FOR KEY SHARE", "SELECT", false, false},
+
+		//SELECT INTO creates a table
+		{"SELECT * INTO copy FROM t", "SELECT", false, false},
+		{"SELECT a INTO TEMP copy FROM t", "SELECT", false, false},
+
+		//functions with side effects
+		{"SELECT nextval('s')", "SELECT", false, false},
+		{"SELECT NEXTVAL ('s')", "SELECT", false, false},
+		{"SELECT currval('s')", "SELECT", false, false},
+		{"SELECT nextval", "SELECT", true, false},
+		{"SELECT pg_advisory_lock(1)", "SELECT", false, true},
+		{"SELECT pg_advisory_xact_lock(1)", "SELECT", false, false},
+		{"SELECT set_config('a', 'b', false)", "SELECT", false, true},
+
+		//session state
+		{"SET search_path = app", "SET", false, true},
+		{"SET SESSION statement_timeout = 0", "SET", false, true},
+		{"SET LOCAL statement_timeout = 0", "SET", false, false},
+		{"set local search_path to app", "SET", false, false},
+		{"SET TRANSACTION ISOLATION LEVEL SERIALIZABLE", "SET", false, false},
+		{"RESET ALL", "RESET", false, true},
+		{"PREPARE p AS SELECT 1", "PREPARE", false, true},
+		{"LISTEN jobs", "LISTEN", false, true},
+		{"CREATE TEMP TABLE x (a int)", "CREATE", false, true},
+		{"CREATE TEMPORARY TABLE x (a int)", "CREATE", false, true},
+		{"CREATE TABLE x (a int)", "CREATE", false, false},
+		{"DECLARE c CURSOR WITH HOLD FOR SELECT 1", "DECLARE", false, true},
+		{"DECLARE c CURSOR FOR SELECT 1", "DECLARE", false, false},
+	}
+	for _, tt := range tests {
+		stmts := Parse(tt.sql)
+		if len(stmts) != 1 {
+			t.Errorf("Parse(%q) gave %d statements, want 1", tt.sql, len(stmts))
+			continue
+		}
+		st := stmts[0]
+		if st.Command != tt.command || st.ReadOnly != tt.readOnly || st.SessionState != tt.sessionState {
+			t.Errorf("Parse(%q) = command %s, read-only %v, session state %v; want %s, %v, %v",
+				tt.sql, st.Command, st.ReadOnly, st.SessionState, tt.command, tt.readOnly, tt.sessionState)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{"", false},
+		{" ; -- nothing", false},
+		{"SELECT 1; SELECT 2", true},
+		{"SELECT 1; UPDATE t SET a = 1", false},
+		{"SELECT 1; SELECT nextval('s')", false},
+	}
+	for _, tt := range tests {
+		if got := ReadOnly(tt.sql); got != tt.want {
+			t.Errorf("ReadOnly(%q) = %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestSessionState(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{"SELECT 1", false},
+		{"BEGIN; SET LOCAL a = 1; COMMIT", false},
+		{"SELECT 1; SET a = 1", true},
+		{"SELECT 'SET a = 1'", false},
+	}
+	for _, tt := range tests {
+		if got := SessionState(tt.sql); got != tt.want {
+			t.Errorf("SessionState(%q) = %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package sqlparse
+
+import "strings"
+
+// tableKeywords are followed by a table name, or a list of them.
+var tableKeywords = map[string]bool{
+	"FROM":     true,
+	"JOIN":     true,
+	"INTO":     true,
+	"UPDATE":   true,
+	"TABLE":    true,
+	"TRUNCATE": true,
+	"SEQUENCE": true,
+	"VIEW":     true,
+	"COPY":     true,
+	"LOCK":     true,
+	"USING":    true,
+}
+
+// nameModifiers may stand between a table keyword and the name, as in
+// DROP TABLE IF EXISTS or DELETE FROM ONLY.
+var nameModifiers = map[string]bool{
+	"ONLY":    true,
+	"IF":      true,
+	"NOT":     true,
+	"EXISTS":  true,
+	"TABLE":   true,
+	"LATERAL": true,
+}
+
+// notNames are words in a table position that are something else.
+var notNames = map[string]bool{
+	"STDIN":   true,
+	"STDOUT":  true,
+	"PROGRAM": true,
+	"SELECT":  true,
+	"VALUES":  true,
+	"DEFAULT": true,
+}
+
+// queryStarts are the words that make a parenthesis hold a query rather
+// than an expression.
+var queryStarts = map[string]bool{
+	"SELECT": true,
+	"WITH":   true,
+	"VALUES": true,
+	"TABLE":  true,
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+	"MERGE":  true,
+}
+
+// tableNames returns the tables and sequences a statement refers to, each
+// once, in order. Unquoted names are folded to lower case the way
+// PostgreSQL does, and schema-qualified names are kept as written, e.g.
+// "public.events". Function calls in FROM and WITH queries are left out,
+// and so are words like FROM inside function arguments
+// (EXTRACT(YEAR FROM ts)).
+func tableNames(tokens []Token) []string {
+	var names []string
+	seen := map[string]bool{}
+	ctes := cteNames(tokens)
+	//whether each open parenthesis holds a query; the statement itself does
+	query := []bool{true}
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.Kind == Punct {
+			switch t.Text {
+			case "(":
+				query = append(query, queryStarts[wordAt(tokens, i+1)])
+			case ")":
+				if len(query) > 1 {
+					query = query[:len(query)-1]
+				}
+			}
+			continue
+		}
+		if t.Kind != Word || !query[len(query)-1] || !tableKeywords[t.Upper()] {
+			continue
+		}
+		prev := wordAt(tokens, i-1)
+		if t.Is("FROM") && prev == "DISTINCT" {
+			continue
+		}
+		if t.Is("UPDATE") && (prev == "FOR" || prev == "KEY" || prev == "NO" || prev == "DO") {
+			//row locks and ON CONFLICT DO UPDATE
+			continue
+		}
+		function := t.Is("FROM") || t.Is("JOIN")
+		j := i + 1
+		for {
+			for nameModifiers[wordAt(tokens, j)] {
+				j++
+			}
+			name, end := qualifiedName(tokens, j)
+			if name == "" {
+				break
+			}
+			if function && isPunct(tokens, end, "(") {
+				//a set-returning function such as generate_series(...)
+				end = closingParen(tokens, end) + 1
+			} else if !seen[name] && !ctes[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			i = end - 1
+			//an alias may follow before the next name of a list
+			k := end
+			if wordAt(tokens, k) == "AS" {
+				k++
+			}
+			if k < len(tokens) && (tokens[k].Kind == Word || tokens[k].Kind == QuotedIdent) {
+				k++
+			}
+			if !isPunct(tokens, k, ",") {
+				break
+			}
+			j = k + 1
+		}
+	}
+	return names
+}
+
+// qualifiedName reads a possibly schema-qualified name starting at
+// tokens[i] and returns it with the index just past it. The name is empty
+// if there is none.
+func qualifiedName(tokens []Token, i int) (string, int) {
+	var parts []string
+	for i < len(tokens) {
+		t := tokens[i]
+		switch {
+		case t.Kind == QuotedIdent:
+			parts = append(parts, t.Text)
+		case t.Kind == Word && !notNames[t.Upper()]:
+			parts = append(parts, strings.ToLower(t.Text))
+		default:
+			return strings.Join(parts, "."), i
+		}
+		i++
+		if !isPunct(tokens, i, ".") {
+			break
+		}
+		i++
+	}
+	return strings.Join(parts, "."), i
+}
+
+// cteNames returns the names the statement's WITH clause defines: a name
+// followed by AS and a parenthesised query.
+func cteNames(tokens []Token) map[string]bool {
+	ctes := map[string]bool{}
+	for i, t := range tokens {
+		if t.Kind != Word && t.Kind != QuotedIdent {
+			continue
+		}
+		j := i + 1
+		if isPunct(tokens, j, "(") {
+			//a column list: name (a, b) AS (...)
+			j = closingParen(tokens, j) + 1
+		}
+		if wordAt(tokens, j) != "AS" {
+			continue
+		}
+		j++
+		for wordAt(tokens, j) == "NOT" || wordAt(tokens, j) == "MATERIALIZED" {
+			j++
+		}
+		if isPunct(tokens, j, "(") && queryStarts[wordAt(tokens, j+1)] {
+			name, _ := qualifiedName(tokens, i)
+			ctes[name] = true
+		}
+	}
+	return ctes
+}
+
+// closingParen returns the index of the parenthesis that closes the one
+// at tokens[i], or the last index if it is never closed.
+func closingParen(tokens []Token, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		if tokens[i].Kind != Punct {
+			continue
+		}
+		switch tokens[i].Text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(tokens) - 1
+}
+
+func isPunct(tokens []Token, i int, text string) bool {
+	return i < len(tokens) && tokens[i].Kind == Punct && tokens[i].Text == text
+}
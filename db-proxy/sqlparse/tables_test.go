@@ -0,0 +1,43 @@
+package sqlparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTables(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want []string
+	}{
+		{"SELECT 1", nil},
+		{"SELECT * FROM t", []string{"t"}},
+		{"SELECT * FROM Public.Events e", []string{"public.events"}},
+		{`SELECT * FROM "Public"."Events"`, []string{"Public.Events"}},
+		{"SELECT * FROM a, b AS x, c y JOIN d ON true", []string{"a", "b", "c", "d"}},
+		{"SELECT * FROM a JOIN a ON true", []string{"a"}},
+		{"SELECT * FROM generate_series(1, 3) g JOIN t ON true", []string{"t"}},
+		{"SELECT extract(year FROM ts) FROM t", []string{"t"}},
+		{"SELECT * FROM t WHERE id IN (SELECT id FROM u)", []string{"t", "u"}},
+		{"WITH x AS (SELECT * FROM t) SELECT * FROM x", []string{"t"}},
+		{"INSERT INTO s.t (a) VALUES (1) ON CONFLICT (a) DO UPDATE SET a = 2", []string{"s.t"}},
+		{"UPDATE t SET a = 1 FROM u WHERE t.id = u.id", []string{"t", "u"}},
+		{"DELETE FROM ONLY t USING u", []string{"t", "u"}},
+		{"SELECT * FROM t FOR UPDATE", []string{"t"}},
+		{"DROP TABLE IF EXISTS a, b", []string{"a", "b"}},
+		{"TRUNCATE TABLE t", []string{"t"}},
+		{"ALTER SEQUENCE app.ids RESTART", []string{"app.ids"}},
+		{"COPY t FROM STDIN", []string{"t"}},
+		{"SELECT * FROM t WHERE a IS DISTINCT FROM b", []string{"t"}},
+	}
+	for _, tt := range tests {
+		stmts := Parse(tt.sql)
+		if len(stmts) != 1 {
+			t.Errorf("Parse(%q) gave %d statements, want 1", tt.sql, len(stmts))
+			continue
+		}
+		if got := stmts[0].Tables; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) tables = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
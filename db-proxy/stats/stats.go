@@ -0,0 +1,375 @@
+// Package stats keeps statistics about the statements clients run, in the
+// manner of pg_stat_statements: statements that differ only in their
+// literals share a fingerprint, and every fingerprint has its calls,
+// errors, rows and latencies counted per user and database.
+package stats
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-wahba/db-proxy-go/metrics"
+	"github.com/mu-wahba/db-proxy-go/sqlparse"
+)
+
+// Config says whether statistics are kept and where they are exported.
+type Config struct {
+	Enabled bool
+	// MaxStatements is how many fingerprints are kept; when it is reached
+	// the least called ones make room
+	MaxStatements int
+	// File, if not empty, gets the statistics as JSON every FileInterval
+	// and at shutdown
+	File         string
+	FileInterval time.Duration
+}
+
+// Key identifies a fingerprint as run by one user on one database.
+type Key struct {
+	Fingerprint string
+	User        string
+	Database    string
+}
+
+// Statement is the statistics of one fingerprint. Times are in
+// milliseconds; the percentiles are estimated to within a tenth.
+type Statement struct {
+	Fingerprint string  `json:"fingerprint"`
+	User        string  `json:"user"`
+	Database    string  `json:"database"`
+	Calls       int64   `json:"calls"`
+	Errors      int64   `json:"errors"`
+	Rows        int64   `json:"rows"`
+	TotalMS     float64 `json:"total_ms"`
+	MeanMS      float64 `json:"mean_ms"`
+	MinMS       float64 `json:"min_ms"`
+	MaxMS       float64 `json:"max_ms"`
+	P50MS       float64 `json:"p50_ms"`
+	P95MS       float64 `json:"p95_ms"`
+	P99MS       float64 `json:"p99_ms"`
+	// FirstSeen and LastSeen are when the fingerprint first and last ran
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Sort orders for Snapshot.
+const (
+	SortTotal  = "total"
+	SortMean   = "mean"
+	SortCalls  = "calls"
+	SortErrors = "errors"
+	SortRows   = "rows"
+	SortP99    = "p99"
+)
+
+// Latencies are counted in buckets on a log scale, bucketsPerDoubling to
+// every power of two from one microsecond up, which is enough to place a
+// percentile within a tenth of its value at a small fixed cost per
+// fingerprint.
+const (
+	bucketsPerDoubling = 4
+	numBuckets         = 32 * bucketsPerDoubling
+)
+
+// evictShare is the part of the fingerprints dropped at once when the
+// collector is full, so a stream of new statements does not evict on
+// every call.
+const evictShare = 20
+
+type entry struct {
+	calls, errors, rows int64
+	total, min, max     time.Duration
+	first, last         time.Time
+	buckets             [numBuckets]uint32
+}
+
+// Collector counts executions by fingerprint. It is safe for concurrent
+// use, and a nil *Collector counts nothing.
+type Collector struct {
+	max int
+
+	mu      sync.Mutex
+	entries map[Key]*entry
+}
+
+// New returns a collector that keeps up to max fingerprints.
+func New(max int) *Collector {
+	return &Collector{max: max, entries: map[Key]*entry{}}
+}
+
+// Add counts one execution of the statement with key that took d and
+// returned or changed rows rows, or failed.
+func (c *Collector) Add(key Key, d time.Duration, rows int64, failed bool) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		if len(c.entries) >= c.max {
+			c.evict()
+		}
+		e = &entry{min: d, first: now}
+		c.entries[key] = e
+	}
+	e.calls++
+	if failed {
+		e.errors++
+	}
+	e.rows += rows
+	e.total += d
+	if d < e.min {
+		e.min = d
+	}
+	if d > e.max {
+		e.max = d
+	}
+	e.last = now
+	e.buckets[bucket(d)]++
+}
+
+// evict drops the least called fingerprints. It must be called with c.mu
+// held.
+func (c *Collector) evict() {
+	keys := make([]Key, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := c.entries[keys[i]], c.entries[keys[j]]
+		if a.calls != b.calls {
+			return a.calls < b.calls
+		}
+		return a.last.Before(b.last)
+	})
+	n := len(keys)/evictShare + 1
+	for _, key := range keys[:n] {
+		delete(c.entries, key)
+	}
+	metrics.StatementsEvicted.Add(float64(n))
+}
+
+// Snapshot returns the statistics of every fingerprint, ordered by sort
+// from the highest down. An unknown order sorts by total time.
+func (c *Collector) Snapshot(order string) []Statement {
+	if c == nil {
+		return []Statement{}
+	}
+	c.mu.Lock()
+	out := make([]Statement, 0, len(c.entries))
+	for key, e := range c.entries {
+		out = append(out, e.statement(key))
+	}
+	c.mu.Unlock()
+	value := func(s Statement) float64 {
+		switch order {
+		case SortMean:
+			return s.MeanMS
+		case SortCalls:
+			return float64(s.Calls)
+		case SortErrors:
+			return float64(s.Errors)
+		case SortRows:
+			return float64(s.Rows)
+		case SortP99:
+			return s.P99MS
+		}
+		return s.TotalMS
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if a, b := value(out[i]), value(out[j]); a != b {
+			return a > b
+		}
+		return out[i].Fingerprint < out[j].Fingerprint
+	})
+	return out
+}
+
+// Reset forgets every fingerprint.
+func (c *Collector) Reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.entries = map[Key]*entry{}
+	c.mu.Unlock()
+}
+
+// WriteFile writes the statistics to path as a JSON array ordered by
+// total time. The file is replaced in one step, so readers never see
+// half of it.
+func (c *Collector) WriteFile(path string) error {
+	data, err := json.MarshalIndent(c.Snapshot(SortTotal), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (e *entry) statement(key Key) Statement {
+	return Statement{
+		Fingerprint: key.Fingerprint,
+		User:        key.User,
+		Database:    key.Database,
+		Calls:       e.calls,
+		Errors:      e.errors,
+		Rows:        e.rows,
+		TotalMS:     ms(e.total),
+		MeanMS:      ms(e.total / time.Duration(e.calls)),
+		MinMS:       ms(e.min),
+		MaxMS:       ms(e.max),
+		P50MS:       ms(e.percentile(0.50)),
+		P95MS:       ms(e.percentile(0.95)),
+		P99MS:       ms(e.percentile(0.99)),
+		FirstSeen:   e.first,
+		LastSeen:    e.last,
+	}
+}
+
+// percentile estimates the latency below which the share p of the calls
+// fell, as the middle of its bucket, kept within the observed range.
+func (e *entry) percentile(p float64) time.Duration {
+	rank := uint64(math.Ceil(p * float64(e.calls)))
+	var seen uint64
+	for i, n := range e.buckets {
+		if seen += uint64(n); seen < rank || n == 0 {
+			continue
+		}
+		d := time.Duration(float64(time.Microsecond) * math.Exp2((float64(i)-0.5)/bucketsPerDoubling))
+		if d < e.min {
+			d = e.min
+		}
+		if d > e.max {
+			d = e.max
+		}
+		return d
+	}
+	return e.max
+}
+
+// bucket returns the histogram bucket of d: 0 up to a microsecond, then
+// bucketsPerDoubling buckets to every power of two.
+func bucket(d time.Duration) int {
+	if d <= time.Microsecond {
+		return 0
+	}
+	i := int(math.Log2(float64(d)/float64(time.Microsecond))*bucketsPerDoubling) + 1
+	if i >= numBuckets {
+		return numBuckets - 1
+	}
+	return i
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// placeholder stands for the literals of a statement in its fingerprint.
+const placeholder = "?"
+
+// Fingerprint returns the statement text with its literals replaced by
+// placeholders, keywords and unquoted names in upper case, and comments
+// and layout dropped, so that runs of the same statement with different
+// values share it. A parenthesised list of literals, such as the values
+// of an IN list or the rows of a VALUES clause, shrinks to a single one,
+// whatever its length. Parameters such as $1 are kept.
+func Fingerprint(sql string) string {
+	return fingerprint(sqlparse.Lex(sql))
+}
+
+// FingerprintMySQL is Fingerprint for a MySQL statement.
+func FingerprintMySQL(sql string) string {
+	return fingerprint(sqlparse.LexMySQL(sql))
+}
+
+func fingerprint(tokens []sqlparse.Token) string {
+	var out []string
+	for _, t := range tokens {
+		switch t.Kind {
+		case sqlparse.Word:
+			out = append(out, t.Upper())
+		case sqlparse.QuotedIdent:
+			out = append(out, `"`+strings.ReplaceAll(t.Text, `"`, `""`)+`"`)
+		case sqlparse.String, sqlparse.Number:
+			if n := len(out); n >= 1 && out[n-1] == "-" && (n == 1 || !isOperand(out[n-2])) {
+				//a negative number is one literal
+				out = out[:n-1]
+			}
+			if n := len(out); n >= 3 && out[n-1] == "," && out[n-2] == placeholder && out[n-3] == "(" {
+				//the next literal of a list adds nothing
+				out = out[:n-1]
+				continue
+			}
+			out = append(out, placeholder)
+		default:
+			out = append(out, t.Text)
+			//( ? ) , ( ? ) is one row of literals
+			if n := len(out); n >= 7 && t.Text == ")" && strings.Join(out[n-7:], " ") == "( ? ) , ( ? )" {
+				out = out[:n-4]
+			}
+		}
+	}
+	if n := len(out); n > 0 && out[n-1] == ";" {
+		out = out[:n-1]
+	}
+	return strings.Join(out, " ")
+}
+
+// negating are the keywords after which a minus sign negates rather than
+// subtracts, although they look like names.
+var negating = map[string]bool{
+	"SELECT":  true,
+	"WHERE":   true,
+	"HAVING":  true,
+	"ON":      true,
+	"AND":     true,
+	"OR":      true,
+	"NOT":     true,
+	"IS":      true,
+	"IN":      true,
+	"LIKE":    true,
+	"BETWEEN": true,
+	"CASE":    true,
+	"WHEN":    true,
+	"THEN":    true,
+	"ELSE":    true,
+	"LIMIT":   true,
+	"OFFSET":  true,
+	"RETURN":  true,
+}
+
+// isOperand reports whether a fingerprint token ends an operand, after
+// which a minus sign subtracts rather than negates.
+func isOperand(tok string) bool {
+	switch tok {
+	case placeholder, ")", "]":
+		return true
+	}
+	if negating[tok] {
+		return false
+	}
+	c := tok[0]
+	return c == '"' || c == '$' || c == '_' || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
@@ -0,0 +1,162 @@
+package stats
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		sql, want string
+	}{
+		{"select * from t where a = 1 and b = 'x'", "SELECT * FROM T WHERE A = ? AND B = ?"},
+		{"SELECT *\n  FROM t /* c */ WHERE a = 1; -- x", "SELECT * FROM T WHERE A = ?"},
+		{"SELECT E'it\\'s', $$x$$, 1.5e3", "SELECT ? , ? , ?"},
+
+		//lists of literals collapse whatever their length
+		{"SELECT * FROM t WHERE id IN (1, 2, 3)", "SELECT * FROM T WHERE ID IN ( ? )"},
+		{"SELECT * FROM t WHERE id IN (4)", "SELECT * FROM T WHERE ID IN ( ? )"},
+		{"SELECT * FROM t WHERE id IN (-1, 'a', 2.5)", "SELECT * FROM T WHERE ID IN ( ? )"},
+		{"INSERT INTO t VALUES (1, 'a'), (2, 'b'), (3, 'c')", "INSERT INTO T VALUES ( ? )"},
+		{"INSERT INTO t VALUES (1)", "INSERT INTO T VALUES ( ? )"},
+		{"SELECT * FROM t WHERE id IN ($1, $2)", "SELECT * FROM T WHERE ID IN ( $1 , $2 )"},
+		{"SELECT * FROM t WHERE (a, b) IN ((1, 2), (3, 4))", "SELECT * FROM T WHERE ( A , B ) IN ( ( ? ) )"},
+		//expressions are not lists
+		{"SELECT a - 1, 1 - 1 FROM t", "SELECT A - ? , ? - ? FROM T"},
+		{"SELECT f(1, a), 2", "SELECT F ( ? , A ) , ?"},
+
+		//negative numbers are one literal, subtraction is kept
+		{"SELECT -1", "SELECT ?"},
+		{"SELECT * FROM t WHERE a = -1", "SELECT * FROM T WHERE A = ?"},
+		{"SELECT * FROM t WHERE a > 0 AND b < -2 OR c BETWEEN -3 AND -4", "SELECT * FROM T WHERE A > ? AND B < ? OR C BETWEEN ? AND ?"},
+		{"SELECT * FROM t LIMIT -1", "SELECT * FROM T LIMIT ?"},
+		{"SELECT CASE WHEN a THEN -1 ELSE -2 END", "SELECT CASE WHEN A THEN ? ELSE ? END"},
+		{"SELECT a-1, a - 1, (a) - 1, a[1] - 1, $1 - 1, 3 - 1", "SELECT A - ? , A - ? , ( A ) - ? , A [ ? ] - ? , $1 - ? , ? - ?"},
+		{`SELECT "a" - 1`, `SELECT "a" - ?`},
+
+		//quoted identifiers keep their case and quotes
+		{`SELECT "MyCol", mycol FROM "My""Table"`, `SELECT "MyCol" , MYCOL FROM "My""Table"`},
+		{`SELECT "1" FROM t`, `SELECT "1" FROM T`},
+	}
+	for _, tt := range tests {
+		if got := Fingerprint(tt.sql); got != tt.want {
+			t.Errorf("Fingerprint(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestFingerprintMySQL(t *testing.T) {
+	tests := []struct {
+		sql, want string
+	}{
+		{`SELECT * FROM users WHERE name = "alice" AND password = 'hunter2'`, "SELECT * FROM USERS WHERE NAME = ? AND PASSWORD = ?"},
+		//an escaped quote does not end the string
+		{`SELECT 'it\'s secret', "say \"secret\""`, "SELECT ? , ?"},
+		{"SELECT `Name` FROM t WHERE id = ? # secret", "SELECT \"Name\" FROM T WHERE ID = ?"},
+	}
+	for _, tt := range tests {
+		if got := FingerprintMySQL(tt.sql); got != tt.want {
+			t.Errorf("FingerprintMySQL(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	distributions := map[string]func(i int) time.Duration{
+		"uniform":     func(i int) time.Duration { return time.Duration(i+1) * 37 * time.Microsecond },
+		"exponential": func(i int) time.Duration { return time.Duration(math.Exp(float64(i)/100)) * time.Microsecond },
+		"bimodal": func(i int) time.Duration {
+			if i%10 == 0 {
+				return 2*time.Second + time.Duration(i)*time.Millisecond
+			}
+			return 3*time.Millisecond + time.Duration(i)*time.Microsecond
+		},
+		"constant": func(int) time.Duration { return 1234 * time.Microsecond },
+	}
+	for name, f := range distributions {
+		c := New(10)
+		key := Key{Fingerprint: name}
+		var all []time.Duration
+		for i := 0; i < 1000; i++ {
+			d := f(i)
+			all = append(all, d)
+			c.Add(key, d, 1, false)
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+		st := c.Snapshot(SortTotal)[0]
+		for _, p := range []struct {
+			share float64
+			got   float64
+		}{{0.50, st.P50MS}, {0.95, st.P95MS}, {0.99, st.P99MS}} {
+			want := ms(all[int(math.Ceil(p.share*float64(len(all))))-1])
+			if math.Abs(p.got-want) > want/10 {
+				t.Errorf("%s: p%.0f = %.4fms, want %.4fms within a tenth", name, p.share*100, p.got, want)
+			}
+		}
+		if st.MinMS != ms(all[0]) || st.MaxMS != ms(all[len(all)-1]) {
+			t.Errorf("%s: min %.4fms, max %.4fms, want %.4fms, %.4fms", name, st.MinMS, st.MaxMS, ms(all[0]), ms(all[len(all)-1]))
+		}
+	}
+}
+
+func TestBucket(t *testing.T) {
+	if b := bucket(0); b != 0 {
+		t.Errorf("bucket(0) = %d", b)
+	}
+	if b := bucket(time.Hour * 24 * 365); b != numBuckets-1 {
+		t.Errorf("bucket(1 year) = %d, want the last", b)
+	}
+	//every bucket spans a quarter of a doubling
+	for d := 2 * time.Microsecond; d < time.Minute; d = d * 3 / 2 {
+		b := bucket(d)
+		lo := time.Duration(float64(time.Microsecond) * math.Exp2(float64(b-1)/bucketsPerDoubling))
+		hi := time.Duration(float64(time.Microsecond) * math.Exp2(float64(b)/bucketsPerDoubling))
+		if d < lo || d > hi {
+			t.Errorf("bucket(%v) = %d, which spans %v to %v", d, b, lo, hi)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	c := New(40)
+	a := Key{Fingerprint: "SELECT ?", User: "app", Database: "db"}
+	c.Add(a, 2*time.Millisecond, 1, false)
+	c.Add(a, 4*time.Millisecond, 0, true)
+	c.Add(Key{Fingerprint: "SELECT ?", User: "other", Database: "db"}, time.Second, 5, false)
+
+	snap := c.Snapshot(SortCalls)
+	if len(snap) != 2 {
+		t.Fatalf("%d statements, want 2", len(snap))
+	}
+	st := snap[0]
+	if st.User != "app" || st.Calls != 2 || st.Errors != 1 || st.Rows != 1 || st.TotalMS != 6 || st.MeanMS != 3 || st.MinMS != 2 || st.MaxMS != 4 {
+		t.Errorf("statistics %+v", st)
+	}
+	if got := c.Snapshot(SortTotal)[0].User; got != "other" {
+		t.Errorf("slowest user %q, want other", got)
+	}
+
+	//a full collector drops the least called twentieth and one more
+	for i := 0; i < 38; i++ {
+		c.Add(Key{Fingerprint: string(rune('a' + i))}, time.Millisecond, 0, false)
+	}
+	c.Add(Key{Fingerprint: "new"}, time.Millisecond, 0, false)
+	if n := len(c.Snapshot(SortTotal)); n != 40-40/evictShare-1+1 {
+		t.Errorf("%d statements after eviction", n)
+	}
+	if s := c.Snapshot(SortCalls); s[0].Calls != 2 {
+		t.Errorf("most called statement evicted")
+	}
+
+	c.Reset()
+	if n := len(c.Snapshot(SortTotal)); n != 0 {
+		t.Errorf("%d statements after Reset", n)
+	}
+	var none *Collector
+	none.Add(a, time.Millisecond, 0, false)
+	if n := len(none.Snapshot(SortTotal)); n != 0 {
+		t.Errorf("nil collector has %d statements", n)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLS modes for the client side (listen.tls.mode).
+const (
+	tlsDisable = "disable"
+	tlsAllow   = "allow"
+	tlsRequire = "require"
+)
+
+// TLS modes for the server side (server_tls.mode), as in libpq's sslmode.
+const (
+	tlsVerifyCA   = "verify-ca"
+	tlsVerifyFull = "verify-full"
+)
+
+// Client certificate modes (listen.tls.client_cert_mode).
+const (
+	certNone     = "none"
+	certOptional = "optional"
+	certRequire  = "require"
+)
+
+// clientTLSConfig builds the configuration used to terminate TLS from
+// clients. It returns nil when the mode is disable.
+func clientTLSConfig(s clientTLSSettings) (cfg *tls.Config, required bool, err error) {
+	mode := s.Mode
+	if mode == "" {
+		mode = tlsDisable
+		if s.CertFile != "" {
+			mode = tlsAllow
+		}
+	}
+	switch mode {
+	case tlsDisable:
+		return nil, false, nil
+	case tlsAllow, tlsRequire:
+	default:
+		return nil, false, fmt.Errorf("listen.tls.mode must be %q, %q or %q, got %q", tlsDisable, tlsAllow, tlsRequire, mode)
+	}
+	if s.CertFile == "" || s.KeyFile == "" {
+		return nil, false, fmt.Errorf("listen.tls.mode %s needs cert_file and key_file", mode)
+	}
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, false, fmt.Errorf("loading client TLS certificate: %w", err)
+	}
+	cfg = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	certMode := s.ClientCertMode
+	if certMode == "" {
+		certMode = certNone
+	}
+	switch certMode {
+	case certNone:
+		return cfg, mode == tlsRequire, nil
+	case certOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case certRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, false, fmt.Errorf("listen.tls.client_cert_mode must be %q, %q or %q, got %q", certNone, certOptional, certRequire, certMode)
+	}
+	if s.ClientCAFile == "" {
+		return nil, false, fmt.Errorf("listen.tls.client_cert_mode %s needs client_ca_file", certMode)
+	}
+	if cfg.ClientCAs, err = loadCertPool(s.ClientCAFile); err != nil {
+		return nil, false, err
+	}
+	//a required certificate is no use if the client can skip TLS
+	return cfg, mode == tlsRequire || certMode == certRequire, nil
+}
+
+// serverTLSConfig builds the configuration used for connections to the
+// backends. It returns nil when the mode is disable.
+func serverTLSConfig(s serverTLSSettings) (*tls.Config, error) {
+	mode := s.Mode
+	if mode == "" {
+		mode = tlsDisable
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch mode {
+	case tlsDisable:
+		return nil, nil
+	case tlsRequire:
+		//encrypted but unauthenticated, like libpq's sslmode=require
+		cfg.InsecureSkipVerify = true
+	case tlsVerifyCA, tlsVerifyFull:
+		if s.CAFile != "" {
+			roots, err := loadCertPool(s.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			cfg.RootCAs = roots
+		}
+		if mode == tlsVerifyCA {
+			//check the chain but not the host name
+			cfg.InsecureSkipVerify = true
+			cfg.VerifyConnection = verifyChain(cfg.RootCAs)
+		}
+	default:
+		return nil, fmt.Errorf("server_tls.mode must be %q, %q, %q or %q, got %q", tlsDisable, tlsRequire, tlsVerifyCA, tlsVerifyFull, mode)
+	}
+
+	if s.CertFile != "" || s.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading server TLS client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// verifyChain checks the server's certificate chain against roots (the
+// system pool when nil) without matching the host name.
+func verifyChain(roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("server sent no certificate")
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return roots, nil
+}
@@ -0,0 +1,124 @@
+// Package tracing sets up the OpenTelemetry tracer the proxy reports its
+// sessions and queries to.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters.
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// InstrumentationName names the proxy's tracer.
+const InstrumentationName = "github.com/mu-wahba/db-proxy-go"
+
+// Config selects where spans go.
+type Config struct {
+	Exporter string
+	// Endpoint is the OTLP HTTP collector as host:port; when empty the
+	// exporter's default and the OTEL_EXPORTER_OTLP_* variables apply
+	Endpoint string
+	// Insecure sends OTLP over plain HTTP
+	Insecure bool
+	// File receives the spans as JSON, one per line, for ExporterFile
+	File        string
+	ServiceName string
+	// SampleRatio is the share of sessions traced, from 0 to 1
+	SampleRatio float64
+}
+
+// Provider exports the spans of a tracer.
+type Provider struct {
+	provider *sdktrace.TracerProvider
+	file     io.Closer
+}
+
+// New creates the provider for cfg. With ExporterNone it returns nil,
+// whose Tracer records nothing.
+func New(cfg Config) (*Provider, error) {
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+	switch cfg.Exporter {
+	case ExporterNone, "":
+		return nil, nil
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case ExporterFile:
+		if cfg.File == "" {
+			return nil, fmt.Errorf("the file exporter needs a file")
+		}
+		if file, err = os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+
+	p := &Provider{provider: sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(cfg.ServiceName),
+		)),
+	)}
+	if file != nil {
+		p.file = file
+	}
+	return p, nil
+}
+
+// Tracer returns the proxy's tracer; a nil Provider gives one that
+// records nothing.
+func (p *Provider) Tracer() trace.Tracer {
+	if p == nil {
+		return trace.NewNoopTracerProvider().Tracer(InstrumentationName)
+	}
+	return p.provider.Tracer(InstrumentationName)
+}
+
+// Shutdown exports the spans still buffered and stops the exporter.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	err := p.provider.Shutdown(ctx)
+	if p.file != nil {
+		if cerr := p.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}